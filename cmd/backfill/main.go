@@ -202,8 +202,13 @@ func targetBuckets(ctx context.Context, store service.ObjectStore, arg string) (
 	if err != nil {
 		return nil, err
 	}
+	// Generated variants and staged upload chunks are never archived; see
+	// service.InternalBucket.
 	out := make([]string, 0, len(infos))
 	for _, b := range infos {
+		if service.InternalBucket(b.Name) {
+			continue
+		}
 		out = append(out, b.Name)
 	}
 	return out, nil
@@ -256,7 +261,7 @@ func handle(ctx context.Context, tiering *service.Tiering, bucket string, obj mi
 		// Ask the archive whether it already holds this object, but stop there.
 		// That is one HeadObject per object and no transfer, which is what makes a
 		// dry run over millions of objects affordable.
-		ok, _, err := tiering.VerifyArchived(ctx, bucket, obj.Key, obj.Size)
+		ok, _, err := tiering.VerifyArchived(ctx, bucket, obj.Key, obj.Size, "")
 		switch {
 		case err != nil:
 			s.failed.Add(1)
@@ -269,8 +274,11 @@ func handle(ctx context.Context, tiering *service.Tiering, bucket string, obj mi
 		return
 	}
 
-	// evict=false is the whole point: this copies, it never moves.
-	res := tiering.ArchiveKnownObject(ctx, bucket, obj.Key, obj.Size, false)
+	// evict=false is the whole point: this copies, it never moves. The digest
+	// costs a StatObject, which is small beside the copy, and is what lets the
+	// retention job later check the archived copy's content and not just its
+	// size.
+	res := tiering.ArchiveKnownObject(ctx, bucket, obj.Key, obj.Size, tiering.LocalSHA256(ctx, bucket, obj.Key), false)
 	switch res.Outcome {
 	case service.TierArchivedKept:
 		s.uploaded.Add(1)
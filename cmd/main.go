@@ -27,6 +27,7 @@ import (
 	"github.com/mstgnz/cdn/pkg/config"
 	"github.com/mstgnz/cdn/pkg/middleware"
 	"github.com/mstgnz/cdn/pkg/observability"
+	"github.com/mstgnz/cdn/pkg/validator"
 	"github.com/mstgnz/cdn/service"
 )
 
@@ -83,6 +84,20 @@ func main() {
 		logger.Warn().Strs("buckets", expiringSoon).Msg("bucket-scoped tokens expire within a week")
 	}
 
+	// Optional per-bucket policies, on the same terms as the token file: absent
+	// is "none yet", present but invalid stops boot. A cache policy the operator
+	// wrote and the service silently dropped would show up as a CDN bill, not as
+	// an error anyone reads.
+	policiesFile := config.GetEnvOrDefault("BUCKET_POLICIES_FILE", "config/buckets.json")
+	bucketPolicyCount, err := config.LoadBucketPolicies(policiesFile)
+	if err != nil {
+		logger.Fatal().Err(err).Str("file", policiesFile).Msg("bucket policy file is present but invalid")
+	}
+	if err := validator.CheckUploadPolicies(); err != nil {
+		logger.Fatal().Err(err).Str("file", policiesFile).Msg("bucket policy file is present but invalid")
+	}
+	logger.Info().Int("count", bucketPolicyCount).Str("file", policiesFile).Msg("bucket policies loaded")
+
 	// ImageMagick reads MAGICK_* limits at genesis, so these must be exported
 	// before Initialize(). The imagick.v3 binding has no width/height resource
 	// constants, so pixel-dimension caps go through these env vars.
@@ -161,18 +176,64 @@ func main() {
 		}()
 	}
 
+	// Upstream cache purges. Off unless PURGE_WEBHOOK_URL is set; a URL that is
+	// set but unusable stops boot, since deletes would otherwise keep being
+	// served from Cloudflare or nginx with nobody told.
+	purgeNotifier, err := service.NewPurgeNotifier()
+	if err != nil {
+		logger.Fatal().Err(err).Msg("invalid upstream purge configuration")
+	}
+
 	// Retention. Off unless asked for, and reporting-only the first time it is,
 	// because the one thing this job does is delete files. It refuses to start at
 	// all without the archive, since without it there is nothing to fall back to.
 	objectStore := service.MinioStore{Client: minioClient}
 	retention := service.NewRetention(objectStore, archive)
+	retention.SetPurgeNotifier(purgeNotifier)
 	retention.Start(ctx)
 
+	// Persistent variant store. Off unless DERIVATIVES_BUCKET names a bucket; a
+	// name that cannot be a bucket stops boot. The bucket is created on first
+	// boot, and a failure to do so only disables writes in practice, so it is
+	// reported rather than fatal.
+	derivatives, err := service.NewDerivativeStore(objectStore)
+	if err != nil {
+		logger.Fatal().Err(err).Msg("invalid derivative store configuration")
+	}
+	if err := derivatives.EnsureBucket(ctx); err != nil {
+		logger.Error().Err(err).Str("bucket", derivatives.Bucket()).Msg("derivative bucket could not be created; variants will not be stored")
+	}
+	derivatives.Start(ctx)
+
+	// Digest index for buckets whose policy turns on dedup; nil when none does.
+	// Unlike the derivative bucket, a missing index bucket would fail every
+	// reference count and with it every delete in those buckets, so it is fatal.
+	dedupIndex, err := service.NewDedupIndex(objectStore)
+	if err != nil {
+		logger.Fatal().Err(err).Msg("invalid dedup index configuration")
+	}
+	if err := dedupIndex.EnsureBucket(ctx); err != nil {
+		logger.Fatal().Err(err).Str("bucket", service.DedupIndexBucket()).Msg("dedup index bucket could not be created")
+	}
+
+	// Trash for buckets whose policy keeps one; nil when none does. Fatal for
+	// the same reason as the index: without its bucket every delete from those
+	// buckets would fail rather than fall back to removing for good.
+	trash, err := service.NewTrash(objectStore)
+	if err != nil {
+		logger.Fatal().Err(err).Msg("invalid trash configuration")
+	}
+	if err := trash.EnsureBucket(ctx); err != nil {
+		logger.Fatal().Err(err).Str("bucket", service.TrashBucket()).Msg("trash bucket could not be created")
+	}
+	trash.Start(ctx)
+
 	// On-demand tiering, driven by the applications that own the content. It is
 	// the only workable trigger on a CDN that objects were migrated into: the
 	// stored timestamps describe the migration, not the content, so age tells the
 	// server nothing about when a file stopped being needed locally.
 	tiering := service.NewTiering(objectStore, archive)
+	tiering.SetPurgeNotifier(purgeNotifier)
 	archiveHandler = handler.NewArchiveHandler(tiering)
 
 	// Initialize cache service.
@@ -188,8 +249,68 @@ func main() {
 		logger.Warn().Err(err).Msg("cache service unavailable at boot; it will reconnect on its own when Redis accepts connections")
 	}
 
+	// Resized variants get a small in-process tier in front of Redis. Purges
+	// reach it directly and, through Redis, on every other replica.
+	variantCache := service.NewMemoryTier(ctx, cacheService)
+
+	// Keys found in neither tier are remembered briefly, so a scanner walking
+	// random keys costs one archive lookup per key rather than one per request.
+	// Uploads drop the entry on every replica through the same purge broadcast.
+	missingObjects := service.NewNegativeCache(cacheService)
+	if sub, ok := cacheService.(service.PurgeSubscriber); ok {
+		missingObjects.Subscribe(ctx, sub)
+	}
+
+	// Uploads are scanned by clamd before they are stored when CLAMD_ADDR is
+	// set. Nothing is checked here: a clamd that is down at boot is the same
+	// as one that goes down later, and each bucket's malware_scan mode decides.
+	scanner := service.NewMalwareScanner()
+	if scanner != nil {
+		logger.Info().Str("clamd", config.GetEnvOrDefault("CLAMD_ADDR", "")).Msg("malware scanning enabled")
+	}
+
 	// Initialize handlers
-	imageHandler = handler.NewImage(minioClient, awsService, archive, imageService)
+	imageHandler = handler.NewImage(minioClient, awsService, archive, imageService, variantCache, purgeNotifier, derivatives, missingObjects, dedupIndex, scanner, trash)
+	cacheHandler := handler.NewCacheHandler(variantCache, derivatives)
+
+	// Resumable uploads stage their chunks in a bucket of their own and share
+	// the rest of the upload pipeline with imageHandler.
+	tusHandler, err := handler.NewTusHandler(imageHandler, objectStore)
+	if err != nil {
+		logger.Fatal().Err(err).Msg("invalid resumable upload configuration")
+	}
+	if err := tusHandler.EnsureBucket(ctx); err != nil {
+		logger.Error().Err(err).Str("bucket", service.TusStagingBucket()).Msg("tus staging bucket could not be created; resumable uploads will fail")
+	}
+	tusHandler.Start(ctx)
+
+	// Presigned uploads stage in the same bucket. The signer only exists when
+	// MINIO_PUBLIC_ENDPOINT says where browsers can reach MinIO.
+	presignClient, err := service.PresignClient()
+	if err != nil {
+		logger.Fatal().Err(err).Msg("invalid MINIO_PUBLIC_ENDPOINT")
+	}
+	presignHandler, err := handler.NewPresignHandler(imageHandler, objectStore, presignClient)
+	if err != nil {
+		logger.Fatal().Err(err).Msg("invalid presigned upload configuration")
+	}
+	presignHandler.Start(ctx)
+
+	// Background jobs, kept in a bucket of their own so a restart or another
+	// replica finishes what was accepted. Kinds are registered by the handlers
+	// that submit them, before the workers start.
+	jobQueue, err := service.NewJobQueue(objectStore)
+	if err != nil {
+		logger.Fatal().Err(err).Msg("invalid job queue configuration")
+	}
+	if err := jobQueue.EnsureBucket(ctx); err != nil {
+		logger.Error().Err(err).Str("bucket", service.JobsBucket()).Msg("jobs bucket could not be created; asynchronous imports will fail")
+	}
+	jobsHandler, err := handler.NewJobsHandler(imageHandler, jobQueue)
+	if err != nil {
+		logger.Fatal().Err(err).Msg("invalid job handler configuration")
+	}
+	jobQueue.Start(ctx)
 	awsHandler = handler.NewAwsHandler(awsService)
 	minioHandler = handler.NewMinioHandler(minioClient)
 	wsHandler = handler.NewWebSocketHandler(statsService)
@@ -224,7 +345,10 @@ func main() {
 		AllowOrigins: "*",
 		AllowHeaders: "*",
 		AllowMethods: "*",
-		MaxAge:       86400,
+		// Browser tus clients must be able to read where to resume from and
+		// where a new upload lives.
+		ExposeHeaders: "Location, Upload-Offset, Upload-Length, Upload-Metadata, Tus-Resumable, Tus-Version, Tus-Extension, Tus-Max-Size, X-Object-Name, X-Object-Link, X-Dedup-Reference, Idempotent-Replayed",
+		MaxAge:        86400,
 	}))
 
 	// Prevent MIME sniffing on served objects: user-uploaded content must not be
@@ -317,6 +441,8 @@ func main() {
 	io.Get("/:bucket/exists", minioHandler.BucketExists)
 	io.Get("/:bucket/create", minioHandler.CreateBucket)
 	io.Delete("/:bucket/delete", minioHandler.RemoveBucket)
+	io.Get("/:bucket/versioning", minioHandler.GetVersioning)
+	io.Put("/:bucket/versioning", minioHandler.SetVersioning)
 
 	// resize
 	// Auth-gated: /resize feeds arbitrary request bytes straight into ImageMagick
@@ -332,6 +458,76 @@ func main() {
 	// afterwards, so this is a move between tiers rather than a deletion.
 	app.Post("/archive", BucketAuthMiddleware, archiveHandler.ArchiveObjects)
 
+	// Scoped purge of cached variants. Operator only, and registered before the
+	// /:bucket/* wildcard like the routes above.
+	app.Post("/cache/purge", GeneralAuthMiddleware, cacheHandler.Purge)
+
+	// Resumable uploads (tus 1.0). Registered ahead of the wildcards: GET also
+	// answers HEAD, and both it and DELETE /:bucket/* would otherwise read
+	// /tus/<id> as an object in a bucket named "tus". Not behind the upload
+	// rate limiter, which counts requests: a chunked upload is many of them by
+	// design. OPTIONS is discovery and needs no token.
+	if !disableUpload {
+		app.Options("/tus/", tusHandler.Options)
+		app.Post("/tus/", BucketAuthMiddleware, tusHandler.Create)
+		app.Head("/tus/:id", BucketAuthMiddleware, tusHandler.Head)
+		app.Patch("/tus/:id", BucketAuthMiddleware, tusHandler.Patch)
+		app.Delete("/tus/:id", BucketAuthMiddleware, tusHandler.Terminate)
+	}
+
+	// Object metadata. Behind BucketAuthMiddleware because it exposes sizes and
+	// ETags a public URL does not, and ahead of the GET wildcards. That shadows
+	// GET on a bucket named "meta", so the name is refused when a bucket is
+	// created (bucket.ValidateNew), as are the other route prefixes below.
+	app.Get("/meta/:bucket/*", BucketAuthMiddleware, imageHandler.GetMetadata)
+	if !disableUpload {
+		// Metadata and tags change without a re-upload, so this is a write.
+		app.Patch("/meta/:bucket/*", BucketAuthMiddleware, imageHandler.UpdateMetadata)
+	}
+
+	// Bucket listing. Behind BucketAuthMiddleware, since it shows what a
+	// public URL only serves to somebody who already knows the key, and ahead
+	// of the GET wildcards for the same reason as /meta; "objects" is reserved
+	// as a bucket name like "meta".
+	app.Get("/objects/:bucket", BucketAuthMiddleware, imageHandler.ListObjects)
+
+	// Server-side copy and move. A copy writes, and a move also deletes, so
+	// each is registered only when the operations it performs are enabled.
+	if !disableUpload {
+		app.Post("/objects/copy", BucketAuthMiddleware, imageHandler.CopyObject)
+		if !disableDelete {
+			app.Post("/objects/move", BucketAuthMiddleware, imageHandler.MoveObject)
+		}
+	}
+
+	// Delete by prefix, a job polled on /jobs/:id. Only deletes are needed; a
+	// dry run deletes nothing, but is only of use ahead of a delete.
+	if !disableDelete {
+		app.Post("/objects/delete-prefix", BucketAuthMiddleware, jobsHandler.DeletePrefix)
+	}
+
+	// Trash of the buckets whose policy keeps one. Listing it is a read, ahead
+	// of the GET wildcards for the same reason as /meta, and "trash" is reserved
+	// as a bucket name for that reason; a restore writes the object back, so it
+	// is registered only when uploads are enabled.
+	app.Get("/trash/:bucket", BucketAuthMiddleware, imageHandler.ListTrash)
+	if !disableUpload {
+		app.Post("/trash/:bucket/restore", BucketAuthMiddleware, imageHandler.RestoreTrash)
+	}
+
+	// Version history of objects in versioned buckets. Listing is a read, ahead
+	// of the GET wildcards for the same reason as /meta, and "versions" is
+	// reserved as a bucket name for that reason; a restore writes a new version,
+	// so it is registered only when uploads are enabled.
+	app.Get("/versions/:bucket/*", BucketAuthMiddleware, imageHandler.ListVersions)
+	if !disableUpload {
+		app.Post("/versions/:bucket/restore", BucketAuthMiddleware, imageHandler.RestoreVersion)
+	}
+
+	// Job status, for whoever submitted the job. Ahead of the GET wildcards for
+	// the same reason as /meta, with "jobs" reserved as a bucket name.
+	app.Get("/jobs/:id", BucketAuthMiddleware, jobsHandler.Status)
+
 	// Minio
 	if !disableGet {
 		/*
@@ -362,9 +558,16 @@ func main() {
 	if !disableUpload {
 		uploadGroup := app.Group("/")
 		uploadGroup.Use(middleware.NewAdvancedRateLimiter(config.GetEnvAsIntOrDefault("UPLOAD_RATE_LIMIT", 50), time.Minute))
-		uploadGroup.Post("/upload", BucketAuthMiddleware, imageHandler.UploadImage)
-		uploadGroup.Post("/upload-url", BucketAuthMiddleware, imageHandler.UploadWithUrl)
-		uploadGroup.Post("/batch/upload", BucketAuthMiddleware, imageHandler.BatchUpload)
+		// A retried upload with the same Idempotency-Key gets the first one's
+		// response instead of storing the file again.
+		idempotent := middleware.Idempotency(cacheService)
+		uploadGroup.Post("/upload", BucketAuthMiddleware, idempotent, imageHandler.UploadImage)
+		uploadGroup.Post("/upload-url", BucketAuthMiddleware, idempotent, jobsHandler.UploadWithUrl)
+		uploadGroup.Post("/upload-url/batch", BucketAuthMiddleware, idempotent, jobsHandler.ImportURLs)
+		uploadGroup.Post("/batch/upload", BucketAuthMiddleware, idempotent, imageHandler.BatchUpload)
+		uploadGroup.Post("/upload/zip", BucketAuthMiddleware, idempotent, imageHandler.UploadZip)
+		uploadGroup.Post("/upload/presign", BucketAuthMiddleware, presignHandler.Presign)
+		uploadGroup.Post("/upload/presign/:id/finalize", BucketAuthMiddleware, presignHandler.Finalize)
 	}
 
 	// Index
@@ -407,6 +610,12 @@ func main() {
 		logger.Error().Err(err).Msg("Server shutdown failed")
 	}
 
+	// Deliver purges still queued from the last deletes, within what is left of
+	// the shutdown budget.
+	if err := purgeNotifier.Close(shutdownCtx); err != nil {
+		logger.Error().Err(err).Msg("upstream purges still queued at shutdown were not delivered")
+	}
+
 	// Close other connections
 	if cacheService != nil {
 		if err := cacheService.Close(); err != nil {
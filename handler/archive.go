@@ -77,6 +77,9 @@ func (h *archiveHandler) ArchiveObjects(c *fiber.Ctx) error {
 	if bucket == "" {
 		return service.Response(c, fiber.StatusBadRequest, false, "Bucket is required", nil)
 	}
+	if service.InternalBucket(bucket) {
+		return bucketReserved(c)
+	}
 
 	maxBatch := config.GetEnvAsIntOrDefault("MAX_BATCH_FILES", 100)
 	if maxBatch > 0 && len(req.Files) > maxBatch {
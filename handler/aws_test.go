@@ -24,6 +24,7 @@ type mockAwsService struct {
 	listBuckets    []s3types.Bucket
 	listBucketsErr error
 	vaultList      *glacier.ListVaultsOutput
+	deleted        []string
 }
 
 var _ service.AwsService = (*mockAwsService)(nil)
@@ -53,7 +54,7 @@ func (m *mockAwsService) GlacierInventoryRetrieval(string) (*glacier.InitiateJob
 }
 func (m *mockAwsService) GlacierDownloadToMinio(string, string, string, string) error { return nil }
 func (m *mockAwsService) GlacierDownloadToLocal(string, string, string) error         { return nil }
-func (m *mockAwsService) S3PutObject(context.Context, string, string, io.Reader) (*manager.UploadOutput, error) {
+func (m *mockAwsService) S3PutObject(context.Context, string, string, io.Reader, map[string]string) (*manager.UploadOutput, error) {
 	return nil, nil
 }
 func (m *mockAwsService) S3HeadObject(context.Context, string, string) (*s3.HeadObjectOutput, error) {
@@ -63,10 +64,16 @@ func (m *mockAwsService) S3HeadBucket(context.Context, string) error { return ni
 func (m *mockAwsService) S3ListObjects(context.Context, string, string, func(string, int64) error) error {
 	return nil
 }
+func (m *mockAwsService) S3CopyObject(context.Context, string, string, string, string) error {
+	return nil
+}
 func (m *mockAwsService) S3GetObject(context.Context, string, string) (*s3.GetObjectOutput, error) {
 	return nil, nil
 }
-func (m *mockAwsService) DeleteObjects(string, []string) error { return nil }
+func (m *mockAwsService) DeleteObjects(_ string, keys []string) error {
+	m.deleted = append(m.deleted, keys...)
+	return nil
+}
 
 func newAwsApp(mock service.AwsService) *fiber.App {
 	h := NewAwsHandler(mock)
@@ -48,3 +48,15 @@ func resolveBucket(c *fiber.Ctx, requested string) (string, error) {
 func bucketForbidden(c *fiber.Ctx) error {
 	return service.Response(c, fiber.StatusForbidden, false, errBucketForbidden.Error(), nil)
 }
+
+// bucketReserved writes the 400 for a request naming one of the service's own
+// buckets (service.InternalBucket): tus staging, jobs, derivatives, and the
+// trash and dedup index when they are configured. Every endpoint that reads,
+// writes or deletes objects by bucket refuses them, not only the newer ones:
+// their contents are the service's working state, and a token able to upload
+// into the jobs bucket or delete from the dedup index could corrupt it for
+// every other caller. GetImage answers these with its not-found image instead,
+// so an anonymous read does not learn which of them exist.
+func bucketReserved(c *fiber.Ctx) error {
+	return service.Response(c, fiber.StatusBadRequest, false, "bucket is reserved for the service", nil)
+}
@@ -172,3 +172,54 @@ func TestBucketForbiddenResponse(t *testing.T) {
 		t.Errorf("message = %q, want %q", body.Message, errBucketForbidden.Error())
 	}
 }
+
+// TestServiceBucketsRefusedEverywhere guards the endpoints that predate the
+// service's own buckets: each must refuse them before it touches storage (the
+// handler has no MinIO client here, so reaching it would panic), and an
+// anonymous read must get the same not-found answer as a missing object.
+func TestServiceBucketsRefusedEverywhere(t *testing.T) {
+	h := &image{}
+	app := fiber.New()
+	app.Get("/meta/:bucket/*", h.GetMetadata)
+	app.Patch("/meta/:bucket/*", h.UpdateMetadata)
+	app.Get("/:bucket/*", h.GetImage)
+	app.Delete("/:bucket/*", h.DeleteImage)
+	app.Post("/upload", h.UploadImage)
+	app.Post("/upload-url", h.UploadWithUrl)
+	app.Post("/batch/upload", h.BatchUpload)
+	app.Post("/batch/delete", h.BatchDelete)
+	app.Post("/upload/zip", h.UploadZip)
+
+	for _, bucket := range []string{service.TusStagingBucket(), service.JobsBucket()} {
+		if resp := doReq(t, app, "DELETE", "/"+bucket+"/a.png"); resp.StatusCode != fiber.StatusBadRequest {
+			t.Errorf("DELETE from %s: status %d, want 400", bucket, resp.StatusCode)
+		}
+		if resp := doReq(t, app, "GET", "/meta/"+bucket+"/a.png"); resp.StatusCode != fiber.StatusBadRequest {
+			t.Errorf("GET metadata in %s: status %d, want 400", bucket, resp.StatusCode)
+		}
+		if resp := doJSON(t, app, "PATCH", "/meta/"+bucket+"/a.png", `{}`); resp.StatusCode != fiber.StatusBadRequest {
+			t.Errorf("PATCH metadata in %s: status %d, want 400", bucket, resp.StatusCode)
+		}
+		if resp := doReq(t, app, "GET", "/"+bucket+"/a.png"); resp.StatusCode == fiber.StatusOK {
+			t.Errorf("GET from %s was served", bucket)
+		}
+		if resp := doJSON(t, app, "POST", "/upload-url", `{"bucket":"`+bucket+`","url":"https://example.com/a.png"}`); resp.StatusCode != fiber.StatusBadRequest {
+			t.Errorf("upload-url into %s: status %d, want 400", bucket, resp.StatusCode)
+		}
+		if resp := doJSON(t, app, "POST", "/batch/delete", `{"bucket":"`+bucket+`","files":["a.png"]}`); resp.StatusCode != fiber.StatusBadRequest {
+			t.Errorf("batch delete in %s: status %d, want 400", bucket, resp.StatusCode)
+		}
+		for target, name := range map[string]string{"/upload": "a.png", "/batch/upload": "a.png", "/upload/zip": "a.zip"} {
+			body, ct := multipartForm(t, map[string]string{"bucket": bucket}, "file", name, []byte("x"))
+			req := httptest.NewRequest("POST", target, body)
+			req.Header.Set("Content-Type", ct)
+			resp, err := app.Test(req, -1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp.StatusCode != fiber.StatusBadRequest || decodeBody(t, resp).Message != "bucket is reserved for the service" {
+				t.Errorf("POST %s into %s: status %d, want the reserved-bucket 400", target, bucket, resp.StatusCode)
+			}
+		}
+	}
+}
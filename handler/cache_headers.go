@@ -0,0 +1,32 @@
+package handler
+
+import (
+	"github.com/gofiber/fiber/v2"
+
+	"github.com/mstgnz/cdn/pkg/config"
+)
+
+// applyCachePolicy sets the Cache-Control and extra headers configured for one
+// served object. Nothing configured means nothing is sent, which is what every
+// response looked like before bucket policies existed.
+//
+// variant selects the block for transformed output (a resize) over the one for
+// the stored original. They are kept apart because a cache holding a variant
+// for a year would also hold every resize bug for a year.
+//
+// Only ever called on a path that is about to send the real object. The
+// notfound placeholder goes out with a 200 as well, and a long max-age on that
+// would pin a "missing" image in every cache in front of this for as long as
+// the policy says, long after the object was uploaded.
+func applyCachePolicy(c *fiber.Ctx, bucket, key string, variant bool) {
+	d := config.CacheDirectivesFor(bucket, key, variant)
+	if d == nil {
+		return
+	}
+	if cc := d.CacheControl(); cc != "" {
+		c.Set("Cache-Control", cc)
+	}
+	for name, value := range d.Headers {
+		c.Set(name, value)
+	}
+}
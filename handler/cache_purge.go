@@ -0,0 +1,109 @@
+package handler
+
+import (
+	"context"
+
+	"github.com/gofiber/fiber/v2"
+
+	"github.com/mstgnz/cdn/pkg/observability"
+	"github.com/mstgnz/cdn/service"
+)
+
+// CacheHandler serves the operator cache endpoints.
+type CacheHandler interface {
+	Purge(c *fiber.Ctx) error
+}
+
+type cacheHandler struct {
+	cache       service.CacheService
+	derivatives *service.DerivativeStore
+}
+
+func NewCacheHandler(cache service.CacheService, derivatives *service.DerivativeStore) CacheHandler {
+	return &cacheHandler{cache: cache, derivatives: derivatives}
+}
+
+// Purge drops cached derived images for one object, a key prefix, or a whole
+// bucket, from Redis and from the derivative store. Originals are never cached
+// here, so nothing a purge removes is lost: the next request for a size
+// recomputes it.
+//
+// This is an operator route rather than a bucket-token one. Deletes already
+// purge what they remove, so the remaining reasons to purge (a resize fix that
+// should reach every variant, a bad batch of cached output) are deployment-wide
+// decisions, not something one tenant needs to make.
+func (h *cacheHandler) Purge(c *fiber.Ctx) error {
+	var scope service.PurgeScope
+	if err := c.BodyParser(&scope); err != nil {
+		return service.Response(c, fiber.StatusBadRequest, false, "Invalid request body", nil)
+	}
+	if err := scope.Validate(); err != nil {
+		return service.Response(c, fiber.StatusBadRequest, false, err.Error(), nil)
+	}
+	// The key is matched as written, so a traversal-shaped one cannot name any
+	// cached object; refusing it keeps the endpoint's inputs as strict as the
+	// routes that create the entries.
+	if scope.Key != "" && service.HasUnsafeObjectKey(scope.Key) {
+		return service.Response(c, fiber.StatusBadRequest, false, "invalid object key", nil)
+	}
+
+	if h.cache == nil && !h.derivatives.Enabled() {
+		return service.Response(c, fiber.StatusServiceUnavailable, false, "cache is not configured", nil)
+	}
+
+	purged := 0
+	if h.cache != nil {
+		n, err := h.cache.PurgeVariants(c.Context(), scope)
+		if err != nil {
+			return service.Response(c, fiber.StatusInternalServerError, false, err.Error(), nil)
+		}
+		purged = n
+	}
+
+	derivatives, err := h.derivatives.Purge(c.Context(), scope)
+	if err != nil {
+		return service.Response(c, fiber.StatusInternalServerError, false, err.Error(), nil)
+	}
+
+	return service.Response(c, fiber.StatusOK, true, "Cache purged", fiber.Map{
+		"bucket":      scope.Bucket,
+		"key":         scope.Key,
+		"prefix":      scope.Prefix,
+		"purged":      purged,
+		"derivatives": derivatives,
+	})
+}
+
+// purgeCaches forgets an object that was just deleted or replaced: its cached
+// variants, its stored derivatives, and its URL in the caches in front of the
+// service.
+//
+// A failure is logged and swallowed rather than failing the delete: the object
+// is already gone from MinIO by the time this runs, and reporting the delete as
+// failed would invite a retry that cannot succeed. What is left behind locally
+// expires with the variant TTL; the upstream notifier counts its own failures.
+// The same goes for an overwrite, whose new bytes are already stored.
+func (i image) purgeCaches(ctx context.Context, reason service.PurgeReason, bucket, object string) {
+	i.notifier.Notify(reason, bucket, object)
+	scope := service.PurgeScope{Bucket: bucket, Key: object}
+	log := observability.Logger()
+
+	if i.cache != nil {
+		_ = i.cache.Delete(presetStatusKey(bucket, object))
+		if _, err := i.cache.PurgeVariants(ctx, scope); err != nil {
+			log.Warn().Err(err).
+				Str("bucket", bucket).
+				Str("key", object).
+				Msg("could not purge cached variants; they expire with the cache TTL")
+		}
+	}
+
+	// Leftovers here are never served, since their ETag no longer matches, but
+	// they hold disk until eviction reaches them.
+	if _, err := i.derivatives.Purge(ctx, scope); err != nil {
+		log.Warn().Err(err).
+			Str("bucket", bucket).
+			Str("key", object).
+			Msg("could not remove stored derivatives; eviction will reclaim them")
+	}
+}
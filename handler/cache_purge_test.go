@@ -0,0 +1,90 @@
+package handler
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+
+	"github.com/mstgnz/cdn/service"
+)
+
+// purgeCache records the scopes it is asked to purge. Only PurgeVariants is
+// implemented; anything else panics through the nil embedded interface.
+type purgeCache struct {
+	service.CacheService
+	scopes []service.PurgeScope
+}
+
+func (p *purgeCache) PurgeVariants(_ context.Context, scope service.PurgeScope) (int, error) {
+	p.scopes = append(p.scopes, scope)
+	return 3, nil
+}
+
+func postPurge(t *testing.T, cache service.CacheService, body string) *http.Response {
+	t.Helper()
+	app := fiber.New()
+	app.Post("/cache/purge", NewCacheHandler(cache, nil).Purge)
+	req := httptest.NewRequest(http.MethodPost, "/cache/purge", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := app.Test(req, -1)
+	if err != nil {
+		t.Fatalf("purge request failed: %v", err)
+	}
+	return resp
+}
+
+func TestCachePurgeRejectsUnscopedOrAmbiguousRequests(t *testing.T) {
+	for name, body := range map[string]string{
+		"no bucket":      `{"key":"a.jpg"}`,
+		"key and prefix": `{"bucket":"photos","key":"a.jpg","prefix":"a"}`,
+		"traversal key":  `{"bucket":"photos","key":"../other/a.jpg"}`,
+		"not json":       `bucket=photos`,
+	} {
+		t.Run(name, func(t *testing.T) {
+			cache := &purgeCache{}
+			resp := postPurge(t, cache, body)
+			if resp.StatusCode != fiber.StatusBadRequest {
+				t.Fatalf("status = %d, want 400", resp.StatusCode)
+			}
+			if len(cache.scopes) != 0 {
+				t.Fatalf("purged %v for a rejected request", cache.scopes)
+			}
+		})
+	}
+}
+
+func TestCachePurgePassesScopeThrough(t *testing.T) {
+	cache := &purgeCache{}
+	resp := postPurge(t, cache, `{"bucket":"photos","prefix":"2026/"}`)
+
+	if resp.StatusCode != fiber.StatusOK {
+		t.Fatalf("status = %d, want 200", resp.StatusCode)
+	}
+	want := service.PurgeScope{Bucket: "photos", Prefix: "2026/"}
+	if len(cache.scopes) != 1 || cache.scopes[0] != want {
+		t.Fatalf("purged %v, want exactly %v", cache.scopes, want)
+	}
+}
+
+// Without Redis there is nothing to purge, and saying so beats a nil panic.
+func TestCachePurgeWithoutCache(t *testing.T) {
+	resp := postPurge(t, nil, `{"bucket":"photos"}`)
+	if resp.StatusCode != fiber.StatusServiceUnavailable {
+		t.Fatalf("status = %d, want 503", resp.StatusCode)
+	}
+}
+
+// A write drops the variants cached for its key even on a replica that keeps
+// no negative entries.
+func TestForgetMissingPurgesWithoutANegativeCache(t *testing.T) {
+	cache := &purgeCache{}
+	image{cache: cache}.forgetMissing(context.Background(), "photos", "a.png")
+	want := service.PurgeScope{Bucket: "photos", Key: "a.png"}
+	if len(cache.scopes) != 1 || cache.scopes[0] != want {
+		t.Fatalf("purged %v, want exactly %v", cache.scopes, want)
+	}
+}
@@ -0,0 +1,106 @@
+package handler
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"io"
+	"mime/multipart"
+	"strings"
+
+	"github.com/mstgnz/cdn/pkg/validator"
+)
+
+// Per-file checksum headers. They are read from the file's own multipart part,
+// which is the only place a header can describe one file rather than the whole
+// request body; a Content-MD5 on the request itself would be the digest of the
+// multipart encoding, which no client means.
+const (
+	headerContentMD5     = "Content-MD5"
+	headerChecksumSHA256 = "X-Checksum-SHA256"
+)
+
+// uploadChecksum is what a client said one file's bytes hash to. Either half
+// may be missing; an empty one checks nothing.
+type uploadChecksum struct {
+	md5    []byte
+	sha256 []byte
+}
+
+// fileChecksum reads the checksum a client sent for one file: from the file
+// part's Content-MD5 and X-Checksum-SHA256 headers, or, for clients such as a
+// browser's FormData that cannot set part headers, from the form values given.
+// A part header wins over a form value.
+func fileChecksum(file *multipart.FileHeader, formMD5, formSHA256 string) (uploadChecksum, error) {
+	md5Value, sha256Value := formMD5, formSHA256
+	if v := file.Header.Get(headerContentMD5); v != "" {
+		md5Value = v
+	}
+	if v := file.Header.Get(headerChecksumSHA256); v != "" {
+		sha256Value = v
+	}
+	return parseChecksum(md5Value, sha256Value)
+}
+
+// parseChecksum decodes the two checksum forms. Content-MD5 is base64, as RFC
+// 1864 has it. The SHA-256 is taken as hex, which is what sha256sum prints, or
+// as base64, which is what S3's x-amz-checksum-sha256 uses, so a client can
+// send whichever it already has.
+func parseChecksum(md5Value, sha256Value string) (uploadChecksum, error) {
+	var out uploadChecksum
+	if md5Value = strings.TrimSpace(md5Value); md5Value != "" {
+		raw, err := base64.StdEncoding.DecodeString(md5Value)
+		if err != nil || len(raw) != md5.Size {
+			return uploadChecksum{}, invalidChecksum("Content-MD5 must be the base64 of a 16-byte MD5 digest")
+		}
+		out.md5 = raw
+	}
+	if sha256Value = strings.TrimSpace(sha256Value); sha256Value != "" {
+		raw, err := hex.DecodeString(sha256Value)
+		if err != nil {
+			raw, err = base64.StdEncoding.DecodeString(sha256Value)
+		}
+		if err != nil || len(raw) != sha256.Size {
+			return uploadChecksum{}, invalidChecksum("X-Checksum-SHA256 must be a SHA-256 digest in hex or base64")
+		}
+		out.sha256 = raw
+	}
+	return out, nil
+}
+
+func invalidChecksum(message string) error {
+	return &validator.FileValidationError{Code: "INVALID_CHECKSUM", Message: message}
+}
+
+// verifyChecksum hashes what is left of rs, rewinds it, and returns its hex
+// SHA-256, having checked it and its MD5 against what the client sent.
+//
+// This is the received bytes, before any optimisation: the checksum describes
+// what left the client, and the point is to catch the upload having been
+// damaged on the way. A mismatch fails the file with CHECKSUM_MISMATCH before
+// anything is stored.
+func verifyChecksum(rs io.ReadSeeker, want uploadChecksum) (string, error) {
+	sumSHA, sumMD5 := sha256.New(), md5.New()
+	if _, err := io.Copy(io.MultiWriter(sumSHA, sumMD5), rs); err != nil {
+		return "", err
+	}
+	if _, err := rs.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	gotSHA := sumSHA.Sum(nil)
+	if want.sha256 != nil && !bytes.Equal(want.sha256, gotSHA) {
+		return "", &validator.FileValidationError{
+			Code:    "CHECKSUM_MISMATCH",
+			Message: "file does not match its X-Checksum-SHA256; received sha256 " + hex.EncodeToString(gotSHA),
+		}
+	}
+	if want.md5 != nil && !bytes.Equal(want.md5, sumMD5.Sum(nil)) {
+		return "", &validator.FileValidationError{
+			Code:    "CHECKSUM_MISMATCH",
+			Message: "file does not match its Content-MD5; received " + base64.StdEncoding.EncodeToString(sumMD5.Sum(nil)),
+		}
+	}
+	return hex.EncodeToString(gotSHA), nil
+}
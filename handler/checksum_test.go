@@ -0,0 +1,86 @@
+package handler
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"mime/multipart"
+	"net/textproto"
+	"strings"
+	"testing"
+
+	"github.com/mstgnz/cdn/pkg/validator"
+)
+
+func checksumCode(err error) string {
+	if valErr, ok := err.(*validator.FileValidationError); ok {
+		return valErr.Code
+	}
+	return ""
+}
+
+// Either digest form is accepted, and the received bytes' SHA-256 comes back
+// for the object's metadata, with the reader rewound for the upload.
+func TestVerifyChecksumAcceptsMatchingDigests(t *testing.T) {
+	data := "a file as the client sent it"
+	sha := sha256.Sum256([]byte(data))
+	md := md5.Sum([]byte(data))
+
+	for name, values := range map[string][2]string{
+		"sha256 hex":    {"", hex.EncodeToString(sha[:])},
+		"sha256 base64": {"", base64.StdEncoding.EncodeToString(sha[:])},
+		"md5":           {base64.StdEncoding.EncodeToString(md[:]), ""},
+		"none":          {"", ""},
+	} {
+		want, err := parseChecksum(values[0], values[1])
+		if err != nil {
+			t.Fatalf("%s: parse: %v", name, err)
+		}
+		r := strings.NewReader(data)
+		sum, err := verifyChecksum(r, want)
+		if err != nil || sum != hex.EncodeToString(sha[:]) {
+			t.Fatalf("%s: verify = (%q, %v)", name, sum, err)
+		}
+		if r.Len() != len(data) {
+			t.Fatalf("%s: reader not rewound", name)
+		}
+	}
+}
+
+func TestVerifyChecksumRejectsMismatchesAndMalformedValues(t *testing.T) {
+	other := sha256.Sum256([]byte("something else"))
+	want, _ := parseChecksum("", hex.EncodeToString(other[:]))
+	if _, err := verifyChecksum(strings.NewReader("the upload"), want); checksumCode(err) != "CHECKSUM_MISMATCH" {
+		t.Errorf("sha256 mismatch: got %v", err)
+	}
+	otherMD5 := md5.Sum([]byte("something else"))
+	want, _ = parseChecksum(base64.StdEncoding.EncodeToString(otherMD5[:]), "")
+	if _, err := verifyChecksum(strings.NewReader("the upload"), want); checksumCode(err) != "CHECKSUM_MISMATCH" {
+		t.Errorf("md5 mismatch: got %v", err)
+	}
+
+	for _, bad := range [][2]string{{"not base64!", ""}, {"c2hvcnQ=", ""}, {"", "abc123"}, {"", strings.Repeat("z", 64)}} {
+		if _, err := parseChecksum(bad[0], bad[1]); checksumCode(err) != "INVALID_CHECKSUM" {
+			t.Errorf("parse %q: got %v", bad, err)
+		}
+	}
+}
+
+// The file's own part header describes that file; a form value is only the
+// fallback for clients that cannot set one.
+func TestFileChecksumPrefersThePartHeader(t *testing.T) {
+	part := sha256.Sum256([]byte("part"))
+	form := sha256.Sum256([]byte("form"))
+	file := &multipart.FileHeader{Header: textproto.MIMEHeader{}}
+
+	got, err := fileChecksum(file, "", hex.EncodeToString(form[:]))
+	if err != nil || string(got.sha256) != string(form[:]) {
+		t.Fatalf("form value: (%x, %v)", got.sha256, err)
+	}
+	file.Header.Set(headerChecksumSHA256, hex.EncodeToString(part[:]))
+	got, err = fileChecksum(file, "", hex.EncodeToString(form[:]))
+	if err != nil || string(got.sha256) != string(part[:]) {
+		t.Fatalf("part header: (%x, %v)", got.sha256, err)
+	}
+}
@@ -0,0 +1,204 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/minio/minio-go/v7"
+
+	"github.com/mstgnz/cdn/pkg/config"
+	"github.com/mstgnz/cdn/pkg/observability"
+	"github.com/mstgnz/cdn/service"
+)
+
+// dedupApplies reports whether an upload is deduplicated: the bucket opts in
+// and the caller did not choose a key. A chosen key is a promise about the URL
+// (see keyedUpload), which answering with some other object would break.
+func (i image) dedupApplies(bucket, key string) bool {
+	return i.dedup.Enabled() && key == "" && config.DedupFor(bucket)
+}
+
+// digestMeta is the user metadata an upload is stored with so that its digest
+// can be found from the object: on a delete, to give back a dedup reference;
+// on a lookup, to confirm the object still holds what the index says; and when
+// the object is archived, to check the archived copy's content and not just
+// its size (see Tiering.VerifyArchived).
+func digestMeta(sum string) map[string]string {
+	if sum == "" {
+		return nil
+	}
+	return map[string]string{service.MetaSHA256: sum}
+}
+
+// reuseDuplicate returns the object that already holds content with digest sum,
+// having counted this upload as one more reference to it, and that reference,
+// which the upload's answer carries so its deletes give back only its own.
+//
+// The index is only trusted after the object confirms it. An entry whose
+// object has gone from both tiers, or has since been overwritten with other
+// bytes, is dropped and the upload is stored as new. An object the retention
+// job moved to the archive still answers on its URL, so it still counts.
+func (i image) reuseDuplicate(ctx context.Context, store service.ObjectStore, bucket, sum string) (string, string, bool) {
+	if sum == "" || !i.dedup.Enabled() || !config.DedupFor(bucket) {
+		return "", "", false
+	}
+	log := observability.Logger()
+
+	entry, found, err := i.dedup.Lookup(ctx, bucket, sum)
+	if err != nil {
+		log.Warn().Err(err).Str("bucket", bucket).Msg("dedup: index lookup failed; storing the upload")
+		return "", "", false
+	}
+	if !found {
+		return "", "", false
+	}
+
+	info, err := store.StatObject(ctx, bucket, entry.Object, minio.StatObjectOptions{})
+	var stale bool
+	switch {
+	case err == nil:
+		stale = info.UserMetadata[service.MetaSHA256] != sum
+	case minio.ToErrorResponse(err).Code == "NoSuchKey":
+		stale = !i.archived(ctx, bucket, entry.Object)
+	default:
+		return "", "", false // cannot tell, so do not count on it
+	}
+	if stale {
+		_ = i.dedup.Drop(ctx, bucket, sum, entry.Object)
+		return "", "", false
+	}
+
+	ref, _, err := i.dedup.AddRef(ctx, bucket, sum, entry.Object)
+	if err != nil {
+		if !errors.Is(err, service.ErrDedupStale) {
+			log.Warn().Err(err).Str("bucket", bucket).Str("object", entry.Object).Msg("dedup: could not count a reference; storing the upload")
+		}
+		return "", "", false
+	}
+	return entry.Object, ref, true
+}
+
+// archived reports whether the archive holds an object.
+func (i image) archived(ctx context.Context, bucket, object string) bool {
+	if i.archive == nil || !i.archive.Enabled() {
+		return false
+	}
+	_, err := i.archive.Stat(ctx, bucket, object)
+	return err == nil
+}
+
+// claimDigest records a newly stored object as the holder of its content.
+// Failing to is logged and otherwise harmless: the object is stored, just not
+// found by the next upload of the same bytes.
+func (i image) claimDigest(ctx context.Context, bucket, key, sum, object string) {
+	if sum == "" || !i.dedupApplies(bucket, key) {
+		return
+	}
+	if _, err := i.dedup.Claim(ctx, bucket, sum, object); err != nil {
+		log := observability.Logger()
+		log.Warn().Err(err).Str("bucket", bucket).Str("object", object).Msg("dedup: could not index the upload")
+	}
+}
+
+// releaseReference gives back a reference to an object before it is deleted
+// and returns how many uploads still hold it. While any do, the object has to
+// stay. Objects without a digest, or that the index does not count, report
+// zero and are deleted as they always were.
+//
+// ref is the reference a deduplicated upload was answered with; "" is the
+// upload that stored the object. Each is given back once, so a retried delete
+// reports the same count again instead of taking another uploader's reference
+// with it.
+//
+// This is keyed on the object, not on the bucket's current policy, so turning
+// dedup off for a bucket does not make its shared objects deletable by the
+// first of their uploaders.
+//
+// An object the retention job moved to the archive is still counted (see
+// reuseDuplicate), so its references are given back too, with the digest its
+// archived copy was recorded with. Otherwise an upload answered with it would
+// hold a reference nothing can return, and a delete with aws_delete would
+// take the archived copy from under it.
+func (i image) releaseReference(ctx context.Context, store service.ObjectStore, bucket, object, ref string) (int, error) {
+	if !i.dedup.Enabled() {
+		return 0, nil
+	}
+	sum, err := i.storedDigest(ctx, store, bucket, object)
+	if err != nil || sum == "" {
+		return 0, err
+	}
+	refs, err := i.dedup.Release(ctx, bucket, sum, object, ref)
+	if errors.Is(err, service.ErrDedupStale) {
+		return 0, nil
+	}
+	return refs, err
+}
+
+// storedDigest returns the digest an object was stored with, from MinIO or,
+// for an object only the archive holds, from its archived copy. An object in
+// neither has none. A failed MinIO stat is taken as none too, as it always
+// was: the delete reports what there is to report. A failed archive stat is
+// not, since with aws_delete it is the archived copy that goes.
+func (i image) storedDigest(ctx context.Context, store service.ObjectStore, bucket, object string) (string, error) {
+	info, err := store.StatObject(ctx, bucket, object, minio.StatObjectOptions{})
+	if err == nil {
+		return info.UserMetadata[service.MetaSHA256], nil
+	}
+	if minio.ToErrorResponse(err).Code != "NoSuchKey" || i.archive == nil || !i.archive.Enabled() {
+		return "", nil
+	}
+	archived, err := i.archive.Stat(ctx, bucket, object)
+	if errors.Is(err, service.ErrArchiveNotFound) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return archived.SHA256, nil
+}
+
+// detachShared takes an object out of the dedup index before its metadata or
+// tags change, and refuses to when other uploads hold it too: they were
+// answered with an object that carried none, and one uploader's alt text or
+// tags would become theirs. An object held by one upload is changed, and is
+// no longer offered to the next upload of its bytes, which would carry none.
+func (i image) detachShared(ctx context.Context, bucket, object, sum string) *keyError {
+	if sum == "" || !i.dedup.Enabled() {
+		return nil
+	}
+	refs, err := i.dedup.Detach(ctx, bucket, sum, object)
+	if err != nil {
+		return &keyError{fiber.StatusServiceUnavailable, "STORAGE_ERROR", "could not update the dedup index: " + err.Error()}
+	}
+	if refs > 1 {
+		return &keyError{fiber.StatusConflict, "OBJECT_SHARED", fmt.Sprintf("the object is shared by %d uploads of the same content; upload a copy with its own metadata instead", refs)}
+	}
+	return nil
+}
+
+// respondDuplicate answers an upload that was deduplicated, in the shape of a
+// stored upload. Nothing was written or archived; the link is the existing
+// object's, and reference is the one the upload holds on it.
+func respondDuplicate(c *fiber.Ctx, bucket, objectName, reference string) error {
+	return service.Response(c, fiber.StatusCreated, true, "success", duplicateData(bucket, objectName, reference))
+}
+
+// duplicateData is the data of respondDuplicate's answer.
+func duplicateData(bucket, objectName, reference string) map[string]any {
+	url := strings.TrimSuffix(config.GetEnvOrDefault("APP_URL", "http://localhost:9090"), "/")
+	return map[string]any{
+		"minioUpload":  "Minio Skipped duplicate of an existing object",
+		"minioResult":  "Minio Skipped duplicate of an existing object",
+		"awsUpload":    "",
+		"awsResult":    "",
+		"imageName":    objectName[strings.LastIndex(objectName, "/")+1:],
+		"objectName":   objectName,
+		"link":         url + "/" + bucket + "/" + objectName,
+		"overwritten":  false,
+		"deduplicated": true,
+		"reference":    reference,
+	}
+}
@@ -0,0 +1,197 @@
+package handler
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/minio/minio-go/v7"
+
+	"github.com/mstgnz/cdn/service"
+)
+
+// newDedupImage returns an image whose "logos" bucket is deduplicated, with
+// the store its index and objects live in.
+func newDedupImage(t *testing.T) (image, *memStore) {
+	t.Helper()
+	loadPresetPolicy(t, `{"buckets":[{"bucket":"logos","dedup":true}]}`)
+	store := newMemStore("logos", service.DedupIndexBucket(), service.TusStagingBucket())
+	idx, err := service.NewDedupIndex(store)
+	if err != nil || idx == nil {
+		t.Fatalf("NewDedupIndex = (%v, %v)", idx, err)
+	}
+	return image{dedup: idx, archive: newMemArchive()}, store
+}
+
+// storeAs stands in for an upload path: stored with its digest, then claimed.
+func storeAs(t *testing.T, img image, store *memStore, object string, data []byte) string {
+	t.Helper()
+	sum := sha256.Sum256(data)
+	digest := hex.EncodeToString(sum[:])
+	opts := minio.PutObjectOptions{UserMetadata: digestMeta(digest)}
+	if _, err := store.PutObject(context.Background(), "logos", object, bytes.NewReader(data), int64(len(data)), opts); err != nil {
+		t.Fatal(err)
+	}
+	img.claimDigest(context.Background(), "logos", "", digest, object)
+	return digest
+}
+
+// Every upload of the same bytes gets the first one's object, and the object
+// outlives every delete but the last. Each upload gives back its own reference
+// once: a delete repeated with the same one, or none, takes nobody else's.
+func TestDedupSharesOneObjectUntilTheLastDelete(t *testing.T) {
+	ctx := context.Background()
+	img, store := newDedupImage(t)
+	sum := storeAs(t, img, store, "first.png", []byte("the company logo"))
+
+	var refs []string
+	for n := 0; n < 2; n++ {
+		existing, ref, ok := img.reuseDuplicate(ctx, store, "logos", sum)
+		if !ok || existing != "first.png" || ref == "" {
+			t.Fatalf("upload %d: reuse = (%q, %q, %v)", n+2, existing, ref, ok)
+		}
+		refs = append(refs, ref)
+	}
+	if refs[0] == refs[1] {
+		t.Fatal("two uploads were answered with one reference")
+	}
+
+	release := func(ref string, want int) {
+		t.Helper()
+		left, err := img.releaseReference(ctx, store, "logos", "first.png", ref)
+		if err != nil || left != want {
+			t.Fatalf("release %q = (%d, %v), want %d left", ref, left, err, want)
+		}
+	}
+	release(refs[0], 2)
+	release(refs[0], 2) // retried
+	release("", 1)
+	release("", 1)                // the original's again
+	release("not-a-reference", 1) // never handed out
+	release(refs[1], 0)
+	if _, _, ok := img.reuseDuplicate(ctx, store, "logos", sum); ok {
+		t.Fatal("a fully released object is still offered")
+	}
+}
+
+func TestDedupLeavesChosenKeysAndOtherBucketsAlone(t *testing.T) {
+	img, _ := newDedupImage(t)
+	if img.dedupApplies("logos", "brand.png") {
+		t.Error("an upload with a chosen key was deduplicated")
+	}
+	if img.dedupApplies("photos", "") {
+		t.Error("a bucket without dedup was deduplicated")
+	}
+	if !img.dedupApplies("logos", "") {
+		t.Error("dedup bucket not deduplicated")
+	}
+}
+
+// The index is checked against the object: one overwritten with other bytes,
+// or gone from both tiers, is forgotten rather than handed out.
+func TestReuseDuplicateForgetsStaleEntries(t *testing.T) {
+	ctx := context.Background()
+	img, store := newDedupImage(t)
+
+	sum := storeAs(t, img, store, "a.png", []byte("logo v1"))
+	_, _ = store.PutObject(ctx, "logos", "a.png", strings.NewReader("logo v2"), 7, minio.PutObjectOptions{})
+	if _, _, ok := img.reuseDuplicate(ctx, store, "logos", sum); ok {
+		t.Fatal("an overwritten object was offered for its old bytes")
+	}
+	if _, found, _ := img.dedup.Lookup(ctx, "logos", sum); found {
+		t.Fatal("the stale entry survived")
+	}
+
+	sum = storeAs(t, img, store, "b.png", []byte("logo v3"))
+	_ = store.RemoveObject(ctx, "logos", "b.png", minio.RemoveObjectOptions{})
+	if _, _, ok := img.reuseDuplicate(ctx, store, "logos", sum); ok {
+		t.Fatal("a removed object was offered")
+	}
+}
+
+// An object the retention job moved to the archive is still served, so it is
+// still the one copy.
+func TestReuseDuplicateCountsArchivedObjects(t *testing.T) {
+	ctx := context.Background()
+	img, store := newDedupImage(t)
+	data := []byte("archived logo")
+	sum := storeAs(t, img, store, "cold.png", data)
+	_ = img.archive.Put(ctx, "logos", "cold.png", bytes.NewReader(data), sum, "")
+	_ = store.RemoveObject(ctx, "logos", "cold.png", minio.RemoveObjectOptions{})
+
+	existing, ref, ok := img.reuseDuplicate(ctx, store, "logos", sum)
+	if !ok || existing != "cold.png" {
+		t.Fatalf("reuse = (%q, %v)", existing, ok)
+	}
+
+	// What is counted is given back, by the archived copy's digest.
+	if left, err := img.releaseReference(ctx, store, "logos", "cold.png", ""); err != nil || left != 1 {
+		t.Fatalf("release the original = (%d, %v), want 1 left", left, err)
+	}
+	if left, err := img.releaseReference(ctx, store, "logos", "cold.png", ref); err != nil || left != 0 {
+		t.Fatalf("release the reuse = (%d, %v), want none left", left, err)
+	}
+}
+
+// A download is only hashed once it is in, so a duplicate is dropped from
+// staging and never reaches the bucket.
+func TestStoreStreamedByHashDropsADuplicateDownload(t *testing.T) {
+	ctx := context.Background()
+	img, store := newDedupImage(t)
+	csv := []byte("id,name\n1,logo\n")
+	name := func(sum string) (string, string) { return generatedName("logos", "", "csv", sum) }
+
+	first, err := img.storeStreamedByHash(ctx, store, "logos", name, true, objectAttrs{}, bytes.NewReader(csv))
+	if err != nil || first.duplicate {
+		t.Fatalf("first = (%+v, %v)", first, err)
+	}
+	second, err := img.storeStreamedByHash(ctx, store, "logos", name, true, objectAttrs{}, bytes.NewReader(csv))
+	if err != nil || !second.duplicate || second.objectName != first.objectName {
+		t.Fatalf("second = (%+v, %v), want a duplicate of %s", second, err, first.objectName)
+	}
+	if keys := store.keys("logos"); len(keys) != 1 {
+		t.Fatalf("bucket holds %v", keys)
+	}
+	if keys := store.keys(service.TusStagingBucket()); len(keys) != 0 {
+		t.Fatalf("staging left behind %v", keys)
+	}
+}
+
+// Uploads answered with a shared object carried no metadata, so one of them
+// cannot give it some: the patch is refused while others hold it. Held by
+// one, it is changed and no longer offered to the next upload of its bytes.
+func TestPatchRefusesASharedObject(t *testing.T) {
+	ctx := context.Background()
+	img, store := newDedupImage(t)
+	sum := storeAs(t, img, store, "logo.png", []byte("the company logo"))
+	_, ref, ok := img.reuseDuplicate(ctx, store, "logos", sum)
+	if !ok {
+		t.Fatal("no second reference")
+	}
+
+	alt := "Our logo"
+	patch := MetadataPatch{Metadata: map[string]*string{"alt": &alt}}
+	if _, kerr := img.patchObjectAttrs(ctx, store, "logos", "logo.png", patch); kerr == nil || kerr.status != fiber.StatusConflict || kerr.code != "OBJECT_SHARED" {
+		t.Fatalf("patch of a shared object = %v, want 409 OBJECT_SHARED", kerr)
+	}
+	if info, _ := store.StatObject(ctx, "logos", "logo.png", minio.StatObjectOptions{}); len(userMeta(info.UserMetadata)) != 0 {
+		t.Fatalf("metadata = %v after a refused patch", info.UserMetadata)
+	}
+
+	if _, err := img.releaseReference(ctx, store, "logos", "logo.png", ref); err != nil {
+		t.Fatal(err)
+	}
+	if _, kerr := img.patchObjectAttrs(ctx, store, "logos", "logo.png", patch); kerr != nil {
+		t.Fatalf("patch held by one upload = %v", kerr)
+	}
+	if _, _, ok := img.reuseDuplicate(ctx, store, "logos", sum); ok {
+		t.Fatal("an object with metadata of its own was offered to an upload without")
+	}
+	if left, err := img.releaseReference(ctx, store, "logos", "logo.png", ""); err != nil || left != 0 {
+		t.Fatalf("release = (%d, %v), want an ordinary delete", left, err)
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"io"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
 
 	"github.com/gofiber/fiber/v2"
@@ -26,6 +27,18 @@ func doReq(t *testing.T, app *fiber.App, method, target string) *http.Response {
 	return resp
 }
 
+// doJSON runs a request with a JSON body through the fiber app (no timeout).
+func doJSON(t *testing.T, app *fiber.App, method, target, body string) *http.Response {
+	t.Helper()
+	req := httptest.NewRequest(method, target, strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := app.Test(req, -1)
+	if err != nil {
+		t.Fatalf("%s %s failed: %v", method, target, err)
+	}
+	return resp
+}
+
 // decodeBody parses the JSON envelope from a response.
 func decodeBody(t *testing.T, resp *http.Response) apiResp {
 	t.Helper()
@@ -8,12 +8,15 @@ package handler
 import (
 	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
 	"log"
 	"mime/multipart"
 	"net/http"
+	"path/filepath"
 	"strconv"
 	"strings"
 	"sync"
@@ -38,7 +41,17 @@ type Image interface {
 	ResizeImage(c *fiber.Ctx) error
 	UploadWithUrl(c *fiber.Ctx) error
 	BatchUpload(c *fiber.Ctx) error
+	UploadZip(c *fiber.Ctx) error
 	BatchDelete(c *fiber.Ctx) error
+	GetMetadata(c *fiber.Ctx) error
+	UpdateMetadata(c *fiber.Ctx) error
+	ListObjects(c *fiber.Ctx) error
+	CopyObject(c *fiber.Ctx) error
+	MoveObject(c *fiber.Ctx) error
+	ListTrash(c *fiber.Ctx) error
+	RestoreTrash(c *fiber.Ctx) error
+	ListVersions(c *fiber.Ctx) error
+	RestoreVersion(c *fiber.Ctx) error
 }
 
 type image struct {
@@ -46,8 +59,40 @@ type image struct {
 	awsService   service.AwsService
 	archive      service.Archive
 	imageService *service.ImageService
-	workerPool   *worker.Pool
-	batchProc    *batch.BatchProcessor
+
+	// cache holds resized variants. Nil when Redis is not configured at all,
+	// in which case every resize is computed and nothing needs purging.
+	cache service.CacheService
+
+	// notifier purges the caches in front of the service. Never nil; NewImage
+	// substitutes a no-op.
+	notifier service.PurgeNotifier
+
+	// derivatives is the persistent variant store behind the cache. Nil when
+	// DERIVATIVES_BUCKET is unset; its methods accept that.
+	derivatives *service.DerivativeStore
+
+	workerPool *worker.Pool
+	batchProc  *batch.BatchProcessor
+
+	// presetPool generates bucket presets after an upload. See presets.go.
+	presetPool *worker.Pool
+
+	// missing remembers keys neither tier has, so repeated misses skip the
+	// archive. Nil when disabled; its methods accept that.
+	missing *service.NegativeCache
+
+	// dedup is the digest index of buckets that store each content once. Nil
+	// when no bucket does; its methods accept that.
+	dedup *service.DedupIndex
+
+	// scanner checks uploads for malware before they are stored. Nil when
+	// CLAMD_ADDR is unset; its methods accept that.
+	scanner *service.MalwareScanner
+
+	// trash keeps what is deleted from buckets whose policy asks for it. Nil
+	// when no bucket does; its methods accept that.
+	trash *service.Trash
 }
 
 // ImageProcessRequest represents an image processing request
@@ -86,6 +131,24 @@ type UploadUrlRequest struct {
 	AWSUpload bool `json:"aws_upload"`
 
 	Optimize bool `json:"optimize"`
+
+	// Key, when set, is the object name to store under instead of a random
+	// one, and Overwrite ("never", "always" or "if-match", with IfMatch) says
+	// what may happen to an object already there. See keyedUpload.
+	Key       string `json:"key"`
+	Overwrite string `json:"overwrite"`
+	IfMatch   string `json:"if_match"`
+
+	// Async queues the import as a job and answers with its ID instead of
+	// waiting for the fetch; CallbackURL, if set, is POSTed the finished job.
+	// See submitURLImport.
+	Async       bool   `json:"async"`
+	CallbackURL string `json:"callback_url"`
+
+	// Metadata and Tags are attached to the stored object, as the alt, author,
+	// x-meta-* and tags fields of /upload are. See objectAttrs.
+	Metadata map[string]string `json:"metadata"`
+	Tags     map[string]string `json:"tags"`
 }
 
 // optimizeSem bounds the number of concurrent ImageMagick optimizations
@@ -127,14 +190,19 @@ func acquireOptimizeSlot() func() {
 //
 // body must be positioned at the start; callers that have already streamed it
 // elsewhere are responsible for rewinding, which is what rewindAndArchive is for.
-func (i image) archiveObject(ctx context.Context, bucket, objectName string, body io.Reader) string {
+// sum is the object's SHA-256 as stored in MinIO, or "" when it was not
+// computed; the archived copy records it so the two can be compared later.
+// version is the MinIO version ID the upload created, or "" in a bucket
+// without versioning, and is recorded the same way: in a versioned bucket the
+// key alone no longer says which bytes the archive holds.
+func (i image) archiveObject(ctx context.Context, bucket, objectName string, body io.Reader, sum, version string) string {
 	// Not configured, or configured to leave this bucket alone. Both are choices
 	// the operator made, so neither is worth a word in the response.
 	if i.archive == nil || !i.archive.InScope(bucket) {
 		return ""
 	}
 
-	if err := i.archive.Put(ctx, bucket, objectName, body); err != nil {
+	if err := i.archive.Put(ctx, bucket, objectName, body, sum, version); err != nil {
 		log.Printf("archive: failed to store %s/%s: %v", bucket, objectName, err)
 		return fmt.Sprintf("Archive Failed %s", err.Error())
 	}
@@ -149,7 +217,7 @@ func (i image) archiveObject(ctx context.Context, bucket, objectName string, bod
 // the S3 call ran the reader sat at EOF, so every object the archive received was
 // zero bytes. Nothing surfaced it because the upload still reported success and
 // nobody read the archive back.
-func (i image) rewindAndArchive(ctx context.Context, bucket, objectName string, body io.ReadSeeker) string {
+func (i image) rewindAndArchive(ctx context.Context, bucket, objectName string, body io.ReadSeeker, sum, version string) string {
 	if i.archive == nil || !i.archive.InScope(bucket) {
 		return ""
 	}
@@ -158,7 +226,7 @@ func (i image) rewindAndArchive(ctx context.Context, bucket, objectName string,
 		log.Printf("archive: cannot rewind %s/%s: %v", bucket, objectName, err)
 		return fmt.Sprintf("Archive Failed %s", err.Error())
 	}
-	return i.archiveObject(ctx, bucket, objectName, body)
+	return i.archiveObject(ctx, bucket, objectName, body, sum, version)
 }
 
 // resizeSem bounds concurrent ImageMagick decodes on the *read* path.
@@ -291,21 +359,37 @@ type BatchDeleteRequest struct {
 	Bucket    string   `json:"bucket"`
 	Files     []string `json:"files" validate:"required,min=1"`
 	AWSDelete bool     `json:"aws_delete"`
+
+	// References maps a file to the dedup reference its upload was answered
+	// with, as DELETE's reference query parameter does for one file.
+	References map[string]string `json:"references"`
 }
 
-func NewImage(minioClient *minio.Client, awsService service.AwsService, archive service.Archive, imageService *service.ImageService) Image {
+func NewImage(minioClient *minio.Client, awsService service.AwsService, archive service.Archive, imageService *service.ImageService, cache service.CacheService, notifier service.PurgeNotifier, derivatives *service.DerivativeStore, missing *service.NegativeCache, dedup *service.DedupIndex, scanner *service.MalwareScanner, trash *service.Trash) Image {
 	// Initialize worker pool with 5 workers
 	workerConfig := worker.DefaultConfig()
 	workerConfig.Workers = 5
 	wp := worker.NewPool(workerConfig)
 	wp.Start()
 
+	if notifier == nil {
+		notifier = service.NopPurgeNotifier{}
+	}
+
 	img := &image{
 		minioClient:  minioClient,
 		awsService:   awsService,
 		archive:      archive,
 		imageService: imageService,
+		cache:        cache,
+		notifier:     notifier,
+		derivatives:  derivatives,
 		workerPool:   wp,
+		presetPool:   newPresetPool(),
+		missing:      missing,
+		dedup:        dedup,
+		scanner:      scanner,
+		trash:        trash,
 	}
 
 	// Initialize batch processor with default config
@@ -325,11 +409,20 @@ func (i image) GetImage(c *fiber.Ctx) error {
 	bucket := c.Params("bucket")
 	objectName := c.Params("*")
 
-	// Reject traversal-like keys instead of forwarding them verbatim to MinIO.
-	if service.HasUnsafeObjectKey(objectName) {
+	// Reject traversal-like keys instead of forwarding them verbatim to MinIO,
+	// and never serve the service's own buckets (see bucketReserved).
+	if service.HasUnsafeObjectKey(objectName) || service.InternalBucket(bucket) {
 		return c.SendFile("./public/notfound.png")
 	}
 
+	// versionId reads an earlier version of the object in a versioned bucket,
+	// as GET /versions/:bucket/* lists them. The Redis variant cache is keyed
+	// on the key alone and holds the current version's variants, so a
+	// versioned read neither reads nor fills it; the derivative store is keyed
+	// on the ETag and serves every version correctly.
+	versionID := c.Query("versionId")
+	cacheVariants := i.cache != nil && versionID == ""
+
 	var width uint
 	var height uint
 	var resize bool
@@ -343,19 +436,56 @@ func (i image) GetImage(c *fiber.Ctx) error {
 		// request, because those routes still matched and this branch then found
 		// no dimensions. The path form is checked first since it is the more
 		// specific route; a request that carries neither falls through unresized.
-		resize, width, height = service.GetWidthAndHeight(c, service.ParamsType)
+		resize, width, height = service.GetWidthAndHeight(c, service.ParamsType, bucket)
 		if !resize {
-			resize, width, height = service.GetWidthAndHeight(c, service.QueryType)
+			resize, width, height = service.GetWidthAndHeight(c, service.QueryType, bucket)
 		}
 	}
 
+	isSVG := strings.HasSuffix(strings.ToLower(objectName), ".svg")
+
+	// contentTypeFor keeps the sniffed type for everything but SVG (see below).
+	// That is what makes a valid image carrying an appended payload serve as
+	// image/*, so it cannot be reinterpreted as script.
+	contentTypeFor := func(head []byte) string {
+		if isSVG {
+			return "image/svg+xml"
+		}
+		return inertContentType(http.DetectContentType(head))
+	}
+
 	if found, err := i.minioClient.BucketExists(ctx, bucket); !found || err != nil {
 		return c.SendFile("./public/notfound.png")
 	}
 
+	// A cached variant answers without reading the object or decoding it. The
+	// bucket check above still runs first so a removed bucket stops serving at
+	// once; a removed object stops because the delete endpoints purge its
+	// variants. Only successful resizes are ever stored, so a hit is always
+	// safe to send under the variant policy.
+	if resize && cacheVariants {
+		if cached, err := i.cache.GetResizedImage(bucket, objectName, width, height); err == nil && len(cached) > 0 {
+			if isSVG {
+				c.Set("Content-Security-Policy", svgSandboxCSP)
+			}
+			applyCachePolicy(c, bucket, objectName, true)
+			c.Set("Content-Type", contentTypeFor(cached))
+			c.Status(http.StatusOK)
+			return c.Send(cached)
+		}
+	}
+
 	// MinIO holds the recent window, the archive holds everything. An object the
 	// retention job has already removed locally is still served from here.
-	body, size, err := i.openObject(ctx, bucket, objectName)
+	var body io.ReadCloser
+	var size int64
+	var etag string
+	var err error
+	if versionID != "" {
+		body, size, etag, err = i.openVersion(ctx, bucket, objectName, versionID)
+	} else {
+		body, size, etag, err = i.openObject(ctx, bucket, objectName)
+	}
 	if err != nil {
 		return c.SendFile("./public/notfound.png")
 	}
@@ -371,19 +501,8 @@ func (i image) GetImage(c *fiber.Ctx) error {
 	// document reaching anything external. In an <img> context scripts never run
 	// regardless. nosniff stays on and now means "this really is SVG", which is
 	// the guarantee it is meant to give.
-	isSVG := strings.HasSuffix(strings.ToLower(objectName), ".svg")
 	if isSVG {
-		c.Set("Content-Security-Policy", "default-src 'none'; style-src 'unsafe-inline'; sandbox")
-	}
-
-	// contentTypeFor keeps the sniffed type for everything else. That is what
-	// makes a valid image carrying an appended payload serve as image/*, so it
-	// cannot be reinterpreted as script.
-	contentTypeFor := func(head []byte) string {
-		if isSVG {
-			return "image/svg+xml"
-		}
-		return inertContentType(http.DetectContentType(head))
+		c.Set("Content-Security-Policy", svgSandboxCSP)
 	}
 
 	// Resize path: ImageMagick must decode the whole image, so the object is
@@ -392,6 +511,19 @@ func (i image) GetImage(c *fiber.Ctx) error {
 	if resize {
 		defer body.Close()
 
+		// A variant stored on disk from an earlier visit skips the decode. The
+		// lookup is keyed on the source's ETag, so a replaced source misses here
+		// instead of serving its predecessor's thumbnail.
+		if stored, ok := i.derivatives.Get(ctx, bucket, objectName, width, height, etag); ok {
+			if cacheVariants {
+				_ = i.cacheVariant(ctx, service.MinioStore{Client: i.minioClient}, bucket, objectName, etag, width, height, stored)
+			}
+			applyCachePolicy(c, bucket, objectName, true)
+			c.Set("Content-Type", contentTypeFor(stored))
+			c.Status(http.StatusOK)
+			return c.Send(stored)
+		}
+
 		getByte := service.StreamToByte(body)
 		if len(getByte) == 0 {
 			return c.SendFile("./public/notfound.png")
@@ -424,9 +556,28 @@ func (i image) GetImage(c *fiber.Ctx) error {
 			c.Set("Height", strconv.Itoa(int(orjHeight)))
 		}
 
+		resized := i.imageService.ImagickResize(getByte, width, height)
+
+		// ImagickResize hands back its input when the decode or the resize fails.
+		// That is the same unresized body the overload branch above serves, and it
+		// needs the same no-store for the same reason; the variant policy would
+		// otherwise let a cache keep it under the resized URL for as long as the
+		// policy says.
+		if bytes.Equal(resized, getByte) {
+			c.Set("Cache-Control", "no-store")
+		} else {
+			applyCachePolicy(c, bucket, objectName, true)
+			if cacheVariants {
+				// Failures are logged by the cache; the response does not depend
+				// on the write. See cacheVariant on a source replaced meanwhile.
+				_ = i.cacheVariant(ctx, service.MinioStore{Client: i.minioClient}, bucket, objectName, etag, width, height, resized)
+			}
+			i.derivatives.Put(bucket, objectName, width, height, etag, resized)
+		}
+
 		c.Set("Content-Type", contentTypeFor(getByte))
 		c.Status(http.StatusOK)
-		return c.Send(i.imageService.ImagickResize(getByte, width, height))
+		return c.Send(resized)
 	}
 
 	// Direct (non-resize) path: stream the object straight to the client with
@@ -447,6 +598,7 @@ func (i image) GetImage(c *fiber.Ctx) error {
 	}
 	head = head[:n]
 
+	applyCachePolicy(c, bucket, objectName, false)
 	c.Set("Content-Type", contentTypeFor(head))
 	c.Status(http.StatusOK)
 	return c.SendStream(streamCloser{
@@ -455,7 +607,8 @@ func (i image) GetImage(c *fiber.Ctx) error {
 	}, int(size))
 }
 
-// openObject returns the object's contents from whichever tier still holds it.
+// openObject returns the object's contents, size and ETag from whichever tier still
+// holds it.
 //
 // MinIO is tried first and answers almost every request; the archive is the
 // fallback for objects the retention job has already removed locally. Nothing is
@@ -467,28 +620,88 @@ func (i image) GetImage(c *fiber.Ctx) error {
 // for the archive on behalf of a bucket MinIO does not have. Requests for keys
 // that never existed do cost one failed archive lookup each; the 404 caching in
 // nginx.conf is what keeps a scanner from turning that into a bill.
-func (i image) openObject(ctx context.Context, bucket, objectName string) (io.ReadCloser, int64, error) {
+func (i image) openObject(ctx context.Context, bucket, objectName string) (io.ReadCloser, int64, string, error) {
+	// Only a definite answer from both tiers may be remembered as missing; a
+	// MinIO error of any other kind leaves the negative cache alone.
+	localMissing := false
 	object, err := i.minioClient.GetObject(ctx, bucket, objectName, minio.GetObjectOptions{})
 	if err == nil {
 		// minio-go defers the request until the object is first used, so a
 		// missing key surfaces at Stat rather than at GetObject.
-		if stat, statErr := object.Stat(); statErr == nil && stat.Size > 0 {
-			return object, stat.Size, nil
+		stat, statErr := object.Stat()
+		if statErr == nil && stat.Size > 0 {
+			return object, stat.Size, stat.ETag, nil
 		}
+		localMissing = statErr == nil || minio.ToErrorResponse(statErr).Code == "NoSuchKey"
 		_ = object.Close()
 	}
 
 	if i.archive == nil || !i.archive.Enabled() {
-		return nil, 0, errObjectMissing
+		return nil, 0, "", errObjectMissing
+	}
+
+	if i.missing.Missing(bucket, objectName) {
+		return nil, 0, "", errObjectMissing
 	}
 
+	// No ETag from the archive: what it would report is the archive's own, not
+	// the one derivatives were keyed on, so archived objects simply skip the
+	// derivative store.
 	rc, size, archiveErr := i.archive.Open(ctx, bucket, objectName)
 	if archiveErr != nil {
-		return nil, 0, errObjectMissing
+		if localMissing && errors.Is(archiveErr, service.ErrArchiveNotFound) {
+			i.missing.Remember(bucket, objectName)
+		}
+		return nil, 0, "", errObjectMissing
+	}
+	return rc, size, "", nil
+}
+
+// openVersion is openObject for one version of the object. MinIO answers for
+// every version it still has; the archive only for the version its copy was
+// made from, which is the one thing it knows. Neither a miss nor its cause is
+// remembered: the negative cache is about keys, not versions.
+func (i image) openVersion(ctx context.Context, bucket, objectName, versionID string) (io.ReadCloser, int64, string, error) {
+	object, err := i.minioClient.GetObject(ctx, bucket, objectName, minio.GetObjectOptions{VersionID: versionID})
+	if err == nil {
+		stat, statErr := object.Stat()
+		if statErr == nil && stat.Size > 0 {
+			return object, stat.Size, stat.ETag, nil
+		}
+		_ = object.Close()
+	}
+
+	if i.archive == nil || !i.archive.Enabled() {
+		return nil, 0, "", errObjectMissing
+	}
+	if archived, err := i.archive.Stat(ctx, bucket, objectName); err != nil || archived.VersionID != versionID {
+		return nil, 0, "", errObjectMissing
+	}
+	rc, size, err := i.archive.Open(ctx, bucket, objectName)
+	if err != nil {
+		return nil, 0, "", errObjectMissing
+	}
+	return rc, size, "", nil
+}
+
+// forgetMissing runs after every successful write to a key, before anything
+// else (presets) caches output for it. The purge is what carries the news to
+// the other replicas' in-process negative entries, and it also drops variants
+// cached for whatever used to live under the key, which is why it runs
+// whether or not this replica keeps negative entries itself.
+func (i image) forgetMissing(ctx context.Context, bucket, objectName string) {
+	if i.missing != nil {
+		i.missing.Forget(bucket, objectName)
+	}
+	if i.cache != nil {
+		_, _ = i.cache.PurgeVariants(ctx, service.PurgeScope{Bucket: bucket, Key: objectName})
 	}
-	return rc, size, nil
 }
 
+// svgSandboxCSP is sent with every SVG response, original or resized; GetImage
+// explains why it is what makes serving SVG as itself safe.
+const svgSandboxCSP = "default-src 'none'; style-src 'unsafe-inline'; sandbox"
+
 // inertContentType downgrades any sniffed type a browser would execute.
 //
 // This closes a stored-XSS hole. Content validation accepts a file whose bytes
@@ -554,6 +767,13 @@ func (i image) UploadImage(c *fiber.Ctx) error {
 	if bucket == "" {
 		return service.Response(c, fiber.StatusBadRequest, false, "Bucket is required", nil)
 	}
+	if service.InternalBucket(bucket) {
+		return bucketReserved(c)
+	}
+	attrs, kerr := formAttrs(c)
+	if kerr != nil {
+		return respondKeyError(c, kerr)
+	}
 
 	// Check to see if the bucket already exists. BucketExists returns
 	// (false, nil) for a genuinely missing bucket, so create when !exists (the
@@ -567,7 +787,7 @@ func (i image) UploadImage(c *fiber.Ctx) error {
 		// Only a genuinely new bucket is name-checked. Buckets that already exist
 		// predate this rule and must keep working whatever they are called, so the
 		// check sits here rather than on the upload path as a whole.
-		if err := bucketname.Validate(bucket); err != nil {
+		if err := bucketname.ValidateNew(bucket); err != nil {
 			return service.Response(c, fiber.StatusBadRequest, false, err.Error(), nil)
 		}
 		if err := i.minioClient.MakeBucket(ctx, bucket, minio.MakeBucketOptions{}); err != nil {
@@ -576,7 +796,7 @@ func (i image) UploadImage(c *fiber.Ctx) error {
 	}
 
 	// Validate file
-	if err := validator.ValidateFile(file); err != nil {
+	if err := validator.ValidateFile(file, bucket); err != nil {
 		if valErr, ok := err.(*validator.FileValidationError); ok {
 			return service.Response(c, fiber.StatusBadRequest, false, valErr.Message, map[string]string{
 				"code": valErr.Code,
@@ -602,6 +822,26 @@ func (i image) UploadImage(c *fiber.Ctx) error {
 		return service.Response(c, fiber.StatusBadRequest, false, err.Error(), nil)
 	}
 
+	// A checksum the client sent is checked against the bytes as received,
+	// before anything is stored. The digest is computed either way: it is
+	// stored with the object, and with its archived copy.
+	want, err := fileChecksum(file, c.FormValue("content_md5"), c.FormValue("checksum_sha256"))
+	var receivedSum string
+	if err == nil {
+		receivedSum, err = verifyChecksum(fileBuffer, want)
+	}
+	if err != nil {
+		if valErr, ok := err.(*validator.FileValidationError); ok {
+			return service.Response(c, fiber.StatusBadRequest, false, valErr.Message, map[string]string{
+				"code": valErr.Code,
+			})
+		}
+		return service.Response(c, fiber.StatusBadRequest, false, err.Error(), nil)
+	}
+	if kerr := i.scanSeeker(ctx, bucket, fileBuffer); kerr != nil {
+		return respondKeyError(c, kerr)
+	}
+
 	// Parse the file name and extension
 	parseFileName := strings.Split(file.Filename, ".")
 	if len(parseFileName) < 2 {
@@ -620,15 +860,86 @@ func (i image) UploadImage(c *fiber.Ctx) error {
 		sanitizedPath := service.SanitizeObjectName(path)
 		objectName = sanitizedPath + "/" + imageName
 	}
+
+	// With neither a path nor a key the bucket's key template, if it has one,
+	// lays the object out. A template that uses the content's hash is expanded
+	// where the stored bytes are final, below.
+	callerKey := c.FormValue("key")
+	tpl := templateFor(bucket, path, callerKey)
+	if tpl != "" && !tpl.NeedsSHA256() {
+		imageName, objectName = templatedName(tpl, fileExtension, "")
+	}
+
+	// A caller-chosen key replaces the random name, for URLs that have to stay
+	// put (an avatar, a logo). See keyedUpload for what it may overwrite.
+	var plan overwritePlan
+	if callerKey != "" {
+		ifMatch := c.FormValue("if_match")
+		if ifMatch == "" {
+			ifMatch = c.Get(fiber.HeaderIfMatch)
+		}
+		var kerr *keyError
+		imageName, objectName, plan, kerr = i.keyedUpload(ctx, bucket, c.FormValue("path"), callerKey, fileExtension, c.FormValue("overwrite"), ifMatch)
+		if kerr != nil {
+			return respondKeyError(c, kerr)
+		}
+	}
+
+	// Anything that is not an image is never decoded or re-encoded, so it has
+	// no reason to be read into memory. See streamUpload.
+	if !service.IsImageFile(file.Filename) {
+		sum := receivedSum
+		if attrs.empty() && i.dedupApplies(bucket, callerKey) {
+			if existing, ref, ok := i.reuseDuplicate(ctx, service.MinioStore{Client: i.minioClient}, bucket, sum); ok {
+				return respondDuplicate(c, bucket, existing, ref)
+			}
+		}
+		if tpl.NeedsSHA256() {
+			imageName, objectName = templatedName(tpl, fileExtension, sum)
+		}
+		up, archiveResult, err := i.storeStreamed(ctx, bucket, objectName, fileBuffer, plan, attrs.options(minio.PutObjectOptions{UserMetadata: digestMeta(sum)}))
+		if err != nil {
+			if kerr := plan.failure(err); kerr != nil {
+				return respondKeyError(c, kerr)
+			}
+			if valErr, ok := err.(*validator.FileValidationError); ok {
+				return service.Response(c, fiber.StatusBadRequest, false, valErr.Message, map[string]string{
+					"code": valErr.Code,
+				})
+			}
+			return service.Response(c, fiber.StatusBadRequest, false, err.Error(), nil)
+		}
+		if attrs.empty() {
+			i.claimDigest(ctx, bucket, callerKey, sum, objectName)
+		}
+		url := strings.TrimSuffix(config.GetEnvOrDefault("APP_URL", "http://localhost:9090"), "/")
+		return service.Response(c, fiber.StatusCreated, true, "success", map[string]any{
+			"minioUpload": fmt.Sprintf("Minio Successfully Uploaded size %d", up.Size),
+			"minioResult": "Minio Successfully Uploaded",
+			"awsUpload":   archiveResult,
+			"awsResult":   archiveResult,
+			"imageName":   imageName,
+			"objectName":  objectName,
+			"link":        url + "/" + bucket + "/" + objectName,
+			"overwritten": plan.replaced,
+		})
+	}
+
 	// Use Header.Get: a multipart part may omit Content-Type, and indexing the
 	// raw header slice ([0]) would panic on a nil/empty slice.
 	contentType := file.Header.Get("Content-Type")
 	fileSize := file.Size
 
+	// body is what is sent: the upload itself, or the optimised or resized
+	// bytes, which are already in memory. They used to be written to a temp file
+	// first, which cost a disk write per upload and left the file behind.
+	var body io.ReadSeeker = fileBuffer
+	rewritten := false
+
 	// size
 	if fileContent, err := io.ReadAll(fileBuffer); err == nil {
-		// Validate file content
-		if err := validator.ValidateFileContent(fileContent); err != nil {
+		// Validate file content, and hold it to the bucket's upload policy
+		if err := validator.ValidateContentFor(bucket, fileContent); err != nil {
 			if valErr, ok := err.(*validator.FileValidationError); ok {
 				return service.Response(c, fiber.StatusBadRequest, false, valErr.Message, map[string]string{
 					"code": valErr.Code,
@@ -650,14 +961,20 @@ func (i image) UploadImage(c *fiber.Ctx) error {
 				"code": "INVALID_IMAGE_CONTENT",
 			})
 		}
+		if err := validator.ValidateImageFor(bucket, orjWidth, orjHeight); err != nil {
+			valErr := err.(*validator.FileValidationError)
+			return service.Response(c, fiber.StatusBadRequest, false, valErr.Message, map[string]string{
+				"code": valErr.Code,
+			})
+		}
 		if orjWidth > 0 && orjHeight > 0 {
 			c.Set("Width", strconv.Itoa(int(orjWidth)))
 			c.Set("Height", strconv.Itoa(int(orjHeight)))
 		}
 
 		// resize / optimize
-		resize, width, height := service.GetWidthAndHeight(c, service.FormsType)
-		optimize := c.FormValue("optimize") == "true"
+		resize, width, height := service.GetWidthAndHeight(c, service.FormsType, bucket)
+		optimize := c.FormValue("optimize") == "true" || validator.ForcedOptimize(bucket)
 
 		switch {
 		case optimize && service.IsImageFile(file.Filename):
@@ -670,41 +987,59 @@ func (i image) UploadImage(c *fiber.Ctx) error {
 			}
 			optimized, ow, oh := i.maybeOptimize(fileContent, opts)
 			fileContent = optimized
-			if tempFile, err := service.CreateFile(fileContent); err == nil {
-				defer func() {
-					_ = tempFile.Close()
-				}()
-				fileSize = int64(len(fileContent))
-				if ow > 0 && oh > 0 {
-					c.Set("Width", strconv.Itoa(int(ow)))
-					c.Set("Height", strconv.Itoa(int(oh)))
-				}
-				c.Set("Content-Length", strconv.Itoa(len(fileContent)))
-				fileBuffer = tempFile
+			fileSize = int64(len(fileContent))
+			if ow > 0 && oh > 0 {
+				c.Set("Width", strconv.Itoa(int(ow)))
+				c.Set("Height", strconv.Itoa(int(oh)))
 			}
+			c.Set("Content-Length", strconv.Itoa(len(fileContent)))
+			body = bytes.NewReader(fileContent)
+			rewritten = true
 		case resize && orjWidth > 0 && orjHeight > 0:
 			width, height = service.RatioWidthHeight(orjWidth, orjHeight, width, height)
 			fileContent = i.imageService.ImagickResize(fileContent, width, height)
-			if tempFile, err := service.CreateFile(fileContent); err == nil {
-				defer func() {
-					_ = tempFile.Close()
-				}()
-				fileSize = int64(len(fileContent))
-				c.Set("Width", strconv.Itoa(int(width)))
-				c.Set("Height", strconv.Itoa(int(height)))
-				c.Set("Content-Length", strconv.Itoa(len(fileContent)))
-				fileBuffer = tempFile
-			}
+			fileSize = int64(len(fileContent))
+			c.Set("Width", strconv.Itoa(int(width)))
+			c.Set("Height", strconv.Itoa(int(height)))
+			c.Set("Content-Length", strconv.Itoa(len(fileContent)))
+			body = bytes.NewReader(fileContent)
+			rewritten = true
+		}
+	}
+
+	// The digest is of the bytes as stored, after any optimisation: that is
+	// what a template names, what a later duplicate will hash to, and what the
+	// archived copy is checked against.
+	sum := receivedSum
+	if rewritten {
+		if sum, err = readerSHA256(body); err != nil {
+			return service.Response(c, fiber.StatusBadRequest, false, err.Error(), nil)
 		}
 	}
+	if attrs.empty() && i.dedupApplies(bucket, callerKey) {
+		if existing, ref, ok := i.reuseDuplicate(ctx, service.MinioStore{Client: i.minioClient}, bucket, sum); ok {
+			return respondDuplicate(c, bucket, existing, ref)
+		}
+	}
+	if tpl.NeedsSHA256() {
+		imageName, objectName = templatedName(tpl, fileExtension, sum)
+	}
 
 	// Minio Upload
-	_, err = i.minioClient.PutObject(ctx, bucket, objectName, fileBuffer, fileSize, minio.PutObjectOptions{ContentType: contentType})
+	info, err := i.minioClient.PutObject(ctx, bucket, objectName, body, fileSize, plan.options(attrs.options(minio.PutObjectOptions{ContentType: contentType, UserMetadata: digestMeta(sum)})))
 	minioResult := "Minio Successfully Uploaded"
 
 	if err != nil {
+		if kerr := plan.failure(err); kerr != nil {
+			return respondKeyError(c, kerr)
+		}
 		return service.Response(c, fiber.StatusBadRequest, false, err.Error(), nil)
 	}
+	i.afterStore(ctx, bucket, objectName, plan.replaced)
+	if attrs.empty() {
+		i.claimDigest(ctx, bucket, callerKey, sum, objectName)
+	}
+	i.schedulePresets(service.MinioStore{Client: i.minioClient}, bucket, objectName, info.ETag)
 
 	url := config.GetEnvOrDefault("APP_URL", "http://localhost:9090")
 	url = strings.TrimSuffix(url, "/")
@@ -712,7 +1047,7 @@ func (i image) UploadImage(c *fiber.Ctx) error {
 
 	// Archive. The reader has just been drained by the MinIO upload, so it has to
 	// be rewound before the archive sees it.
-	archiveResult := i.rewindAndArchive(ctx, bucket, objectName, fileBuffer)
+	archiveResult := i.rewindAndArchive(ctx, bucket, objectName, body, sum, info.VersionID)
 
 	return service.Response(c, fiber.StatusCreated, true, "success", map[string]any{
 		"minioUpload": fmt.Sprintf("Minio Successfully Uploaded size %d", fileSize),
@@ -722,12 +1057,18 @@ func (i image) UploadImage(c *fiber.Ctx) error {
 		"imageName":   imageName,
 		"objectName":  objectName,
 		"link":        link,
+		"overwritten": plan.replaced,
 	})
 }
 
 func (i image) UploadWithUrl(c *fiber.Ctx) error {
-	ctx := context.Background()
+	return i.uploadWithURL(c, nil)
+}
 
+// uploadWithURL serves /upload-url. With jobs, a request with async set is
+// queued as a URL import job and answered at once; without, such a request is
+// refused, since there is nothing to queue it on.
+func (i image) uploadWithURL(c *fiber.Ctx, jobs *service.JobQueue) error {
 	// Parse request body
 	var req UploadUrlRequest
 	if err := c.BodyParser(&req); err != nil {
@@ -747,6 +1088,9 @@ func (i image) UploadWithUrl(c *fiber.Ctx) error {
 	if bucketName == "" {
 		return service.Response(c, fiber.StatusBadRequest, false, "Bucket is required", nil)
 	}
+	if service.InternalBucket(bucketName) {
+		return bucketReserved(c)
+	}
 	req.Bucket = bucketName
 
 	// SSRF guard: reject non-http(s) schemes and literal private/loopback/
@@ -755,110 +1099,293 @@ func (i image) UploadWithUrl(c *fiber.Ctx) error {
 	if err := validator.ValidateUploadURL(req.URL); err != nil {
 		return service.Response(c, fiber.StatusBadRequest, false, err.Error(), nil)
 	}
+	if req.IfMatch == "" {
+		req.IfMatch = c.Get(fiber.HeaderIfMatch)
+	}
+	if _, kerr := newObjectAttrs(req.Metadata, req.Tags); kerr != nil {
+		return respondKeyError(c, kerr)
+	}
+
+	if req.Async {
+		if jobs == nil {
+			return service.Response(c, fiber.StatusBadRequest, false, "asynchronous imports are not available", nil)
+		}
+		return submitURLImport(c, jobs, []UploadUrlRequest{req}, req.CallbackURL)
+	}
+
+	out := i.importURL(context.Background(), req, urlFetchTimeout)
+	if out.width > 0 && out.height > 0 {
+		c.Set("Width", strconv.Itoa(int(out.width)))
+		c.Set("Height", strconv.Itoa(int(out.height)))
+	}
+	return service.Response(c, out.status, out.status < fiber.StatusBadRequest, out.message, out.data)
+}
+
+// urlFetchTimeout bounds the fetch of a synchronous URL upload, which a client
+// is waiting on. Queued imports have URL_IMPORT_TIMEOUT_SECONDS instead.
+const urlFetchTimeout = 30 * time.Second
+
+// urlOutcome is how one URL import ended, in the terms of the response it is
+// answered with: directly by /upload-url, or as one item of a job's result.
+type urlOutcome struct {
+	status  int
+	message string
+	data    any
+
+	// width and height are those of an optimised image, for the response
+	// headers of a synchronous upload.
+	width, height uint
+}
+
+func urlFailure(status int, message string, data any) urlOutcome {
+	return urlOutcome{status: status, message: message, data: data}
+}
+
+func urlKeyFailure(err *keyError) urlOutcome {
+	return urlFailure(err.status, err.message, map[string]string{"code": err.code})
+}
+
+// importURL fetches req.URL and stores it in req.Bucket: everything
+// /upload-url does once the request has been checked and its bucket resolved.
+// The fetch goes through NewSafeHTTPClient whichever way it was asked for, so
+// a queued import is held to the same address rules as a synchronous one.
+func (i image) importURL(ctx context.Context, req UploadUrlRequest, timeout time.Duration) urlOutcome {
+	attrs, kerr := newObjectAttrs(req.Metadata, req.Tags)
+	if kerr != nil {
+		return urlKeyFailure(kerr)
+	}
 
 	// Check to see if the bucket already exists (create when genuinely missing;
 	// BucketExists returns (false, nil) in that case).
 	exists, err := i.minioClient.BucketExists(ctx, req.Bucket)
 	if err != nil {
-		return service.Response(c, fiber.StatusBadRequest, false, "bucket check failed: "+err.Error(), nil)
+		return urlFailure(fiber.StatusBadRequest, "bucket check failed: "+err.Error(), nil)
 	}
 	if !exists {
 		// See UploadImage: the name rule applies to bucket creation only.
-		if err := bucketname.Validate(req.Bucket); err != nil {
-			return service.Response(c, fiber.StatusBadRequest, false, err.Error(), nil)
+		if err := bucketname.ValidateNew(req.Bucket); err != nil {
+			return urlFailure(fiber.StatusBadRequest, err.Error(), nil)
 		}
 		if err := i.minioClient.MakeBucket(ctx, req.Bucket, minio.MakeBucketOptions{}); err != nil {
-			return service.Response(c, fiber.StatusBadRequest, false, "Bucket Not Found And Not Created!", nil)
+			return urlFailure(fiber.StatusBadRequest, "Bucket Not Found And Not Created!", nil)
 		}
 	}
 
 	// See UploadImage: a missing or unreachable archive bucket must not stop an
 	// upload that MinIO can serve perfectly well.
 
-	httpClient := validator.NewSafeHTTPClient(30 * time.Second)
-	res, err := httpClient.Get(req.URL)
+	httpClient := validator.NewSafeHTTPClient(timeout)
+	fetch, err := http.NewRequestWithContext(ctx, http.MethodGet, req.URL, nil)
 	if err != nil {
-		return service.Response(c, fiber.StatusBadRequest, false, err.Error(), nil)
+		return urlFailure(fiber.StatusBadRequest, err.Error(), nil)
+	}
+	res, err := httpClient.Do(fetch)
+	if err != nil {
+		return urlFailure(fiber.StatusBadRequest, err.Error(), nil)
 	}
 	defer res.Body.Close()
 
+	// The head decides the type, and the type decides whether the body is
+	// read into memory at all: only images are, because only images are
+	// decoded. Everything else streams to MinIO; see streamUpload.
+	head := make([]byte, sniffLen)
+	n, err := io.ReadFull(res.Body, head)
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) && !errors.Is(err, io.EOF) {
+		return urlFailure(fiber.StatusBadRequest, "Failed to read content from URL", nil)
+	}
+	head = head[:n]
+	// A file that is to be scanned is read into memory whatever it is: clamd
+	// has to see all of it before any of it is stored, and the streaming path
+	// stores as it reads.
+	scan := i.scanner.Enabled(req.Bucket)
+	if extension, ok := urlExtension(http.DetectContentType(head), req.URL); ok && !service.IsImageFile("f."+extension) && !scan {
+		var (
+			up                    streamedUpload
+			archiveResult         string
+			imageName, objectName string
+			plan                  overwritePlan
+		)
+		// The MIME types and byte limits of the bucket's upload policy are
+		// held to as the body streams; its extensions are known now.
+		if err := validator.ValidateExtensionFor(req.Bucket, "f."+extension); err != nil {
+			valErr := err.(*validator.FileValidationError)
+			return urlFailure(fiber.StatusBadRequest, valErr.Message, map[string]string{
+				"code": valErr.Code,
+			})
+		}
+		body := io.MultiReader(bytes.NewReader(head), res.Body)
+		dedup := attrs.empty() && i.dedupApplies(req.Bucket, req.Key)
+		if dedup || templateFor(req.Bucket, req.Path, req.Key).NeedsSHA256() {
+			var hashed hashedStore
+			hashed, err = i.storeStreamedByHash(ctx, service.MinioStore{Client: i.minioClient}, req.Bucket, func(sum string) (string, string) {
+				return generatedName(req.Bucket, req.Path, extension, sum)
+			}, dedup, attrs, body)
+			if err == nil && hashed.duplicate {
+				return urlOutcome{status: fiber.StatusCreated, message: "success", data: duplicateData(req.Bucket, hashed.objectName, hashed.reference)}
+			}
+			up, imageName, objectName, archiveResult = hashed.streamedUpload, hashed.imageName, hashed.objectName, hashed.archive
+		} else {
+			var kerr *keyError
+			imageName, objectName, plan, kerr = i.urlObjectName(ctx, req, extension, "")
+			if kerr != nil {
+				return urlKeyFailure(kerr)
+			}
+			up, archiveResult, err = i.storeStreamed(ctx, req.Bucket, objectName, body, plan, attrs.options(minio.PutObjectOptions{}))
+		}
+		if err != nil {
+			if kerr := plan.failure(err); kerr != nil {
+				return urlKeyFailure(kerr)
+			}
+			if valErr, ok := err.(*validator.FileValidationError); ok {
+				return urlFailure(fiber.StatusBadRequest, valErr.Message, map[string]string{
+					"code": valErr.Code,
+				})
+			}
+			return urlFailure(fiber.StatusBadRequest, err.Error(), nil)
+		}
+		url := strings.TrimSuffix(config.GetEnvOrDefault("APP_URL", "http://localhost:9090"), "/")
+		return urlOutcome{status: fiber.StatusCreated, message: "success", data: map[string]any{
+			"minioUpload": fmt.Sprintf("Minio Successfully Uploaded size %d", up.Size),
+			"minioResult": minio.UploadInfo{Bucket: req.Bucket, Key: objectName, ETag: up.ETag, Size: up.Size},
+			"awsUpload":   archiveResult,
+			"awsResult":   archiveResult,
+			"imageName":   imageName,
+			"objectName":  objectName,
+			"link":        url + "/" + req.Bucket + "/" + objectName,
+			"overwritten": plan.replaced,
+		}}
+	}
+
 	// Read content from URL, capped at the configured max file size
 	maxSize := config.GetEnvAsIntOrDefault("MAX_FILE_SIZE", int(validator.DefaultMaxFileSize))
-	content, err := io.ReadAll(io.LimitReader(res.Body, int64(maxSize)))
+	content, err := io.ReadAll(io.LimitReader(io.MultiReader(bytes.NewReader(head), res.Body), int64(maxSize)))
 	if err != nil {
-		return service.Response(c, fiber.StatusBadRequest, false, "Failed to read content from URL", nil)
+		return urlFailure(fiber.StatusBadRequest, "Failed to read content from URL", nil)
+	}
+	if kerr := i.scanUpload(ctx, req.Bucket, bytes.NewReader(content)); kerr != nil {
+		return urlKeyFailure(kerr)
 	}
 
 	// Automatically detect content type
 	contentType := http.DetectContentType(content)
 
+	extension, ok := urlExtension(contentType, req.URL)
+	if !ok {
+		return urlFailure(fiber.StatusBadRequest, "Unsupported or unrecognized file type", nil)
+	}
+
+	// If the resolved type is an image, the downloaded bytes must be a valid
+	// image; non-image content uploads unchanged. The bucket's upload policy
+	// is checked against what was downloaded, before any optimisation.
+	origWidth, origHeight, verr := i.validateImageContent("f."+extension, content)
+	if verr != nil {
+		return urlFailure(fiber.StatusBadRequest, "invalid image content", map[string]string{
+			"code": "INVALID_IMAGE_CONTENT",
+		})
+	}
+	if err := urlPolicyCheck(req.Bucket, extension, content, origWidth, origHeight); err != nil {
+		return urlFailure(fiber.StatusBadRequest, err.Message, map[string]string{
+			"code": err.Code,
+		})
+	}
+
 	// Opt-in optimization. Non-image / non-resizable content passes through
-	// unchanged, so this runs safely before the file-type checks below. Format
-	// is preserved, so the content type is re-detected to keep the invariant.
-	if req.Optimize {
+	// unchanged. Format is preserved, so the extension still holds and the
+	// content type is re-detected to keep the invariant.
+	var width, height uint
+	if req.Optimize || validator.ForcedOptimize(req.Bucket) {
 		optimized, ow, oh := i.maybeOptimize(content, service.DefaultOptimizeOptions())
 		content = optimized
 		contentType = http.DetectContentType(content)
-		if ow > 0 && oh > 0 {
-			c.Set("Width", strconv.Itoa(int(ow)))
-			c.Set("Height", strconv.Itoa(int(oh)))
-		}
+		width, height = ow, oh
 	}
 
-	// Determine file extension from content type
-	extension := filetype.GetExtensionFromContentType(contentType)
-	if extension == "" {
-		// Try to extract extension from URL if content type is not recognized
-		extension = filetype.GetExtensionFromURL(req.URL)
-		if !filetype.IsValidExtension(extension) {
-			return service.Response(c, fiber.StatusBadRequest, false, "Unsupported or unrecognized file type", nil)
+	digest := sha256.Sum256(content)
+	sum := hex.EncodeToString(digest[:])
+	if req.Key == "" && attrs.empty() {
+		if existing, ref, ok := i.reuseDuplicate(ctx, service.MinioStore{Client: i.minioClient}, req.Bucket, sum); ok {
+			return urlOutcome{status: fiber.StatusCreated, message: "success", data: duplicateData(req.Bucket, existing, ref), width: width, height: height}
 		}
 	}
-
-	// If the resolved type is an image, the downloaded bytes must be a valid
-	// image; non-image content uploads unchanged.
-	if _, _, verr := i.validateImageContent("f."+extension, content); verr != nil {
-		return service.Response(c, fiber.StatusBadRequest, false, "invalid image content", map[string]string{
-			"code": "INVALID_IMAGE_CONTENT",
-		})
-	}
-
-	randomName := uuid.New().String()
-	// Sanitize extension
-	sanitizedExtension := service.SanitizeObjectName(extension)
-	objectName := randomName + "." + sanitizedExtension
-	if req.Path != "" {
-		// Sanitize path as well
-		req.Path = strings.Trim(req.Path, "/")
-		sanitizedPath := service.SanitizeObjectName(req.Path)
-		objectName = sanitizedPath + "/" + randomName + "." + sanitizedExtension
+	imageName, objectName, plan, kerr := i.urlObjectName(ctx, req, extension, sum)
+	if kerr != nil {
+		return urlKeyFailure(kerr)
 	}
 
 	// Prepare content as a new reader
 	contentReader := bytes.NewReader(content)
 
 	// Upload with PutObject
-	minioResult, err := i.minioClient.PutObject(ctx, req.Bucket, objectName, contentReader, int64(len(content)), minio.PutObjectOptions{ContentType: contentType})
+	minioResult, err := i.minioClient.PutObject(ctx, req.Bucket, objectName, contentReader, int64(len(content)), plan.options(attrs.options(minio.PutObjectOptions{ContentType: contentType, UserMetadata: digestMeta(sum)})))
 	if err != nil {
-		return service.Response(c, fiber.StatusBadRequest, false, err.Error(), nil)
+		if kerr := plan.failure(err); kerr != nil {
+			return urlKeyFailure(kerr)
+		}
+		return urlFailure(fiber.StatusBadRequest, err.Error(), nil)
 	}
 
 	url := config.GetEnvOrDefault("APP_URL", "http://localhost:9090")
 	url = strings.TrimSuffix(url, "/")
 	link := url + "/" + req.Bucket + "/" + objectName
 
+	i.afterStore(ctx, req.Bucket, objectName, plan.replaced)
+	if attrs.empty() {
+		i.claimDigest(ctx, req.Bucket, req.Key, sum, objectName)
+	}
+	i.schedulePresets(service.MinioStore{Client: i.minioClient}, req.Bucket, objectName, minioResult.ETag)
+
 	// Archive. contentReader was drained by the MinIO upload above.
-	archiveResult := i.rewindAndArchive(ctx, req.Bucket, objectName, contentReader)
+	archiveResult := i.rewindAndArchive(ctx, req.Bucket, objectName, contentReader, sum, minioResult.VersionID)
 
-	return service.Response(c, fiber.StatusCreated, true, "success", map[string]any{
+	return urlOutcome{status: fiber.StatusCreated, message: "success", width: width, height: height, data: map[string]any{
 		"minioUpload": fmt.Sprintf("Minio Successfully Uploaded size %d", minioResult.Size),
 		"minioResult": minioResult,
 		"awsUpload":   archiveResult,
 		"awsResult":   archiveResult,
-		"imageName":   randomName + "." + extension,
+		"imageName":   imageName,
 		"objectName":  objectName,
 		"link":        link,
-	})
+		"overwritten": plan.replaced,
+	}}
+}
+
+// urlPolicyCheck holds a downloaded file to the bucket's upload policy. Its
+// name, and so its extension, is only known once it has been read.
+func urlPolicyCheck(bucket, extension string, content []byte, width, height uint) *validator.FileValidationError {
+	for _, err := range []error{
+		validator.ValidateExtensionFor(bucket, "f."+extension),
+		validator.ValidateBytesFor(bucket, content),
+		validator.ValidateImageFor(bucket, width, height),
+	} {
+		if err != nil {
+			return err.(*validator.FileValidationError)
+		}
+	}
+	return nil
+}
+
+// urlExtension decides the stored extension of a URL upload: the sniffed
+// content type when it is one we know, the URL's own extension otherwise, and
+// nothing when neither is on the list.
+func urlExtension(contentType, rawURL string) (string, bool) {
+	if extension := filetype.GetExtensionFromContentType(contentType); extension != "" {
+		return extension, true
+	}
+	extension := filetype.GetExtensionFromURL(rawURL)
+	return extension, filetype.IsValidExtension(extension)
+}
+
+// urlObjectName names a URL upload: the request's key when it has one (see
+// keyedUpload), otherwise a random name with the given extension under path
+// when there is one, or the bucket's key template when there is not. sum is
+// the SHA-256 of the stored bytes, for templates that use it. req.IfMatch
+// already carries the If-Match header when the body had no if_match.
+func (i image) urlObjectName(ctx context.Context, req UploadUrlRequest, extension, sum string) (string, string, overwritePlan, *keyError) {
+	if req.Key != "" {
+		return i.keyedUpload(ctx, req.Bucket, req.Path, req.Key, extension, req.Overwrite, req.IfMatch)
+	}
+	imageName, objectName := generatedName(req.Bucket, req.Path, extension, sum)
+	return imageName, objectName, overwritePlan{}, nil
 }
 
 // DeleteImage handles image deletion
@@ -877,6 +1404,9 @@ func (i image) DeleteImage(c *fiber.Ctx) error {
 	if len(bucket) == 0 || len(object) == 0 {
 		return service.Response(c, fiber.StatusBadRequest, false, "invalid path or bucket or file.", nil)
 	}
+	if service.InternalBucket(bucket) {
+		return bucketReserved(c)
+	}
 
 	// Reject traversal-like keys instead of forwarding them verbatim to MinIO.
 	if service.HasUnsafeObjectKey(object) {
@@ -893,11 +1423,27 @@ func (i image) DeleteImage(c *fiber.Ctx) error {
 		return service.Response(c, fiber.StatusBadRequest, false, "Bucket Not Found On Aws S3!", "")
 	}
 
-	// Remove object from Minio
-	if err := i.minioClient.RemoveObject(ctx, bucket, object, minio.RemoveObjectOptions{}); err != nil {
+	// A deduplicated object is shared by every upload that was answered with
+	// it, and only the last of them deletes it. Each gives back the reference
+	// its upload was answered with; none is the upload that stored it.
+	refs, err := i.releaseReference(ctx, service.MinioStore{Client: i.minioClient}, bucket, object, c.Query("reference"))
+	if err != nil {
+		return service.Response(c, fiber.StatusServiceUnavailable, false, "could not update the reference count: "+err.Error(), "")
+	}
+	if refs > 0 {
+		return service.Response(c, fiber.StatusOK, true, "File Successfully Deleted", map[string]any{"remaining_references": refs})
+	}
+
+	// Remove object from Minio, into the trash when the bucket keeps one.
+	trashID, err := i.discard(ctx, service.MinioStore{Client: i.minioClient}, bucket, object)
+	if err != nil {
 		return service.Response(c, fiber.StatusInternalServerError, false, err.Error(), "")
 	}
 
+	// The object is gone from MinIO, so every cached copy of it goes too, before
+	// anything else can fail and return early.
+	i.purgeCaches(ctx, service.PurgeDeleted, bucket, object)
+
 	// Remove object from AWS S3 if required
 	if awsDelete {
 		if err := i.awsService.DeleteObjects(bucket, []string{object}); err != nil {
@@ -905,12 +1451,16 @@ func (i image) DeleteImage(c *fiber.Ctx) error {
 		}
 	}
 
+	if trashID != "" {
+		return service.Response(c, fiber.StatusOK, true, "File Successfully Deleted", map[string]any{"trash_id": trashID})
+	}
 	return service.Response(c, fiber.StatusOK, true, "File Successfully Deleted", "")
 }
 
 // ResizeImage handles image resizing using worker pool
 func (i *image) ResizeImage(c *fiber.Ctx) error {
-	resize, width, height := service.GetWidthAndHeight(c, service.FormsType)
+	// Nothing is stored, so no bucket's limit applies; the defaults' does.
+	resize, width, height := service.GetWidthAndHeight(c, service.FormsType, "")
 	file, err := c.FormFile("file")
 
 	if file == nil || err != nil {
@@ -1054,6 +1604,9 @@ func (i *image) BatchUpload(c *fiber.Ctx) error {
 	if bucketName == "" {
 		return service.Response(c, fiber.StatusBadRequest, false, "Bucket is required", nil)
 	}
+	if service.InternalBucket(bucketName) {
+		return bucketReserved(c)
+	}
 
 	path := form.Value["path"]
 	pathPrefix := ""
@@ -1062,6 +1615,11 @@ func (i *image) BatchUpload(c *fiber.Ctx) error {
 	}
 
 	optimize := form.Value["optimize"] != nil && form.Value["optimize"][0] == "true"
+	// Metadata and tags apply to every file of the batch.
+	attrs, kerr := formAttrs(c)
+	if kerr != nil {
+		return respondKeyError(c, kerr)
+	}
 
 	// Check bucket existence
 	exists, err := i.minioClient.BucketExists(context.Background(), bucketName)
@@ -1083,22 +1641,33 @@ func (i *image) BatchUpload(c *fiber.Ctx) error {
 		return service.Response(c, fiber.StatusBadRequest, false, fmt.Sprintf("Too many files in one batch (max %d)", maxBatch), nil)
 	}
 
+	// Checksums for clients that cannot set part headers: one content_md5 or
+	// checksum_sha256 value per file, in the order of the files. See
+	// fileChecksum.
+	formMD5, formSHA256 := form.Value["content_md5"], form.Value["checksum_sha256"]
+	nth := func(values []string, n int) string {
+		if n < len(values) {
+			return values[n]
+		}
+		return ""
+	}
+
 	results := make([]map[string]any, 0)
 	var wg sync.WaitGroup
 	resultChan := make(chan map[string]any, len(files))
 	sem := make(chan struct{}, 10)
 
-	for _, file := range files {
+	for n, file := range files {
 		wg.Add(1)
 		sem <- struct{}{}
-		go func(file *multipart.FileHeader) {
+		go func(n int, file *multipart.FileHeader) {
 			defer func() { <-sem; wg.Done() }()
 
 			result := make(map[string]any)
 			result["filename"] = file.Filename
 
 			// Validate file
-			if err := validator.ValidateFile(file); err != nil {
+			if err := validator.ValidateFile(file, bucketName); err != nil {
 				result["success"] = false
 				result["error"] = err.Error()
 				resultChan <- result
@@ -1115,6 +1684,41 @@ func (i *image) BatchUpload(c *fiber.Ctx) error {
 			}
 			defer fileContent.Close()
 
+			// See UploadImage: the file is checked against its checksum as
+			// received, and the digest is kept either way.
+			want, err := fileChecksum(file, nth(formMD5, n), nth(formSHA256, n))
+			var receivedSum string
+			if err == nil {
+				receivedSum, err = verifyChecksum(fileContent, want)
+			}
+			if err != nil {
+				result["success"] = false
+				result["error"] = err.Error()
+				if valErr, ok := err.(*validator.FileValidationError); ok {
+					result["error"] = valErr.Message
+					result["code"] = valErr.Code
+				}
+				resultChan <- result
+				return
+			}
+			if kerr := i.scanSeeker(context.Background(), bucketName, fileContent); kerr != nil {
+				result["success"] = false
+				result["error"] = kerr.message
+				result["code"] = kerr.code
+				resultChan <- result
+				return
+			}
+			if err := sniffPolicy(bucketName, fileContent); err != nil {
+				result["success"] = false
+				result["error"] = err.Error()
+				if valErr, ok := err.(*validator.FileValidationError); ok {
+					result["error"] = valErr.Message
+					result["code"] = valErr.Code
+				}
+				resultChan <- result
+				return
+			}
+
 			// Generate object name
 			randomName := uuid.New().String()
 			// Sanitize filename
@@ -1125,6 +1729,12 @@ func (i *image) BatchUpload(c *fiber.Ctx) error {
 				sanitizedPath := service.SanitizeObjectName(pathPrefix)
 				objectName = sanitizedPath + "/" + objectName
 			}
+			// See UploadImage: without a path, the bucket's key template lays
+			// the batch out like any other upload.
+			tpl := templateFor(bucketName, pathPrefix, "")
+			if tpl != "" && !tpl.NeedsSHA256() {
+				_, objectName = templatedName(tpl, filepath.Ext(file.Filename), "")
+			}
 
 			// Determine the bytes to store. Image-extension files are buffered so
 			// their content can be validated as a real image (and optionally
@@ -1142,13 +1752,22 @@ func (i *image) BatchUpload(c *fiber.Ctx) error {
 					resultChan <- result
 					return
 				}
-				if _, _, verr := i.validateImageContent(file.Filename, raw); verr != nil {
+				w, h, verr := i.validateImageContent(file.Filename, raw)
+				if verr != nil {
 					result["success"] = false
 					result["error"] = "invalid image content"
 					resultChan <- result
 					return
 				}
-				if optimize {
+				if err := validator.ValidateImageFor(bucketName, w, h); err != nil {
+					valErr := err.(*validator.FileValidationError)
+					result["success"] = false
+					result["error"] = valErr.Message
+					result["code"] = valErr.Code
+					resultChan <- result
+					return
+				}
+				if optimize || validator.ForcedOptimize(bucketName) {
 					raw, _, _ = i.maybeOptimize(raw, service.DefaultOptimizeOptions())
 					optimized = true
 				}
@@ -1157,19 +1776,39 @@ func (i *image) BatchUpload(c *fiber.Ctx) error {
 				contentType = http.DetectContentType(payload)
 			}
 
-			var minioReader io.Reader = fileContent
+			var minioReader io.ReadSeeker = fileContent
+			sum := receivedSum
 			if payload != nil {
 				minioReader = bytes.NewReader(payload)
+				if sum, err = readerSHA256(minioReader); err != nil {
+					result["success"] = false
+					result["error"] = err.Error()
+					resultChan <- result
+					return
+				}
+			}
+			if attrs.empty() {
+				if existing, ref, ok := i.reuseDuplicate(context.Background(), service.MinioStore{Client: i.minioClient}, bucketName, sum); ok {
+					result["success"] = true
+					result["object_name"] = existing
+					result["deduplicated"] = true
+					result["reference"] = ref
+					resultChan <- result
+					return
+				}
+			}
+			if tpl.NeedsSHA256() {
+				_, objectName = templatedName(tpl, filepath.Ext(file.Filename), sum)
 			}
 
 			// Upload to MinIO
-			_, err = i.minioClient.PutObject(
+			info, err := i.minioClient.PutObject(
 				context.Background(),
 				bucketName,
 				objectName,
 				minioReader,
 				uploadSize,
-				minio.PutObjectOptions{ContentType: contentType},
+				attrs.options(minio.PutObjectOptions{ContentType: contentType, UserMetadata: digestMeta(sum)}),
 			)
 
 			if err != nil {
@@ -1178,6 +1817,11 @@ func (i *image) BatchUpload(c *fiber.Ctx) error {
 				resultChan <- result
 				return
 			}
+			i.forgetMissing(context.Background(), bucketName, objectName)
+			if attrs.empty() {
+				i.claimDigest(context.Background(), bucketName, "", sum, objectName)
+			}
+			i.schedulePresets(service.MinioStore{Client: i.minioClient}, bucketName, objectName, info.ETag)
 
 			// Archive. Unlike the single-file paths this one always did rewind
 			// before handing the reader over, so only the destination changes.
@@ -1188,7 +1832,7 @@ func (i *image) BatchUpload(c *fiber.Ctx) error {
 				_, _ = fileContent.Seek(0, io.SeekStart)
 				archiveReader = fileContent
 			}
-			if msg := i.archiveObject(context.Background(), bucketName, objectName, archiveReader); msg != "" {
+			if msg := i.archiveObject(context.Background(), bucketName, objectName, archiveReader, sum, info.VersionID); msg != "" {
 				result["archive"] = msg
 			}
 
@@ -1198,7 +1842,7 @@ func (i *image) BatchUpload(c *fiber.Ctx) error {
 				result["size"] = uploadSize
 			}
 			resultChan <- result
-		}(file)
+		}(n, file)
 	}
 
 	// Wait for all uploads to complete
@@ -1234,6 +1878,9 @@ func (i *image) BatchDelete(c *fiber.Ctx) error {
 	if bucketName == "" {
 		return service.Response(c, fiber.StatusBadRequest, false, "Bucket is required", nil)
 	}
+	if service.InternalBucket(bucketName) {
+		return bucketReserved(c)
+	}
 	req.Bucket = bucketName
 
 	// Cap the batch size so a huge JSON array cannot pre-allocate an unbounded
@@ -1268,14 +1915,34 @@ func (i *image) BatchDelete(c *fiber.Ctx) error {
 			result := make(map[string]any)
 			result["filename"] = filename
 
-			// Delete from MinIO
-			err := i.minioClient.RemoveObject(context.Background(), req.Bucket, filename, minio.RemoveObjectOptions{})
+			// See DeleteImage on shared objects.
+			refs, err := i.releaseReference(context.Background(), service.MinioStore{Client: i.minioClient}, req.Bucket, filename, req.References[filename])
+			if err != nil {
+				result["success"] = false
+				result["error"] = "could not update the reference count: " + err.Error()
+				resultChan <- result
+				return
+			}
+			if refs > 0 {
+				result["success"] = true
+				result["remaining_references"] = refs
+				resultChan <- result
+				return
+			}
+
+			// Delete from MinIO, into the trash when the bucket keeps one.
+			trashID, err := i.discard(context.Background(), service.MinioStore{Client: i.minioClient}, req.Bucket, filename)
 			if err != nil {
 				result["success"] = false
 				result["error"] = err.Error()
 				resultChan <- result
 				return
 			}
+			if trashID != "" {
+				result["trash_id"] = trashID
+			}
+
+			i.purgeCaches(context.Background(), service.PurgeDeleted, req.Bucket, filename)
 
 			// Delete from AWS if requested
 			if req.AWSDelete {
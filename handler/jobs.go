@@ -0,0 +1,293 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+
+	"github.com/mstgnz/cdn/pkg/config"
+	"github.com/mstgnz/cdn/pkg/validator"
+	"github.com/mstgnz/cdn/service"
+)
+
+// urlImportKind is the job kind of queued URL imports.
+const urlImportKind = "url_import"
+
+// JobsHandler serves the routes that run as background jobs, and their status.
+type JobsHandler interface {
+	// UploadWithUrl is /upload-url: Image.UploadWithUrl, plus async.
+	UploadWithUrl(c *fiber.Ctx) error
+
+	// ImportURLs queues an import of many URLs as one job.
+	ImportURLs(c *fiber.Ctx) error
+
+	// DeletePrefix queues a delete of everything under a key prefix.
+	DeletePrefix(c *fiber.Ctx) error
+
+	// Status reports on a job.
+	Status(c *fiber.Ctx) error
+}
+
+type jobsHandler struct {
+	img  image
+	jobs *service.JobQueue
+
+	// store is MinIO, as the jobs that walk a bucket read it.
+	store service.ObjectStore
+
+	// importTimeout bounds the fetch of each queued URL. Nobody is waiting on
+	// the connection, so it can be far longer than a synchronous upload's.
+	importTimeout time.Duration
+	maxBatch      int
+
+	// deleteRate caps the objects a prefix delete removes a second.
+	deleteRate int
+}
+
+// URLImportBatchRequest is the body of /upload-url/batch. Items are full
+// /upload-url requests, for imports that need a key or overwrite policy per
+// URL; URLs is the short form for everything else. Either way Bucket, Path and
+// Optimize are the defaults of every item, and an item may not name another
+// bucket.
+type URLImportBatchRequest struct {
+	Bucket      string             `json:"bucket"`
+	Path        string             `json:"path"`
+	Optimize    bool               `json:"optimize"`
+	CallbackURL string             `json:"callback_url"`
+	URLs        []string           `json:"urls"`
+	Items       []UploadUrlRequest `json:"items"`
+}
+
+// urlImportParams is what a URL import job is asked to do.
+type urlImportParams struct {
+	Items []UploadUrlRequest `json:"items"`
+}
+
+// urlImportResult is what became of one URL, in the shape /upload-url would
+// have answered it with.
+type urlImportResult struct {
+	URL     string `json:"url"`
+	Status  int    `json:"status"`
+	Success bool   `json:"success"`
+	Message string `json:"message"`
+	Data    any    `json:"data,omitempty"`
+}
+
+// NewJobsHandler shares the upload pipeline of images, which must come from
+// NewImage, and registers the job kinds it submits with jobs. Call it before
+// jobs.Start.
+func NewJobsHandler(images Image, jobs *service.JobQueue) (JobsHandler, error) {
+	img, ok := images.(*image)
+	if !ok {
+		return nil, fmt.Errorf("jobs: images must come from NewImage")
+	}
+	h := &jobsHandler{
+		img:           *img,
+		jobs:          jobs,
+		store:         service.MinioStore{Client: img.minioClient},
+		importTimeout: time.Duration(config.GetEnvAsIntOrDefault("URL_IMPORT_TIMEOUT_SECONDS", 300)) * time.Second,
+		maxBatch:      config.GetEnvAsIntOrDefault("URL_IMPORT_BATCH_MAX", 100),
+		deleteRate:    config.GetEnvAsIntOrDefault("PREFIX_DELETE_RATE", 100),
+	}
+	jobs.Handle(urlImportKind, h.runURLImport)
+	jobs.Handle(prefixDeleteKind, h.runPrefixDelete)
+	return h, nil
+}
+
+func (h *jobsHandler) UploadWithUrl(c *fiber.Ctx) error {
+	return h.img.uploadWithURL(c, h.jobs)
+}
+
+func (h *jobsHandler) ImportURLs(c *fiber.Ctx) error {
+	var req URLImportBatchRequest
+	if err := c.BodyParser(&req); err != nil {
+		return service.Response(c, fiber.StatusBadRequest, false, "Invalid request body", nil)
+	}
+	bucketName, err := resolveBucket(c, req.Bucket)
+	if err != nil {
+		return bucketForbidden(c)
+	}
+	if bucketName == "" {
+		return service.Response(c, fiber.StatusBadRequest, false, "Bucket is required", nil)
+	}
+	if service.InternalBucket(bucketName) {
+		return bucketReserved(c)
+	}
+
+	items := make([]UploadUrlRequest, 0, len(req.URLs)+len(req.Items))
+	for _, u := range req.URLs {
+		items = append(items, UploadUrlRequest{URL: u})
+	}
+	items = append(items, req.Items...)
+	if len(items) == 0 {
+		return service.Response(c, fiber.StatusBadRequest, false, "urls or items is required", nil)
+	}
+	if len(items) > h.maxBatch {
+		return service.Response(c, fiber.StatusBadRequest, false, fmt.Sprintf("at most %d URLs per batch", h.maxBatch), map[string]string{
+			"code": "BATCH_SIZE_EXCEEDED",
+		})
+	}
+
+	// Every URL is checked before anything is queued, so a batch is accepted
+	// or refused whole rather than half imported.
+	for n := range items {
+		item := &items[n]
+		if item.Bucket != "" && item.Bucket != bucketName {
+			return service.Response(c, fiber.StatusBadRequest, false, fmt.Sprintf("item %d: every item must be in the batch's bucket", n), nil)
+		}
+		item.Bucket = bucketName
+		if item.Path == "" {
+			item.Path = req.Path
+		}
+		item.Optimize = item.Optimize || req.Optimize
+		item.Async, item.CallbackURL = false, ""
+		if err := validator.ValidateStruct(*item); err != nil {
+			return service.Response(c, fiber.StatusBadRequest, false, fmt.Sprintf("item %d: %v", n, err), nil)
+		}
+		if err := validator.ValidateUploadURL(item.URL); err != nil {
+			return service.Response(c, fiber.StatusBadRequest, false, fmt.Sprintf("item %d: %v", n, err), nil)
+		}
+		if _, kerr := newObjectAttrs(item.Metadata, item.Tags); kerr != nil {
+			return service.Response(c, fiber.StatusBadRequest, false, fmt.Sprintf("item %d: %s", n, kerr.message), map[string]string{
+				"code": kerr.code,
+			})
+		}
+	}
+	return submitURLImport(c, h.jobs, items, req.CallbackURL)
+}
+
+// submitURLImport queues items as one URL import job and answers 202 with the
+// job and where to poll it. The items are already checked and resolved.
+func submitURLImport(c *fiber.Ctx, jobs *service.JobQueue, items []UploadUrlRequest, callbackURL string) error {
+	// The callback is fetched like the URLs are, by the same rules.
+	if callbackURL != "" {
+		if err := validator.ValidateUploadURL(callbackURL); err != nil {
+			return service.Response(c, fiber.StatusBadRequest, false, "callback_url: "+err.Error(), nil)
+		}
+	}
+	for n := range items {
+		items[n].Async, items[n].CallbackURL = false, ""
+	}
+	params, err := json.Marshal(urlImportParams{Items: items})
+	if err != nil {
+		return service.Response(c, fiber.StatusInternalServerError, false, err.Error(), nil)
+	}
+	job, err := jobs.Submit(context.Background(), service.Job{
+		Kind:        urlImportKind,
+		Owner:       service.JobOwner(service.PrincipalFrom(c)),
+		Params:      params,
+		Total:       len(items),
+		CallbackURL: callbackURL,
+	})
+	if err != nil {
+		return service.Response(c, fiber.StatusServiceUnavailable, false, "could not queue the import: "+err.Error(), nil)
+	}
+	return respondQueued(c, job, nil)
+}
+
+// respondQueued answers 202 with a submitted job, where to poll it, and any
+// fields of extra.
+func respondQueued(c *fiber.Ctx, job service.Job, extra map[string]any) error {
+	statusURL := strings.TrimSuffix(config.GetEnvOrDefault("APP_URL", "http://localhost:9090"), "/") + "/jobs/" + job.ID
+	c.Set(fiber.HeaderLocation, statusURL)
+	data := map[string]any{
+		"job_id":     job.ID,
+		"state":      job.State,
+		"total":      job.Total,
+		"status_url": statusURL,
+	}
+	for k, v := range extra {
+		data[k] = v
+	}
+	return service.Response(c, fiber.StatusAccepted, true, "queued", data)
+}
+
+// runURLImport imports a job's URLs one after the other, checkpointing after
+// each. Results already recorded are kept when a job is resumed after its
+// replica died, so a resumed import carries on where it stopped instead of
+// storing the first URLs twice.
+//
+// A job fails only when every URL did; otherwise it succeeds and its result
+// lists which URLs failed and why.
+func (h *jobsHandler) runURLImport(ctx context.Context, job *service.Job, checkpoint func() error) error {
+	var params urlImportParams
+	if err := json.Unmarshal(job.Params, &params); err != nil {
+		return fmt.Errorf("invalid job parameters: %w", err)
+	}
+	var results []urlImportResult
+	if len(job.Result) > 0 {
+		_ = json.Unmarshal(job.Result, &results)
+	}
+	if len(results) > len(params.Items) {
+		results = results[:0]
+	}
+
+	for n := len(results); n < len(params.Items); n++ {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		item := params.Items[n]
+		out := h.img.importURL(ctx, item, h.importTimeout)
+		results = append(results, urlImportResult{
+			URL:     item.URL,
+			Status:  out.status,
+			Success: out.status < fiber.StatusBadRequest,
+			Message: out.message,
+			Data:    out.data,
+		})
+		recordURLImport(job, results)
+		if err := checkpoint(); err != nil {
+			return err
+		}
+	}
+
+	recordURLImport(job, results)
+	if job.Done == 0 && job.Failed > 0 {
+		if job.Failed == 1 {
+			return errors.New(results[0].Message)
+		}
+		return fmt.Errorf("all %d URLs failed", job.Failed)
+	}
+	return nil
+}
+
+// recordURLImport puts an import's results so far on its job.
+func recordURLImport(job *service.Job, results []urlImportResult) {
+	job.Done, job.Failed = 0, 0
+	for _, r := range results {
+		if r.Success {
+			job.Done++
+		} else {
+			job.Failed++
+		}
+	}
+	job.Result, _ = json.Marshal(results)
+}
+
+// Status answers GET /jobs/:id. A job the caller may not see is answered like
+// one that does not exist, so job IDs tell a scoped token nothing about other
+// buckets' work.
+func (h *jobsHandler) Status(c *fiber.Ctx) error {
+	job, err := h.jobs.Get(context.Background(), c.Params("id"))
+	if err == nil && !job.VisibleTo(service.PrincipalFrom(c)) {
+		err = service.ErrJobNotFound
+	}
+	if errors.Is(err, service.ErrJobNotFound) {
+		return service.Response(c, fiber.StatusNotFound, false, "job not found", map[string]string{
+			"code": "JOB_NOT_FOUND",
+		})
+	}
+	if err != nil {
+		return service.Response(c, fiber.StatusServiceUnavailable, false, "could not read the job: "+err.Error(), nil)
+	}
+	if !job.State.Finished() {
+		c.Set(fiber.HeaderRetryAfter, "2")
+	}
+	c.Set(fiber.HeaderCacheControl, "no-store")
+	return service.Response(c, fiber.StatusOK, true, string(job.State), job)
+}
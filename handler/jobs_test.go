@@ -0,0 +1,162 @@
+package handler
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+
+	"github.com/mstgnz/cdn/service"
+)
+
+// newJobsApp serves the job routes over an in-memory queue that is never
+// started, so submitted jobs stay queued for inspection. X-Test-Bucket picks a
+// bucket-scoped principal, as in the idempotency tests.
+func newJobsApp(t *testing.T) (*fiber.App, *service.JobQueue) {
+	t.Helper()
+	jobs, err := service.NewJobQueue(newMemStore(service.JobsBucket()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := &jobsHandler{jobs: jobs, store: newMemStore("photos"), maxBatch: 3}
+	app := fiber.New()
+	app.Use(func(c *fiber.Ctx) error {
+		if b := c.Get("X-Test-Bucket"); b != "" {
+			service.StorePrincipal(c, service.Principal{Scoped: true, Bucket: b})
+		}
+		return c.Next()
+	})
+	app.Post("/upload-url", h.UploadWithUrl)
+	app.Post("/upload-url/batch", h.ImportURLs)
+	app.Post("/objects/delete-prefix", h.DeletePrefix)
+	app.Get("/jobs/:id", h.Status)
+	return app, jobs
+}
+
+func postJSON(t *testing.T, app *fiber.App, target, bucket string, body any) (int, map[string]any) {
+	t.Helper()
+	raw, _ := json.Marshal(body)
+	req := httptest.NewRequest(fiber.MethodPost, target, bytes.NewReader(raw))
+	req.Header.Set(fiber.HeaderContentType, fiber.MIMEApplicationJSON)
+	if bucket != "" {
+		req.Header.Set("X-Test-Bucket", bucket)
+	}
+	resp, err := app.Test(req, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out map[string]any
+	data, _ := io.ReadAll(resp.Body)
+	_ = json.Unmarshal(data, &out)
+	return resp.StatusCode, out
+}
+
+// An async /upload-url answers at once with a job that holds the resolved
+// request, and only its submitter's bucket can read it.
+func TestAsyncUploadWithUrlQueuesAJob(t *testing.T) {
+	app, jobs := newJobsApp(t)
+	status, out := postJSON(t, app, "/upload-url", "photos", map[string]any{
+		"url": "https://example.com/cat.png", "async": true, "key": "cat.png",
+	})
+	if status != fiber.StatusAccepted {
+		t.Fatalf("status %d: %v", status, out)
+	}
+	id, _ := out["data"].(map[string]any)["job_id"].(string)
+
+	job, err := jobs.Get(context.Background(), id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var params urlImportParams
+	_ = json.Unmarshal(job.Params, &params)
+	if job.State != service.JobQueued || job.Total != 1 || len(params.Items) != 1 || params.Items[0].Bucket != "photos" || params.Items[0].Key != "cat.png" {
+		t.Fatalf("job = %+v, params = %+v", job, params)
+	}
+
+	for bucket, want := range map[string]int{"photos": fiber.StatusOK, "docs": fiber.StatusNotFound, "": fiber.StatusOK} {
+		req := httptest.NewRequest(fiber.MethodGet, "/jobs/"+id, nil)
+		if bucket != "" {
+			req.Header.Set("X-Test-Bucket", bucket)
+		}
+		resp, _ := app.Test(req, -1)
+		if resp.StatusCode != want {
+			t.Errorf("as %q: status %d, want %d", bucket, resp.StatusCode, want)
+		}
+	}
+	if resp, _ := app.Test(httptest.NewRequest(fiber.MethodGet, "/jobs/../x", nil), -1); resp.StatusCode == fiber.StatusOK {
+		t.Error("a non-UUID job ID was looked up")
+	}
+}
+
+// Queued or not, the SSRF rules apply: a private URL or callback is refused
+// before anything is queued.
+func TestURLImportRefusesPrivateTargets(t *testing.T) {
+	app, _ := newJobsApp(t)
+	cases := []struct {
+		target string
+		body   map[string]any
+	}{
+		{"/upload-url", map[string]any{"bucket": "photos", "url": "http://127.0.0.1/x.png", "async": true}},
+		{"/upload-url", map[string]any{"bucket": "photos", "url": "https://example.com/x.png", "async": true, "callback_url": "http://169.254.169.254/"}},
+		{"/upload-url/batch", map[string]any{"bucket": "photos", "urls": []string{"https://example.com/a.png", "http://10.0.0.1/b.png"}}},
+		{"/upload-url/batch", map[string]any{"bucket": "photos", "urls": []string{"https://example.com/a.png"}, "callback_url": "http://127.0.0.1:8080/"}},
+	}
+	for _, tc := range cases {
+		if status, out := postJSON(t, app, tc.target, "", tc.body); status != fiber.StatusBadRequest {
+			t.Errorf("%s %v: status %d %v", tc.target, tc.body, status, out)
+		}
+	}
+}
+
+func TestURLImportBatch(t *testing.T) {
+	app, jobs := newJobsApp(t)
+
+	status, out := postJSON(t, app, "/upload-url/batch", "photos", map[string]any{
+		"path":  "imports",
+		"urls":  []string{"https://example.com/a.png"},
+		"items": []map[string]any{{"url": "https://example.com/b.png", "key": "b.png", "path": "other"}},
+	})
+	if status != fiber.StatusAccepted {
+		t.Fatalf("status %d: %v", status, out)
+	}
+	job, _ := jobs.Get(context.Background(), out["data"].(map[string]any)["job_id"].(string))
+	var params urlImportParams
+	_ = json.Unmarshal(job.Params, &params)
+	if job.Total != 2 || params.Items[0].Path != "imports" || params.Items[1].Path != "other" || params.Items[1].Bucket != "photos" {
+		t.Fatalf("params = %+v", params)
+	}
+
+	for name, body := range map[string]map[string]any{
+		"empty":        {"urls": []string{}},
+		"too many":     {"urls": []string{"https://a.example/1", "https://a.example/2", "https://a.example/3", "https://a.example/4"}},
+		"other bucket": {"items": []map[string]any{{"url": "https://a.example/1", "bucket": "docs"}}},
+	} {
+		if status, out := postJSON(t, app, "/upload-url/batch", "photos", body); status != fiber.StatusBadRequest {
+			t.Errorf("%s: status %d %v", name, status, out)
+		}
+	}
+	if status, _ := postJSON(t, app, "/upload-url/batch", "photos", map[string]any{"bucket": "docs", "urls": []string{"https://a.example/1"}}); status != fiber.StatusForbidden {
+		t.Errorf("a scoped token queued an import into another bucket: %d", status)
+	}
+}
+
+// A resumed import keeps what it already did and carries on from there.
+func TestRunURLImportResumesAfterRecordedResults(t *testing.T) {
+	h := &jobsHandler{}
+	params, _ := json.Marshal(urlImportParams{Items: []UploadUrlRequest{{URL: "https://a.example/1"}, {URL: "https://a.example/2"}}})
+	done, _ := json.Marshal([]urlImportResult{{URL: "https://a.example/1", Status: 201, Success: true}, {URL: "https://a.example/2", Status: 400, Message: "gone"}})
+	job := &service.Job{Params: params, Result: done}
+
+	checkpoints := 0
+	if err := h.runURLImport(context.Background(), job, func() error { checkpoints++; return nil }); err != nil {
+		t.Fatal(err)
+	}
+	if checkpoints != 0 || job.Done != 1 || job.Failed != 1 || !strings.Contains(string(job.Result), "gone") {
+		t.Fatalf("re-ran recorded items: checkpoints=%d result=%s", checkpoints, job.Result)
+	}
+}
@@ -0,0 +1,49 @@
+package handler
+
+import (
+	"context"
+	"io"
+
+	"github.com/gofiber/fiber/v2"
+
+	"github.com/mstgnz/cdn/pkg/config"
+	"github.com/mstgnz/cdn/pkg/observability"
+)
+
+// scanUpload runs an upload to bucket past the malware scanner before it is
+// stored, and returns why it must not be, if it must not.
+//
+// An infected file is refused whatever the bucket's mode. A scan that got no
+// verdict is refused with 503 in a fail_closed bucket, where a client can
+// retry once clamd is back, and let through in a fail_open one, counted and
+// logged so it does not go unnoticed. r is read to its end; callers holding a
+// ReadSeeker rewind it themselves.
+func (i image) scanUpload(ctx context.Context, bucket string, r io.Reader) *keyError {
+	if !i.scanner.Enabled(bucket) {
+		return nil
+	}
+	verdict, err := i.scanner.Scan(ctx, r)
+	if err != nil {
+		if config.MalwareScanFor(bucket) == config.MalwareScanFailOpen {
+			observability.MalwareScanBypassed.Inc()
+			log := observability.Logger()
+			log.Warn().Err(err).Str("bucket", bucket).Msg("malware scan failed; storing unscanned (fail_open)")
+			return nil
+		}
+		return &keyError{fiber.StatusServiceUnavailable, "MALWARE_SCAN_UNAVAILABLE", "the file could not be scanned for malware; try again later"}
+	}
+	if verdict.Infected {
+		return &keyError{fiber.StatusBadRequest, "MALWARE_DETECTED", "the file contains malware (" + verdict.Signature + ")"}
+	}
+	return nil
+}
+
+// scanSeeker is scanUpload for an upload held as a ReadSeeker, which is
+// rewound for whatever reads it next.
+func (i image) scanSeeker(ctx context.Context, bucket string, rs io.ReadSeeker) *keyError {
+	kerr := i.scanUpload(ctx, bucket, rs)
+	if _, err := rs.Seek(0, io.SeekStart); err != nil && kerr == nil {
+		return &keyError{fiber.StatusBadRequest, "INVALID_FILE_CONTENT", err.Error()}
+	}
+	return kerr
+}
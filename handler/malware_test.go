@@ -0,0 +1,114 @@
+package handler
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+
+	"github.com/mstgnz/cdn/service"
+)
+
+// eicarFile is the antivirus test file, split so this source is not flagged.
+var eicarFile = []byte(`X5O!P%@AP[4\PZX54(P^)7CC)7}$` + `EICAR-STANDARD-ANTIVIRUS-TEST-FILE!$H+H*`)
+
+// fakeClamd is a minimal clamd: it reads one INSTREAM and reports the EICAR
+// file as found. It returns the scanner pointed at it.
+func fakeClamd(t *testing.T) *service.MalwareScanner {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			r := bufio.NewReader(conn)
+			_, _ = r.ReadString(0)
+			var data []byte
+			for {
+				var size uint32
+				if binary.Read(r, binary.BigEndian, &size) != nil || size == 0 {
+					break
+				}
+				chunk := make([]byte, size)
+				_, _ = io.ReadFull(r, chunk)
+				data = append(data, chunk...)
+			}
+			reply := "stream: OK\x00"
+			if bytes.Contains(data, []byte("EICAR-STANDARD")) {
+				reply = "stream: Win.Test.EICAR_HDB-1 FOUND\x00"
+			}
+			_, _ = io.WriteString(conn, reply)
+			conn.Close()
+		}
+	}()
+	t.Setenv("CLAMD_ADDR", ln.Addr().String())
+	return service.NewMalwareScanner()
+}
+
+// Infected is refused everywhere; no verdict is refused or let through by the
+// bucket's mode; off skips the scan.
+func TestScanUploadFollowsTheBucketMode(t *testing.T) {
+	loadPresetPolicy(t, `{"buckets": [
+		{"bucket": "open", "malware_scan": "fail_open"},
+		{"bucket": "skipped", "malware_scan": "off"}
+	]}`)
+	img := image{scanner: fakeClamd(t)}
+	ctx := context.Background()
+
+	if kerr := img.scanUpload(ctx, "photos", strings.NewReader("hello")); kerr != nil {
+		t.Fatalf("clean file: %v", kerr)
+	}
+	for _, bucket := range []string{"photos", "open"} {
+		if kerr := img.scanUpload(ctx, bucket, bytes.NewReader(eicarFile)); kerr == nil || kerr.code != "MALWARE_DETECTED" {
+			t.Errorf("%s: EICAR got %v", bucket, kerr)
+		}
+	}
+	if kerr := img.scanUpload(ctx, "skipped", bytes.NewReader(eicarFile)); kerr != nil {
+		t.Errorf("off: scanned anyway: %v", kerr)
+	}
+
+	ln, _ := net.Listen("tcp", "127.0.0.1:0")
+	down := ln.Addr().String()
+	ln.Close()
+	t.Setenv("CLAMD_ADDR", down)
+	img.scanner = service.NewMalwareScanner()
+	if kerr := img.scanUpload(ctx, "photos", strings.NewReader("hello")); kerr == nil || kerr.status != fiber.StatusServiceUnavailable {
+		t.Errorf("fail_closed with clamd down: %v", kerr)
+	}
+	if kerr := img.scanUpload(ctx, "open", strings.NewReader("hello")); kerr != nil {
+		t.Errorf("fail_open with clamd down: %v", kerr)
+	}
+}
+
+// A presigned upload is scanned at finalize, and an infected one is removed
+// rather than moved into the bucket.
+func TestPresignFinalizeRejectsMalware(t *testing.T) {
+	store := newMemStore(presignStaging, "photos")
+	app, h := newPresignApp(store, offlineSigner(t))
+	h.img.scanner = fakeClamd(t)
+	id := issue(t, app, "report.csv")
+	browserUpload(t, store, id, eicarFile)
+
+	code, out := presignCall(t, app, "/upload/presign/"+id+"/finalize", nil, nil)
+	if code != fiber.StatusBadRequest || out.Data["code"] != "MALWARE_DETECTED" {
+		t.Fatalf("finalize = %d %+v", code, out)
+	}
+	if keys := store.keys("photos"); len(keys) != 0 {
+		t.Fatalf("infected file was stored: %v", keys)
+	}
+	if keys := store.keys(presignStaging); len(keys) != 0 {
+		t.Fatalf("infected upload left staging objects: %v", keys)
+	}
+}
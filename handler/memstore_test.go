@@ -0,0 +1,364 @@
+package handler
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/tags"
+)
+
+// memStore is an in-memory service.ObjectStore for handlers that take one
+// instead of a *minio.Client. Missing keys answer like MinIO does, with a
+// NoSuchKey error response.
+//
+// A bucket passed to versionBucket keeps history as a versioned MinIO bucket
+// does: a write or a delete pushes the current object into history (a delete
+// as a delete marker on top), every version has an ID and its own ETag, and
+// versions can be stated, copied from and listed.
+type memStore struct {
+	mu        sync.Mutex
+	buckets   map[string]bool
+	objects   map[string]memObject   // bucket + "/" + key
+	history   map[string][]memObject // noncurrent versions and delete markers, oldest first
+	versioned map[string]bool
+	seq       int
+	now       func() time.Time
+}
+
+type memObject struct {
+	data         []byte
+	contentType  string
+	meta         map[string]string
+	tags         map[string]string
+	modified     time.Time
+	version      string
+	deleteMarker bool
+}
+
+func newMemStore(buckets ...string) *memStore {
+	m := &memStore{buckets: map[string]bool{}, objects: map[string]memObject{}, history: map[string][]memObject{}, versioned: map[string]bool{}, now: time.Now}
+	for _, b := range buckets {
+		m.buckets[b] = true
+	}
+	return m
+}
+
+func noSuchKey() error {
+	return minio.ErrorResponse{Code: "NoSuchKey", Message: "The specified key does not exist."}
+}
+
+// versionBucket turns versioning on for a bucket.
+func (m *memStore) versionBucket(bucket string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.versioned[bucket] = true
+}
+
+// memETag is an object's ETag: per key, and per version in a versioned
+// bucket, so that a copy conditional on one version's ETag fails on another.
+func memETag(key, version string) string {
+	if version == "" {
+		return "etag-" + key
+	}
+	return "etag-" + key + "@" + version
+}
+
+// store makes o the current object under bucket/key, the one it replaces
+// becoming history in a versioned bucket. Called with mu held.
+func (m *memStore) store(bucket, key string, o memObject) memObject {
+	k := bucket + "/" + key
+	o.version = ""
+	if m.versioned[bucket] {
+		if cur, ok := m.objects[k]; ok {
+			m.history[k] = append(m.history[k], cur)
+		}
+		m.seq++
+		o.version = fmt.Sprintf("v%d", m.seq)
+	}
+	m.objects[k] = o
+	return o
+}
+
+// version finds one version of an object, current or not. Called with mu
+// held.
+func (m *memStore) version(bucket, key, version string) (memObject, bool) {
+	k := bucket + "/" + key
+	if o, ok := m.objects[k]; ok && o.version == version {
+		return o, true
+	}
+	for _, o := range m.history[k] {
+		if o.version == version {
+			return o, true
+		}
+	}
+	return memObject{}, false
+}
+
+// get returns an object's bytes for assertions.
+func (m *memStore) get(bucket, key string) ([]byte, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	o, ok := m.objects[bucket+"/"+key]
+	return o.data, ok
+}
+
+// keys lists a bucket's keys in order, for assertions.
+func (m *memStore) keys(bucket string) []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var out []string
+	for k := range m.objects {
+		if rest, ok := strings.CutPrefix(k, bucket+"/"); ok {
+			out = append(out, rest)
+		}
+	}
+	sort.Strings(out)
+	return out
+}
+
+func (m *memStore) ListBuckets(context.Context) ([]minio.BucketInfo, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var out []minio.BucketInfo
+	for b := range m.buckets {
+		out = append(out, minio.BucketInfo{Name: b})
+	}
+	return out, nil
+}
+
+// ListObjects lists in key order the way MinIO does: from after StartAfter,
+// rolled up at "/" unless Recursive, and with tags only WithMetadata.
+// WithVersions lists every version of each key, newest first, delete markers
+// included.
+func (m *memStore) ListObjects(_ context.Context, bucket string, opts minio.ListObjectsOptions) <-chan minio.ObjectInfo {
+	if opts.WithVersions {
+		return m.listVersions(bucket, opts)
+	}
+	m.mu.Lock()
+	var infos []minio.ObjectInfo
+	seen := map[string]bool{}
+	for k, o := range m.objects {
+		key, ok := strings.CutPrefix(k, bucket+"/")
+		if !ok || !strings.HasPrefix(key, opts.Prefix) {
+			continue
+		}
+		if !opts.Recursive {
+			if i := strings.Index(key[len(opts.Prefix):], "/"); i >= 0 {
+				if p := key[:len(opts.Prefix)+i+1]; !seen[p] {
+					seen[p] = true
+					infos = append(infos, minio.ObjectInfo{Key: p})
+				}
+				continue
+			}
+		}
+		info := minio.ObjectInfo{Key: key, ETag: memETag(key, o.version), Size: int64(len(o.data)), LastModified: o.modified, ContentType: o.contentType, UserMetadata: o.meta, VersionID: o.version}
+		if opts.WithMetadata {
+			info.UserTags = o.tags
+		}
+		infos = append(infos, info)
+	}
+	m.mu.Unlock()
+	sort.Slice(infos, func(a, b int) bool { return infos[a].Key < infos[b].Key })
+
+	ch := make(chan minio.ObjectInfo, len(infos))
+	for _, info := range infos {
+		if info.Key > opts.StartAfter {
+			ch <- info
+		}
+	}
+	close(ch)
+	return ch
+}
+
+func (m *memStore) listVersions(bucket string, opts minio.ListObjectsOptions) <-chan minio.ObjectInfo {
+	m.mu.Lock()
+	var infos []minio.ObjectInfo
+	add := func(key string, o memObject, latest bool) {
+		infos = append(infos, minio.ObjectInfo{
+			Key: key, ETag: memETag(key, o.version), Size: int64(len(o.data)), LastModified: o.modified,
+			VersionID: o.version, IsLatest: latest, IsDeleteMarker: o.deleteMarker,
+		})
+	}
+	keys := map[string]bool{}
+	for k := range m.objects {
+		keys[k] = true
+	}
+	for k := range m.history {
+		keys[k] = true
+	}
+	for k := range keys {
+		key, ok := strings.CutPrefix(k, bucket+"/")
+		if !ok || !strings.HasPrefix(key, opts.Prefix) || key <= opts.StartAfter {
+			continue
+		}
+		cur, hasCur := m.objects[k]
+		if hasCur {
+			add(key, cur, true)
+		}
+		older := m.history[k]
+		for n := len(older) - 1; n >= 0; n-- {
+			add(key, older[n], !hasCur && n == len(older)-1)
+		}
+	}
+	m.mu.Unlock()
+	sort.SliceStable(infos, func(a, b int) bool { return infos[a].Key < infos[b].Key })
+
+	ch := make(chan minio.ObjectInfo, len(infos))
+	for _, info := range infos {
+		ch <- info
+	}
+	close(ch)
+	return ch
+}
+
+func (m *memStore) StatObject(_ context.Context, bucket, key string, opts minio.StatObjectOptions) (minio.ObjectInfo, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	o, ok := m.objects[bucket+"/"+key]
+	if opts.VersionID != "" {
+		if o, ok = m.version(bucket, key, opts.VersionID); !ok {
+			return minio.ObjectInfo{}, minio.ErrorResponse{Code: "NoSuchVersion", Message: "The specified version does not exist."}
+		}
+		if o.deleteMarker {
+			return minio.ObjectInfo{}, minio.ErrorResponse{Code: "MethodNotAllowed", Message: "The specified method is not allowed against this resource."}
+		}
+	}
+	if !ok {
+		return minio.ObjectInfo{}, noSuchKey()
+	}
+	return minio.ObjectInfo{Key: key, ETag: memETag(key, o.version), Size: int64(len(o.data)), LastModified: o.modified, ContentType: o.contentType, UserMetadata: o.meta, UserTagCount: len(o.tags), VersionID: o.version}, nil
+}
+
+func (m *memStore) RemoveObject(_ context.Context, bucket, key string, _ minio.RemoveObjectOptions) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	k := bucket + "/" + key
+	if m.versioned[bucket] {
+		if cur, ok := m.objects[k]; ok {
+			m.seq++
+			m.history[k] = append(m.history[k], cur, memObject{version: fmt.Sprintf("v%d", m.seq), deleteMarker: true, modified: m.now()})
+		}
+	}
+	delete(m.objects, k)
+	return nil
+}
+
+// PutObject honours If-Match and If-None-Match as MinIO does for conditional
+// writes. The headers are compared as sent: If-Match with the ETag quoted,
+// If-None-Match only as a bare *, which is all MinIO treats as "not if it
+// exists" (a quoted "*" names an ETag no object has).
+func (m *memStore) PutObject(_ context.Context, bucket, key string, r io.Reader, _ int64, opts minio.PutObjectOptions) (minio.UploadInfo, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return minio.UploadInfo{}, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	h := opts.Header()
+	cur, exists := m.objects[bucket+"/"+key]
+	ifMatch, ifNoneMatch := h.Get("If-Match"), h.Get("If-None-Match")
+	if ifMatch != "" && (!exists || ifMatch != `"`+memETag(key, cur.version)+`"`) || ifNoneMatch == "*" && exists {
+		return minio.UploadInfo{}, minio.ErrorResponse{Code: "PreconditionFailed", Message: "At least one of the pre-conditions you specified did not hold"}
+	}
+	o := m.store(bucket, key, memObject{data: data, contentType: opts.ContentType, meta: opts.UserMetadata, tags: opts.UserTags, modified: m.now()})
+	return minio.UploadInfo{Bucket: bucket, Key: key, Size: int64(len(data)), ETag: memETag(key, o.version), VersionID: o.version}, nil
+}
+
+func (m *memStore) MakeBucket(_ context.Context, bucket string, _ minio.MakeBucketOptions) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.buckets[bucket] = true
+	return nil
+}
+
+func (m *memStore) BucketExists(_ context.Context, bucket string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.buckets[bucket], nil
+}
+
+func (m *memStore) CopyObject(_ context.Context, dst minio.CopyDestOptions, src minio.CopySrcOptions) (minio.UploadInfo, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	o, ok := m.objects[src.Bucket+"/"+src.Object]
+	if src.VersionID != "" {
+		o, ok = m.version(src.Bucket, src.Object, src.VersionID)
+	}
+	if !ok || o.deleteMarker {
+		return minio.UploadInfo{}, noSuchKey()
+	}
+	if src.MatchETag != "" && src.MatchETag != memETag(src.Object, o.version) {
+		return minio.UploadInfo{}, minio.ErrorResponse{Code: "PreconditionFailed", Message: "At least one of the pre-conditions you specified did not hold"}
+	}
+	o.modified = m.now()
+	if dst.ReplaceMetadata {
+		o.meta = dst.UserMetadata
+		if ct, ok := o.meta["Content-Type"]; ok {
+			o.contentType = ct
+		}
+	}
+	if dst.ReplaceTags {
+		o.tags = dst.UserTags
+	}
+	o = m.store(dst.Bucket, dst.Object, o)
+	return minio.UploadInfo{Bucket: dst.Bucket, Key: dst.Object, Size: int64(len(o.data)), ETag: memETag(dst.Object, o.version), VersionID: o.version}, nil
+}
+
+func (m *memStore) OpenObject(_ context.Context, bucket, key string) (io.ReadCloser, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	o, ok := m.objects[bucket+"/"+key]
+	if !ok {
+		return nil, noSuchKey()
+	}
+	return io.NopCloser(bytes.NewReader(o.data)), nil
+}
+
+func (m *memStore) GetObjectTagging(_ context.Context, bucket, key string, _ minio.GetObjectTaggingOptions) (*tags.Tags, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	o, ok := m.objects[bucket+"/"+key]
+	if !ok {
+		return nil, noSuchKey()
+	}
+	return tags.NewTags(o.tags, true)
+}
+
+func (m *memStore) PutObjectTagging(_ context.Context, bucket, key string, t *tags.Tags, _ minio.PutObjectTaggingOptions) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	o, ok := m.objects[bucket+"/"+key]
+	if !ok {
+		return noSuchKey()
+	}
+	o.tags = t.ToMap()
+	m.objects[bucket+"/"+key] = o
+	return nil
+}
+
+func (m *memStore) RemoveObjectTagging(_ context.Context, bucket, key string, _ minio.RemoveObjectTaggingOptions) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	o, ok := m.objects[bucket+"/"+key]
+	if !ok {
+		return noSuchKey()
+	}
+	o.tags = nil
+	m.objects[bucket+"/"+key] = o
+	return nil
+}
+
+// object returns a stored object whole, for assertions on its metadata.
+func (m *memStore) object(bucket, key string) (memObject, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	o, ok := m.objects[bucket+"/"+key]
+	return o, ok
+}
@@ -0,0 +1,88 @@
+package handler
+
+import (
+	"context"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/minio/minio-go/v7"
+
+	"github.com/mstgnz/cdn/service"
+)
+
+// GetMetadata describes one stored object without sending its bytes: where it
+// lives, how big it is, the metadata and tags it was given, and how far the
+// bucket's presets have got. The archive keeps neither metadata nor tags, so
+// an object only found there reports none.
+//
+// The local tier is asked first and the archive second, the same order
+// GetImage reads in, so the tier reported is the one a request would be served
+// from.
+func (i image) GetMetadata(c *fiber.Ctx) error {
+	bucket, err := resolveBucket(c, c.Params("bucket"))
+	if err != nil {
+		return bucketForbidden(c)
+	}
+	object := c.Params("*")
+	if bucket == "" || object == "" {
+		return service.Response(c, fiber.StatusBadRequest, false, "invalid path or bucket or file.", nil)
+	}
+	if service.InternalBucket(bucket) {
+		return bucketReserved(c)
+	}
+	if service.HasUnsafeObjectKey(object) {
+		return service.Response(c, fiber.StatusBadRequest, false, "invalid object key", nil)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	data := map[string]any{
+		"bucket": bucket,
+		"key":    object,
+	}
+
+	found := false
+	if i.minioClient != nil {
+		if info, err := i.minioClient.StatObject(ctx, bucket, object, minio.StatObjectOptions{}); err == nil {
+			found = true
+			data["tier"] = "local"
+			data["size"] = info.Size
+			data["content_type"] = info.ContentType
+			data["etag"] = info.ETag
+			data["last_modified"] = info.LastModified.UTC()
+			if info.VersionID != "" {
+				data["version_id"] = info.VersionID
+			}
+			if sum := info.UserMetadata[service.MetaSHA256]; sum != "" {
+				data["sha256"] = sum
+			}
+			data["metadata"] = userMeta(info.UserMetadata)
+			if tagMap, err := objectTags(ctx, service.MinioStore{Client: i.minioClient}, bucket, object, info); err == nil {
+				data["tags"] = tagMap
+			}
+		}
+	}
+	if !found && i.archive != nil && i.archive.Enabled() {
+		if info, err := i.archive.Stat(ctx, bucket, object); err == nil {
+			found = true
+			data["tier"] = "archive"
+			data["size"] = info.Size
+			if info.SHA256 != "" {
+				data["sha256"] = info.SHA256
+			}
+			if info.VersionID != "" {
+				data["version_id"] = info.VersionID
+			}
+		}
+	}
+	if !found {
+		return service.Response(c, fiber.StatusNotFound, false, "object not found", nil)
+	}
+
+	// Reported as null when nothing is known, which is also the answer for a
+	// bucket without presets.
+	data["presets"] = i.presetStatus(bucket, object)
+
+	return service.Response(c, fiber.StatusOK, true, "success", data)
+}
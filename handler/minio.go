@@ -2,9 +2,13 @@ package handler
 
 import (
 	"context"
+	"strings"
+	"time"
 
 	"github.com/gofiber/fiber/v2"
 	"github.com/minio/minio-go/v7"
+
+	bucketname "github.com/mstgnz/cdn/pkg/bucket"
 	"github.com/mstgnz/cdn/service"
 )
 
@@ -13,6 +17,15 @@ type MinioHandler interface {
 	BucketExists(c *fiber.Ctx) error
 	CreateBucket(c *fiber.Ctx) error
 	RemoveBucket(c *fiber.Ctx) error
+	GetVersioning(c *fiber.Ctx) error
+	SetVersioning(c *fiber.Ctx) error
+}
+
+// VersioningRequest is the body of PUT /minio/:bucket/versioning. Status is
+// "Enabled" or "Suspended"; a bucket cannot go back to never having been
+// versioned, which is MinIO's rule and not this service's.
+type VersioningRequest struct {
+	Status string `json:"status"`
 }
 
 type minioHandler struct {
@@ -43,8 +56,14 @@ func (m minioHandler) BucketExists(c *fiber.Ctx) error {
 	return service.Response(c, fiber.StatusOK, true, "bucket exists", nil)
 }
 
+// CreateBucket creates a bucket, held to the same name rules as one created by
+// a first upload, so an operator cannot create a bucket that one of the API
+// routes would shadow.
 func (m minioHandler) CreateBucket(c *fiber.Ctx) error {
 	bucketName := c.Params("bucket")
+	if err := bucketname.ValidateNew(bucketName); err != nil {
+		return service.Response(c, fiber.StatusBadRequest, false, err.Error(), nil)
+	}
 	err := m.minioClient.MakeBucket(context.Background(), bucketName, minio.MakeBucketOptions{})
 	if err != nil {
 		return service.Response(c, fiber.StatusOK, false, err.Error(), bucketName)
@@ -52,11 +71,77 @@ func (m minioHandler) CreateBucket(c *fiber.Ctx) error {
 	return service.Response(c, fiber.StatusCreated, true, "bucket created", bucketName)
 }
 
+// RemoveBucket deletes an empty bucket. The service's own buckets are refused
+// even when they happen to be empty: the service expects them to exist and
+// would fail its next tus upload, job or trash move until it recreated them.
 func (m minioHandler) RemoveBucket(c *fiber.Ctx) error {
 	bucketName := c.Params("bucket")
+	if service.InternalBucket(bucketName) {
+		return bucketReserved(c)
+	}
 	err := m.minioClient.RemoveBucket(context.Background(), bucketName)
 	if err != nil {
 		return service.Response(c, fiber.StatusOK, false, err.Error(), bucketName)
 	}
 	return service.Response(c, fiber.StatusOK, true, "bucket deleted", bucketName)
 }
+
+// GetVersioning reports a bucket's versioning status: "Enabled", "Suspended",
+// or "Off" for a bucket that was never versioned.
+func (m minioHandler) GetVersioning(c *fiber.Ctx) error {
+	bucketName := c.Params("bucket")
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	cfg, err := m.minioClient.GetBucketVersioning(ctx, bucketName)
+	if err != nil {
+		if minio.ToErrorResponse(err).Code == "NoSuchBucket" {
+			return service.Response(c, fiber.StatusNotFound, false, "bucket not found", nil)
+		}
+		return service.Response(c, fiber.StatusBadGateway, false, err.Error(), nil)
+	}
+	status := cfg.Status
+	if status == "" {
+		status = "Off"
+	}
+	return service.Response(c, fiber.StatusOK, true, "success", map[string]any{"bucket": bucketName, "status": status})
+}
+
+// SetVersioning turns a bucket's versioning on or suspends it. Once it is on,
+// every overwrite keeps the previous bytes as a noncurrent version and every
+// delete leaves a delete marker, which GET /versions lists and POST
+// /versions/:bucket/restore brings back. Suspending stops new versions being
+// kept but leaves the ones already there.
+//
+// The service's own buckets are refused: their objects are overwritten and
+// deleted constantly by design, and versioning them would only keep garbage.
+func (m minioHandler) SetVersioning(c *fiber.Ctx) error {
+	bucketName := c.Params("bucket")
+	if service.InternalBucket(bucketName) {
+		return bucketReserved(c)
+	}
+	var req VersioningRequest
+	if err := c.BodyParser(&req); err != nil {
+		return service.Response(c, fiber.StatusBadRequest, false, "invalid request body", nil)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	var err error
+	switch req.Status {
+	case minio.Enabled:
+		err = m.minioClient.EnableVersioning(ctx, bucketName)
+	case minio.Suspended:
+		err = m.minioClient.SuspendVersioning(ctx, bucketName)
+	default:
+		return service.Response(c, fiber.StatusBadRequest, false, "status must be Enabled or Suspended", nil)
+	}
+	if err != nil {
+		if minio.ToErrorResponse(err).Code == "NoSuchBucket" {
+			return service.Response(c, fiber.StatusNotFound, false, "bucket not found", nil)
+		}
+		return service.Response(c, fiber.StatusBadGateway, false, err.Error(), nil)
+	}
+	return service.Response(c, fiber.StatusOK, true, "versioning "+strings.ToLower(req.Status), map[string]any{"bucket": bucketName, "status": req.Status})
+}
@@ -1,6 +1,7 @@
 package handler
 
 import (
+	"encoding/json"
 	"testing"
 
 	"github.com/gofiber/fiber/v2"
@@ -18,6 +19,8 @@ func TestMinioHandler_Integration(t *testing.T) {
 	app.Get("/minio/bucket-list", h.BucketList)
 	app.Get("/minio/:bucket/create", h.CreateBucket)
 	app.Delete("/minio/:bucket/delete", h.RemoveBucket)
+	app.Get("/minio/:bucket/versioning", h.GetVersioning)
+	app.Put("/minio/:bucket/versioning", h.SetVersioning)
 
 	const bucket = "cdn-minio-itest"
 	// Ensure a clean slate even if a previous run left the bucket behind.
@@ -48,6 +51,24 @@ func TestMinioHandler_Integration(t *testing.T) {
 		}
 	})
 
+	t.Run("versioning", func(t *testing.T) {
+		if got := versioningStatus(t, app, bucket); got != "Off" {
+			t.Fatalf("status of a new bucket = %q, want Off", got)
+		}
+		for _, status := range []string{"Enabled", "Suspended"} {
+			resp := doJSON(t, app, "PUT", "/minio/"+bucket+"/versioning", `{"status":"`+status+`"}`)
+			if resp.StatusCode != fiber.StatusOK {
+				t.Fatalf("set %s status = %d, want 200", status, resp.StatusCode)
+			}
+			if got := versioningStatus(t, app, bucket); got != status {
+				t.Fatalf("status = %q, want %s", got, status)
+			}
+		}
+		if resp := doJSON(t, app, "PUT", "/minio/"+bucket+"/versioning", `{"status":"Off"}`); resp.StatusCode != fiber.StatusBadRequest {
+			t.Fatalf("set Off status = %d, want 400", resp.StatusCode)
+		}
+	})
+
 	t.Run("remove", func(t *testing.T) {
 		resp := doReq(t, app, "DELETE", "/minio/"+bucket+"/delete")
 		if resp.StatusCode != fiber.StatusOK {
@@ -62,3 +83,20 @@ func TestMinioHandler_Integration(t *testing.T) {
 		}
 	})
 }
+
+func versioningStatus(t *testing.T, app *fiber.App, bucket string) string {
+	t.Helper()
+	resp := doReq(t, app, "GET", "/minio/"+bucket+"/versioning")
+	if resp.StatusCode != fiber.StatusOK {
+		t.Fatalf("versioning status = %d, want 200", resp.StatusCode)
+	}
+	var out struct {
+		Data struct {
+			Status string `json:"status"`
+		} `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		t.Fatal(err)
+	}
+	return out.Data.Status
+}
@@ -0,0 +1,130 @@
+package handler
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/minio/minio-go/v7"
+
+	"github.com/mstgnz/cdn/pkg/config"
+	"github.com/mstgnz/cdn/service"
+)
+
+// hashStagingPrefix holds downloads in the staging bucket while their hash is
+// not yet known. The tus sweep removes whatever a crash leaves behind there.
+const hashStagingPrefix = "hashed/"
+
+// generatedName names an upload the caller did not name: by the bucket's key
+// template when there is no path, and "<uuid>.<ext>" under the path, or at the
+// top of the bucket, otherwise. sum is the stored bytes' SHA-256, for
+// templates that use it.
+func generatedName(bucket, path, ext, sum string) (string, string) {
+	if tpl := templateFor(bucket, path, ""); tpl != "" {
+		return templatedName(tpl, ext, sum)
+	}
+	imageName := uuid.New().String() + "." + service.SanitizeObjectName(ext)
+	if path = strings.Trim(path, "/"); path != "" {
+		return imageName, service.SanitizeObjectName(path) + "/" + imageName
+	}
+	return imageName, imageName
+}
+
+// templateFor returns the bucket's key template when it applies to an upload,
+// which is when the caller chose neither a path nor a key. Either of those is
+// the caller deciding where the object goes, and the template only decides
+// what nobody else has.
+func templateFor(bucket, path, key string) config.KeyTemplate {
+	if strings.Trim(path, "/") != "" || key != "" {
+		return ""
+	}
+	return config.KeyTemplateFor(bucket)
+}
+
+// templatedName expands tpl for a file with extension ext whose stored bytes
+// hash to sum, which may be empty for a template that does not use it. The
+// image name is the last segment, as it is for every other name.
+func templatedName(tpl config.KeyTemplate, ext, sum string) (string, string) {
+	objectName := tpl.Expand(config.KeyValues{
+		Time:   time.Now(),
+		UUID:   uuid.New().String(),
+		SHA256: sum,
+		Ext:    service.SanitizeObjectName(ext),
+	})
+	return objectName[strings.LastIndex(objectName, "/")+1:], objectName
+}
+
+// readerSHA256 hashes what is left of rs and rewinds it for whoever sends it.
+// Uploads held by the server (a multipart file, optimised bytes) can be read
+// twice; a download cannot, see storeStreamedByHash.
+func readerSHA256(rs io.ReadSeeker) (string, error) {
+	sum := sha256.New()
+	if _, err := io.Copy(sum, rs); err != nil {
+		return "", err
+	}
+	if _, err := rs.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(sum.Sum(nil)), nil
+}
+
+// hashedStore is the outcome of storeStreamedByHash.
+type hashedStore struct {
+	streamedUpload
+	imageName, objectName string
+	archive               string
+	duplicate             bool   // objectName is an existing object; nothing was stored
+	reference             string // the duplicate's dedup reference
+}
+
+// storeStreamedByHash is storeStreamed for a download whose key, or whose
+// deduplication, needs its hash. The hash is only known once the last byte has
+// gone by, and by then the bytes are in MinIO, so they go to the staging bucket
+// first. Once the hash is known they are either dropped for an existing copy
+// or copied into place server-side under the name that name gives, with attrs.
+// The bytes still pass through this process once.
+func (i image) storeStreamedByHash(ctx context.Context, store service.ObjectStore, bucket string, name func(sum string) (string, string), dedup bool, attrs objectAttrs, r io.Reader) (hashedStore, error) {
+	staging := service.TusStagingBucket()
+	stagingKey := hashStagingPrefix + uuid.New().String()
+
+	up, err := streamUploadFor(ctx, store, bucket, staging, stagingKey, r, minio.PutObjectOptions{})
+	if err != nil {
+		return hashedStore{}, err
+	}
+	defer func() { _ = store.RemoveObject(ctx, staging, stagingKey, minio.RemoveObjectOptions{}) }()
+
+	out := hashedStore{streamedUpload: up}
+	if dedup {
+		if existing, ref, ok := i.reuseDuplicate(ctx, store, bucket, up.SHA256); ok {
+			out.objectName, out.reference, out.duplicate = existing, ref, true
+			return out, nil
+		}
+	}
+
+	out.imageName, out.objectName = name(up.SHA256)
+	meta := map[string]string{"Content-Type": up.ContentType, service.MetaSHA256: up.SHA256}
+	info, err := store.CopyObject(ctx,
+		attrs.copyOptions(minio.CopyDestOptions{
+			Bucket:          bucket,
+			Object:          out.objectName,
+			ReplaceMetadata: true,
+			UserMetadata:    meta,
+		}),
+		minio.CopySrcOptions{Bucket: staging, Object: stagingKey})
+	if err != nil {
+		return hashedStore{}, err
+	}
+	out.ETag = info.ETag
+	out.VersionID = info.VersionID
+
+	i.afterStore(ctx, bucket, out.objectName, false)
+	if dedup {
+		i.claimDigest(ctx, bucket, "", up.SHA256, out.objectName)
+	}
+	out.archive = i.archiveFromStore(ctx, store, bucket, out.objectName, up.SHA256, out.VersionID)
+	return out, nil
+}
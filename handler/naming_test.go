@@ -0,0 +1,63 @@
+package handler
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+	"testing"
+
+	"github.com/mstgnz/cdn/service"
+)
+
+// The template lays out only what nobody named: a path or a key is the caller
+// choosing, and wins.
+func TestTemplateForOnlyWhenUnnamed(t *testing.T) {
+	loadPresetPolicy(t, `{"buckets":[{"bucket":"media","key_template":"{yyyy}/{uuid}.{ext}"}]}`)
+
+	if templateFor("media", "", "") == "" {
+		t.Error("unnamed upload ignores the template")
+	}
+	if templateFor("media", "/avatars/", "") != "" || templateFor("media", "", "logo.png") != "" {
+		t.Error("template overrides a path or a key")
+	}
+	if templateFor("other", "", "") != "" {
+		t.Error("template applied to a bucket without one")
+	}
+}
+
+// A download named by its hash is staged, copied into place under the name
+// the hash gives, and leaves nothing behind in the staging bucket.
+func TestStoreStreamedByHashNamesByContent(t *testing.T) {
+	loadPresetPolicy(t, `{"buckets":[{"bucket":"docs","key_template":"{sha256:2}/{sha256}.{ext}"}]}`)
+	store := newMemStore("docs", service.TusStagingBucket())
+	archive := newMemArchive()
+	img := image{archive: archive}
+	csv := []byte(strings.Repeat("id,name\n1,a\n", 100))
+	sum := sha256.Sum256(csv)
+	want := hex.EncodeToString(sum[:])
+
+	out, err := img.storeStreamedByHash(context.Background(), store, "docs", func(sum string) (string, string) {
+		return generatedName("docs", "", "csv", sum)
+	}, false, objectAttrs{}, bytes.NewReader(csv))
+	if err != nil {
+		t.Fatal(err)
+	}
+	up, imageName, objectName, archived := out.streamedUpload, out.imageName, out.objectName, out.archive
+	if objectName != want[:2]+"/"+want+".csv" || imageName != want+".csv" {
+		t.Fatalf("named (%q, %q)", imageName, objectName)
+	}
+	if up.SHA256 != want {
+		t.Errorf("SHA256 = %s", up.SHA256)
+	}
+	if got, _ := store.get("docs", objectName); !bytes.Equal(got, csv) {
+		t.Error("stored bytes differ from the download")
+	}
+	if keys := store.keys(service.TusStagingBucket()); len(keys) != 0 {
+		t.Errorf("staging left behind %v", keys)
+	}
+	if archived != "Archive Successfully Uploaded" {
+		t.Errorf("archive = %q", archived)
+	}
+}
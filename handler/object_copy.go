@@ -0,0 +1,319 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"math"
+	"mime/multipart"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/minio/minio-go/v7"
+
+	"github.com/mstgnz/cdn/pkg/config"
+	"github.com/mstgnz/cdn/pkg/validator"
+	"github.com/mstgnz/cdn/service"
+)
+
+// CopyRequest is the body of POST /objects/copy and /objects/move. ToBucket
+// defaults to Bucket, which makes a move within a bucket a rename. Overwrite
+// and IfMatch apply to the destination the way they apply to an upload under
+// a caller-chosen key.
+type CopyRequest struct {
+	Bucket    string `json:"bucket"`
+	Key       string `json:"key"`
+	ToBucket  string `json:"to_bucket"`
+	ToKey     string `json:"to_key"`
+	Overwrite string `json:"overwrite"`
+	IfMatch   string `json:"if_match"`
+
+	// Reference is, for a move, the dedup reference the source's upload was
+	// answered with; see DeleteImage.
+	Reference string `json:"reference"`
+}
+
+// CopyObject copies an object to a new key, in the same bucket or another,
+// without it passing through the service or the caller.
+func (i image) CopyObject(c *fiber.Ctx) error {
+	return i.copyOrMove(c, false)
+}
+
+// MoveObject is CopyObject followed by a delete of the source, which is how a
+// rename or a folder reorganisation is done.
+func (i image) MoveObject(c *fiber.Ctx) error {
+	return i.copyOrMove(c, true)
+}
+
+func (i image) copyOrMove(c *fiber.Ctx, move bool) error {
+	var req CopyRequest
+	if err := c.BodyParser(&req); err != nil {
+		return service.Response(c, fiber.StatusBadRequest, false, "invalid request body", nil)
+	}
+
+	// Both sides are checked, so a bucket token can copy and move inside its
+	// own bucket and nowhere else, in either direction.
+	srcBucket, err := resolveBucket(c, req.Bucket)
+	if err != nil {
+		return bucketForbidden(c)
+	}
+	dstBucket := srcBucket
+	if strings.TrimSpace(req.ToBucket) != "" {
+		if dstBucket, err = resolveBucket(c, req.ToBucket); err != nil {
+			return bucketForbidden(c)
+		}
+	}
+	if srcBucket == "" {
+		return service.Response(c, fiber.StatusBadRequest, false, "Bucket is required", nil)
+	}
+	if service.InternalBucket(srcBucket) || service.InternalBucket(dstBucket) {
+		return bucketReserved(c)
+	}
+	ifMatch := req.IfMatch
+	if ifMatch == "" {
+		ifMatch = c.Get(fiber.HeaderIfMatch)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+
+	data, kerr := i.copyObject(ctx, service.MinioStore{Client: i.minioClient}, srcBucket, req.Key, dstBucket, req.ToKey, req.Overwrite, ifMatch, move, req.Reference)
+	if kerr != nil {
+		return respondKeyError(c, kerr)
+	}
+	return service.Response(c, fiber.StatusOK, true, "success", data)
+}
+
+// copyObject copies srcKey to dstKey with MinIO's server-side CopyObject, and
+// with move removes the source afterwards.
+//
+// The copy keeps the object's content type, user metadata (its digest
+// included) and tags: CopyObject carries them over unless told to replace
+// them. The destination is held to its bucket's upload policy as an upload
+// would be, since a copy is a way into the bucket; its extension must match
+// the source's, since the content type served is the one the bytes have.
+//
+// The source is read as it was when stat'ed: the copy is conditional on its
+// ETag, so what is moved is what was checked, and a move does not delete a
+// source that was replaced in between.
+//
+// Only objects in MinIO are copied. One only in the archive has to be restored
+// first: the archive keeps no content type, metadata or tags to copy.
+func (i image) copyObject(ctx context.Context, store service.ObjectStore, srcBucket, srcKey, dstBucket, dstKey, overwrite, ifMatch string, move bool, reference string) (map[string]any, *keyError) {
+	for _, key := range []string{srcKey, dstKey} {
+		if key == "" || service.HasUnsafeObjectKey(key) {
+			return nil, &keyError{fiber.StatusBadRequest, "INVALID_KEY", "key and to_key must be safe object keys"}
+		}
+	}
+	if srcBucket == dstBucket && srcKey == dstKey {
+		return nil, &keyError{fiber.StatusBadRequest, "SAME_OBJECT", "the source and the destination are the same object"}
+	}
+	// to_key is chosen by the caller, and can be overwritten like an upload's
+	// key; see keyedObjectName.
+	if config.IsUUIDNamed(dstKey) {
+		return nil, uuidKeyError()
+	}
+	if ext := filepath.Ext(srcKey); !sameExtension(ext, filepath.Ext(dstKey)) {
+		return nil, &keyError{fiber.StatusBadRequest, "KEY_EXTENSION_MISMATCH", "the new key's extension must match the object's (" + ext + ")"}
+	}
+
+	info, err := store.StatObject(ctx, srcBucket, srcKey, minio.StatObjectOptions{})
+	if err != nil {
+		if minio.ToErrorResponse(err).Code != "NoSuchKey" {
+			return nil, &keyError{fiber.StatusBadGateway, "STORAGE_ERROR", err.Error()}
+		}
+		if i.archived(ctx, srcBucket, srcKey) {
+			return nil, &keyError{fiber.StatusNotFound, "OBJECT_NOT_FOUND", "the object is only in the archive; restore it before copying it"}
+		}
+		return nil, &keyError{fiber.StatusNotFound, "OBJECT_NOT_FOUND", "object not found"}
+	}
+	if dstBucket != srcBucket {
+		exists, err := store.BucketExists(ctx, dstBucket)
+		if err != nil {
+			return nil, &keyError{fiber.StatusBadGateway, "STORAGE_ERROR", err.Error()}
+		}
+		if !exists {
+			return nil, &keyError{fiber.StatusNotFound, "BUCKET_NOT_FOUND", "destination bucket not found"}
+		}
+	}
+	if kerr := i.checkCopyPolicy(ctx, store, srcBucket, srcKey, dstBucket, dstKey, info.Size); kerr != nil {
+		return nil, kerr
+	}
+
+	plan, kerr := i.checkOverwrite(ctx, store, dstBucket, dstKey, overwrite, ifMatch)
+	if kerr != nil {
+		return nil, kerr
+	}
+	// CopyObject takes no preconditions on the destination, so the overwrite
+	// policy is checked again right before it (see recheck): close to the
+	// write, but not atomic with it as an upload's If-Match is.
+	err = plan.recheck(ctx, store, dstBucket, dstKey)
+	var copied minio.UploadInfo
+	if err == nil {
+		copied, err = store.CopyObject(ctx,
+			minio.CopyDestOptions{Bucket: dstBucket, Object: dstKey},
+			minio.CopySrcOptions{Bucket: srcBucket, Object: srcKey, MatchETag: info.ETag})
+	}
+	if err != nil {
+		if kerr := plan.failure(err); kerr != nil {
+			return nil, kerr
+		}
+		return nil, &keyError{fiber.StatusBadGateway, "STORAGE_ERROR", "could not copy the object: " + err.Error()}
+	}
+	i.afterStore(ctx, dstBucket, dstKey, plan.replaced)
+
+	sum := info.UserMetadata[service.MetaSHA256]
+	url := strings.TrimSuffix(config.GetEnvOrDefault("APP_URL", "http://localhost:9090"), "/")
+	data := map[string]any{
+		"bucket":      dstBucket,
+		"key":         dstKey,
+		"from_bucket": srcBucket,
+		"from_key":    srcKey,
+		"etag":        copied.ETag,
+		"size":        info.Size,
+		"overwritten": plan.replaced,
+		"link":        url + "/" + dstBucket + "/" + dstKey,
+	}
+	archived := i.archiveCopy(ctx, store, srcBucket, srcKey, dstBucket, dstKey, info.Size, sum, copied.VersionID)
+	if archived != "" {
+		data["archive"] = archived
+	}
+	if move {
+		i.removeMoved(ctx, store, srcBucket, srcKey, reference, archived, data)
+	}
+	return data, nil
+}
+
+// checkCopyPolicy holds a copy to the destination bucket's upload policy.
+//
+// A copy does not come through the API's body limit, so MAX_FILE_SIZE, which
+// stands in for it, does not hold it. A copy inside a bucket is held to no
+// size at all: its policy accepted the object when it was stored, and only the
+// name is new, so only the extension is checked. A copy into another bucket
+// is held to that bucket's byte limits, from the stat, and when the bucket has
+// a policy its content is checked against it too: streamed through checkStream
+// for a file, which holds none of it; decoded for an image, which needs all of
+// it, and is held to MAX_FILE_SIZE for that as an upload is.
+func (i image) checkCopyPolicy(ctx context.Context, store service.ObjectStore, srcBucket, srcKey, dstBucket, dstKey string, size int64) *keyError {
+	policyError := func(err error) *keyError {
+		var valErr *validator.FileValidationError
+		if errors.As(err, &valErr) {
+			return &keyError{fiber.StatusBadRequest, valErr.Code, valErr.Message}
+		}
+		return &keyError{fiber.StatusBadRequest, "INVALID_FILE_CONTENT", err.Error()}
+	}
+	if dstBucket == srcBucket {
+		if err := validator.ValidateName(dstKey, dstBucket); err != nil {
+			return policyError(err)
+		}
+		return nil
+	}
+	isImage := service.IsImageFile(dstKey)
+	maxSize := int64(math.MaxInt64)
+	if isImage {
+		maxSize = int64(config.GetEnvAsIntOrDefault("MAX_FILE_SIZE", int(validator.DefaultMaxFileSize)))
+	}
+	if err := validator.ValidateFileUpTo(&multipart.FileHeader{Filename: dstKey, Size: size}, dstBucket, maxSize); err != nil {
+		return policyError(err)
+	}
+	if config.UploadPolicyFor(dstBucket) == nil {
+		return nil
+	}
+
+	rc, err := store.OpenObject(ctx, srcBucket, srcKey)
+	if err != nil {
+		return &keyError{fiber.StatusBadGateway, "STORAGE_ERROR", "could not read the object: " + err.Error()}
+	}
+	defer rc.Close()
+	if !isImage {
+		_, kerr := i.checkStream(ctx, dstBucket, rc, maxSize)
+		return kerr
+	}
+	content, err := io.ReadAll(io.LimitReader(rc, maxSize+1))
+	if err != nil {
+		return &keyError{fiber.StatusBadGateway, "STORAGE_ERROR", "could not read the object: " + err.Error()}
+	}
+	if err := validator.ValidateContentFor(dstBucket, content); err != nil {
+		return policyError(err)
+	}
+	width, height, err := i.validateImageContent(dstKey, content)
+	if err != nil {
+		return &keyError{fiber.StatusBadRequest, "INVALID_IMAGE_CONTENT", "invalid image content"}
+	}
+	if err := validator.ValidateImageFor(dstBucket, width, height); err != nil {
+		return policyError(err)
+	}
+	return nil
+}
+
+// archiveCopy gives the copy its archived copy, reported the way
+// archiveObject reports an upload's. When the archive holds the source as it
+// is in MinIO, the copy is made inside the archive and verified there;
+// otherwise (never archived, or archived before it was last overwritten) the
+// copy is archived from MinIO, as an upload is.
+//
+// A copy into a versioned bucket is always archived from MinIO: a copy made
+// inside the archive would carry the source's version ID, which means nothing
+// in the destination, and version is the one the copy was given.
+func (i image) archiveCopy(ctx context.Context, store service.ObjectStore, srcBucket, srcKey, dstBucket, dstKey string, size int64, sum, version string) string {
+	if i.archive == nil || !i.archive.InScope(dstBucket) {
+		return ""
+	}
+	archived, err := i.archive.Stat(ctx, srcBucket, srcKey)
+	if err != nil || archived.Size != size || archived.SHA256 != sum || version != "" {
+		return i.archiveFromStore(ctx, store, dstBucket, dstKey, sum, version)
+	}
+	if err := i.archive.Copy(ctx, srcBucket, srcKey, dstBucket, dstKey); err != nil {
+		log.Printf("archive: failed to copy %s/%s to %s/%s: %v", srcBucket, srcKey, dstBucket, dstKey, err)
+		return "Archive Failed " + err.Error()
+	}
+	return "Archive Successfully Copied"
+}
+
+// removeMoved deletes the source of a move once its copy is stored, the way
+// DeleteImage deletes: a deduplicated object gives back this reference and
+// stays while other uploads hold it, and a removed one has its caches purged.
+// The copy is done by now, so a failure here is reported in data rather than
+// as a failed request, which a retry could not fix.
+//
+// The source's archived copy is deleted too once the copy's own archived copy
+// is verified (archived is archiveCopy's report), so the archive does not keep
+// answering on the old URL. When the copy was not archived, because it failed
+// or its bucket is out of scope, the source's archived copy stays: it is then
+// the only one, and a move must not lose what a copy would have kept.
+func (i image) removeMoved(ctx context.Context, store service.ObjectStore, bucket, key, reference, archived string, data map[string]any) {
+	data["source_removed"] = false
+	refs, err := i.releaseReference(ctx, store, bucket, key, reference)
+	if err != nil {
+		data["source_error"] = "could not update the reference count: " + err.Error()
+		return
+	}
+	if refs > 0 {
+		data["remaining_references"] = refs
+		return
+	}
+	if err := store.RemoveObject(ctx, bucket, key, minio.RemoveObjectOptions{}); err != nil {
+		data["source_error"] = "could not remove the source: " + err.Error()
+		return
+	}
+	i.purgeCaches(ctx, service.PurgeMoved, bucket, key)
+	data["source_removed"] = true
+
+	if i.archive == nil || !i.archive.InScope(bucket) || i.awsService == nil {
+		return
+	}
+	if archived != "Archive Successfully Copied" && archived != "Archive Successfully Uploaded" {
+		data["source_archive_removed"] = false
+		return
+	}
+	if err := i.awsService.DeleteObjects(bucket, []string{key}); err != nil {
+		log.Printf("archive: failed to delete moved %s/%s: %v", bucket, key, err)
+		data["source_archive_removed"] = false
+		data["source_archive_error"] = err.Error()
+		return
+	}
+	data["source_archive_removed"] = true
+}
@@ -0,0 +1,223 @@
+package handler
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/minio/minio-go/v7"
+
+	"github.com/mstgnz/cdn/service"
+)
+
+func newCopyImage(t *testing.T) (image, *memStore, *memArchive, *recordingNotifier) {
+	t.Helper()
+	store := newMemStore("photos", "docs")
+	archive := newMemArchive()
+	notifier := &recordingNotifier{}
+	return image{archive: archive, notifier: notifier}, store, archive, notifier
+}
+
+// A copy keeps everything the object was stored with, leaves the source
+// alone, and is copied inside the archive when the archive holds the source.
+func TestCopyObjectKeepsMetadataAndTags(t *testing.T) {
+	ctx := context.Background()
+	img, store, archive, _ := newCopyImage(t)
+	attrs, _ := newObjectAttrs(map[string]string{"alt": "A cat"}, map[string]string{"team": "web"})
+	if _, err := store.PutObject(ctx, "photos", "2025/cat.png", bytes.NewReader([]byte("png")), 3,
+		attrs.options(minio.PutObjectOptions{ContentType: "image/png", UserMetadata: digestMeta("abc")})); err != nil {
+		t.Fatal(err)
+	}
+	_ = archive.Put(ctx, "photos", "2025/cat.png", bytes.NewReader([]byte("png")), "abc", "")
+
+	data, kerr := img.copyObject(ctx, store, "photos", "2025/cat.png", "photos", "pets/cat.png", "", "", false, "")
+	if kerr != nil {
+		t.Fatal(kerr)
+	}
+	if data["archive"] != "Archive Successfully Copied" || data["overwritten"] != false {
+		t.Errorf("data = %v", data)
+	}
+	o, ok := store.object("photos", "pets/cat.png")
+	if !ok || o.contentType != "image/png" || o.meta[service.MetaSHA256] != "abc" || userMeta(o.meta)["alt"] != "A cat" || o.tags["team"] != "web" {
+		t.Errorf("copy stored with %+v", o)
+	}
+	if _, ok := store.get("photos", "2025/cat.png"); !ok {
+		t.Error("a copy removed its source")
+	}
+	if info, err := archive.Stat(ctx, "photos", "pets/cat.png"); err != nil || info.SHA256 != "abc" {
+		t.Errorf("archived copy = (%+v, %v)", info, err)
+	}
+
+	// The destination now exists, so a second copy is a conflict unless asked
+	// to replace it.
+	if _, kerr := img.copyObject(ctx, store, "photos", "2025/cat.png", "photos", "pets/cat.png", "", "", false, ""); kerr == nil || kerr.code != "KEY_EXISTS" {
+		t.Errorf("existing destination: %v", kerr)
+	}
+	if data, kerr := img.copyObject(ctx, store, "photos", "2025/cat.png", "photos", "pets/cat.png", overwriteAlways, "", false, ""); kerr != nil || data["overwritten"] != true {
+		t.Errorf("overwrite=always: (%v, %v)", data, kerr)
+	}
+}
+
+// A move is a copy and a delete: the old key is gone and purged upstream as
+// moved, and once the copy is archived the source's archived copy goes too.
+func TestMoveObjectRemovesAndPurgesTheSource(t *testing.T) {
+	ctx := context.Background()
+	img, store, archive, notifier := newCopyImage(t)
+	aws := &mockAwsService{}
+	img.awsService = aws
+	putObjects(t, store, "photos", "old/report.csv")
+
+	data, kerr := img.copyObject(ctx, store, "photos", "old/report.csv", "docs", "2026/report.csv", "", "", true, "")
+	if kerr != nil {
+		t.Fatal(kerr)
+	}
+	if data["source_removed"] != true {
+		t.Errorf("data = %v", data)
+	}
+	if _, ok := store.get("photos", "old/report.csv"); ok {
+		t.Error("the source survived the move")
+	}
+	if got, _ := store.get("docs", "2026/report.csv"); string(got) != "old/report.csv" {
+		t.Errorf("moved bytes = %q", got)
+	}
+	if len(notifier.events) != 1 || notifier.events[0].Reason != service.PurgeMoved || notifier.events[0].Key != "old/report.csv" {
+		t.Errorf("upstream events = %+v", notifier.events)
+	}
+	// Never archived before, so the copy is archived from MinIO.
+	if _, err := archive.Stat(ctx, "docs", "2026/report.csv"); err != nil {
+		t.Errorf("destination not archived: %v", err)
+	}
+	if data["source_archive_removed"] != true || len(aws.deleted) != 1 || aws.deleted[0] != "old/report.csv" {
+		t.Errorf("source archive: data = %v, deleted = %v", data, aws.deleted)
+	}
+}
+
+// A move whose copy could not be archived keeps the source's archived copy,
+// which is then the only one.
+func TestMoveObjectKeepsTheArchiveWhenTheCopyIsNotArchived(t *testing.T) {
+	ctx := context.Background()
+	img, store, _, _ := newCopyImage(t)
+	aws := &mockAwsService{}
+	img.awsService = aws
+	putObjects(t, store, "photos", "old/report.csv")
+
+	data := map[string]any{}
+	img.removeMoved(ctx, store, "photos", "old/report.csv", "", "Archive Failed timeout", data)
+	if data["source_removed"] != true || data["source_archive_removed"] != false || len(aws.deleted) != 0 {
+		t.Errorf("data = %v, deleted = %v", data, aws.deleted)
+	}
+}
+
+// A destination that appears between the overwrite check and the copy is not
+// replaced under "never": the copy carries no precondition, so it is checked
+// again right before it.
+func TestCopyObjectRechecksTheDestination(t *testing.T) {
+	ctx := context.Background()
+	img, store, _, _ := newCopyImage(t)
+	putObjects(t, store, "photos", "a.csv")
+
+	plan, kerr := img.checkOverwrite(ctx, store, "photos", "b.csv", "", "")
+	if kerr != nil {
+		t.Fatal(kerr)
+	}
+	putObjects(t, store, "photos", "b.csv")
+	err := plan.recheck(ctx, store, "photos", "b.csv")
+	if kerr := plan.failure(err); kerr == nil || kerr.code != "KEY_EXISTS" {
+		t.Errorf("recheck after a racing write = %v", err)
+	}
+	if err := plan.recheck(ctx, store, "photos", "c.csv"); err != nil {
+		t.Errorf("recheck of a free key = %v", err)
+	}
+}
+
+// A deduplicated object shared by other uploads is copied, and stays for them.
+func TestMoveObjectKeepsASharedSource(t *testing.T) {
+	ctx := context.Background()
+	img, store := newDedupImage(t)
+	img.notifier = &recordingNotifier{}
+	sum := storeAs(t, img, store, "first.png", []byte("the company logo"))
+	if _, _, ok := img.reuseDuplicate(ctx, store, "logos", sum); !ok {
+		t.Fatal("no second reference")
+	}
+
+	data, kerr := img.copyObject(ctx, store, "logos", "first.png", "logos", "brand/logo.png", "", "", true, "")
+	if kerr != nil {
+		t.Fatal(kerr)
+	}
+	if data["source_removed"] != false || data["remaining_references"] != 1 {
+		t.Errorf("data = %v", data)
+	}
+	if _, ok := store.get("logos", "first.png"); !ok {
+		t.Error("a shared object was removed")
+	}
+}
+
+func TestCopyObjectRefusals(t *testing.T) {
+	ctx := context.Background()
+	img, store, _, _ := newCopyImage(t)
+	putObjects(t, store, "photos", "a.png", "b.csv")
+	loadPresetPolicy(t, `{"buckets":[{"bucket":"docs","upload":{"mime_types":["application/pdf"]}}]}`)
+
+	cases := []struct {
+		name                           string
+		srcBucket, src, dstBucket, dst string
+		status                         int
+		code                           string
+	}{
+		{"same object", "photos", "a.png", "photos", "a.png", fiber.StatusBadRequest, "SAME_OBJECT"},
+		{"extension change", "photos", "a.png", "photos", "a.jpg", fiber.StatusBadRequest, "KEY_EXTENSION_MISMATCH"},
+		{"unsafe key", "photos", "a.png", "photos", "../a.png", fiber.StatusBadRequest, "INVALID_KEY"},
+		{"uuid-named key", "photos", "a.png", "photos", "x/3f2b8c1e-9a4d-4c7e-8f10-2b3c4d5e6f70.png", fiber.StatusBadRequest, "RESERVED_KEY"},
+		{"missing source", "photos", "c.png", "photos", "d.png", fiber.StatusNotFound, "OBJECT_NOT_FOUND"},
+		{"missing bucket", "photos", "a.png", "nowhere", "a.png", fiber.StatusNotFound, "BUCKET_NOT_FOUND"},
+		{"destination policy", "photos", "b.csv", "docs", "b.csv", fiber.StatusBadRequest, "INVALID_MIME_TYPE"},
+	}
+	for _, tc := range cases {
+		_, kerr := img.copyObject(ctx, store, tc.srcBucket, tc.src, tc.dstBucket, tc.dst, "", "", false, "")
+		if kerr == nil || kerr.status != tc.status || kerr.code != tc.code {
+			t.Errorf("%s: %v, want %d %s", tc.name, kerr, tc.status, tc.code)
+		}
+	}
+	if keys := store.keys("docs"); len(keys) != 0 {
+		t.Errorf("a refused copy stored %v", keys)
+	}
+}
+
+// A copy never came through the body limit MAX_FILE_SIZE stands for. Inside
+// its bucket it is held to no size; into another, to that bucket's policy,
+// and a file's content is streamed through the checks, not read whole.
+func TestCopyObjectSizeLimits(t *testing.T) {
+	ctx := context.Background()
+	t.Setenv("MAX_FILE_SIZE", "64")
+	img, store, _, _ := newCopyImage(t)
+	loadPresetPolicy(t, `{"buckets":[{"bucket":"docs","upload":{"max_bytes":4096}}]}`)
+	big := []byte(strings.Repeat("id,name\n", 100))
+	putObjectData(t, store, "photos", "big.csv", big)
+
+	if _, kerr := img.copyObject(ctx, store, "photos", "big.csv", "photos", "copy.csv", "", "", false, ""); kerr != nil {
+		t.Fatalf("copy within the bucket: %v", kerr)
+	}
+	if _, kerr := img.copyObject(ctx, store, "photos", "big.csv", "docs", "from-photos.csv", "", "", false, ""); kerr != nil {
+		t.Fatalf("copy within the destination's policy: %v", kerr)
+	}
+
+	huge := []byte(strings.Repeat("id,name\n", 1000))
+	bad := append(bytes.Repeat([]byte("a"), 600), 0xff, 0xfe)
+	putObjectData(t, store, "photos", "huge.csv", huge)
+	putObjectData(t, store, "photos", "bad.csv", bad)
+	if _, kerr := img.copyObject(ctx, store, "photos", "huge.csv", "docs", "huge.csv", "", "", false, ""); kerr == nil || kerr.code != "FILE_TOO_LARGE" {
+		t.Errorf("copy past the destination's max_bytes = %v, want FILE_TOO_LARGE", kerr)
+	}
+	if _, kerr := img.copyObject(ctx, store, "photos", "bad.csv", "docs", "bad.csv", "", "", false, ""); kerr == nil || kerr.status != fiber.StatusBadRequest {
+		t.Errorf("copy of invalid content = %v, want 400", kerr)
+	}
+}
+
+func putObjectData(t *testing.T, store *memStore, bucket, key string, data []byte) {
+	t.Helper()
+	if _, err := store.PutObject(context.Background(), bucket, key, bytes.NewReader(data), int64(len(data)), minio.PutObjectOptions{}); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,257 @@
+package handler
+
+import (
+	"context"
+	"path/filepath"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/minio/minio-go/v7"
+
+	"github.com/mstgnz/cdn/pkg/config"
+	"github.com/mstgnz/cdn/service"
+)
+
+// Overwrite policies for a caller-chosen key.
+const (
+	overwriteNever   = "never"    // the default: an existing key is a conflict
+	overwriteAlways  = "always"   // replace whatever is there
+	overwriteIfMatch = "if-match" // replace only the version the caller has seen
+)
+
+// keyError is a refused key or overwrite, carrying the status and code the
+// handler answers with. It is an error rather than a written response because
+// service.Response returns nil either way, which would read as success.
+type keyError struct {
+	status  int
+	code    string
+	message string
+}
+
+func (e *keyError) Error() string { return e.message }
+
+// respondKeyError answers a keyError.
+func respondKeyError(c *fiber.Ctx, err *keyError) error {
+	return service.Response(c, err.status, false, err.message, map[string]string{"code": err.code})
+}
+
+// sameExtension treats the spellings of one format as one extension, so a
+// photo.jpeg can be stored as avatar.jpg.
+func sameExtension(a, b string) bool {
+	canonical := func(ext string) string {
+		ext = strings.ToLower(strings.TrimPrefix(ext, "."))
+		switch ext {
+		case "jpeg":
+			return "jpg"
+		case "tif":
+			return "tiff"
+		}
+		return ext
+	}
+	return canonical(a) == canonical(b)
+}
+
+// keyedObjectName turns a caller-chosen key into an object name, the way a
+// random name is turned into one: sanitised, and under path when there is one.
+// It returns the last segment as the image name, like the random path does.
+//
+// The key's extension has to be the file's. Content is validated against the
+// extension of the uploaded file, and the read path decides what to do with an
+// object (resize it or not, sandbox it or not) from the key's; letting the two
+// differ would store a validated PNG under a name that says .html. A key with
+// no extension gets the file's.
+//
+// A key named like a generated upload, starting with a UUID, is refused. The
+// cache policy's uuid_named rules serve such names as immutable, which holds
+// for a random name that is never written twice and not for a key its owner
+// can overwrite: the new bytes would sit behind the old ones in every browser
+// and CDN for as long as the rule says.
+func keyedObjectName(path, key, ext string) (string, string, *keyError) {
+	// Checked before and after sanitising: a traversal is refused rather than
+	// quietly rewritten into some other key, and sanitising can leave an edge
+	// slash behind where it strips a dot.
+	if service.HasUnsafeObjectKey(key) {
+		return "", "", &keyError{fiber.StatusBadRequest, "INVALID_KEY", "invalid object key"}
+	}
+	key = strings.Trim(service.SanitizeObjectName(strings.Trim(key, "/")), "/")
+	if service.HasUnsafeObjectKey(key) || strings.Contains(key, "//") {
+		return "", "", &keyError{fiber.StatusBadRequest, "INVALID_KEY", "invalid object key"}
+	}
+	if config.IsUUIDNamed(key) {
+		return "", "", uuidKeyError()
+	}
+	switch keyExt := filepath.Ext(key); {
+	case keyExt == "":
+		key += "." + service.SanitizeObjectName(ext)
+	case !sameExtension(keyExt, ext):
+		return "", "", &keyError{fiber.StatusBadRequest, "KEY_EXTENSION_MISMATCH", "the key's extension must match the file's (." + ext + ")"}
+	}
+
+	objectName := key
+	if path = strings.Trim(path, "/"); path != "" {
+		objectName = service.SanitizeObjectName(path) + "/" + key
+	}
+	return objectName[strings.LastIndex(objectName, "/")+1:], objectName, nil
+}
+
+// uuidKeyError refuses a caller-chosen key named like a generated upload; see
+// keyedObjectName.
+func uuidKeyError() *keyError {
+	return &keyError{fiber.StatusBadRequest, "RESERVED_KEY", "keys starting with a UUID are reserved for generated names"}
+}
+
+// overwritePlan is what an upload under a caller-chosen key carries from the
+// check to the write. The zero value, used for random names, changes nothing.
+type overwritePlan struct {
+	policy   string
+	ifMatch  string
+	replaced bool // an object existed under the key
+}
+
+// options adds the write-time half of the policy to opts: If-Match for
+// "if-match", and If-None-Match: * for "never", so of two uploads racing for
+// the same new key only the first creates it. The * has to go out bare; a
+// quoted "*" is an ETag that matches nothing, which minio-go sent before
+// v7.0.78. The headers are part of opts, so a streamed upload carries them to
+// the request that completes its multipart upload too, which is where MinIO
+// decides.
+func (p overwritePlan) options(opts minio.PutObjectOptions) minio.PutObjectOptions {
+	switch p.policy {
+	case overwriteIfMatch:
+		opts.SetMatchETag(p.ifMatch)
+	case overwriteNever:
+		opts.SetMatchETagExcept("*")
+	}
+	return opts
+}
+
+// mayReplace reports whether a write under the plan can replace an object:
+// one under a random name or with "never" only ever creates one.
+func (p overwritePlan) mayReplace() bool {
+	return p.policy == overwriteAlways || p.policy == overwriteIfMatch
+}
+
+// recheck is the write-time half of "if-match" and "never" for a write that
+// cannot carry If-Match or If-None-Match, a server-side copy: the key is
+// stat'ed again just before it. A changed object, or under "never" one that
+// has appeared, fails like a refused conditional write, for failure.
+//
+// Unlike the headers this is not atomic: a write that lands between the stat
+// and the copy is still replaced. It narrows the window from the whole request
+// to one round trip, which is as far as MinIO's CopyObject allows.
+func (p overwritePlan) recheck(ctx context.Context, store service.ObjectStore, bucket, objectName string) error {
+	if p.policy != overwriteIfMatch && p.policy != overwriteNever {
+		return nil
+	}
+	info, err := store.StatObject(ctx, bucket, objectName, minio.StatObjectOptions{})
+	if err != nil && minio.ToErrorResponse(err).Code != "NoSuchKey" {
+		return err
+	}
+	switch {
+	case p.policy == overwriteNever && err != nil:
+		return nil
+	case p.policy == overwriteIfMatch && err == nil && normalizeETag(info.ETag) == p.ifMatch:
+		return nil
+	}
+	return minio.ErrorResponse{Code: "PreconditionFailed", Message: "At least one of the pre-conditions you specified did not hold"}
+}
+
+// keyedUpload resolves an upload's key and applies its overwrite policy before
+// anything is written. It returns the image name, the object name and the plan
+// for the write.
+func (i image) keyedUpload(ctx context.Context, bucket, path, key, ext, policy, ifMatch string) (string, string, overwritePlan, *keyError) {
+	imageName, objectName, kerr := keyedObjectName(path, key, ext)
+	if kerr != nil {
+		return "", "", overwritePlan{}, kerr
+	}
+	plan, kerr := i.checkOverwrite(ctx, service.MinioStore{Client: i.minioClient}, bucket, objectName, policy, ifMatch)
+	return imageName, objectName, plan, kerr
+}
+
+// checkOverwrite applies an overwrite policy to objectName.
+//
+// Existing means servable: an object the retention job moved to the archive
+// still answers on its URL, so "never" refuses it too. "if-match" can only be
+// judged against MinIO's ETag, which an archive-only object no longer has, so
+// such an object fails the precondition.
+//
+// The check and the write are two requests. The write also carries the
+// policy as a precondition (see overwritePlan.options): If-Match for
+// "if-match", If-None-Match: * for "never". A MinIO that supports conditional
+// writes refuses the write when the key changed since the check; one that
+// predates them ignores the headers, and two uploads racing for the same key
+// can then both pass with the later one winning. A server-side copy carries no
+// precondition of its own; see overwritePlan.recheck.
+func (i image) checkOverwrite(ctx context.Context, store service.ObjectStore, bucket, objectName, policy, ifMatch string) (overwritePlan, *keyError) {
+	plan := overwritePlan{policy: policy, ifMatch: normalizeETag(ifMatch)}
+	switch policy {
+	case "":
+		plan.policy = overwriteNever
+	case overwriteNever, overwriteAlways, overwriteIfMatch:
+	default:
+		return plan, &keyError{fiber.StatusBadRequest, "INVALID_OVERWRITE", "overwrite must be never, always or if-match"}
+	}
+	if plan.policy == overwriteIfMatch && plan.ifMatch == "" {
+		return plan, &keyError{fiber.StatusBadRequest, "IF_MATCH_REQUIRED", "overwrite=if-match needs the current ETag in if_match or If-Match"}
+	}
+
+	info, err := store.StatObject(ctx, bucket, objectName, minio.StatObjectOptions{})
+	local := err == nil
+	if err != nil && minio.ToErrorResponse(err).Code != "NoSuchKey" {
+		return plan, &keyError{fiber.StatusBadGateway, "STORAGE_ERROR", "could not check for an existing object: " + err.Error()}
+	}
+	archived := false
+	if !local && i.archive != nil && i.archive.Enabled() {
+		_, aerr := i.archive.Stat(ctx, bucket, objectName)
+		archived = aerr == nil
+	}
+	plan.replaced = local || archived
+
+	switch plan.policy {
+	case overwriteIfMatch:
+		if !local || normalizeETag(info.ETag) != plan.ifMatch {
+			return plan, &keyError{fiber.StatusPreconditionFailed, "PRECONDITION_FAILED", "the object has changed or does not exist"}
+		}
+	case overwriteNever:
+		if plan.replaced {
+			return plan, &keyError{fiber.StatusConflict, "KEY_EXISTS", "an object with this key already exists"}
+		}
+	}
+	return plan, nil
+}
+
+// failure is putFailure for a write under the plan: a "never" write refused
+// on its precondition lost the race for a new key, which is a conflict.
+func (p overwritePlan) failure(err error) *keyError {
+	if p.policy == overwriteNever && minio.ToErrorResponse(err).Code == "PreconditionFailed" {
+		return &keyError{fiber.StatusConflict, "KEY_EXISTS", "an object with this key already exists"}
+	}
+	return putFailure(err)
+}
+
+// putFailure maps a failed write to a keyError when the store refused it on a
+// precondition, which is how a lost "if-match" race surfaces.
+func putFailure(err error) *keyError {
+	if minio.ToErrorResponse(err).Code == "PreconditionFailed" {
+		return &keyError{fiber.StatusPreconditionFailed, "PRECONDITION_FAILED", "the object has changed or does not exist"}
+	}
+	return nil
+}
+
+// normalizeETag accepts an ETag as a client is likely to send it back: quoted,
+// weak, or bare.
+func normalizeETag(etag string) string {
+	return strings.Trim(strings.TrimPrefix(strings.TrimSpace(etag), "W/"), `"`)
+}
+
+// afterStore is what every upload does once its object is in MinIO. A
+// replaced object additionally has every cached copy of its old bytes dropped:
+// variants are cached by key, not by content, so without this the new original
+// would be served next to the old one's thumbnails. Called before presets are
+// scheduled, since the purge also clears their status.
+func (i image) afterStore(ctx context.Context, bucket, objectName string, replaced bool) {
+	if replaced {
+		i.purgeCaches(ctx, service.PurgeOverwritten, bucket, objectName)
+	}
+	i.forgetMissing(ctx, bucket, objectName)
+}
@@ -0,0 +1,164 @@
+package handler
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/minio/minio-go/v7"
+
+	"github.com/mstgnz/cdn/service"
+)
+
+func TestKeyedObjectName(t *testing.T) {
+	for name, tc := range map[string]struct {
+		path, key, ext     string
+		wantImage, wantObj string
+		wantCode           string
+	}{
+		"plain":           {"", "user-123.jpg", "jpg", "user-123.jpg", "user-123.jpg", ""},
+		"under a path":    {"/avatars/", "user-123.png", "png", "user-123.png", "avatars/user-123.png", ""},
+		"nested key":      {"", "/2024/logo.svg/", "svg", "logo.svg", "2024/logo.svg", ""},
+		"extension added": {"", "user-123", "webp", "user-123.webp", "user-123.webp", ""},
+		"jpeg is jpg":     {"", "photo.JPG", "jpeg", "photo.JPG", "photo.JPG", ""},
+		"sanitised":       {"", "my avatar;.png", "png", "my_avatar.png", "my_avatar.png", ""},
+		"other extension": {"", "evil.html", "png", "", "", "KEY_EXTENSION_MISMATCH"},
+		"traversal":       {"", "../other-bucket/x.png", "png", "", "", "INVALID_KEY"},
+		"empty segment":   {"", "a//b.png", "png", "", "", "INVALID_KEY"},
+		"uuid-named":      {"", "2026/3f2b8c1e-9a4d-4c7e-8f10-2b3c4d5e6f70.png", "png", "", "", "RESERVED_KEY"},
+		"uuid, no ext":    {"", "3f2b8c1e-9a4d-4c7e-8f10-2b3c4d5e6f70", "png", "", "", "RESERVED_KEY"},
+		"uuid-prefixed":   {"", "3f2b8c1e-9a4d-4c7e-8f10-2b3c4d5e6f70_logo.png", "png", "", "", "RESERVED_KEY"},
+		"uuid mid-name":   {"", "logo-3f2b8c1e-9a4d-4c7e-8f10-2b3c4d5e6f70.png", "png", "logo-3f2b8c1e-9a4d-4c7e-8f10-2b3c4d5e6f70.png", "logo-3f2b8c1e-9a4d-4c7e-8f10-2b3c4d5e6f70.png", ""},
+	} {
+		t.Run(name, func(t *testing.T) {
+			img, obj, kerr := keyedObjectName(tc.path, tc.key, tc.ext)
+			if tc.wantCode != "" {
+				if kerr == nil || kerr.code != tc.wantCode {
+					t.Fatalf("err = %v, want %s", kerr, tc.wantCode)
+				}
+				return
+			}
+			if kerr != nil {
+				t.Fatal(kerr)
+			}
+			if img != tc.wantImage || obj != tc.wantObj {
+				t.Fatalf("got (%q, %q), want (%q, %q)", img, obj, tc.wantImage, tc.wantObj)
+			}
+		})
+	}
+}
+
+func TestCheckOverwrite(t *testing.T) {
+	ctx := context.Background()
+	store := newMemStore("avatars")
+	archive := newMemArchive()
+	img := image{archive: archive}
+	put := func(key string) {
+		if _, err := store.PutObject(ctx, "avatars", key, strings.NewReader("x"), 1, minio.PutObjectOptions{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	put("taken.png")
+	_ = archive.Put(ctx, "avatars", "cold.png", bytes.NewReader([]byte("x")), "", "") // evicted from MinIO
+
+	for name, tc := range map[string]struct {
+		key, policy, ifMatch string
+		wantCode             string
+		wantReplaced         bool
+	}{
+		"new key":                {"new.png", "", "", "", false},
+		"never refuses":          {"taken.png", "never", "", "KEY_EXISTS", true},
+		"default is never":       {"taken.png", "", "", "KEY_EXISTS", true},
+		"never sees the archive": {"cold.png", "never", "", "KEY_EXISTS", true},
+		"always replaces":        {"taken.png", "always", "", "", true},
+		"if-match with the ETag": {"taken.png", "if-match", `"etag-taken.png"`, "", true},
+		"if-match, stale ETag":   {"taken.png", "if-match", "etag-other", "PRECONDITION_FAILED", true},
+		"if-match, no object":    {"new.png", "if-match", "etag-new.png", "PRECONDITION_FAILED", false},
+		"if-match, archive only": {"cold.png", "if-match", "whatever", "PRECONDITION_FAILED", true},
+		"if-match needs an ETag": {"taken.png", "if-match", "", "IF_MATCH_REQUIRED", false},
+		"unknown policy":         {"taken.png", "sometimes", "", "INVALID_OVERWRITE", false},
+	} {
+		t.Run(name, func(t *testing.T) {
+			plan, kerr := img.checkOverwrite(ctx, store, "avatars", tc.key, tc.policy, tc.ifMatch)
+			if tc.wantCode == "" && kerr != nil {
+				t.Fatalf("refused: %v", kerr)
+			}
+			if tc.wantCode != "" && (kerr == nil || kerr.code != tc.wantCode) {
+				t.Fatalf("err = %v, want %s", kerr, tc.wantCode)
+			}
+			if tc.wantCode == "" && plan.replaced != tc.wantReplaced {
+				t.Fatalf("replaced = %v, want %v", plan.replaced, tc.wantReplaced)
+			}
+		})
+	}
+}
+
+// The write carries the policy: of two uploads that both found a key free,
+// only the first creates it, and the second is a conflict rather than an
+// overwrite. "if-match" fails the write when the ETag no longer holds.
+func TestOverwritePlanGuardsTheWrite(t *testing.T) {
+	ctx := context.Background()
+	store := newMemStore("avatars")
+	img := image{}
+	write := func(plan overwritePlan, body string) error {
+		_, err := store.PutObject(ctx, "avatars", "a.png", strings.NewReader(body), int64(len(body)), plan.options(minio.PutObjectOptions{}))
+		return err
+	}
+
+	first, kerr := img.checkOverwrite(ctx, store, "avatars", "a.png", "never", "")
+	second, kerr2 := img.checkOverwrite(ctx, store, "avatars", "a.png", "never", "")
+	if kerr != nil || kerr2 != nil {
+		t.Fatal(kerr, kerr2)
+	}
+	if err := write(first, "first"); err != nil {
+		t.Fatal(err)
+	}
+	err := write(second, "second")
+	if kerr := second.failure(err); kerr == nil || kerr.code != "KEY_EXISTS" {
+		t.Fatalf("second writer: err = %v, want KEY_EXISTS", err)
+	}
+	if got, _ := store.get("avatars", "a.png"); string(got) != "first" {
+		t.Fatalf("object = %q", got)
+	}
+
+	stale := overwritePlan{policy: overwriteIfMatch, ifMatch: "etag-other"}
+	if kerr := stale.failure(write(stale, "x")); kerr == nil || kerr.code != "PRECONDITION_FAILED" {
+		t.Fatalf("stale if-match = %v, want PRECONDITION_FAILED", kerr)
+	}
+	if got, _ := store.get("avatars", "a.png"); string(got) != "first" {
+		t.Fatalf("object = %q after a failed precondition", got)
+	}
+}
+
+// recordingNotifier keeps what would have been sent upstream.
+type recordingNotifier struct{ events []service.PurgeEvent }
+
+func (r *recordingNotifier) Notify(reason service.PurgeReason, bucket string, keys ...string) {
+	for _, k := range keys {
+		r.events = append(r.events, service.PurgeEvent{Bucket: bucket, Key: k, Reason: reason})
+	}
+}
+func (r *recordingNotifier) Close(context.Context) error { return nil }
+
+// An overwrite changes what the URL serves, so everything cached for the old
+// bytes goes: the variants, the preset status, and the upstream copies.
+func TestAfterStorePurgesAReplacedObject(t *testing.T) {
+	cache := newPresetCache()
+	notifier := &recordingNotifier{}
+	img := image{cache: cache, notifier: notifier}
+	_ = cache.Set(presetStatusKey("avatars", "u.png"), []byte(`{"state":"done"}`), 0)
+
+	img.afterStore(context.Background(), "avatars", "new.png", false)
+	if len(notifier.events) != 0 {
+		t.Fatalf("a new key was purged upstream: %v", notifier.events)
+	}
+
+	img.afterStore(context.Background(), "avatars", "u.png", true)
+	if len(notifier.events) != 1 || notifier.events[0].Reason != service.PurgeOverwritten || notifier.events[0].Key != "u.png" {
+		t.Fatalf("upstream events = %+v", notifier.events)
+	}
+	if img.presetStatus("avatars", "u.png") != nil {
+		t.Fatal("preset status of the old bytes survived")
+	}
+}
@@ -0,0 +1,356 @@
+package handler
+
+import (
+	"context"
+	"encoding/base64"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/minio/minio-go/v7"
+
+	"github.com/mstgnz/cdn/service"
+)
+
+const (
+	defaultListLimit = 100
+	maxListLimit     = 1000
+)
+
+// listQuery is what GET /objects/:bucket was asked for.
+type listQuery struct {
+	prefix    string
+	delimiter string // "" or "/"
+	after     string // decoded continuation token; "" for the first page
+	limit     int
+	metadata  bool
+	archive   bool
+}
+
+// listedObject is one object in a listing. LastModified, ETag and
+// ContentType are known only for the local tier: the archive walk reports
+// keys and sizes.
+type listedObject struct {
+	Key          string            `json:"key"`
+	Size         int64             `json:"size"`
+	Tier         string            `json:"tier"`
+	LastModified *time.Time        `json:"last_modified,omitempty"`
+	ETag         string            `json:"etag,omitempty"`
+	ContentType  string            `json:"content_type,omitempty"`
+	Metadata     map[string]string `json:"metadata,omitempty"`
+	Tags         map[string]string `json:"tags,omitempty"`
+}
+
+// listPage is one page of a listing. Prefixes are the "folders" a delimiter
+// rolled keys up into. NextToken is set exactly when IsTruncated is.
+type listPage struct {
+	Bucket      string         `json:"bucket"`
+	Prefix      string         `json:"prefix"`
+	Delimiter   string         `json:"delimiter"`
+	Objects     []listedObject `json:"objects"`
+	Prefixes    []string       `json:"prefixes"`
+	IsTruncated bool           `json:"is_truncated"`
+	NextToken   string         `json:"next_token,omitempty"`
+}
+
+// listItem is an object or a prefix, ordered by name. Both tiers are read
+// into these so they can be merged in one order.
+type listItem struct {
+	name   string
+	prefix bool
+	object listedObject
+}
+
+func listError(code, message string) *keyError {
+	return &keyError{fiber.StatusBadRequest, code, message}
+}
+
+// parseListQuery reads and checks the query string. The continuation token
+// is the last name of the previous page, encoded so that nobody mistakes it
+// for something to edit; a token from a listing with another prefix simply
+// starts after that name.
+func parseListQuery(c *fiber.Ctx) (listQuery, *keyError) {
+	q := listQuery{
+		prefix:    c.Query("prefix"),
+		delimiter: c.Query("delimiter"),
+		limit:     defaultListLimit,
+		metadata:  c.QueryBool("metadata"),
+		archive:   c.QueryBool("archive"),
+	}
+	if q.prefix != "" && service.HasUnsafeObjectKey(q.prefix) {
+		return q, listError("INVALID_KEY", "invalid prefix")
+	}
+	// MinIO rolls up at "/" or not at all, so that is all a listing offers.
+	if q.delimiter != "" && q.delimiter != "/" {
+		return q, listError("INVALID_DELIMITER", `delimiter must be "/" or empty`)
+	}
+	if raw := c.Query("limit"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n < 1 || n > maxListLimit {
+			return q, listError("INVALID_LIMIT", "limit must be between 1 and "+strconv.Itoa(maxListLimit))
+		}
+		q.limit = n
+	}
+	if token := c.Query("token"); token != "" {
+		after, ok := decodeListToken(token)
+		if !ok {
+			return q, listError("INVALID_CONTINUATION_TOKEN", "invalid continuation token")
+		}
+		q.after = after
+	}
+	return q, nil
+}
+
+func encodeListToken(name string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(name))
+}
+
+func decodeListToken(token string) (string, bool) {
+	name, err := base64.RawURLEncoding.DecodeString(token)
+	return string(name), err == nil && len(name) > 0
+}
+
+// rollUp is the name a key is listed under: the key itself, or with a
+// delimiter the prefix up to and including the first delimiter past q.prefix.
+func (q listQuery) rollUp(key string) (string, bool) {
+	if q.delimiter == "" {
+		return key, false
+	}
+	if i := strings.Index(key[len(q.prefix):], q.delimiter); i >= 0 {
+		return key[:len(q.prefix)+i+len(q.delimiter)], true
+	}
+	return key, false
+}
+
+// startAfter is where MinIO is asked to resume. After a prefix, that is past
+// every key under it: starting right after the prefix's own name would roll
+// its keys up into the same prefix again and spend a slot of the page on it.
+// U+10FFFF is the largest code point, so only a key that continues with it
+// sorts later, and nobody names a file with a noncharacter.
+func (q listQuery) startAfter() string {
+	if q.delimiter != "" && strings.HasSuffix(q.after, q.delimiter) {
+		return q.after + "\U0010FFFF"
+	}
+	return q.after
+}
+
+// listLocal reads the first q.limit names after the token from MinIO, and
+// whether there are more. MinIO's listing is not one sorted stream: each page
+// it fetches sends its objects, then its prefixes. Asking for pages of exactly
+// q.limit makes the first page the first q.limit names, which are sorted here;
+// one item more, from the next page, says there is another.
+func listLocal(ctx context.Context, store service.ObjectStore, bucket string, q listQuery) ([]listItem, bool, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var items []listItem
+	more := false
+	for info := range store.ListObjects(ctx, bucket, minio.ListObjectsOptions{
+		Prefix:       q.prefix,
+		Recursive:    q.delimiter == "",
+		StartAfter:   q.startAfter(),
+		MaxKeys:      q.limit,
+		WithMetadata: q.metadata,
+	}) {
+		if info.Err != nil {
+			return nil, false, info.Err
+		}
+		if info.Key <= q.after {
+			continue
+		}
+		if len(items) == q.limit {
+			more = true
+			break
+		}
+		// A common prefix arrives as an ObjectInfo with nothing but a key.
+		if q.delimiter != "" && strings.HasSuffix(info.Key, q.delimiter) && info.ETag == "" && info.LastModified.IsZero() {
+			items = append(items, listItem{name: info.Key, prefix: true})
+			continue
+		}
+		modified := info.LastModified.UTC()
+		obj := listedObject{
+			Key:          info.Key,
+			Size:         info.Size,
+			Tier:         "local",
+			LastModified: &modified,
+			ETag:         info.ETag,
+			ContentType:  info.ContentType,
+		}
+		if q.metadata {
+			obj.Metadata = userMeta(listedMeta(info.UserMetadata))
+			obj.Tags = map[string]string(info.UserTags)
+			if obj.Tags == nil {
+				obj.Tags = map[string]string{}
+			}
+		}
+		items = append(items, listItem{name: info.Key, object: obj})
+	}
+	sort.Slice(items, func(a, b int) bool { return items[a].name < items[b].name })
+	return items, more, nil
+}
+
+// listedMeta is the user metadata a MinIO listing reports, which names it as
+// the request headers it came with (X-Amz-Meta-Alt) and mixes in the
+// object's own headers, in the form StatObject reports it.
+func listedMeta(listed map[string]string) map[string]string {
+	out := map[string]string{}
+	for k, v := range listed {
+		name := strings.ToLower(k)
+		if rest, ok := strings.CutPrefix(name, "x-amz-meta-"); ok {
+			out[rest] = v
+		} else if !strings.HasPrefix(name, "x-amz-") {
+			out[name] = v
+		}
+	}
+	return out
+}
+
+// listArchive reads the q.limit+1 smallest names after the token the archive
+// holds under the prefix. Walk promises no order and no way to start
+// anywhere but at the beginning, so every key of the bucket is looked at and
+// only the smallest are kept; what memory that takes does not grow with the
+// archive.
+func listArchive(ctx context.Context, archive service.Archive, bucket string, q listQuery) ([]listItem, error) {
+	keep := q.limit + 1
+	byName := map[string]listItem{}
+	var items []listItem
+	trim := func() {
+		sort.Slice(items, func(a, b int) bool { return items[a].name < items[b].name })
+		for _, it := range items[keep:] {
+			delete(byName, it.name)
+		}
+		items = items[:keep]
+	}
+	err := archive.Walk(ctx, bucket, func(key string, size int64) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if !strings.HasPrefix(key, q.prefix) {
+			return nil
+		}
+		name, isPrefix := q.rollUp(key)
+		if name <= q.after {
+			return nil
+		}
+		if _, ok := byName[name]; ok {
+			return nil
+		}
+		it := listItem{name: name, prefix: isPrefix}
+		if !isPrefix {
+			it.object = listedObject{Key: key, Size: size, Tier: "archive"}
+		}
+		byName[name] = it
+		items = append(items, it)
+		if len(items) >= 2*keep {
+			trim()
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(items) > keep {
+		trim()
+	}
+	sort.Slice(items, func(a, b int) bool { return items[a].name < items[b].name })
+	return items, nil
+}
+
+// listObjects answers one page of a bucket listing. With q.archive, keys only
+// the archive holds are merged in by name; a key in both tiers is listed
+// once, as local, since that is where a read would be served from. The page
+// is the first q.limit names of the merge: each tier contributes its first
+// names after the token, which is all the merge can take from it.
+func listObjects(ctx context.Context, store service.ObjectStore, archive service.Archive, bucket string, q listQuery) (listPage, *keyError) {
+	local, more, err := listLocal(ctx, store, bucket, q)
+	if err != nil {
+		return listPage{}, &keyError{fiber.StatusBadGateway, "STORAGE_ERROR", "could not list the bucket: " + err.Error()}
+	}
+	items := local
+	if q.archive && archive != nil && archive.Enabled() {
+		archived, err := listArchive(ctx, archive, bucket, q)
+		if err != nil {
+			return listPage{}, &keyError{fiber.StatusBadGateway, "ARCHIVE_ERROR", "could not list the archive: " + err.Error()}
+		}
+		seen := make(map[string]bool, len(local))
+		for _, it := range local {
+			seen[it.name] = true
+		}
+		for _, it := range archived {
+			if !seen[it.name] {
+				items = append(items, it)
+			}
+		}
+		sort.Slice(items, func(a, b int) bool { return items[a].name < items[b].name })
+	}
+
+	page := listPage{
+		Bucket:    bucket,
+		Prefix:    q.prefix,
+		Delimiter: q.delimiter,
+		Objects:   []listedObject{},
+		Prefixes:  []string{},
+	}
+	if len(items) > q.limit {
+		items, more = items[:q.limit], true
+	}
+	for _, it := range items {
+		if it.prefix {
+			page.Prefixes = append(page.Prefixes, it.name)
+		} else {
+			page.Objects = append(page.Objects, it.object)
+		}
+	}
+	if more && len(items) > 0 {
+		page.IsTruncated = true
+		page.NextToken = encodeListToken(items[len(items)-1].name)
+	}
+	return page, nil
+}
+
+// ListObjects lists a bucket's objects a page at a time: prefix narrows the
+// listing, delimiter=/ rolls keys up into "folders", limit sets the page size
+// (1 to 1000, 100 by default), and token, from next_token, asks for the next
+// page. metadata=true adds each object's user metadata and tags, which MinIO
+// sends with the listing rather than per object. archive=true merges in the
+// keys only the archive holds, marked with tier "archive"; that walks the
+// bucket's whole archive for every page, so it is for occasional use.
+//
+// A bucket token lists its own bucket only. The service's working buckets are
+// not listed: what is in them is not anybody's objects.
+func (i image) ListObjects(c *fiber.Ctx) error {
+	bucket, err := resolveBucket(c, c.Params("bucket"))
+	if err != nil {
+		return bucketForbidden(c)
+	}
+	if bucket == "" {
+		return service.Response(c, fiber.StatusBadRequest, false, "Bucket is required", nil)
+	}
+	if service.InternalBucket(bucket) {
+		return bucketReserved(c)
+	}
+	q, kerr := parseListQuery(c)
+	if kerr != nil {
+		return respondKeyError(c, kerr)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
+	defer cancel()
+
+	store := service.MinioStore{Client: i.minioClient}
+	exists, err := store.BucketExists(ctx, bucket)
+	if err != nil {
+		return respondKeyError(c, &keyError{fiber.StatusBadGateway, "STORAGE_ERROR", err.Error()})
+	}
+	if !exists {
+		return service.Response(c, fiber.StatusNotFound, false, "Bucket not found", nil)
+	}
+
+	page, kerr := listObjects(ctx, store, i.archive, bucket, q)
+	if kerr != nil {
+		return respondKeyError(c, kerr)
+	}
+	return service.Response(c, fiber.StatusOK, true, "success", page)
+}
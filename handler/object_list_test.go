@@ -0,0 +1,172 @@
+package handler
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/minio/minio-go/v7"
+)
+
+func putObjects(t *testing.T, store *memStore, bucket string, keys ...string) {
+	t.Helper()
+	for _, k := range keys {
+		if _, err := store.PutObject(context.Background(), bucket, k, bytes.NewReader([]byte(k)), int64(len(k)), minio.PutObjectOptions{ContentType: "image/png"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func nextAfter(t *testing.T, p listPage) string {
+	t.Helper()
+	after, ok := decodeListToken(p.NextToken)
+	if !ok {
+		t.Fatalf("next_token %q", p.NextToken)
+	}
+	return after
+}
+
+func pageNames(p listPage) []string {
+	var out []string
+	for _, o := range p.Objects {
+		out = append(out, o.Key)
+	}
+	return append(out, p.Prefixes...)
+}
+
+// Following next_token visits every name once, folders included, and a
+// folder is not listed again on the page after it.
+func TestListObjectsPagesThroughFolders(t *testing.T) {
+	store := newMemStore("photos")
+	putObjects(t, store, "photos", "a.png", "cats/1.png", "cats/2.png", "dogs/1.png", "z.png", "other/x.png")
+
+	q := listQuery{prefix: "", delimiter: "/", limit: 2}
+	var got []string
+	for pages := 0; ; pages++ {
+		if pages > 5 {
+			t.Fatal("listing does not end")
+		}
+		page, kerr := listObjects(context.Background(), store, nil, "photos", q)
+		if kerr != nil {
+			t.Fatal(kerr)
+		}
+		got = append(got, pageNames(page)...)
+		sort.Strings(got)
+		if !page.IsTruncated {
+			break
+		}
+		q.after, q.limit = nextAfter(t, page), 2
+	}
+	want := "a.png cats/ dogs/ other/ z.png"
+	if strings.Join(got, " ") != want {
+		t.Errorf("listed %v, want %s", got, want)
+	}
+
+	// A prefix narrows the listing to one folder.
+	page, _ := listObjects(context.Background(), store, nil, "photos", listQuery{prefix: "cats/", delimiter: "/", limit: 10})
+	if strings.Join(pageNames(page), " ") != "cats/1.png cats/2.png" || page.IsTruncated {
+		t.Errorf("cats/: %+v", page)
+	}
+}
+
+// With archive, keys only the archive holds are merged in and marked, and a
+// key in both tiers is listed once, as local.
+func TestListObjectsMergesTheArchive(t *testing.T) {
+	store := newMemStore("photos")
+	putObjects(t, store, "photos", "b.png", "d.png")
+	archive := newMemArchive()
+	for _, k := range []string{"a.png", "b.png", "c.png", "old/e.png"} {
+		_ = archive.Put(context.Background(), "photos", k, strings.NewReader("xx"), "", "")
+	}
+
+	page, kerr := listObjects(context.Background(), store, archive, "photos", listQuery{delimiter: "/", limit: 3, archive: true})
+	if kerr != nil {
+		t.Fatal(kerr)
+	}
+	tiers := map[string]string{}
+	for _, o := range page.Objects {
+		tiers[o.Key] = o.Tier
+	}
+	if len(tiers) != 3 || tiers["a.png"] != "archive" || tiers["b.png"] != "local" || tiers["c.png"] != "archive" {
+		t.Errorf("first page: %+v", page.Objects)
+	}
+	if !page.IsTruncated {
+		t.Fatal("first page is the whole listing")
+	}
+
+	page, _ = listObjects(context.Background(), store, archive, "photos", listQuery{delimiter: "/", limit: 3, archive: true, after: nextAfter(t, page)})
+	if strings.Join(pageNames(page), " ") != "d.png old/" || page.IsTruncated {
+		t.Errorf("second page: %+v", page)
+	}
+
+	// Without archive, only the local tier.
+	page, _ = listObjects(context.Background(), store, archive, "photos", listQuery{limit: 10})
+	if strings.Join(pageNames(page), " ") != "b.png d.png" {
+		t.Errorf("local only: %v", pageNames(page))
+	}
+}
+
+func TestListObjectsWithMetadata(t *testing.T) {
+	store := newMemStore("photos")
+	attrs, _ := newObjectAttrs(map[string]string{"alt": "A cat"}, map[string]string{"team": "web"})
+	if _, err := store.PutObject(context.Background(), "photos", "cat.png", strings.NewReader("png"), 3,
+		attrs.options(minio.PutObjectOptions{UserMetadata: digestMeta("abc")})); err != nil {
+		t.Fatal(err)
+	}
+	page, _ := listObjects(context.Background(), store, nil, "photos", listQuery{limit: 10, metadata: true})
+	if len(page.Objects) != 1 {
+		t.Fatalf("listed %+v", page)
+	}
+	o := page.Objects[0]
+	if len(o.Metadata) != 1 || o.Metadata["alt"] != "A cat" || o.Tags["team"] != "web" {
+		t.Errorf("metadata %v, tags %v", o.Metadata, o.Tags)
+	}
+	if got := listedMeta(map[string]string{"X-Amz-Meta-Alt": "x", "content-type": "image/png", "X-Amz-Tagging-Count": "1"}); len(got) != 2 || got["alt"] != "x" {
+		t.Errorf("listedMeta = %v", got)
+	}
+}
+
+func TestParseListQuery(t *testing.T) {
+	app := fiber.New()
+	app.Get("/", func(c *fiber.Ctx) error {
+		q, kerr := parseListQuery(c)
+		if kerr != nil {
+			return respondKeyError(c, kerr)
+		}
+		return c.JSON(map[string]any{"prefix": q.prefix, "after": q.after, "limit": q.limit})
+	})
+	call := func(query string) (int, map[string]any) {
+		resp, err := app.Test(httptest.NewRequest("GET", "/?"+query, nil), -1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var out map[string]any
+		body, _ := io.ReadAll(resp.Body)
+		_ = json.Unmarshal(body, &out)
+		return resp.StatusCode, out
+	}
+
+	if code, out := call("prefix=cats/&token=" + encodeListToken("cats/1.png")); code != fiber.StatusOK || out["after"] != "cats/1.png" || out["limit"] != float64(defaultListLimit) {
+		t.Errorf("valid query: %d %v", code, out)
+	}
+	for query, wantCode := range map[string]string{
+		"delimiter=-":       "INVALID_DELIMITER",
+		"limit=0":           "INVALID_LIMIT",
+		"limit=1001":        "INVALID_LIMIT",
+		"limit=ten":         "INVALID_LIMIT",
+		"token=!!":          "INVALID_CONTINUATION_TOKEN",
+		"prefix=../secrets": "INVALID_KEY",
+	} {
+		code, out := call(query)
+		data, _ := out["data"].(map[string]any)
+		if code != fiber.StatusBadRequest || data["code"] != wantCode {
+			t.Errorf("%s: %d %v, want %s", query, code, out, wantCode)
+		}
+	}
+}
@@ -0,0 +1,373 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/url"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/tags"
+
+	"github.com/mstgnz/cdn/service"
+)
+
+// maxUserMetaBytes bounds the metadata a caller may attach to one object,
+// names and encoded values together. S3 allows 2 KB of user metadata per
+// object; what is left is for the fields the service stores itself.
+const maxUserMetaBytes = 1536
+
+// metaFieldPrefix marks a free-form metadata field in a multipart form or in
+// tus Upload-Metadata. alt and author need no prefix.
+const metaFieldPrefix = "x-meta-"
+
+// reservedMeta are the user metadata names the service writes itself, or that
+// S3 treats as headers rather than metadata. A caller can neither set nor see
+// them as metadata.
+var reservedMeta = map[string]bool{
+	strings.ToLower(service.MetaSHA256): true,
+	"content-type":                      true,
+	"content-encoding":                  true,
+	"content-disposition":               true,
+	"content-language":                  true,
+	"cache-control":                     true,
+	"expires":                           true,
+}
+
+// objectAttrs is what a caller attaches to an object besides its bytes: user
+// metadata (alt text, an author, free-form fields), stored as S3 user
+// metadata, and tags, stored as S3 object tags. Names are lowercase; values
+// are stored MIME-encoded when they are not ASCII, since S3 metadata travels
+// in HTTP headers.
+//
+// Deduplication does not apply to an upload that carries either: a shared
+// object cannot hold two uploaders' alt text, and a later PATCH by one would
+// rewrite the other's.
+type objectAttrs struct {
+	Meta map[string]string `json:"metadata,omitempty"`
+	Tags map[string]string `json:"tags,omitempty"`
+}
+
+func (a objectAttrs) empty() bool { return len(a.Meta) == 0 && len(a.Tags) == 0 }
+
+func metaError(format string, args ...any) *keyError {
+	return &keyError{fiber.StatusBadRequest, "INVALID_METADATA", fmt.Sprintf(format, args...)}
+}
+
+// newObjectAttrs checks metadata and tags as a caller sent them. A metadata
+// name may carry the x-meta- prefix of the form fields; it is dropped.
+func newObjectAttrs(meta, tagMap map[string]string) (objectAttrs, *keyError) {
+	var out objectAttrs
+	size := 0
+	for name, value := range meta {
+		name = strings.TrimPrefix(strings.ToLower(name), metaFieldPrefix)
+		if err := checkMetaName(name); err != nil {
+			return objectAttrs{}, err
+		}
+		if !utf8.ValidString(value) || strings.ContainsAny(value, "\r\n\x00") {
+			return objectAttrs{}, metaError("metadata %q must be a single line of UTF-8 text", name)
+		}
+		if out.Meta == nil {
+			out.Meta = map[string]string{}
+		}
+		out.Meta[name] = value
+		size += len(name) + len(encodeMetaValue(value))
+	}
+	if size > maxUserMetaBytes {
+		return objectAttrs{}, metaError("metadata is %d bytes; at most %d are stored per object", size, maxUserMetaBytes)
+	}
+	if len(tagMap) > 0 {
+		if _, err := tags.NewTags(tagMap, true); err != nil {
+			return objectAttrs{}, &keyError{fiber.StatusBadRequest, "INVALID_TAGS", "tags: " + err.Error()}
+		}
+		out.Tags = tagMap
+	}
+	return out, nil
+}
+
+func checkMetaName(name string) *keyError {
+	if name == "" || len(name) > 64 || strings.Trim(name, "abcdefghijklmnopqrstuvwxyz0123456789-") != "" ||
+		strings.HasPrefix(name, "-") || strings.HasSuffix(name, "-") {
+		return metaError("metadata name %q must be 1-64 lowercase letters, digits or '-'", name)
+	}
+	if reservedMeta[name] {
+		return metaError("metadata name %q is reserved", name)
+	}
+	return nil
+}
+
+// fieldAttrs picks metadata and tags out of flat upload fields: a multipart
+// form's values, or tus Upload-Metadata. alt and author are metadata as they
+// are, x-meta-<name> is metadata named <name>, and tags is a query string
+// ("team=web&license=cc-by"), as in S3's x-amz-tagging header.
+func fieldAttrs(fields map[string]string) (objectAttrs, *keyError) {
+	meta := map[string]string{}
+	for name, value := range fields {
+		lower := strings.ToLower(name)
+		if lower == "alt" || lower == "author" || strings.HasPrefix(lower, metaFieldPrefix) {
+			meta[lower] = value
+		}
+	}
+	var tagMap map[string]string
+	if raw := fields["tags"]; raw != "" {
+		q, err := url.ParseQuery(raw)
+		if err != nil {
+			return objectAttrs{}, &keyError{fiber.StatusBadRequest, "INVALID_TAGS", "tags must be a query string: " + err.Error()}
+		}
+		tagMap = make(map[string]string, len(q))
+		for k, v := range q {
+			if len(v) > 1 {
+				return objectAttrs{}, &keyError{fiber.StatusBadRequest, "INVALID_TAGS", fmt.Sprintf("tag %q is given more than once", k)}
+			}
+			tagMap[k] = v[0]
+		}
+	}
+	return newObjectAttrs(meta, tagMap)
+}
+
+// formAttrs is fieldAttrs for a multipart form, which allows a field more
+// than once; the first value counts, as it does for FormValue.
+func formAttrs(c *fiber.Ctx) (objectAttrs, *keyError) {
+	form, err := c.MultipartForm()
+	if err != nil {
+		return objectAttrs{}, nil
+	}
+	fields := make(map[string]string, len(form.Value))
+	for name, values := range form.Value {
+		if len(values) > 0 {
+			fields[name] = values[0]
+		}
+	}
+	return fieldAttrs(fields)
+}
+
+// withMeta adds the attributes' metadata to meta, the metadata an upload is
+// stored with anyway, and returns it.
+func (a objectAttrs) withMeta(meta map[string]string) map[string]string {
+	if len(a.Meta) == 0 {
+		return meta
+	}
+	out := make(map[string]string, len(meta)+len(a.Meta))
+	for k, v := range meta {
+		out[k] = v
+	}
+	for k, v := range a.Meta {
+		out[k] = encodeMetaValue(v)
+	}
+	return out
+}
+
+// options completes the options of a PutObject with the attributes.
+func (a objectAttrs) options(opts minio.PutObjectOptions) minio.PutObjectOptions {
+	opts.UserMetadata = a.withMeta(opts.UserMetadata)
+	if len(a.Tags) > 0 {
+		opts.UserTags = a.Tags
+	}
+	return opts
+}
+
+// copyOptions is options for a server-side copy that replaces the metadata.
+func (a objectAttrs) copyOptions(dst minio.CopyDestOptions) minio.CopyDestOptions {
+	dst.UserMetadata = a.withMeta(dst.UserMetadata)
+	if len(a.Tags) > 0 {
+		dst.UserTags, dst.ReplaceTags = a.Tags, true
+	}
+	return dst
+}
+
+func encodeMetaValue(v string) string {
+	for i := 0; i < len(v); i++ {
+		if v[i] >= utf8.RuneSelf {
+			return mime.QEncoding.Encode("utf-8", v)
+		}
+	}
+	return v
+}
+
+var metaDecoder = new(mime.WordDecoder)
+
+// userMeta is the caller-visible part of an object's user metadata, names
+// lowercased and values decoded.
+func userMeta(stored map[string]string) map[string]string {
+	out := map[string]string{}
+	for k, v := range stored {
+		name := strings.ToLower(k)
+		if reservedMeta[name] {
+			continue
+		}
+		if decoded, err := metaDecoder.DecodeHeader(v); err == nil {
+			v = decoded
+		}
+		out[name] = v
+	}
+	return out
+}
+
+// objectTagStore is an ObjectStore that also reaches object tags.
+// service.MinioStore is one.
+type objectTagStore interface {
+	service.ObjectStore
+	GetObjectTagging(ctx context.Context, bucket, object string, opts minio.GetObjectTaggingOptions) (*tags.Tags, error)
+	PutObjectTagging(ctx context.Context, bucket, object string, otags *tags.Tags, opts minio.PutObjectTaggingOptions) error
+	RemoveObjectTagging(ctx context.Context, bucket, object string, opts minio.RemoveObjectTaggingOptions) error
+}
+
+// objectTags reads an object's tags, skipping the round trip when the stat
+// says there are none.
+func objectTags(ctx context.Context, store objectTagStore, bucket, object string, info minio.ObjectInfo) (map[string]string, error) {
+	if info.UserTagCount == 0 {
+		return map[string]string{}, nil
+	}
+	t, err := store.GetObjectTagging(ctx, bucket, object, minio.GetObjectTaggingOptions{})
+	if err != nil {
+		return nil, err
+	}
+	return t.ToMap(), nil
+}
+
+// MetadataPatch is the body of PATCH /meta/:bucket/*, a JSON merge patch
+// (RFC 7396) of the object's metadata and tags: a name with a value sets it, a
+// name with null removes it, and a name left out is left alone. A section left
+// out is not touched at all.
+type MetadataPatch struct {
+	Metadata map[string]*string `json:"metadata"`
+	Tags     map[string]*string `json:"tags"`
+}
+
+func mergePatch(current map[string]string, patch map[string]*string) map[string]string {
+	out := make(map[string]string, len(current)+len(patch))
+	for k, v := range current {
+		out[k] = v
+	}
+	for k, v := range patch {
+		if v == nil {
+			delete(out, k)
+		} else {
+			out[k] = *v
+		}
+	}
+	return out
+}
+
+// patchObjectAttrs applies patch to an object in MinIO and returns what it
+// carries afterwards.
+//
+// Metadata cannot be edited in place in S3, so a metadata change is a
+// server-side copy of the object onto itself with its metadata replaced: the
+// bytes are not sent anywhere, and the fields the service keeps (the digest,
+// the content type) are carried over. Tags are set directly. Neither changes
+// what is served, so nothing is purged.
+//
+// A deduplicated object is shared by the uploads answered with it, none of
+// which carried metadata or tags; see detachShared.
+func (i image) patchObjectAttrs(ctx context.Context, store objectTagStore, bucket, object string, patch MetadataPatch) (objectAttrs, *keyError) {
+	info, err := store.StatObject(ctx, bucket, object, minio.StatObjectOptions{})
+	if err != nil {
+		if minio.ToErrorResponse(err).Code == "NoSuchKey" {
+			return objectAttrs{}, &keyError{fiber.StatusNotFound, "OBJECT_NOT_FOUND", "object not found"}
+		}
+		return objectAttrs{}, &keyError{fiber.StatusBadGateway, "STORAGE_ERROR", err.Error()}
+	}
+	current, err := objectTags(ctx, store, bucket, object, info)
+	if err != nil {
+		return objectAttrs{}, &keyError{fiber.StatusBadGateway, "STORAGE_ERROR", err.Error()}
+	}
+	meta := userMeta(info.UserMetadata)
+	if patch.Metadata != nil {
+		meta = mergePatch(meta, patch.Metadata)
+	}
+	tagMap := current
+	if patch.Tags != nil {
+		tagMap = mergePatch(current, patch.Tags)
+	}
+	next, kerr := newObjectAttrs(meta, tagMap)
+	if kerr != nil {
+		return objectAttrs{}, kerr
+	}
+	if kerr := i.detachShared(ctx, bucket, object, info.UserMetadata[service.MetaSHA256]); kerr != nil {
+		return objectAttrs{}, kerr
+	}
+
+	if patch.Metadata != nil {
+		kept := map[string]string{}
+		if info.ContentType != "" {
+			kept["Content-Type"] = info.ContentType
+		}
+		for k, v := range info.UserMetadata {
+			if reservedMeta[strings.ToLower(k)] {
+				kept[k] = v
+			}
+		}
+		_, err := store.CopyObject(ctx,
+			minio.CopyDestOptions{Bucket: bucket, Object: object, ReplaceMetadata: true, UserMetadata: objectAttrs{Meta: next.Meta}.withMeta(kept)},
+			minio.CopySrcOptions{Bucket: bucket, Object: object, MatchETag: info.ETag})
+		if err != nil {
+			return objectAttrs{}, &keyError{fiber.StatusBadGateway, "STORAGE_ERROR", "metadata could not be updated: " + err.Error()}
+		}
+	}
+	if patch.Tags != nil {
+		if len(next.Tags) == 0 {
+			err = store.RemoveObjectTagging(ctx, bucket, object, minio.RemoveObjectTaggingOptions{})
+		} else {
+			t, _ := tags.NewTags(next.Tags, true) // checked by newObjectAttrs
+			err = store.PutObjectTagging(ctx, bucket, object, t, minio.PutObjectTaggingOptions{})
+		}
+		if err != nil {
+			return objectAttrs{}, &keyError{fiber.StatusBadGateway, "STORAGE_ERROR", "tags could not be updated: " + err.Error()}
+		}
+	}
+	return next, nil
+}
+
+// UpdateMetadata changes an object's metadata and tags without a re-upload.
+// See MetadataPatch and patchObjectAttrs. Only objects in MinIO can be
+// changed; one the retention job has moved to the archive answers 404.
+func (i image) UpdateMetadata(c *fiber.Ctx) error {
+	bucket, err := resolveBucket(c, c.Params("bucket"))
+	if err != nil {
+		return bucketForbidden(c)
+	}
+	object := c.Params("*")
+	if bucket == "" || object == "" {
+		return service.Response(c, fiber.StatusBadRequest, false, "invalid path or bucket or file.", nil)
+	}
+	if service.InternalBucket(bucket) {
+		return bucketReserved(c)
+	}
+	if service.HasUnsafeObjectKey(object) {
+		return service.Response(c, fiber.StatusBadRequest, false, "invalid object key", nil)
+	}
+	var patch MetadataPatch
+	if err := json.Unmarshal(c.Body(), &patch); err != nil {
+		return service.Response(c, fiber.StatusBadRequest, false, "Invalid request body", nil)
+	}
+	if patch.Metadata == nil && patch.Tags == nil {
+		return service.Response(c, fiber.StatusBadRequest, false, "nothing to update: send metadata, tags or both", nil)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	attrs, kerr := i.patchObjectAttrs(ctx, service.MinioStore{Client: i.minioClient}, bucket, object, patch)
+	if kerr != nil {
+		return respondKeyError(c, kerr)
+	}
+	return service.Response(c, fiber.StatusOK, true, "success", attrsData(bucket, object, attrs.Meta, attrs.Tags))
+}
+
+// attrsData is the metadata and tags part of a metadata answer. Both are
+// always present, empty when the object has none.
+func attrsData(bucket, object string, meta, tagMap map[string]string) map[string]any {
+	if meta == nil {
+		meta = map[string]string{}
+	}
+	if tagMap == nil {
+		tagMap = map[string]string{}
+	}
+	return map[string]any{"bucket": bucket, "key": object, "metadata": meta, "tags": tagMap}
+}
@@ -0,0 +1,159 @@
+package handler
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/minio/minio-go/v7"
+
+	"github.com/mstgnz/cdn/service"
+)
+
+func TestFieldAttrs(t *testing.T) {
+	attrs, kerr := fieldAttrs(map[string]string{
+		"alt":            "A cat on a wall",
+		"author":         "Ayşe Yılmaz",
+		"x-meta-License": "cc-by",
+		"bucket":         "photos", // not metadata
+		"tags":           "team=web&year=2026",
+	})
+	if kerr != nil {
+		t.Fatal(kerr)
+	}
+	wantMeta := map[string]string{"alt": "A cat on a wall", "author": "Ayşe Yılmaz", "license": "cc-by"}
+	if len(attrs.Meta) != len(wantMeta) {
+		t.Fatalf("metadata = %v", attrs.Meta)
+	}
+	for k, v := range wantMeta {
+		if attrs.Meta[k] != v {
+			t.Errorf("metadata %s = %q, want %q", k, attrs.Meta[k], v)
+		}
+	}
+	if attrs.Tags["team"] != "web" || attrs.Tags["year"] != "2026" {
+		t.Errorf("tags = %v", attrs.Tags)
+	}
+
+	for name, fields := range map[string]map[string]string{
+		"reserved name":  {"x-meta-sha256": "0000"},
+		"bad name":       {"x-meta-a_b": "x"},
+		"multi-line":     {"alt": "one\r\ntwo"},
+		"too large":      {"alt": strings.Repeat("a", maxUserMetaBytes)},
+		"repeated tag":   {"tags": "a=1&a=2"},
+		"bad tag value":  {"tags": "a=<script>"},
+		"too many tags":  {"tags": "a=1&b=2&c=3&d=4&e=5&f=6&g=7&h=8&i=9&j=10&k=11"},
+		"empty meta key": {"x-meta-": "x"},
+	} {
+		if _, kerr := fieldAttrs(fields); kerr == nil || kerr.status != fiber.StatusBadRequest {
+			t.Errorf("%s: accepted", name)
+		}
+	}
+}
+
+// Non-ASCII values survive the round trip through S3's ASCII headers, and
+// the service's own fields are neither shown nor settable.
+func TestObjectAttrsRoundTrip(t *testing.T) {
+	attrs, kerr := newObjectAttrs(map[string]string{"alt": "Kız Kulesi, İstanbul"}, nil)
+	if kerr != nil {
+		t.Fatal(kerr)
+	}
+	opts := attrs.options(minio.PutObjectOptions{UserMetadata: digestMeta("abc")})
+	if v := opts.UserMetadata["alt"]; v == "Kız Kulesi, İstanbul" || !strings.HasPrefix(v, "=?utf-8?") {
+		t.Errorf("stored value %q is not encoded", v)
+	}
+	got := userMeta(map[string]string{"Alt": opts.UserMetadata["alt"], service.MetaSHA256: "abc"})
+	if len(got) != 1 || got["alt"] != "Kız Kulesi, İstanbul" {
+		t.Errorf("read back %v", got)
+	}
+}
+
+// A patch is merged into what the object has: set, removed, or left alone.
+// The digest and content type survive the copy that rewrites the metadata.
+func TestPatchObjectAttrsMerges(t *testing.T) {
+	store := newMemStore("photos")
+	ctx := context.Background()
+	img := image{}
+	attrs, _ := newObjectAttrs(map[string]string{"alt": "old", "author": "someone"}, map[string]string{"team": "web"})
+	if _, err := store.PutObject(ctx, "photos", "cat.png", bytes.NewReader([]byte("png")), 3,
+		attrs.options(minio.PutObjectOptions{ContentType: "image/png", UserMetadata: digestMeta("abc")})); err != nil {
+		t.Fatal(err)
+	}
+
+	alt, credit, year := "A cat", "Photo: Ayşe", "2026"
+	next, kerr := img.patchObjectAttrs(ctx, store, "photos", "cat.png", MetadataPatch{
+		Metadata: map[string]*string{"alt": &alt, "author": nil, "credit": &credit},
+		Tags:     map[string]*string{"year": &year},
+	})
+	if kerr != nil {
+		t.Fatal(kerr)
+	}
+	if len(next.Meta) != 2 || next.Meta["alt"] != alt || next.Meta["credit"] != credit {
+		t.Errorf("metadata = %v", next.Meta)
+	}
+	if len(next.Tags) != 2 || next.Tags["team"] != "web" || next.Tags["year"] != year {
+		t.Errorf("tags = %v", next.Tags)
+	}
+
+	o, _ := store.object("photos", "cat.png")
+	if o.meta[service.MetaSHA256] != "abc" || o.contentType != "image/png" {
+		t.Errorf("service fields lost: %v, %q", o.meta, o.contentType)
+	}
+	if got := userMeta(o.meta); got["credit"] != credit || got["author"] != "" {
+		t.Errorf("stored metadata = %v", got)
+	}
+
+	// A tags-only patch leaves the metadata as it is, and an emptied tag set
+	// is removed.
+	if _, kerr := img.patchObjectAttrs(ctx, store, "photos", "cat.png", MetadataPatch{Tags: map[string]*string{"team": nil, "year": nil}}); kerr != nil {
+		t.Fatal(kerr)
+	}
+	if o, _ := store.object("photos", "cat.png"); len(o.tags) != 0 || userMeta(o.meta)["alt"] != alt {
+		t.Errorf("after tags-only patch: %v, %v", o.tags, o.meta)
+	}
+
+	if _, kerr := img.patchObjectAttrs(ctx, store, "photos", "dog.png", MetadataPatch{Metadata: map[string]*string{"alt": &alt}}); kerr == nil || kerr.status != fiber.StatusNotFound {
+		t.Errorf("missing object: %v", kerr)
+	}
+	bad := "x"
+	if _, kerr := img.patchObjectAttrs(ctx, store, "photos", "cat.png", MetadataPatch{Metadata: map[string]*string{"sha256": &bad}}); kerr == nil || kerr.code != "INVALID_METADATA" {
+		t.Errorf("reserved name: %v", kerr)
+	}
+}
+
+// A presigned upload carries the metadata and tags it was issued with into
+// the object it finalizes to.
+func TestPresignCarriesMetadataAndTags(t *testing.T) {
+	store := newMemStore(presignStaging, "photos")
+	app, _ := newPresignApp(store, offlineSigner(t))
+	code, out := presignCall(t, app, "/upload/presign", nil, map[string]any{
+		"bucket": "photos", "filename": "report.csv",
+		"metadata": map[string]string{"author": "Finance"},
+		"tags":     map[string]string{"quarter": "q3"},
+	})
+	if code != fiber.StatusCreated {
+		t.Fatalf("presign = %d %+v", code, out)
+	}
+	id := out.Data["id"].(string)
+	browserUpload(t, store, id, []byte("id,total\n1,10\n"))
+	if code, out := presignCall(t, app, "/upload/presign/"+id+"/finalize", nil, nil); code != fiber.StatusCreated {
+		t.Fatalf("finalize = %d %+v", code, out)
+	}
+
+	keys := store.keys("photos")
+	if len(keys) != 1 {
+		t.Fatalf("stored %v", keys)
+	}
+	o, _ := store.object("photos", keys[0])
+	if userMeta(o.meta)["author"] != "Finance" || o.tags["quarter"] != "q3" {
+		t.Errorf("stored with %v, %v", o.meta, o.tags)
+	}
+
+	code, out = presignCall(t, app, "/upload/presign", nil, map[string]any{
+		"bucket": "photos", "filename": "report.csv", "metadata": map[string]string{"content-type": "text/html"},
+	})
+	if code != fiber.StatusBadRequest || out.Data["code"] != "INVALID_METADATA" {
+		t.Errorf("reserved metadata name: %d %+v", code, out)
+	}
+}
@@ -0,0 +1,440 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/minio/minio-go/v7"
+
+	"github.com/mstgnz/cdn/pkg/validator"
+	"github.com/mstgnz/cdn/service"
+)
+
+// prefixDeleteKind is the job kind of deletes by prefix.
+const prefixDeleteKind = "prefix_delete"
+
+// Limits of a prefix delete's bookkeeping: how many keys a dry run shows, how
+// many failures are itemised, how many archived keys go in one S3 delete
+// (its API's own limit), and how often progress is saved.
+const (
+	prefixDeleteSample     = 20
+	prefixDeleteMaxErrors  = 100
+	prefixDeleteArchiveMax = 1000
+	prefixDeleteCheckpoint = 500
+)
+
+// PrefixDeleteRequest is the body of POST /objects/delete-prefix. DryRun
+// defaults to true: nothing is deleted unless it is given as false.
+// MaxObjects, when set, fails the job before it deletes anything if more
+// objects than that are under the prefix, which is how the count a dry run
+// showed is held to. AWSDelete also removes the archived copies, as it does
+// on /batch/delete.
+type PrefixDeleteRequest struct {
+	Bucket      string `json:"bucket"`
+	Prefix      string `json:"prefix"`
+	DryRun      *bool  `json:"dry_run"`
+	AWSDelete   bool   `json:"aws_delete"`
+	MaxObjects  int64  `json:"max_objects"`
+	CallbackURL string `json:"callback_url"`
+}
+
+// prefixDeleteParams is what a prefix delete job is asked to do.
+type prefixDeleteParams struct {
+	Bucket     string `json:"bucket"`
+	Prefix     string `json:"prefix"`
+	DryRun     bool   `json:"dry_run"`
+	AWSDelete  bool   `json:"aws_delete"`
+	MaxObjects int64  `json:"max_objects,omitempty"`
+}
+
+// prefixDeleteResult is a prefix delete's progress and outcome. Objects and
+// Bytes are the count taken before anything is deleted; the archive's are
+// counted only when its copies are to be deleted too. After is the last key
+// the delete has dealt with, where a resumed job carries on from.
+type prefixDeleteResult struct {
+	Phase           string              `json:"phase"` // counting, deleting, archive, done
+	Objects         int64               `json:"objects"`
+	Bytes           int64               `json:"bytes"`
+	ArchivedObjects int64               `json:"archived_objects,omitempty"`
+	ArchivedBytes   int64               `json:"archived_bytes,omitempty"`
+	Sample          []string            `json:"sample,omitempty"`
+	Deleted         int64               `json:"deleted"`
+	Trashed         int64               `json:"trashed,omitempty"`
+	Kept            int64               `json:"kept,omitempty"`
+	ArchiveDeleted  int64               `json:"archive_deleted,omitempty"`
+	ArchiveKept     int64               `json:"archive_kept,omitempty"`
+	Failed          int64               `json:"failed"`
+	Errors          []prefixDeleteError `json:"errors,omitempty"`
+	After           string              `json:"after,omitempty"`
+}
+
+type prefixDeleteError struct {
+	Key   string `json:"key"`
+	Error string `json:"error"`
+}
+
+func (r *prefixDeleteResult) fail(key string, err error) {
+	r.Failed++
+	if len(r.Errors) < prefixDeleteMaxErrors {
+		r.Errors = append(r.Errors, prefixDeleteError{Key: key, Error: err.Error()})
+	}
+}
+
+// DeletePrefix queues the delete of everything under a prefix of a bucket, for
+// what /batch/delete cannot reach: a retired folder of hundreds of thousands
+// of objects nobody has the list of. The general token may use it on any
+// bucket, a bucket token on its own.
+//
+// Without "dry_run": false the job only counts: how many objects and bytes
+// the delete would remove, and a sample of their keys. Both kinds are polled
+// on GET /jobs/:id.
+func (h *jobsHandler) DeletePrefix(c *fiber.Ctx) error {
+	var req PrefixDeleteRequest
+	if err := c.BodyParser(&req); err != nil {
+		return service.Response(c, fiber.StatusBadRequest, false, "Invalid request body", nil)
+	}
+	bucketName, err := resolveBucket(c, req.Bucket)
+	if err != nil {
+		return bucketForbidden(c)
+	}
+	if bucketName == "" {
+		return service.Response(c, fiber.StatusBadRequest, false, "Bucket is required", nil)
+	}
+	if service.InternalBucket(bucketName) {
+		return bucketReserved(c)
+	}
+	// An empty prefix would be the whole bucket. That is DELETE
+	// /minio/:bucket/delete's business, with its own token, not a delete
+	// reachable by leaving a field out.
+	if req.Prefix == "" || service.HasUnsafeObjectKey(req.Prefix) {
+		return respondKeyError(c, &keyError{fiber.StatusBadRequest, "INVALID_KEY", "prefix must be a non-empty, safe key prefix"})
+	}
+	if req.MaxObjects < 0 {
+		return service.Response(c, fiber.StatusBadRequest, false, "max_objects must not be negative", nil)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	if exists, err := h.store.BucketExists(ctx, bucketName); err != nil || !exists {
+		return service.Response(c, fiber.StatusBadRequest, false, "Bucket not found", nil)
+	}
+	if req.AWSDelete && (h.img.awsService == nil || !h.img.awsService.BucketExists(bucketName)) {
+		return service.Response(c, fiber.StatusBadRequest, false, "AWS bucket not found", nil)
+	}
+
+	params, err := json.Marshal(prefixDeleteParams{
+		Bucket:     bucketName,
+		Prefix:     req.Prefix,
+		DryRun:     req.DryRun == nil || *req.DryRun,
+		AWSDelete:  req.AWSDelete,
+		MaxObjects: req.MaxObjects,
+	})
+	if err != nil {
+		return service.Response(c, fiber.StatusInternalServerError, false, err.Error(), nil)
+	}
+	if req.CallbackURL != "" {
+		if err := validator.ValidateUploadURL(req.CallbackURL); err != nil {
+			return service.Response(c, fiber.StatusBadRequest, false, "callback_url: "+err.Error(), nil)
+		}
+	}
+	job, err := h.jobs.Submit(context.Background(), service.Job{
+		Kind:        prefixDeleteKind,
+		Owner:       service.JobOwner(service.PrincipalFrom(c)),
+		Params:      params,
+		CallbackURL: req.CallbackURL,
+	})
+	if err != nil {
+		return service.Response(c, fiber.StatusServiceUnavailable, false, "could not queue the delete: "+err.Error(), nil)
+	}
+	return respondQueued(c, job, map[string]any{"dry_run": req.DryRun == nil || *req.DryRun})
+}
+
+// runPrefixDelete counts what is under the prefix and, unless the job is a
+// dry run, deletes it one object at a time at no more than deleteRate objects
+// a second.
+//
+// Each object is deleted the way DELETE /:bucket/* deletes it: a shared,
+// deduplicated object gives back a reference and stays while other uploads
+// hold it, a bucket with a trash moves it there, and its cached copies are
+// purged. The listing is in key order and the job records the last key it
+// dealt with, so a job resumed after its replica died starts after it: no
+// object has its reference given back twice. A reference given back is saved
+// at once for that reason; everything else every few hundred objects.
+//
+// With aws_delete, the archive is walked afterwards and every archived copy
+// under the prefix is deleted, including those of objects the retention job
+// had already evicted, except where MinIO still holds the object or, for an
+// evicted one, other uploads still hold its reference.
+func (h *jobsHandler) runPrefixDelete(ctx context.Context, job *service.Job, checkpoint func() error) error {
+	var params prefixDeleteParams
+	if err := json.Unmarshal(job.Params, &params); err != nil {
+		return fmt.Errorf("invalid job parameters: %w", err)
+	}
+	var res prefixDeleteResult
+	if len(job.Result) > 0 {
+		_ = json.Unmarshal(job.Result, &res)
+	}
+	save := func() error {
+		job.Total = int(res.Objects)
+		job.Done = int(res.Deleted + res.Kept)
+		job.Failed = int(res.Failed)
+		job.Result, _ = json.Marshal(res)
+		return checkpoint()
+	}
+
+	if res.Phase == "" || res.Phase == "counting" {
+		res = prefixDeleteResult{Phase: "counting"}
+		if err := h.countPrefix(ctx, params, &res, save); err != nil {
+			return err
+		}
+		if params.MaxObjects > 0 && res.Objects > params.MaxObjects {
+			res.Phase = "done"
+			if err := save(); err != nil {
+				return err
+			}
+			return fmt.Errorf("%d objects are under the prefix, more than max_objects (%d); nothing was deleted", res.Objects, params.MaxObjects)
+		}
+		res.Phase = "deleting"
+		if params.DryRun {
+			res.Phase = "done"
+		}
+		if err := save(); err != nil {
+			return err
+		}
+	}
+
+	if res.Phase == "deleting" {
+		if err := h.deletePrefix(ctx, params, &res, save); err != nil {
+			return err
+		}
+		res.Phase = "archive"
+		if err := save(); err != nil {
+			return err
+		}
+	}
+	if res.Phase == "archive" {
+		if params.AWSDelete {
+			if err := h.deleteArchivedPrefix(ctx, params, &res, save); err != nil {
+				return err
+			}
+		}
+		res.Phase = "done"
+		if err := save(); err != nil {
+			return err
+		}
+	}
+
+	if res.Failed > 0 && res.Deleted == 0 && res.Kept == 0 {
+		return fmt.Errorf("all %d deletes failed", res.Failed)
+	}
+	return nil
+}
+
+// countPrefix is the dry run every prefix delete starts with.
+func (h *jobsHandler) countPrefix(ctx context.Context, params prefixDeleteParams, res *prefixDeleteResult, save func() error) error {
+	for info := range h.store.ListObjects(ctx, params.Bucket, minio.ListObjectsOptions{Prefix: params.Prefix, Recursive: true}) {
+		if info.Err != nil {
+			return fmt.Errorf("list %s: %w", params.Bucket, info.Err)
+		}
+		res.Objects++
+		res.Bytes += info.Size
+		if len(res.Sample) < prefixDeleteSample {
+			res.Sample = append(res.Sample, info.Key)
+		}
+		// Counting a large prefix takes a while; the record has to be touched
+		// meanwhile, or the job looks dead to the other replicas.
+		if res.Objects%(10*prefixDeleteCheckpoint) == 0 {
+			if err := save(); err != nil {
+				return err
+			}
+		}
+	}
+	if params.AWSDelete && h.img.archive != nil && h.img.archive.Enabled() {
+		// The archive is walked a key at a time too, and a large one takes as
+		// long as the listing; it is saved on the same beat, counting every
+		// key walked, since keys outside the prefix take as long to get past.
+		walked := 0
+		err := h.img.archive.Walk(ctx, params.Bucket, func(key string, size int64) error {
+			if strings.HasPrefix(key, params.Prefix) {
+				res.ArchivedObjects++
+				res.ArchivedBytes += size
+			}
+			if walked++; walked%(10*prefixDeleteCheckpoint) == 0 {
+				if err := save(); err != nil {
+					return err
+				}
+			}
+			return ctx.Err()
+		})
+		if err != nil {
+			return fmt.Errorf("walk the archive of %s: %w", params.Bucket, err)
+		}
+	}
+	return nil
+}
+
+func (h *jobsHandler) deletePrefix(ctx context.Context, params prefixDeleteParams, res *prefixDeleteResult, save func() error) error {
+	pace := newPacer(h.deleteRate)
+	unsaved := 0
+	for info := range h.store.ListObjects(ctx, params.Bucket, minio.ListObjectsOptions{
+		Prefix:     params.Prefix,
+		Recursive:  true,
+		StartAfter: res.After,
+	}) {
+		if info.Err != nil {
+			return fmt.Errorf("list %s: %w", params.Bucket, info.Err)
+		}
+		if info.Key <= res.After {
+			continue
+		}
+		if err := pace.wait(ctx); err != nil {
+			return err
+		}
+
+		kept := false
+		refs, err := h.img.releaseReference(ctx, h.store, params.Bucket, info.Key, "")
+		switch {
+		case err != nil:
+			res.fail(info.Key, fmt.Errorf("could not update the reference count: %w", err))
+		case refs > 0:
+			res.Kept++
+			kept = true
+		default:
+			trashID, err := h.img.discard(ctx, h.store, params.Bucket, info.Key)
+			if err != nil {
+				res.fail(info.Key, err)
+				break
+			}
+			h.img.purgeCaches(ctx, service.PurgeDeleted, params.Bucket, info.Key)
+			res.Deleted++
+			if trashID != "" {
+				res.Trashed++
+			}
+		}
+		res.After = info.Key
+
+		if unsaved++; kept || unsaved >= prefixDeleteCheckpoint {
+			if err := save(); err != nil {
+				return err
+			}
+			unsaved = 0
+		}
+	}
+	return nil
+}
+
+// deleteArchivedPrefix deletes the archived copies under the prefix a batch
+// at a time, each batch one request paced like one delete. An object still in
+// MinIO (kept for other uploads, or one whose delete failed) keeps its
+// archived copy too. So does an archive-only object other uploads were
+// answered with, which the listing of MinIO never reached: its reference is
+// given back here instead, like deletePrefix gives back those of the objects
+// it lists.
+func (h *jobsHandler) deleteArchivedPrefix(ctx context.Context, params prefixDeleteParams, res *prefixDeleteResult, save func() error) error {
+	if h.img.archive == nil || !h.img.archive.Enabled() || h.img.awsService == nil {
+		return nil
+	}
+	pace := newPacer(h.deleteRate)
+	var batch []string
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		if err := pace.wait(ctx); err != nil {
+			return err
+		}
+		if err := h.img.awsService.DeleteObjects(params.Bucket, batch); err != nil {
+			for _, key := range batch {
+				res.fail(key, fmt.Errorf("archive: %w", err))
+			}
+		} else {
+			res.ArchiveDeleted += int64(len(batch))
+		}
+		batch = batch[:0]
+		return save()
+	}
+
+	// Neither the walk nor the stats write anything until a batch is full,
+	// and with most keys still in MinIO that can be never; both save on the
+	// counting beat so the job stays claimed meanwhile.
+	var keys []string
+	walked := 0
+	err := h.img.archive.Walk(ctx, params.Bucket, func(key string, _ int64) error {
+		if strings.HasPrefix(key, params.Prefix) {
+			keys = append(keys, key)
+		}
+		if walked++; walked%(10*prefixDeleteCheckpoint) == 0 {
+			if err := save(); err != nil {
+				return err
+			}
+		}
+		return ctx.Err()
+	})
+	if err != nil {
+		return fmt.Errorf("walk the archive of %s: %w", params.Bucket, err)
+	}
+	for n, key := range keys {
+		if n > 0 && n%(10*prefixDeleteCheckpoint) == 0 {
+			if err := save(); err != nil {
+				return err
+			}
+		}
+		if _, err := h.store.StatObject(ctx, params.Bucket, key, minio.StatObjectOptions{}); err == nil {
+			continue
+		} else if minio.ToErrorResponse(err).Code != "NoSuchKey" {
+			res.fail(key, fmt.Errorf("archive: could not check for a local copy: %w", err))
+			continue
+		}
+		if refs, err := h.img.releaseReference(ctx, h.store, params.Bucket, key, ""); err != nil {
+			res.fail(key, fmt.Errorf("archive: could not update the reference count: %w", err))
+			continue
+		} else if refs > 0 {
+			res.ArchiveKept++
+			continue
+		}
+		if batch = append(batch, key); len(batch) == prefixDeleteArchiveMax {
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+	}
+	return flush()
+}
+
+// pacer spaces out a job's writes to at most a given number a second, so a
+// delete of a few hundred thousand objects leaves MinIO to the requests being
+// served meanwhile. A rate of 0 or less does not wait.
+type pacer struct {
+	every time.Duration
+	next  time.Time
+}
+
+func newPacer(perSecond int) *pacer {
+	if perSecond <= 0 {
+		return &pacer{}
+	}
+	return &pacer{every: time.Second / time.Duration(perSecond)}
+}
+
+func (p *pacer) wait(ctx context.Context) error {
+	if p.every == 0 {
+		return ctx.Err()
+	}
+	now := time.Now()
+	if d := p.next.Sub(now); d > 0 {
+		timer := time.NewTimer(d)
+		defer timer.Stop()
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-timer.C:
+		}
+		now = p.next
+	}
+	p.next = now.Add(p.every)
+	return nil
+}
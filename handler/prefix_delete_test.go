@@ -0,0 +1,249 @@
+package handler
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/minio/minio-go/v7"
+
+	"github.com/mstgnz/cdn/service"
+)
+
+// newPrefixDeleteJobs is a jobs handler over a bucket holding a few objects
+// under "a/" and a few beside it, one of them only starting with "a".
+func newPrefixDeleteJobs(t *testing.T) (*jobsHandler, *memStore, *memArchive, *mockAwsService) {
+	t.Helper()
+	store := newMemStore("photos")
+	for _, key := range []string{"a/1.png", "a/2.png", "a/sub/3.png", "ab/4.png", "b/5.png"} {
+		if _, err := store.PutObject(context.Background(), "photos", key, bytes.NewReader([]byte(key)), int64(len(key)), minio.PutObjectOptions{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	archive := newMemArchive()
+	aws := &mockAwsService{bucketExists: true}
+	img := image{archive: archive, notifier: &recordingNotifier{}, awsService: aws}
+	return &jobsHandler{img: img, store: store}, store, archive, aws
+}
+
+func runPrefixDeleteJob(t *testing.T, h *jobsHandler, job *service.Job, params prefixDeleteParams) (prefixDeleteResult, error) {
+	t.Helper()
+	job.Params, _ = json.Marshal(params)
+	err := h.runPrefixDelete(context.Background(), job, func() error { return nil })
+	var res prefixDeleteResult
+	if jerr := json.Unmarshal(job.Result, &res); jerr != nil {
+		t.Fatalf("result %s: %v", job.Result, jerr)
+	}
+	return res, err
+}
+
+func storedKeys(store *memStore) []string {
+	var keys []string
+	for info := range store.ListObjects(context.Background(), "photos", minio.ListObjectsOptions{Recursive: true}) {
+		keys = append(keys, info.Key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// A dry run counts what the delete would remove and removes nothing.
+func TestPrefixDeleteDryRunOnlyCounts(t *testing.T) {
+	h, store, _, _ := newPrefixDeleteJobs(t)
+	res, err := runPrefixDeleteJob(t, h, &service.Job{}, prefixDeleteParams{Bucket: "photos", Prefix: "a/", DryRun: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Phase != "done" || res.Objects != 3 || res.Bytes != int64(len("a/1.png")*2+len("a/sub/3.png")) || len(res.Sample) != 3 || res.Deleted != 0 {
+		t.Errorf("result = %+v", res)
+	}
+	if got := storedKeys(store); len(got) != 5 {
+		t.Errorf("a dry run deleted: %v", got)
+	}
+}
+
+// The delete removes everything under the prefix and nothing beside it, and
+// with aws_delete the archived copies under it, including one whose object the
+// retention job had already evicted.
+func TestPrefixDeleteRemovesThePrefixAndItsArchive(t *testing.T) {
+	ctx := context.Background()
+	h, store, archive, aws := newPrefixDeleteJobs(t)
+	for _, key := range []string{"a/1.png", "a/evicted.png", "b/5.png"} {
+		if err := archive.Put(ctx, "photos", key, bytes.NewReader([]byte(key)), "", ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	job := &service.Job{}
+	res, err := runPrefixDeleteJob(t, h, job, prefixDeleteParams{Bucket: "photos", Prefix: "a/", AWSDelete: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := storedKeys(store); len(got) != 2 || got[0] != "ab/4.png" || got[1] != "b/5.png" {
+		t.Errorf("left = %v", got)
+	}
+	sort.Strings(aws.deleted)
+	if len(aws.deleted) != 2 || aws.deleted[0] != "a/1.png" || aws.deleted[1] != "a/evicted.png" {
+		t.Errorf("archive deletes = %v", aws.deleted)
+	}
+	if res.Phase != "done" || res.Deleted != 3 || res.ArchivedObjects != 2 || res.ArchiveDeleted != 2 || res.Failed != 0 || res.After != "a/sub/3.png" {
+		t.Errorf("result = %+v", res)
+	}
+	if job.Total != 3 || job.Done != 3 {
+		t.Errorf("job progress = %d/%d", job.Done, job.Total)
+	}
+}
+
+// A job resumed after its replica died carries on after the last key it
+// recorded instead of starting over.
+func TestPrefixDeleteResumesAfterTheLastKey(t *testing.T) {
+	h, store, _, _ := newPrefixDeleteJobs(t)
+	job := &service.Job{}
+	job.Result, _ = json.Marshal(prefixDeleteResult{Phase: "deleting", Objects: 3, Deleted: 1, After: "a/1.png"})
+
+	res, err := runPrefixDeleteJob(t, h, job, prefixDeleteParams{Bucket: "photos", Prefix: "a/"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := storedKeys(store); len(got) != 3 || got[0] != "a/1.png" {
+		t.Errorf("left = %v", got)
+	}
+	if res.Deleted != 3 || res.Objects != 3 {
+		t.Errorf("result = %+v", res)
+	}
+}
+
+// More objects than max_objects fails the job before anything is deleted.
+func TestPrefixDeleteHoldsToMaxObjects(t *testing.T) {
+	h, store, _, _ := newPrefixDeleteJobs(t)
+	res, err := runPrefixDeleteJob(t, h, &service.Job{}, prefixDeleteParams{Bucket: "photos", Prefix: "a/", MaxObjects: 2})
+	if err == nil {
+		t.Fatal("a delete over max_objects succeeded")
+	}
+	if res.Objects != 3 || res.Deleted != 0 {
+		t.Errorf("result = %+v", res)
+	}
+	if got := storedKeys(store); len(got) != 5 {
+		t.Errorf("deleted over max_objects: %v", got)
+	}
+}
+
+// A long archive walk checkpoints as it goes, and stops the job, with nothing
+// deleted, once a checkpoint reports that another replica has taken it over.
+func TestPrefixDeleteCheckpointsDuringTheArchiveWalk(t *testing.T) {
+	h, store, archive, _ := newPrefixDeleteJobs(t)
+	for n := 0; n < 10*prefixDeleteCheckpoint; n++ {
+		archive.objects[fmt.Sprintf("photos/old/%d.png", n)] = []byte("x")
+	}
+	job := &service.Job{}
+	job.Params, _ = json.Marshal(prefixDeleteParams{Bucket: "photos", Prefix: "a/", AWSDelete: true})
+	checkpoints := 0
+	err := h.runPrefixDelete(context.Background(), job, func() error {
+		checkpoints++
+		return service.ErrJobLost
+	})
+	if !errors.Is(err, service.ErrJobLost) || checkpoints != 1 {
+		t.Fatalf("err = %v after %d checkpoints", err, checkpoints)
+	}
+	if keys := storedKeys(store); len(keys) != 5 {
+		t.Errorf("a job whose claim was lost deleted objects: %v", keys)
+	}
+}
+
+// A deduplicated object other uploads still hold is kept, as on DELETE.
+func TestPrefixDeleteKeepsSharedObjects(t *testing.T) {
+	ctx := context.Background()
+	img, store := newDedupImage(t)
+	img.notifier = &recordingNotifier{}
+	sum := storeAs(t, img, store, "shared/logo.png", []byte("the company logo"))
+	if _, _, ok := img.reuseDuplicate(ctx, store, "logos", sum); !ok {
+		t.Fatal("no second reference")
+	}
+	h := &jobsHandler{img: img, store: store}
+
+	job := &service.Job{}
+	job.Params, _ = json.Marshal(prefixDeleteParams{Bucket: "logos", Prefix: "shared/"})
+	if err := h.runPrefixDelete(ctx, job, func() error { return nil }); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := store.get("logos", "shared/logo.png"); !ok {
+		t.Fatal("a shared object was deleted")
+	}
+	var res prefixDeleteResult
+	_ = json.Unmarshal(job.Result, &res)
+	if res.Kept != 1 || res.Deleted != 0 || job.Done != 1 {
+		t.Errorf("result = %+v", res)
+	}
+}
+
+// An archive-only object is not in the listing of MinIO, but other uploads
+// can hold it all the same: the archive pass gives back its reference, and
+// keeps the archived copy while any remain.
+func TestPrefixDeleteKeepsSharedArchivedObjects(t *testing.T) {
+	ctx := context.Background()
+	img, store := newDedupImage(t)
+	aws := &mockAwsService{bucketExists: true}
+	img.notifier, img.awsService = &recordingNotifier{}, aws
+	for key, data := range map[string]string{"cold/shared.png": "the company logo", "cold/alone.png": "an old banner"} {
+		sum := storeAs(t, img, store, key, []byte(data))
+		_ = img.archive.Put(ctx, "logos", key, bytes.NewReader([]byte(data)), sum, "")
+		_ = store.RemoveObject(ctx, "logos", key, minio.RemoveObjectOptions{})
+		if key == "cold/shared.png" {
+			if _, _, ok := img.reuseDuplicate(ctx, store, "logos", sum); !ok {
+				t.Fatal("no second reference")
+			}
+		}
+	}
+	h := &jobsHandler{img: img, store: store}
+
+	job := &service.Job{}
+	job.Params, _ = json.Marshal(prefixDeleteParams{Bucket: "logos", Prefix: "cold/", AWSDelete: true})
+	if err := h.runPrefixDelete(ctx, job, func() error { return nil }); err != nil {
+		t.Fatal(err)
+	}
+	if len(aws.deleted) != 1 || aws.deleted[0] != "cold/alone.png" {
+		t.Fatalf("archive deletes = %v, want only the unshared object", aws.deleted)
+	}
+	var res prefixDeleteResult
+	_ = json.Unmarshal(job.Result, &res)
+	if res.ArchiveKept != 1 || res.ArchiveDeleted != 1 || res.Failed != 0 {
+		t.Errorf("result = %+v", res)
+	}
+}
+
+// The endpoint refuses another bucket and an empty prefix, and queues a dry
+// run unless told otherwise.
+func TestDeletePrefixQueuesADryRun(t *testing.T) {
+	app, jobs := newJobsApp(t)
+	if status, _ := postJSON(t, app, "/objects/delete-prefix", "docs", map[string]any{"bucket": "photos", "prefix": "a/"}); status != fiber.StatusForbidden {
+		t.Errorf("other bucket: status %d", status)
+	}
+	if status, out := postJSON(t, app, "/objects/delete-prefix", "photos", map[string]any{"bucket": "photos"}); status != fiber.StatusBadRequest {
+		t.Errorf("empty prefix: status %d: %v", status, out)
+	}
+	if status, _ := postJSON(t, app, "/objects/delete-prefix", "", map[string]any{"bucket": "missing", "prefix": "a/"}); status != fiber.StatusBadRequest {
+		t.Errorf("missing bucket: status %d", status)
+	}
+
+	status, out := postJSON(t, app, "/objects/delete-prefix", "photos", map[string]any{"prefix": "a/"})
+	if status != fiber.StatusAccepted {
+		t.Fatalf("status %d: %v", status, out)
+	}
+	data := out["data"].(map[string]any)
+	if data["dry_run"] != true {
+		t.Errorf("data = %v", data)
+	}
+	job, err := jobs.Get(context.Background(), data["job_id"].(string))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var params prefixDeleteParams
+	_ = json.Unmarshal(job.Params, &params)
+	if job.Kind != prefixDeleteKind || params != (prefixDeleteParams{Bucket: "photos", Prefix: "a/", DryRun: true}) {
+		t.Errorf("job = %+v, params = %+v", job, params)
+	}
+}
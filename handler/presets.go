@@ -0,0 +1,304 @@
+package handler
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/minio/minio-go/v7"
+
+	"github.com/mstgnz/cdn/pkg/config"
+	"github.com/mstgnz/cdn/pkg/observability"
+	"github.com/mstgnz/cdn/pkg/worker"
+	"github.com/mstgnz/cdn/service"
+)
+
+// Preset generation states, as reported on the metadata endpoint.
+const (
+	presetsPending = "pending" // queued, nothing generated yet
+	presetsDone    = "done"    // every preset generated
+	presetsPartial = "partial" // some generated, some failed
+	presetsFailed  = "failed"  // none generated
+	presetsSkipped = "skipped" // never queued: the pool was full or shutting down
+)
+
+// presetStatusTTL outlives any sensible generation time by far. The record is
+// only useful shortly after an upload, and a missing record reads as "nothing
+// known" rather than as an error.
+const presetStatusTTL = 7 * 24 * time.Hour
+
+// PresetStatus is what the metadata endpoint reports about an upload's
+// eagerly generated sizes.
+type PresetStatus struct {
+	State     string         `json:"state"`
+	Results   []PresetResult `json:"results,omitempty"`
+	UpdatedAt time.Time      `json:"updated_at"`
+}
+
+// PresetResult is the outcome for one preset.
+type PresetResult struct {
+	Name   string `json:"name"`
+	Width  uint   `json:"width,omitempty"`
+	Height uint   `json:"height,omitempty"`
+	OK     bool   `json:"ok"`
+	Error  string `json:"error,omitempty"`
+
+	// Warning is set on a generated preset that is stored less durably than
+	// it should be; see generatePresets.
+	Warning string `json:"warning,omitempty"`
+}
+
+func presetStatusKey(bucket, object string) string {
+	return service.CacheNamespace() + ":presets:" + bucket + ":" + object
+}
+
+// newPresetPool is separate from the /resize pool on purpose. Eager generation
+// is work nobody is waiting for, and a burst of uploads must not fill the queue
+// an interactive resize needs. It never retries: a preset that failed once
+// fails the same way again, and the read path still computes it on demand.
+func newPresetPool() *worker.Pool {
+	cfg := worker.DefaultConfig()
+	cfg.Workers = config.GetEnvAsIntOrDefault("PRESET_WORKERS", 2)
+	cfg.QueueSize = config.GetEnvAsIntOrDefault("PRESET_QUEUE_SIZE", 1000)
+	cfg.MaxRetries = 0
+	if cfg.Workers < 1 {
+		cfg.Workers = 1
+	}
+	p := worker.NewPool(cfg)
+	p.Start()
+	return p
+}
+
+// schedulePresets queues the bucket's presets for a just-stored upload. It is
+// called after the object is in MinIO, so the ETag it is given is the one the
+// read path will look variants up under.
+//
+// The queue holds the object's name and ETag, not its bytes: PRESET_QUEUE_SIZE
+// full uploads held in memory until a worker gets to them would be gigabytes
+// at the default. The worker reads the object back from store instead (see
+// runPresets), which costs one read of something just written.
+//
+// Nothing here can fail the upload. A full queue is recorded as skipped and
+// the sizes are then produced the ordinary way, on first request.
+func (i image) schedulePresets(store service.ObjectStore, bucket, object, etag string) {
+	if i.presetPool == nil || !service.IsImageFile(object) || etag == "" {
+		return
+	}
+	presets := config.PresetsFor(bucket)
+	if len(presets) == 0 {
+		return
+	}
+
+	i.writePresetStatus(bucket, object, PresetStatus{State: presetsPending})
+
+	err := i.presetPool.Submit(worker.Job{
+		ID:   uuid.New().String(),
+		Task: func() error { i.runPresets(store, bucket, object, etag, presets); return nil },
+		// Buffered so the worker's result send never waits on a reader; nobody
+		// reads it.
+		Response: make(chan error, 1),
+	})
+	if err != nil {
+		log := observability.Logger()
+		log.Warn().Err(err).
+			Str("bucket", bucket).
+			Str("key", object).
+			Msg("presets not queued; they are generated on first request instead")
+		i.writePresetStatus(bucket, object, PresetStatus{State: presetsSkipped})
+	}
+}
+
+// errSourceChanged is sourceUnchanged's answer for an object that no longer
+// has the ETag it was read with.
+var errSourceChanged = errors.New("the object changed after it was read")
+
+// sourceUnchanged checks that object still has etag, the ETag it was read
+// with; "" is an object read from the archive, which MinIO still does not
+// hold. It is for whatever is derived from the bytes and kept by name alone,
+// as a variant in Redis is, where bytes of the replaced object would go on
+// being served as the new one's.
+func sourceUnchanged(ctx context.Context, store service.ObjectStore, bucket, object, etag string) error {
+	info, err := store.StatObject(ctx, bucket, object, minio.StatObjectOptions{})
+	if err != nil {
+		if minio.ToErrorResponse(err).Code == "NoSuchKey" {
+			if etag == "" {
+				return nil
+			}
+			return errSourceChanged
+		}
+		return err
+	}
+	if normalizeETag(info.ETag) != normalizeETag(etag) {
+		return errSourceChanged
+	}
+	return nil
+}
+
+// cacheVariant puts a variant of object, made from the bytes etag names, in
+// the cache, and reports whether it is there. The cache is keyed on the name,
+// and the read and resize before this can take long enough (a preset waits up
+// to PRESET_SLOT_WAIT_SEC for a slot) for the object to be replaced
+// meanwhile, and its variants purged. Caching the variant after that purge
+// would serve the old image at the new one's URL until it expired, so the
+// ETag is checked again just before the write. That is not atomic with it, but
+// leaves a window of one round trip rather than a resize's.
+func (i image) cacheVariant(ctx context.Context, store service.ObjectStore, bucket, object, etag string, width, height uint, data []byte) bool {
+	if i.cache == nil || sourceUnchanged(ctx, store, bucket, object, etag) != nil {
+		return false
+	}
+	return i.cache.SetResizedImage(bucket, object, width, height, data) == nil
+}
+
+// runPresets reads a queued upload back and generates its presets.
+//
+// An object replaced or deleted since it was queued is dropped without a
+// word: the status record is keyed on the name alone, so failing it here would
+// overwrite whatever the replacing upload recorded, and presets made from the
+// new bytes under the old ETag would never be looked up anyway.
+func (i image) runPresets(store service.ObjectStore, bucket, object, etag string, presets []config.Preset) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	content, err := presetSource(ctx, store, bucket, object, etag)
+	cancel()
+	if errors.Is(err, errSourceChanged) {
+		return
+	}
+	if err != nil {
+		results := make([]PresetResult, 0, len(presets))
+		for _, p := range presets {
+			results = append(results, PresetResult{Name: p.Name, Width: p.Width, Height: p.Height, Error: "could not read the upload: " + err.Error()})
+		}
+		i.writePresetStatus(bucket, object, PresetStatus{State: presetsFailed, Results: results})
+		return
+	}
+	i.generatePresets(store, bucket, object, etag, content, presets)
+}
+
+// presetSource reads object as it was when stored with etag. OpenObject takes
+// no precondition, so the ETag is checked on both sides of the read: equal
+// before and after means the bytes read are the ones the ETag names.
+func presetSource(ctx context.Context, store service.ObjectStore, bucket, object, etag string) ([]byte, error) {
+	unchanged := func() error { return sourceUnchanged(ctx, store, bucket, object, etag) }
+	if err := unchanged(); err != nil {
+		return nil, err
+	}
+	rc, err := store.OpenObject(ctx, bucket, object)
+	if err != nil {
+		return nil, err
+	}
+	content, err := io.ReadAll(rc)
+	rc.Close()
+	if err != nil {
+		return nil, err
+	}
+	if err := unchanged(); err != nil {
+		return nil, err
+	}
+	return content, nil
+}
+
+// generatePresets produces each preset in turn. Every decode goes through the
+// same slots as the read path, so eager work competes fairly with visitors
+// instead of starving them; it just waits longer for a slot, since nobody is
+// waiting on it.
+//
+// A preset counts as generated once it is stored somewhere the read path
+// looks. When the derivative store refuses it but Redis took it, it is
+// generated with a warning, since it is served until Redis evicts it; when
+// neither took it, it failed.
+//
+// Redis keys a variant on the name alone, so before each write the object is
+// checked to still have etag (see cacheVariant). One replaced while a preset
+// waited for its slot is dropped as runPresets drops it.
+func (i image) generatePresets(store service.ObjectStore, bucket, object, etag string, content []byte, presets []config.Preset) {
+	wait := time.Duration(config.GetEnvAsIntOrDefault("PRESET_SLOT_WAIT_SEC", 60)) * time.Second
+	results := make([]PresetResult, 0, len(presets))
+	generated := 0
+
+	for _, p := range presets {
+		res := PresetResult{Name: p.Name, Width: p.Width, Height: p.Height}
+		release, ok := acquireResizeSlotWithin(wait)
+		if !ok {
+			res.Error = "no resize slot available"
+			results = append(results, res)
+			continue
+		}
+		resized := i.imageService.ImagickResize(content, p.Width, p.Height)
+		release()
+
+		// ImagickResize returns its input unchanged on failure; storing that
+		// would cache the original under the preset's size.
+		if bytes.Equal(resized, content) {
+			res.Error = "resize failed"
+			results = append(results, res)
+			continue
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		err := sourceUnchanged(ctx, store, bucket, object, etag)
+		if errors.Is(err, errSourceChanged) {
+			cancel()
+			return
+		}
+		cached := err == nil && i.cache != nil && i.cache.SetResizedImage(bucket, object, p.Width, p.Height, resized) == nil
+		err = i.derivatives.Store(ctx, bucket, object, p.Width, p.Height, etag, resized)
+		cancel()
+		switch {
+		case err == nil:
+			res.OK = true
+		case cached:
+			res.OK = true
+			res.Warning = "derivative store write failed; served from the cache until it is evicted"
+		default:
+			res.Error = "derivative store write failed: " + err.Error()
+		}
+		if res.OK {
+			generated++
+		}
+		results = append(results, res)
+	}
+
+	state := presetsDone
+	switch {
+	case generated == 0:
+		state = presetsFailed
+	case generated < len(presets):
+		state = presetsPartial
+	}
+	i.writePresetStatus(bucket, object, PresetStatus{State: state, Results: results})
+}
+
+// writePresetStatus records progress in the shared cache so any replica can
+// answer the metadata endpoint. Without a cache there is nowhere shared to put
+// it and the endpoint reports no status.
+func (i image) writePresetStatus(bucket, object string, st PresetStatus) {
+	if i.cache == nil {
+		return
+	}
+	st.UpdatedAt = time.Now().UTC()
+	data, err := json.Marshal(st)
+	if err != nil {
+		return
+	}
+	_ = i.cache.Set(presetStatusKey(bucket, object), data, presetStatusTTL)
+}
+
+// presetStatus reads the record back. Nil means none is known: the bucket has
+// no presets, the upload predates them, or the record has expired.
+func (i image) presetStatus(bucket, object string) *PresetStatus {
+	if i.cache == nil {
+		return nil
+	}
+	data, err := i.cache.Get(presetStatusKey(bucket, object))
+	if err != nil || len(data) == 0 {
+		return nil
+	}
+	var st PresetStatus
+	if json.Unmarshal(data, &st) != nil {
+		return nil
+	}
+	return &st
+}
@@ -0,0 +1,265 @@
+package handler
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+
+	"github.com/mstgnz/cdn/pkg/config"
+	"github.com/mstgnz/cdn/service"
+)
+
+// presetCache keeps variants and plain keys in memory. Anything else panics
+// through the nil embedded interface.
+type presetCache struct {
+	service.CacheService
+	mu       sync.Mutex
+	values   map[string][]byte
+	variants map[string][]byte
+}
+
+func newPresetCache() *presetCache {
+	return &presetCache{values: map[string][]byte{}, variants: map[string][]byte{}}
+}
+
+func (p *presetCache) Get(key string) ([]byte, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.values[key], nil
+}
+
+func (p *presetCache) Set(key string, value []byte, _ time.Duration) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.values[key] = value
+	return nil
+}
+
+func (p *presetCache) SetResizedImage(bucket, object string, width, height uint, data []byte) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.variants[memoryKey(bucket, object, width, height)] = data
+	return nil
+}
+
+func (p *presetCache) Delete(key string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.values, key)
+	return nil
+}
+
+func (p *presetCache) PurgeVariants(_ context.Context, scope service.PurgeScope) (int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	n := 0
+	for k := range p.variants {
+		if strings.HasPrefix(k, scope.Bucket+"/"+scope.Key+"@") {
+			delete(p.variants, k)
+			n++
+		}
+	}
+	return n, nil
+}
+
+func memoryKey(bucket, object string, width, height uint) string {
+	return fmt.Sprintf("%s/%s@%dx%d", bucket, object, width, height)
+}
+
+func loadPresetPolicy(t *testing.T, body string) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "buckets.json")
+	if err := os.WriteFile(path, []byte(body), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := config.LoadBucketPolicies(path); err != nil {
+		t.Fatalf("load policies: %v", err)
+	}
+	t.Cleanup(func() { _, _ = config.LoadBucketPolicies(filepath.Join(t.TempDir(), "absent.json")) })
+}
+
+func TestGeneratePresetsFillsTheCacheAndRecordsStatus(t *testing.T) {
+	cache := newPresetCache()
+	img := image{imageService: &service.ImageService{}, cache: cache}
+
+	presets := []config.Preset{
+		{Name: "thumb", Width: 100},
+		{Name: "card", Width: 200, Height: 100},
+	}
+	store := newMemStore("photos")
+	etag := putPNG(t, store, "photos", "a.png", pngFixture(t, 400, 300))
+	img.generatePresets(store, "photos", "a.png", etag, pngFixture(t, 400, 300), presets)
+
+	if len(cache.variants) != 2 {
+		t.Fatalf("cached %d variants, want 2", len(cache.variants))
+	}
+	st := img.presetStatus("photos", "a.png")
+	if st == nil || st.State != presetsDone || len(st.Results) != 2 {
+		t.Fatalf("status = %+v, want done with two results", st)
+	}
+	for _, r := range st.Results {
+		if !r.OK {
+			t.Errorf("preset %s not generated: %s", r.Name, r.Error)
+		}
+	}
+}
+
+// An undecodable source must not be stored under the preset sizes:
+// ImagickResize hands the input back, and caching that would serve the
+// original as a thumbnail.
+func TestGeneratePresetsDoesNotCacheAFailedResize(t *testing.T) {
+	cache := newPresetCache()
+	img := image{imageService: &service.ImageService{}, cache: cache}
+
+	store := newMemStore("photos")
+	etag := putPNG(t, store, "photos", "a.png", []byte("not an image"))
+	img.generatePresets(store, "photos", "a.png", etag, []byte("not an image"), []config.Preset{{Name: "thumb", Width: 100}})
+
+	if len(cache.variants) != 0 {
+		t.Fatalf("cached %d variants for an undecodable source", len(cache.variants))
+	}
+	if st := img.presetStatus("photos", "a.png"); st == nil || st.State != presetsFailed {
+		t.Fatalf("status = %+v, want failed", st)
+	}
+}
+
+func TestSchedulePresetsOnlyForBucketsThatHaveThem(t *testing.T) {
+	loadPresetPolicy(t, `{"buckets":[{"bucket":"photos","presets":[{"name":"thumb","width":100}]}]}`)
+
+	cache := newPresetCache()
+	img := image{imageService: &service.ImageService{}, cache: cache, presetPool: newPresetPool()}
+	t.Cleanup(img.presetPool.Stop)
+
+	store := newMemStore("docs", "photos")
+	stored := func(bucket string) string {
+		return putPNG(t, store, bucket, "a.png", pngFixture(t, 400, 300))
+	}
+
+	img.schedulePresets(store, "docs", "a.png", stored("docs"))
+	if st := img.presetStatus("docs", "a.png"); st != nil {
+		t.Fatalf("a bucket without presets got status %+v", st)
+	}
+
+	img.schedulePresets(store, "photos", "a.png", stored("photos"))
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		st := img.presetStatus("photos", "a.png")
+		if st != nil && st.State == presetsDone {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("presets not generated in time; status %+v", st)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// putPNG stores an image and returns its ETag.
+func putPNG(t *testing.T, store *memStore, bucket, key string, data []byte) string {
+	t.Helper()
+	info, err := store.PutObject(context.Background(), bucket, key, bytes.NewReader(data), int64(len(data)), minio.PutObjectOptions{ContentType: "image/png"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return info.ETag
+}
+
+// A queued upload replaced before its turn is dropped rather than resized:
+// the replacing upload's own presets and status are the ones that count.
+func TestRunPresetsSkipsAReplacedUpload(t *testing.T) {
+	cache := newPresetCache()
+	img := image{imageService: &service.ImageService{}, cache: cache}
+	store := newMemStore("photos")
+	store.versionBucket("photos") // so the replacement has another ETag
+	old := putPNG(t, store, "photos", "a.png", pngFixture(t, 400, 300))
+	putPNG(t, store, "photos", "a.png", pngFixture(t, 300, 200))
+	img.writePresetStatus("photos", "a.png", PresetStatus{State: presetsPending})
+
+	img.runPresets(store, "photos", "a.png", old, []config.Preset{{Name: "thumb", Width: 100}})
+
+	if len(cache.variants) != 0 {
+		t.Fatalf("cached %d variants of a replaced upload", len(cache.variants))
+	}
+	if st := img.presetStatus("photos", "a.png"); st == nil || st.State != presetsPending {
+		t.Fatalf("status = %+v, want the replacing upload's pending", st)
+	}
+}
+
+// The source replaced while a preset was being made, as one that waited for
+// a slot can be, and purged with it: the variant of the old bytes must not go
+// into Redis after the purge, where it would be served for the new image.
+func TestGeneratePresetsSkipsTheCacheForAReplacedSource(t *testing.T) {
+	cache := newPresetCache()
+	img := image{imageService: &service.ImageService{}, cache: cache}
+	store := newMemStore("photos")
+	store.versionBucket("photos")
+	old := putPNG(t, store, "photos", "a.png", pngFixture(t, 400, 300))
+	putPNG(t, store, "photos", "a.png", pngFixture(t, 300, 200))
+	img.writePresetStatus("photos", "a.png", PresetStatus{State: presetsPending})
+
+	img.generatePresets(store, "photos", "a.png", old, pngFixture(t, 400, 300), []config.Preset{{Name: "thumb", Width: 100}})
+
+	if len(cache.variants) != 0 {
+		t.Fatalf("cached %d variants of the replaced bytes", len(cache.variants))
+	}
+	if st := img.presetStatus("photos", "a.png"); st == nil || st.State != presetsPending {
+		t.Fatalf("status = %+v, want the replacing upload's pending", st)
+	}
+	if img.cacheVariant(context.Background(), store, "photos", "a.png", old, 100, 0, []byte("old thumb")) {
+		t.Fatal("cacheVariant cached a variant of the replaced bytes")
+	}
+}
+
+// refusingStore fails every write, as a derivative store that is full or
+// unreachable does.
+type refusingStore struct{ *memStore }
+
+func (refusingStore) PutObject(context.Context, string, string, io.Reader, int64, minio.PutObjectOptions) (minio.UploadInfo, error) {
+	return minio.UploadInfo{}, errors.New("bucket unreachable")
+}
+
+// A preset the derivative store refused is a failure when nothing else holds
+// it, not a success with an error beside it.
+func TestGeneratePresetsReportsAFailedStoreWrite(t *testing.T) {
+	t.Setenv("DERIVATIVES_BUCKET", "cdn-derivatives")
+	derivatives, err := service.NewDerivativeStore(refusingStore{newMemStore("cdn-derivatives")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	img := image{imageService: &service.ImageService{}, cache: newPresetCache(), derivatives: derivatives}
+	thumb := []config.Preset{{Name: "thumb", Width: 100}}
+	store := newMemStore("photos")
+	etag := putPNG(t, store, "photos", "a.png", pngFixture(t, 400, 300))
+
+	img.generatePresets(store, "photos", "a.png", etag, pngFixture(t, 400, 300), thumb)
+	st := img.presetStatus("photos", "a.png")
+	if st == nil || st.State != presetsDone || !st.Results[0].OK || st.Results[0].Warning == "" {
+		t.Fatalf("with the cache holding it: status = %+v, want done with a warning", st)
+	}
+
+	// Without a cache the status has nowhere to go, so the results are read
+	// from a cache that refuses variants.
+	img.cache = &refusingCache{newPresetCache()}
+	img.generatePresets(store, "photos", "a.png", etag, pngFixture(t, 400, 300), thumb)
+	st = img.presetStatus("photos", "a.png")
+	if st == nil || st.State != presetsFailed || st.Results[0].OK || st.Results[0].Error == "" {
+		t.Fatalf("with nothing holding it: status = %+v, want failed", st)
+	}
+}
+
+// refusingCache keeps plain keys but refuses variants.
+type refusingCache struct{ *presetCache }
+
+func (refusingCache) SetResizedImage(string, string, uint, uint, []byte) error {
+	return errors.New("cache full")
+}
@@ -0,0 +1,547 @@
+package handler
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"github.com/minio/minio-go/v7"
+	"github.com/rs/zerolog"
+
+	bucketname "github.com/mstgnz/cdn/pkg/bucket"
+	"github.com/mstgnz/cdn/pkg/config"
+	"github.com/mstgnz/cdn/pkg/observability"
+	"github.com/mstgnz/cdn/pkg/validator"
+	"github.com/mstgnz/cdn/service"
+)
+
+// PresignHandler hands out direct-to-MinIO upload URLs and turns what arrives
+// through them into ordinary objects.
+type PresignHandler interface {
+	Presign(c *fiber.Ctx) error
+	Finalize(c *fiber.Ctx) error
+
+	// Start removes staged uploads that were never finalized.
+	Start(ctx context.Context)
+}
+
+// presignSigner is the part of *minio.Client that signs URLs. Signing is
+// local; no request is made.
+type presignSigner interface {
+	PresignedPutObject(ctx context.Context, bucket, object string, expires time.Duration) (*url.URL, error)
+	PresignedPostPolicy(ctx context.Context, p *minio.PostPolicy) (*url.URL, map[string]string, error)
+}
+
+// presignHandler takes large uploads off the API pods. Every byte of /upload
+// passes through this process and under its 100MB BodyLimit; here the browser
+// writes straight to MinIO with a short-lived signed URL, and the service only
+// sees the file again when asked to finalize it. Such an upload may be up to
+// PRESIGN_MAX_FILE_SIZE, which is not bound to MAX_FILE_SIZE.
+//
+// The signed URL can only ever write one staging key in the staging bucket, so
+// nothing a client uploads reaches a real bucket without passing the same
+// checks as /upload. Finalize moves the staged object out of the URL's reach,
+// validates it, optionally optimises it, and moves it to a random name in the
+// requested bucket; an unmodified file is moved with a server-side copy rather
+// than a second upload. Only images are read into memory to be checked, and
+// only up to MAX_FILE_SIZE; everything else is checked as it streams from
+// MinIO.
+type presignHandler struct {
+	img      image
+	store    service.ObjectStore
+	signer   presignSigner
+	staging  string
+	expiry   time.Duration // how long the URL is valid
+	keep     time.Duration // how long an unfinalized upload is kept
+	maxSize  int64         // PRESIGN_MAX_FILE_SIZE, for any upload
+	imageMax int64         // MAX_FILE_SIZE, for images, which are decoded in memory
+	logger   zerolog.Logger
+	now      func() time.Time
+}
+
+// presignedUpload is the record of an issued URL, kept in the staging bucket
+// next to where the data will land.
+type presignedUpload struct {
+	ID        string    `json:"id"`
+	Bucket    string    `json:"bucket"`
+	Path      string    `json:"path,omitempty"`
+	Filename  string    `json:"filename"`
+	CreatedAt time.Time `json:"created_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+
+	// Attrs are the metadata and tags the object is stored with at finalize.
+	Attrs objectAttrs `json:"attrs"`
+}
+
+// PresignRequest asks for an upload URL. Filename decides the stored extension
+// and is checked against the allowlist now, before anything is uploaded. Size
+// is optional; when given, an over-limit file is refused before it is sent.
+type PresignRequest struct {
+	Bucket   string `json:"bucket"`
+	Path     string `json:"path"`
+	Filename string `json:"filename" validate:"required"`
+	Size     int64  `json:"size"`
+
+	// Metadata and Tags are attached to the object at finalize, as on
+	// /upload-url. See objectAttrs.
+	Metadata map[string]string `json:"metadata"`
+	Tags     map[string]string `json:"tags"`
+}
+
+// FinalizeRequest is the optional body of the finalize call.
+type FinalizeRequest struct {
+	Optimize bool `json:"optimize"`
+}
+
+const presignPrefix = "presigned/"
+
+// defaultPresignMaxSize is the most a single PUT to S3 can be, and so the
+// most a signed PUT URL can take and a server-side copy can move.
+const defaultPresignMaxSize int64 = 5 << 30
+
+func presignInfoKey(id string) string { return presignPrefix + id + "/info" }
+func presignDataKey(id string) string { return presignPrefix + id + "/data" }
+
+// presignCheckedKey is where finalize moves the data before checking it, out
+// of reach of the signed URL.
+func presignCheckedKey(id string) string { return presignPrefix + id + "/checked" }
+
+// NewPresignHandler shares the upload pipeline of images, which must come from
+// NewImage. A nil signer means MINIO_PUBLIC_ENDPOINT is unset: the routes
+// answer 503 rather than not existing, so a client can tell "off" from "wrong
+// URL".
+func NewPresignHandler(images Image, store service.ObjectStore, signer *minio.Client) (PresignHandler, error) {
+	img, ok := images.(*image)
+	if !ok {
+		return nil, fmt.Errorf("presign: images must come from NewImage")
+	}
+	var s presignSigner
+	if signer != nil {
+		s = signer
+	}
+	return newPresignHandler(*img, store, s, service.TusStagingBucket()), nil
+}
+
+func newPresignHandler(img image, store service.ObjectStore, signer presignSigner, staging string) *presignHandler {
+	minutes := config.GetEnvAsIntOrDefault("PRESIGN_EXPIRY_MINUTES", 15)
+	if minutes < 1 {
+		minutes = 1
+	}
+	hours := config.GetEnvAsIntOrDefault("PRESIGN_FINALIZE_HOURS", 24)
+	if hours < 1 {
+		hours = 1
+	}
+	return &presignHandler{
+		img:      img,
+		store:    store,
+		signer:   signer,
+		staging:  staging,
+		expiry:   time.Duration(minutes) * time.Minute,
+		keep:     time.Duration(hours) * time.Hour,
+		maxSize:  int64(config.GetEnvAsIntOrDefault("PRESIGN_MAX_FILE_SIZE", int(defaultPresignMaxSize))),
+		imageMax: int64(config.GetEnvAsIntOrDefault("MAX_FILE_SIZE", int(validator.DefaultMaxFileSize))),
+		logger:   observability.Logger(),
+		now:      time.Now,
+	}
+}
+
+// Presign issues a PUT URL and an equivalent POST form for one staging key.
+// The POST form also carries a size limit MinIO enforces itself; a PUT cannot,
+// so its size is checked at finalize instead.
+func (p *presignHandler) Presign(c *fiber.Ctx) error {
+	if p.signer == nil {
+		return service.Response(c, fiber.StatusServiceUnavailable, false, "presigned uploads are not configured", nil)
+	}
+
+	var req PresignRequest
+	if err := c.BodyParser(&req); err != nil {
+		return service.Response(c, fiber.StatusBadRequest, false, "Invalid request body", nil)
+	}
+	if err := validator.ValidateStruct(req); err != nil {
+		return service.Response(c, fiber.StatusBadRequest, false, err.Error(), nil)
+	}
+	if len(strings.Split(req.Filename, ".")) < 2 {
+		return service.Response(c, fiber.StatusBadRequest, false, "File extension not found!", nil)
+	}
+	attrs, kerr := newObjectAttrs(req.Metadata, req.Tags)
+	if kerr != nil {
+		return respondKeyError(c, kerr)
+	}
+	bucket, err := resolveBucket(c, req.Bucket)
+	if err != nil {
+		return bucketForbidden(c)
+	}
+	if bucket == "" {
+		return service.Response(c, fiber.StatusBadRequest, false, "Bucket is required", nil)
+	}
+	if service.InternalBucket(bucket) {
+		return bucketReserved(c)
+	}
+	// Checked once the bucket is known, since its upload policy may narrow
+	// what the global allowlist accepts. An image is decoded at finalize, so
+	// it is held to MAX_FILE_SIZE as on /upload.
+	maxSize := p.maxSize
+	if service.IsImageFile(req.Filename) {
+		maxSize = min(maxSize, p.imageMax)
+	}
+	if err := validator.ValidateFileUpTo(&multipart.FileHeader{Filename: req.Filename, Size: req.Size}, bucket, maxSize); err != nil {
+		if valErr, ok := err.(*validator.FileValidationError); ok {
+			return service.Response(c, fiber.StatusBadRequest, false, valErr.Message, map[string]string{
+				"code": valErr.Code,
+			})
+		}
+		return service.Response(c, fiber.StatusBadRequest, false, err.Error(), nil)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	// Decided now rather than at finalize, for the same reason tus does: a
+	// client should not upload a gigabyte to learn the bucket name is invalid.
+	exists, err := p.store.BucketExists(ctx, bucket)
+	if err != nil {
+		return service.Response(c, fiber.StatusBadRequest, false, "bucket check failed: "+err.Error(), nil)
+	}
+	if !exists {
+		if err := bucketname.ValidateNew(bucket); err != nil {
+			return service.Response(c, fiber.StatusBadRequest, false, err.Error(), nil)
+		}
+		if err := p.store.MakeBucket(ctx, bucket, minio.MakeBucketOptions{}); err != nil {
+			return service.Response(c, fiber.StatusBadRequest, false, "Bucket Not Found And Not Created!", nil)
+		}
+	}
+
+	now := p.now().UTC()
+	up := &presignedUpload{
+		ID:        uuid.New().String(),
+		Bucket:    bucket,
+		Path:      strings.Trim(req.Path, "/"),
+		Filename:  req.Filename,
+		CreatedAt: now,
+		ExpiresAt: now.Add(p.expiry),
+		Attrs:     attrs,
+	}
+
+	putURL, err := p.signer.PresignedPutObject(ctx, p.staging, presignDataKey(up.ID), p.expiry)
+	if err != nil {
+		return service.Response(c, fiber.StatusInternalServerError, false, "could not sign upload URL", nil)
+	}
+	policy := minio.NewPostPolicy()
+	_ = policy.SetBucket(p.staging)
+	_ = policy.SetKey(presignDataKey(up.ID))
+	_ = policy.SetExpires(up.ExpiresAt)
+	_ = policy.SetContentLengthRange(1, maxSize)
+	postURL, fields, err := p.signer.PresignedPostPolicy(ctx, policy)
+	if err != nil {
+		return service.Response(c, fiber.StatusInternalServerError, false, "could not sign upload form", nil)
+	}
+
+	if err := p.save(ctx, up); err != nil {
+		return service.Response(c, fiber.StatusInternalServerError, false, "could not record upload", nil)
+	}
+
+	return service.Response(c, fiber.StatusCreated, true, "success", map[string]any{
+		"id":         up.ID,
+		"put_url":    putURL.String(),
+		"post_url":   postURL.String(),
+		"post_form":  fields,
+		"expires_at": up.ExpiresAt,
+		"max_size":   maxSize,
+		"finalize":   "/upload/presign/" + up.ID + "/finalize",
+	})
+}
+
+// Finalize turns a staged upload into an object, with the same checks and the
+// same response as /upload. The staged data and the record are removed either
+// way once a decision is made; only a storage failure leaves them for a retry.
+func (p *presignHandler) Finalize(c *fiber.Ctx) error {
+	var req FinalizeRequest
+	if len(c.Body()) > 0 {
+		if err := c.BodyParser(&req); err != nil {
+			return service.Response(c, fiber.StatusBadRequest, false, "Invalid request body", nil)
+		}
+	}
+
+	id := c.Params("id")
+	if _, err := uuid.Parse(id); err != nil {
+		return service.Response(c, fiber.StatusNotFound, false, "upload not found", nil)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+
+	up, err := p.load(ctx, id)
+	if err != nil {
+		return service.Response(c, fiber.StatusNotFound, false, "upload not found", nil)
+	}
+	if _, err := resolveBucket(c, up.Bucket); err != nil {
+		return bucketForbidden(c)
+	}
+
+	info, err := p.freeze(ctx, id)
+	if err != nil {
+		switch minio.ToErrorResponse(err).Code {
+		case "NoSuchKey":
+			return service.Response(c, fiber.StatusConflict, false, "nothing has been uploaded yet", nil)
+		case "PreconditionFailed":
+			return service.Response(c, fiber.StatusConflict, false, "the upload changed while it was being finalized; try again", nil)
+		}
+		return service.Response(c, fiber.StatusInternalServerError, false, err.Error(), nil)
+	}
+	src := presignCheckedKey(id)
+
+	reject := func(message, code string) error {
+		p.remove(ctx, id)
+		return service.Response(c, fiber.StatusBadRequest, false, message, map[string]string{"code": code})
+	}
+	if info.Size > p.maxSize {
+		return reject(fmt.Sprintf("File size is too large. Maximum: %d bytes", p.maxSize), "FILE_TOO_LARGE")
+	}
+
+	// Only an image is read into memory, because only an image is decoded;
+	// everything else is checked, hashed and scanned as it streams by. An
+	// image is held to MAX_FILE_SIZE, as on /upload, before any of it is read.
+	var (
+		content     []byte
+		sum         string
+		contentType string
+		size        = info.Size
+		optimized   bool
+	)
+	if service.IsImageFile(up.Filename) {
+		if info.Size > p.imageMax {
+			return reject(fmt.Sprintf("Image is too large. Maximum: %d bytes", p.imageMax), "FILE_TOO_LARGE")
+		}
+		rc, err := p.store.OpenObject(ctx, p.staging, src)
+		if err != nil {
+			return service.Response(c, fiber.StatusInternalServerError, false, err.Error(), nil)
+		}
+		content, err = io.ReadAll(io.LimitReader(rc, p.imageMax+1))
+		_ = rc.Close()
+		if err != nil {
+			return service.Response(c, fiber.StatusInternalServerError, false, err.Error(), nil)
+		}
+		if err := validator.ValidateContentFor(up.Bucket, content); err != nil {
+			if valErr, ok := err.(*validator.FileValidationError); ok {
+				return reject(valErr.Message, valErr.Code)
+			}
+			return reject(err.Error(), "INVALID_FILE_CONTENT")
+		}
+		width, height, err := p.img.validateImageContent(up.Filename, content)
+		if err != nil {
+			return reject("invalid image content", "INVALID_IMAGE_CONTENT")
+		}
+		if err := validator.ValidateImageFor(up.Bucket, width, height); err != nil {
+			valErr := err.(*validator.FileValidationError)
+			return reject(valErr.Message, valErr.Code)
+		}
+		// Infected files go the way of invalid ones. A scan without a
+		// verdict keeps the upload staged, so finalize can be retried.
+		if kerr := p.img.scanUpload(ctx, up.Bucket, bytes.NewReader(content)); kerr != nil {
+			if kerr.status == fiber.StatusServiceUnavailable {
+				return respondKeyError(c, kerr)
+			}
+			return reject(kerr.message, kerr.code)
+		}
+		if req.Optimize || validator.ForcedOptimize(up.Bucket) {
+			if out, _, _ := p.img.maybeOptimize(content, service.DefaultOptimizeOptions()); !bytes.Equal(out, content) {
+				content = out
+				optimized = true
+			}
+		}
+		digest := sha256.Sum256(content)
+		sum, contentType, size = hex.EncodeToString(digest[:]), http.DetectContentType(content), int64(len(content))
+	} else {
+		checked, kerr := p.checkStream(ctx, up.Bucket, src)
+		if kerr != nil {
+			if kerr.status != fiber.StatusBadRequest {
+				return respondKeyError(c, kerr)
+			}
+			return reject(kerr.message, kerr.code)
+		}
+		sum, contentType = checked.SHA256, checked.ContentType
+	}
+
+	// As on tus, an upload that only brought bytes can be answered with an
+	// object already holding them; one that brought metadata or tags cannot,
+	// since the object it would be answered with carries none of them.
+	if up.Attrs.empty() && p.img.dedupApplies(up.Bucket, "") {
+		if existing, ref, ok := p.img.reuseDuplicate(ctx, p.store, up.Bucket, sum); ok {
+			p.remove(ctx, id)
+			return respondDuplicate(c, up.Bucket, existing, ref)
+		}
+	}
+
+	parts := strings.Split(up.Filename, ".")
+	imageName := uuid.New().String() + "." + service.SanitizeObjectName(parts[len(parts)-1])
+	objectName := imageName
+	if up.Path != "" {
+		objectName = service.SanitizeObjectName(up.Path) + "/" + imageName
+	} else if tpl := config.KeyTemplateFor(up.Bucket); tpl != "" {
+		imageName, objectName = templatedName(tpl, parts[len(parts)-1], sum)
+	}
+
+	var result minio.UploadInfo
+	if optimized {
+		result, err = p.store.PutObject(ctx, up.Bucket, objectName, bytes.NewReader(content), size,
+			up.Attrs.options(minio.PutObjectOptions{ContentType: contentType, UserMetadata: digestMeta(sum)}))
+	} else {
+		// The bytes are already in MinIO; a server-side copy moves them
+		// without sending them through this process again. The copy is of
+		// the bytes that were checked: the checked key is one no signed URL
+		// can write, and the copy is conditional on its ETag all the same.
+		result, err = p.store.CopyObject(ctx,
+			up.Attrs.copyOptions(minio.CopyDestOptions{
+				Bucket:          up.Bucket,
+				Object:          objectName,
+				ReplaceMetadata: true,
+				UserMetadata:    map[string]string{"Content-Type": contentType, service.MetaSHA256: sum},
+			}),
+			minio.CopySrcOptions{Bucket: p.staging, Object: src, MatchETag: info.ETag})
+	}
+	if err != nil {
+		// Nothing is wrong with the file, so the upload stays staged and
+		// finalize can be retried.
+		return respondKeyError(c, &keyError{fiber.StatusBadGateway, "STORAGE_ERROR", "could not store the upload: " + err.Error()})
+	}
+	p.remove(ctx, id)
+
+	p.img.forgetMissing(ctx, up.Bucket, objectName)
+	if up.Attrs.empty() {
+		p.img.claimDigest(ctx, up.Bucket, "", sum, objectName)
+	}
+	p.img.schedulePresets(p.store, up.Bucket, objectName, result.ETag)
+	var archiveResult string
+	if content != nil {
+		archiveResult = p.img.archiveObject(ctx, up.Bucket, objectName, bytes.NewReader(content), sum, result.VersionID)
+	} else {
+		archiveResult = p.img.archiveFromStore(ctx, p.store, up.Bucket, objectName, sum, result.VersionID)
+	}
+
+	base := strings.TrimSuffix(config.GetEnvOrDefault("APP_URL", "http://localhost:9090"), "/")
+	return service.Response(c, fiber.StatusCreated, true, "success", map[string]any{
+		"minioUpload": fmt.Sprintf("Minio Successfully Uploaded size %d", size),
+		"minioResult": "Minio Successfully Uploaded",
+		"awsUpload":   archiveResult,
+		"awsResult":   archiveResult,
+		"imageName":   imageName,
+		"objectName":  objectName,
+		"link":        base + "/" + up.Bucket + "/" + objectName,
+	})
+}
+
+// freeze moves a staged upload out of reach of its signed URL, which is still
+// valid while the upload is finalized: a client could otherwise send other
+// bytes between the checks and the copy into the bucket, and those would be
+// stored unchecked. The move is conditional on the ETag the data was stated
+// with, and finalize reads only the checked key from then on. A finalize
+// retried after a scan without a verdict finds the data there already.
+func (p *presignHandler) freeze(ctx context.Context, id string) (minio.ObjectInfo, error) {
+	info, err := p.store.StatObject(ctx, p.staging, presignDataKey(id), minio.StatObjectOptions{})
+	if err != nil {
+		if minio.ToErrorResponse(err).Code == "NoSuchKey" {
+			return p.store.StatObject(ctx, p.staging, presignCheckedKey(id), minio.StatObjectOptions{})
+		}
+		return minio.ObjectInfo{}, err
+	}
+	if _, err := p.store.CopyObject(ctx,
+		minio.CopyDestOptions{Bucket: p.staging, Object: presignCheckedKey(id)},
+		minio.CopySrcOptions{Bucket: p.staging, Object: presignDataKey(id), MatchETag: info.ETag}); err != nil {
+		return minio.ObjectInfo{}, err
+	}
+	_ = p.store.RemoveObject(ctx, p.staging, presignDataKey(id), minio.RemoveObjectOptions{})
+	return p.store.StatObject(ctx, p.staging, presignCheckedKey(id), minio.StatObjectOptions{})
+}
+
+// checkStream validates, hashes and scans a staged upload that is not an
+// image in one read; see image.checkStream. A staged object that cannot be
+// opened is not the file's fault, and the upload stays staged for a retry.
+func (p *presignHandler) checkStream(ctx context.Context, bucket, key string) (streamedUpload, *keyError) {
+	rc, err := p.store.OpenObject(ctx, p.staging, key)
+	if err != nil {
+		return streamedUpload{}, &keyError{fiber.StatusBadGateway, "STORAGE_ERROR", "could not read the upload: " + err.Error()}
+	}
+	defer rc.Close()
+	return p.img.checkStream(ctx, bucket, rc, p.maxSize)
+}
+
+func (p *presignHandler) save(ctx context.Context, up *presignedUpload) error {
+	data, err := json.Marshal(up)
+	if err != nil {
+		return err
+	}
+	_, err = p.store.PutObject(ctx, p.staging, presignInfoKey(up.ID), bytes.NewReader(data), int64(len(data)),
+		minio.PutObjectOptions{ContentType: "application/json"})
+	return err
+}
+
+func (p *presignHandler) load(ctx context.Context, id string) (*presignedUpload, error) {
+	rc, err := p.store.OpenObject(ctx, p.staging, presignInfoKey(id))
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+
+	var up presignedUpload
+	if err := json.NewDecoder(io.LimitReader(rc, 64<<10)).Decode(&up); err != nil {
+		return nil, err
+	}
+	return &up, nil
+}
+
+func (p *presignHandler) remove(ctx context.Context, id string) {
+	_ = p.store.RemoveObject(ctx, p.staging, presignDataKey(id), minio.RemoveObjectOptions{})
+	_ = p.store.RemoveObject(ctx, p.staging, presignCheckedKey(id), minio.RemoveObjectOptions{})
+	_ = p.store.RemoveObject(ctx, p.staging, presignInfoKey(id), minio.RemoveObjectOptions{})
+}
+
+func (p *presignHandler) Start(ctx context.Context) {
+	if p.signer == nil {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(time.Hour)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if n := p.expire(ctx); n > 0 {
+					p.logger.Info().Int("uploads", n).Msg("presign: removed unfinalized uploads")
+				}
+			}
+		}
+	}()
+}
+
+// expire removes uploads issued more than PRESIGN_FINALIZE_HOURS ago, whether
+// or not anything was ever sent to their URL.
+func (p *presignHandler) expire(ctx context.Context) int {
+	cutoff := p.now().Add(-p.keep)
+	var stale []string
+	for obj := range p.store.ListObjects(ctx, p.staging, minio.ListObjectsOptions{Prefix: presignPrefix, Recursive: true}) {
+		if obj.Err != nil {
+			continue
+		}
+		rest := strings.TrimPrefix(obj.Key, presignPrefix)
+		if id, ok := strings.CutSuffix(rest, "/info"); ok && obj.LastModified.Before(cutoff) {
+			stale = append(stale, id)
+		}
+	}
+	for _, id := range stale {
+		p.remove(ctx, id)
+	}
+	return len(stale)
+}
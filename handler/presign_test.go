@@ -0,0 +1,401 @@
+package handler
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+
+	"github.com/mstgnz/cdn/service"
+)
+
+const presignStaging = "presign-staging"
+
+// offlineSigner signs for a MinIO that does not exist. With the region fixed
+// the client never has to ask the server anything, which is also how it runs
+// in production.
+func offlineSigner(t *testing.T) *minio.Client {
+	t.Helper()
+	c, err := minio.New("cdn.test:9000", &minio.Options{
+		Creds:  credentials.NewStaticV4("access", "secretsecret", ""),
+		Region: "us-east-1",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func newPresignApp(store *memStore, signer presignSigner) (*fiber.App, *presignHandler) {
+	h := newPresignHandler(image{imageService: &service.ImageService{}}, store, signer, presignStaging)
+	app := fiber.New()
+	app.Use(func(c *fiber.Ctx) error {
+		if b := c.Get("X-Test-Bucket"); b != "" {
+			service.StorePrincipal(c, service.Principal{Scoped: true, Bucket: b})
+		}
+		return c.Next()
+	})
+	app.Post("/upload/presign", h.Presign)
+	app.Post("/upload/presign/:id/finalize", h.Finalize)
+	return app, h
+}
+
+type presignResp struct {
+	Success bool           `json:"success"`
+	Message string         `json:"message"`
+	Data    map[string]any `json:"data"`
+}
+
+func presignCall(t *testing.T, app *fiber.App, target string, headers map[string]string, body any) (int, presignResp) {
+	t.Helper()
+	raw, _ := json.Marshal(body)
+	req := httptest.NewRequest(http.MethodPost, target, bytes.NewReader(raw))
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := app.Test(req, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out presignResp
+	data, _ := io.ReadAll(resp.Body)
+	_ = json.Unmarshal(data, &out)
+	return resp.StatusCode, out
+}
+
+// issue asks for a URL and returns the upload id.
+func issue(t *testing.T, app *fiber.App, filename string) string {
+	t.Helper()
+	code, out := presignCall(t, app, "/upload/presign", nil, map[string]any{"bucket": "photos", "path": "pets", "filename": filename})
+	if code != fiber.StatusCreated {
+		t.Fatalf("presign status = %d: %s", code, out.Message)
+	}
+	return out.Data["id"].(string)
+}
+
+// browserUpload stands in for the client's PUT to the signed URL.
+func browserUpload(t *testing.T, store *memStore, id string, data []byte) {
+	t.Helper()
+	if _, err := store.PutObject(context.Background(), presignStaging, presignDataKey(id), bytes.NewReader(data), int64(len(data)), minio.PutObjectOptions{}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPresignSignsOnlyTheStagingKey(t *testing.T) {
+	store := newMemStore(presignStaging, "photos")
+	app, _ := newPresignApp(store, offlineSigner(t))
+
+	code, out := presignCall(t, app, "/upload/presign", nil, map[string]any{"bucket": "photos", "filename": "cat.png", "size": 1024})
+	if code != fiber.StatusCreated {
+		t.Fatalf("status = %d: %s", code, out.Message)
+	}
+	id := out.Data["id"].(string)
+	put := out.Data["put_url"].(string)
+	if !strings.Contains(put, "/"+presignStaging+"/"+presignDataKey(id)) || !strings.Contains(put, "X-Amz-Signature=") {
+		t.Fatalf("put_url %q does not sign the staging key", put)
+	}
+	fields := out.Data["post_form"].(map[string]any)
+	if fields["key"] != presignDataKey(id) || fields["policy"] == nil {
+		t.Fatalf("post_form = %v", fields)
+	}
+	if _, ok := store.get(presignStaging, presignInfoKey(id)); !ok {
+		t.Fatal("no record kept for the issued URL")
+	}
+}
+
+func TestPresignChecksBeforeAnythingIsSigned(t *testing.T) {
+	app, _ := newPresignApp(newMemStore(presignStaging, "photos"), offlineSigner(t))
+	for name, tc := range map[string]struct {
+		body    map[string]any
+		headers map[string]string
+		want    int
+	}{
+		"bad extension":     {map[string]any{"bucket": "photos", "filename": "a.exe"}, nil, 400},
+		"too large":         {map[string]any{"bucket": "photos", "filename": "a.png", "size": 999999999999}, nil, 400},
+		"no bucket":         {map[string]any{"filename": "a.png"}, nil, 400},
+		"staging bucket":    {map[string]any{"bucket": service.TusStagingBucket(), "filename": "a.png"}, nil, 400},
+		"other token's one": {map[string]any{"bucket": "photos", "filename": "a.png"}, map[string]string{"X-Test-Bucket": "docs"}, 403},
+	} {
+		t.Run(name, func(t *testing.T) {
+			if code, out := presignCall(t, app, "/upload/presign", tc.headers, tc.body); code != tc.want {
+				t.Fatalf("status = %d, want %d: %s", code, tc.want, out.Message)
+			}
+		})
+	}
+
+	off, _ := newPresignApp(newMemStore(presignStaging, "photos"), nil)
+	if code, _ := presignCall(t, off, "/upload/presign", nil, map[string]any{"bucket": "photos", "filename": "a.png"}); code != fiber.StatusServiceUnavailable {
+		t.Fatalf("unconfigured status = %d, want 503", code)
+	}
+}
+
+func TestPresignFinalizeMovesTheObject(t *testing.T) {
+	store := newMemStore(presignStaging, "photos")
+	app, _ := newPresignApp(store, offlineSigner(t))
+	id := issue(t, app, "cat.png")
+
+	if code, _ := presignCall(t, app, "/upload/presign/"+id+"/finalize", nil, nil); code != fiber.StatusConflict {
+		t.Fatalf("finalize before upload = %d, want 409", code)
+	}
+
+	file := pngFixture(t, 64, 48)
+	browserUpload(t, store, id, file)
+
+	if code, _ := presignCall(t, app, "/upload/presign/"+id+"/finalize", map[string]string{"X-Test-Bucket": "docs"}, nil); code != fiber.StatusForbidden {
+		t.Fatalf("other bucket's token = %d, want 403", code)
+	}
+
+	code, out := presignCall(t, app, "/upload/presign/"+id+"/finalize", nil, nil)
+	if code != fiber.StatusCreated {
+		t.Fatalf("finalize status = %d: %s", code, out.Message)
+	}
+	name, _ := out.Data["objectName"].(string)
+	if !strings.HasPrefix(name, "pets/") || !strings.HasSuffix(name, ".png") {
+		t.Fatalf("objectName = %q, want pets/<uuid>.png", name)
+	}
+	if link, _ := out.Data["link"].(string); !strings.HasSuffix(link, "/photos/"+name) {
+		t.Fatalf("link = %q", link)
+	}
+	if got, ok := store.get("photos", name); !ok || !bytes.Equal(got, file) {
+		t.Fatal("final object differs from the uploaded file")
+	}
+	if keys := store.keys(presignStaging); len(keys) != 0 {
+		t.Fatalf("staging left behind: %v", keys)
+	}
+	if code, _ := presignCall(t, app, "/upload/presign/"+id+"/finalize", nil, nil); code != fiber.StatusNotFound {
+		t.Fatalf("second finalize = %d, want 404", code)
+	}
+}
+
+func TestPresignFinalizeRejectsInvalidContent(t *testing.T) {
+	store := newMemStore(presignStaging, "photos")
+	app, _ := newPresignApp(store, offlineSigner(t))
+	id := issue(t, app, "x.png")
+	browserUpload(t, store, id, []byte("MZ\x90\x00 definitely not a png, but named like one"))
+
+	if code, _ := presignCall(t, app, "/upload/presign/"+id+"/finalize", nil, nil); code != fiber.StatusBadRequest {
+		t.Fatalf("status = %d, want 400", code)
+	}
+	if keys := store.keys("photos"); len(keys) != 0 {
+		t.Fatalf("invalid content was stored: %v", keys)
+	}
+	if keys := store.keys(presignStaging); len(keys) != 0 {
+		t.Fatalf("rejected upload left staging objects: %v", keys)
+	}
+}
+
+func TestPresignExpiresUnfinalizedUploads(t *testing.T) {
+	store := newMemStore(presignStaging, "photos")
+	app, h := newPresignApp(store, offlineSigner(t))
+	old := issue(t, app, "a.png")
+	browserUpload(t, store, old, []byte("abandoned"))
+
+	store.now = func() time.Time { return time.Now().Add(48 * time.Hour) }
+	h.now = store.now
+	fresh := issue(t, app, "b.png")
+
+	if n := h.expire(context.Background()); n != 1 {
+		t.Fatalf("expired %d uploads, want 1", n)
+	}
+	for _, k := range store.keys(presignStaging) {
+		if strings.Contains(k, old) {
+			t.Fatalf("abandoned upload object %s survived", k)
+		}
+	}
+	if _, ok := store.get(presignStaging, presignInfoKey(fresh)); !ok {
+		t.Fatal("fresh upload was expired")
+	}
+}
+
+// A bucket's upload policy refuses at presign what its name already rules out,
+// and at finalize what its bytes do.
+func TestPresignFollowsTheBucketUploadPolicy(t *testing.T) {
+	loadPresetPolicy(t, `{"buckets": [{"bucket": "photos", "upload": {"extensions": ["pdf", "csv"], "mime_types": ["application/pdf"]}}]}`)
+	store := newMemStore(presignStaging, "photos")
+	app, _ := newPresignApp(store, offlineSigner(t))
+
+	code, out := presignCall(t, app, "/upload/presign", nil, map[string]any{"bucket": "photos", "filename": "cat.png"})
+	if code != fiber.StatusBadRequest || out.Data["code"] != "INVALID_FILE_FORMAT" {
+		t.Fatalf("png presign = %d %+v", code, out)
+	}
+
+	id := issue(t, app, "report.csv")
+	browserUpload(t, store, id, []byte("id,name\n1,a\n"))
+	code, out = presignCall(t, app, "/upload/presign/"+id+"/finalize", nil, nil)
+	if code != fiber.StatusBadRequest || out.Data["code"] != "INVALID_MIME_TYPE" {
+		t.Fatalf("csv finalize = %d %+v", code, out)
+	}
+	if keys := store.keys("photos"); len(keys) != 0 {
+		t.Fatalf("refused file was stored: %v", keys)
+	}
+}
+
+// A file that is not an image may be larger than MAX_FILE_SIZE: it is checked
+// and hashed as it streams from the staging bucket, and stored with its
+// digest. An image is still held to MAX_FILE_SIZE, since it is decoded.
+func TestPresignFinalizeStreamsLargeFiles(t *testing.T) {
+	t.Setenv("MAX_FILE_SIZE", "1024")
+	t.Setenv("PRESIGN_MAX_FILE_SIZE", "65536")
+	store := newMemStore(presignStaging, "photos")
+	app, _ := newPresignApp(store, offlineSigner(t))
+
+	id := issue(t, app, "big.csv")
+	file := []byte(strings.Repeat("id,name\n", 1000))
+	browserUpload(t, store, id, file)
+	code, out := presignCall(t, app, "/upload/presign/"+id+"/finalize", nil, nil)
+	if code != fiber.StatusCreated {
+		t.Fatalf("finalize status = %d: %s", code, out.Message)
+	}
+	name := out.Data["objectName"].(string)
+	info, err := store.StatObject(context.Background(), "photos", name, minio.StatObjectOptions{})
+	if err != nil || info.Size != int64(len(file)) || info.UserMetadata[service.MetaSHA256] != sha256Hex(file) {
+		t.Fatalf("stored = (%+v, %v)", info, err)
+	}
+
+	code, out = presignCall(t, app, "/upload/presign", nil, map[string]any{"bucket": "photos", "filename": "big.png", "size": 4096})
+	if code != fiber.StatusBadRequest || out.Data["code"] != "FILE_TOO_LARGE" {
+		t.Fatalf("large image presign = %d %+v", code, out)
+	}
+	id = issue(t, app, "big.png")
+	browserUpload(t, store, id, bytes.Repeat([]byte{0x89}, 4096))
+	if code, out = presignCall(t, app, "/upload/presign/"+id+"/finalize", nil, nil); code != fiber.StatusBadRequest || out.Data["code"] != "FILE_TOO_LARGE" {
+		t.Fatalf("large image finalize = %d %+v", code, out)
+	}
+}
+
+// Finalize moves the data out of reach of the signed URL before checking it,
+// and only ever copies what it checked: a move or copy against an ETag that
+// no longer holds fails.
+func TestPresignFinalizeChecksWhatItStores(t *testing.T) {
+	ctx := context.Background()
+	store := newMemStore(presignStaging, "photos")
+	app, h := newPresignApp(store, offlineSigner(t))
+	id := issue(t, app, "report.csv")
+	browserUpload(t, store, id, []byte("id,name\n1,a\n"))
+
+	info, err := h.freeze(ctx, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := store.get(presignStaging, presignDataKey(id)); ok {
+		t.Fatal("the signed URL's key still holds the data")
+	}
+	// What the client sends to the URL now lands beside the checked copy.
+	browserUpload(t, store, id, []byte("MZ\x90\x00 something else"))
+	if got, _ := store.get(presignStaging, presignCheckedKey(id)); string(got) != "id,name\n1,a\n" {
+		t.Fatalf("checked copy = %q", got)
+	}
+	if _, err := store.CopyObject(ctx, minio.CopyDestOptions{Bucket: "photos", Object: "x.csv"},
+		minio.CopySrcOptions{Bucket: presignStaging, Object: presignCheckedKey(id), MatchETag: info.ETag + "x"}); err == nil {
+		t.Fatal("a copy against a stale ETag succeeded")
+	}
+
+	// The re-sent data is frozen and checked in its turn, and refused.
+	if code, _ := presignCall(t, app, "/upload/presign/"+id+"/finalize", nil, nil); code != fiber.StatusBadRequest {
+		t.Fatalf("finalize of the re-sent data = %d, want 400", code)
+	}
+	if keys := store.keys("photos"); len(keys) != 0 {
+		t.Fatalf("stored: %v", keys)
+	}
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// A presigned upload of bytes a deduplicated bucket already holds is answered
+// with the existing object, as on /upload and tus, and one that brought its
+// own metadata is not.
+func TestPresignFinalizeDeduplicates(t *testing.T) {
+	ctx := context.Background()
+	img, store := newDedupImage(t)
+	if err := store.MakeBucket(ctx, presignStaging, minio.MakeBucketOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	h := newPresignHandler(img, store, offlineSigner(t), presignStaging)
+	app := fiber.New()
+	app.Post("/upload/presign", h.Presign)
+	app.Post("/upload/presign/:id/finalize", h.Finalize)
+
+	file := []byte("id,name\n1,a\n")
+	upload := func(body map[string]any) presignResp {
+		t.Helper()
+		code, out := presignCall(t, app, "/upload/presign", nil, body)
+		if code != fiber.StatusCreated {
+			t.Fatalf("presign = %d %+v", code, out)
+		}
+		id := out.Data["id"].(string)
+		browserUpload(t, store, id, file)
+		code, out = presignCall(t, app, "/upload/presign/"+id+"/finalize", nil, nil)
+		if code != fiber.StatusCreated {
+			t.Fatalf("finalize = %d %+v", code, out)
+		}
+		if keys := store.keys(presignStaging); len(keys) != 0 {
+			t.Fatalf("staging left behind: %v", keys)
+		}
+		return out
+	}
+
+	first := upload(map[string]any{"bucket": "logos", "filename": "a.csv"})
+	second := upload(map[string]any{"bucket": "logos", "filename": "b.csv"})
+	if ref, _ := second.Data["reference"].(string); second.Data["deduplicated"] != true || second.Data["objectName"] != first.Data["objectName"] || ref == "" {
+		t.Fatalf("second upload = %+v, want the first's object %v", second.Data, first.Data["objectName"])
+	}
+	if entry, found, _ := img.dedup.Lookup(ctx, "logos", sha256Hex(file)); !found || entry.Refs != 2 {
+		t.Fatalf("index = (%+v, %v), want two references", entry, found)
+	}
+
+	third := upload(map[string]any{"bucket": "logos", "filename": "c.csv", "metadata": map[string]string{"author": "Finance"}})
+	if third.Data["deduplicated"] == true || third.Data["objectName"] == first.Data["objectName"] {
+		t.Fatalf("an upload with metadata was deduplicated: %+v", third.Data)
+	}
+	if keys := store.keys("logos"); len(keys) != 2 {
+		t.Fatalf("stored %v, want two objects", keys)
+	}
+}
+
+// failingCopyStore refuses every copy into one bucket.
+type failingCopyStore struct {
+	*memStore
+	bucket string
+}
+
+func (s failingCopyStore) CopyObject(ctx context.Context, dst minio.CopyDestOptions, src minio.CopySrcOptions) (minio.UploadInfo, error) {
+	if dst.Bucket == s.bucket {
+		return minio.UploadInfo{}, minio.ErrorResponse{Code: "InternalError", Message: "We encountered an internal error"}
+	}
+	return s.memStore.CopyObject(ctx, dst, src)
+}
+
+// A store that fails to take the file is not the file's fault: finalize
+// answers a storage error and keeps the upload staged for a retry.
+func TestPresignFinalizeStorageFailureKeepsTheUpload(t *testing.T) {
+	store := newMemStore(presignStaging, "photos")
+	h := newPresignHandler(image{imageService: &service.ImageService{}}, failingCopyStore{store, "photos"}, offlineSigner(t), presignStaging)
+	app := fiber.New()
+	app.Post("/upload/presign", h.Presign)
+	app.Post("/upload/presign/:id/finalize", h.Finalize)
+
+	id := issue(t, app, "report.csv")
+	browserUpload(t, store, id, []byte("id,name\n1,a\n"))
+	code, out := presignCall(t, app, "/upload/presign/"+id+"/finalize", nil, nil)
+	if code != fiber.StatusBadGateway || out.Data["code"] != "STORAGE_ERROR" {
+		t.Fatalf("finalize = %d %+v, want 502 STORAGE_ERROR", code, out)
+	}
+	if _, ok := store.get(presignStaging, presignCheckedKey(id)); !ok {
+		t.Fatal("the staged upload was dropped")
+	}
+}
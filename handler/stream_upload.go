@@ -0,0 +1,272 @@
+package handler
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"github.com/minio/minio-go/v7"
+
+	"github.com/mstgnz/cdn/pkg/config"
+	"github.com/mstgnz/cdn/pkg/validator"
+	"github.com/mstgnz/cdn/service"
+)
+
+// sniffLen is what http.DetectContentType looks at, and so all of a file the
+// streaming path ever holds before sending it on.
+const sniffLen = 512
+
+// sniffPolicy checks the head of an upload held as a ReadSeeker against the
+// MIME types of bucket's upload policy, and rewinds it. It is for the paths
+// that store such an upload without otherwise reading it.
+func sniffPolicy(bucket string, rs io.ReadSeeker) error {
+	head := make([]byte, sniffLen)
+	n, err := io.ReadFull(rs, head)
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) && !errors.Is(err, io.EOF) {
+		return err
+	}
+	if _, err := rs.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	return validator.ValidateMimeFor(bucket, head[:n])
+}
+
+// streamedUpload describes an object written by streamUpload.
+type streamedUpload struct {
+	Size        int64
+	SHA256      string
+	ContentType string
+	ETag        string
+	VersionID   string
+}
+
+// uploadPartSize is the part size for uploads of unknown length. It has to be
+// set: given size -1 and no part size, minio-go plans for the largest object S3
+// allows and allocates a part buffer of over half a gigabyte per upload, which
+// is precisely the memory this path exists to save.
+func uploadPartSize() uint64 {
+	mb := config.GetEnvAsIntOrDefault("UPLOAD_PART_SIZE_MB", 16)
+	if mb < 5 {
+		mb = 5 // S3's minimum for every part but the last
+	}
+	return uint64(mb) << 20
+}
+
+// streamUpload writes a non-image file to MinIO without holding it in memory.
+//
+// The buffered path read the whole file, validated it, then wrote it out and
+// kept the buffer around to rewind for the archive: a 100MB video cost at least
+// 100MB of heap per concurrent upload, and several of them at once is how pods
+// were OOM-killed. Here only the first 512 bytes are read up front, for the
+// content type; the rest goes straight from r to MinIO through a tee that
+// validates and hashes it on the way. (For /upload the server has already
+// buffered the request body by then, up to BodyLimit; what this removes are
+// the copies that were made on top of it. /upload-url gains the whole amount.)
+//
+// A file that fails validation part way stops the upload where it fails; one
+// that only fails at the end (text cut off mid-character) has been stored by
+// then and is removed again. Either way the error is the validator's
+// *FileValidationError, for the caller to report like ValidateFileContent's.
+// Removing it is only safe because objectName held nothing the write could
+// have replaced: a write that may overwrite goes through streamReplace.
+//
+// Images do not come through here. Their bytes have to be decoded to be
+// validated, which needs them all anyway.
+//
+// The upload policy of bucket applies as well: its MIME types to the sniffed
+// head, before anything is sent, and its byte limits to the stream.
+//
+// opts is completed with the sniffed content type and the part size.
+func streamUpload(ctx context.Context, store service.ObjectStore, bucket, objectName string, r io.Reader, opts minio.PutObjectOptions) (streamedUpload, error) {
+	return streamUploadFor(ctx, store, bucket, bucket, objectName, r, opts)
+}
+
+// streamUploadFor is streamUpload for bytes written somewhere other than
+// where they are going, the staging bucket, with the upload policy of dest.
+func streamUploadFor(ctx context.Context, store service.ObjectStore, dest, bucket, objectName string, r io.Reader, opts minio.PutObjectOptions) (streamedUpload, error) {
+	head := make([]byte, sniffLen)
+	n, err := io.ReadFull(r, head)
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) && !errors.Is(err, io.EOF) {
+		return streamedUpload{}, err
+	}
+	head = head[:n]
+	if err := validator.ValidateMimeFor(dest, head); err != nil {
+		return streamedUpload{}, err
+	}
+
+	check := validator.NewContentValidatorFor(dest)
+	sum := sha256.New()
+	body := io.TeeReader(io.MultiReader(bytes.NewReader(head), r), io.MultiWriter(check, sum))
+
+	out := streamedUpload{ContentType: http.DetectContentType(head)}
+	opts.ContentType = out.ContentType
+	opts.PartSize = uploadPartSize()
+	info, err := store.PutObject(ctx, bucket, objectName, body, -1, opts)
+	if verr := check.Close(); verr != nil {
+		if err == nil {
+			_ = store.RemoveObject(ctx, bucket, objectName, minio.RemoveObjectOptions{})
+		}
+		return streamedUpload{}, verr
+	}
+	if err != nil {
+		return streamedUpload{}, err
+	}
+
+	out.Size = check.Size()
+	out.SHA256 = hex.EncodeToString(sum.Sum(nil))
+	out.ETag = info.ETag
+	out.VersionID = info.VersionID
+	return out, nil
+}
+
+// archiveFromStore archives an object by reading it back from MinIO, for
+// uploads that kept no copy to rewind. The bytes are hashed on their way to
+// the archive and compared with what was uploaded, so a read-back that differs
+// is reported as a failed archive rather than trusted. version is the MinIO
+// version ID the upload created, recorded with the archived copy.
+func (i image) archiveFromStore(ctx context.Context, store service.ObjectStore, bucket, objectName, wantSHA256, version string) string {
+	if i.archive == nil || !i.archive.InScope(bucket) {
+		return ""
+	}
+
+	rc, err := store.OpenObject(ctx, bucket, objectName)
+	if err != nil {
+		log.Printf("archive: cannot read back %s/%s: %v", bucket, objectName, err)
+		return fmt.Sprintf("Archive Failed %s", err.Error())
+	}
+	defer rc.Close()
+
+	sum := sha256.New()
+	result := i.archiveObject(ctx, bucket, objectName, io.TeeReader(rc, sum), wantSHA256, version)
+	if result != "Archive Successfully Uploaded" || wantSHA256 == "" {
+		return result
+	}
+	if got := hex.EncodeToString(sum.Sum(nil)); got != wantSHA256 {
+		log.Printf("archive: %s/%s read back with sha256 %s, uploaded as %s", bucket, objectName, got, wantSHA256)
+		return "Archive Failed content read back from MinIO does not match the upload"
+	}
+	return result
+}
+
+// streamReplace is streamUpload for a write that may replace an object. The
+// stream is only known to be valid once it has all been written, and a write
+// straight to objectName would by then have replaced the object there, which
+// removing the rejected bytes would not bring back. So the stream is staged
+// under a key of its own and copied onto objectName server-side once it has
+// passed.
+//
+// A copy cannot carry the write's precondition, so an "if-match" write checks
+// the ETag again just before the copy instead; the two are not atomic.
+func streamReplace(ctx context.Context, store service.ObjectStore, bucket, objectName string, r io.Reader, plan overwritePlan, opts minio.PutObjectOptions) (streamedUpload, error) {
+	staging := service.TusStagingBucket()
+	stagingKey := hashStagingPrefix + uuid.New().String()
+	up, err := streamUploadFor(ctx, store, bucket, staging, stagingKey, r, minio.PutObjectOptions{})
+	if err != nil {
+		return streamedUpload{}, err
+	}
+	defer func() { _ = store.RemoveObject(ctx, staging, stagingKey, minio.RemoveObjectOptions{}) }()
+
+	if err := plan.recheck(ctx, store, bucket, objectName); err != nil {
+		return streamedUpload{}, err
+	}
+	meta := map[string]string{"Content-Type": up.ContentType}
+	for k, v := range opts.UserMetadata {
+		meta[k] = v
+	}
+	info, err := store.CopyObject(ctx,
+		minio.CopyDestOptions{
+			Bucket:          bucket,
+			Object:          objectName,
+			ReplaceMetadata: true,
+			UserMetadata:    meta,
+			UserTags:        opts.UserTags,
+			ReplaceTags:     len(opts.UserTags) > 0,
+		},
+		minio.CopySrcOptions{Bucket: staging, Object: stagingKey})
+	if err != nil {
+		return streamedUpload{}, err
+	}
+	up.ETag, up.VersionID = info.ETag, info.VersionID
+	return up, nil
+}
+
+// storeStreamed is the streaming half of UploadImage and UploadWithUrl: it
+// stores r under plan with the given options (user metadata and tags), runs
+// afterStore, and archives the object from MinIO. The archive result is
+// reported the way archiveObject reports it.
+func (i image) storeStreamed(ctx context.Context, bucket, objectName string, r io.Reader, plan overwritePlan, opts minio.PutObjectOptions) (streamedUpload, string, error) {
+	store := service.MinioStore{Client: i.minioClient}
+	var (
+		up  streamedUpload
+		err error
+	)
+	if plan.mayReplace() {
+		up, err = streamReplace(ctx, store, bucket, objectName, r, plan, opts)
+	} else {
+		up, err = streamUpload(ctx, store, bucket, objectName, r, plan.options(opts))
+	}
+	if err != nil {
+		return streamedUpload{}, "", err
+	}
+	i.afterStore(ctx, bucket, objectName, plan.replaced)
+	return up, i.archiveFromStore(ctx, store, bucket, objectName, up.SHA256, up.VersionID), nil
+}
+
+// checkStream validates, hashes and scans an upload that is not an image in
+// one read of r, holding none of it but the head: that is sniffed against
+// bucket's MIME types, and the rest goes through the streaming validator
+// (limited to max bytes) and the hash on its way to the scanner. It is for
+// uploads already staged somewhere, which are only copied or streamed into
+// their bucket once they pass. A refused file is a 400; a read that fails, or
+// a scan without a verdict, is not, and the caller keeps what it staged for a
+// retry.
+func (i image) checkStream(ctx context.Context, bucket string, r io.Reader, max int64) (streamedUpload, *keyError) {
+	policyError := func(err error) *keyError {
+		var valErr *validator.FileValidationError
+		if errors.As(err, &valErr) {
+			return &keyError{fiber.StatusBadRequest, valErr.Code, valErr.Message}
+		}
+		return &keyError{fiber.StatusBadRequest, "INVALID_FILE_CONTENT", err.Error()}
+	}
+
+	head := make([]byte, sniffLen)
+	n, err := io.ReadFull(r, head)
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) && !errors.Is(err, io.EOF) {
+		return streamedUpload{}, &keyError{fiber.StatusBadGateway, "STORAGE_ERROR", "could not read the upload: " + err.Error()}
+	}
+	head = head[:n]
+	if err := validator.ValidateMimeFor(bucket, head); err != nil {
+		return streamedUpload{}, policyError(err)
+	}
+
+	check := validator.NewContentValidatorUpTo(bucket, max)
+	sum := sha256.New()
+	body := io.TeeReader(io.MultiReader(bytes.NewReader(head), r), io.MultiWriter(check, sum))
+	scanErr := i.scanUpload(ctx, bucket, body)
+	// Whatever the scanner left unread (all of it, when the bucket is not
+	// scanned) still has to be validated and hashed.
+	_, readErr := io.Copy(io.Discard, body)
+	checkErr := check.Close()
+	if readErr != nil && !errors.Is(readErr, checkErr) {
+		return streamedUpload{}, &keyError{fiber.StatusBadGateway, "STORAGE_ERROR", "could not read the upload: " + readErr.Error()}
+	}
+	if checkErr != nil {
+		return streamedUpload{}, policyError(checkErr)
+	}
+	if scanErr != nil {
+		return streamedUpload{}, scanErr
+	}
+	return streamedUpload{
+		Size:        check.Size(),
+		SHA256:      hex.EncodeToString(sum.Sum(nil)),
+		ContentType: http.DetectContentType(head),
+	}, nil
+}
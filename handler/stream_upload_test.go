@@ -0,0 +1,333 @@
+package handler
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/minio/minio-go/v7"
+
+	"github.com/mstgnz/cdn/pkg/validator"
+	"github.com/mstgnz/cdn/service"
+)
+
+// memArchive is an in-memory service.Archive that archives every bucket.
+type memArchive struct {
+	mu       sync.Mutex
+	objects  map[string][]byte
+	sums     map[string]string
+	versions map[string]string
+}
+
+func newMemArchive() *memArchive {
+	return &memArchive{objects: map[string][]byte{}, sums: map[string]string{}, versions: map[string]string{}}
+}
+
+func (a *memArchive) Enabled() bool                           { return true }
+func (a *memArchive) InScope(string) bool                     { return true }
+func (a *memArchive) Reachable(context.Context, string) error { return nil }
+func (a *memArchive) VerifyDestination(context.Context) error { return nil }
+
+func (a *memArchive) Put(_ context.Context, bucket, object string, body io.Reader, sum, version string) error {
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return err
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.objects[bucket+"/"+object] = data
+	a.sums[bucket+"/"+object] = sum
+	a.versions[bucket+"/"+object] = version
+	return nil
+}
+
+func (a *memArchive) Open(_ context.Context, bucket, object string) (io.ReadCloser, int64, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	data, ok := a.objects[bucket+"/"+object]
+	if !ok {
+		return nil, 0, service.ErrArchiveNotFound
+	}
+	return io.NopCloser(bytes.NewReader(data)), int64(len(data)), nil
+}
+
+func (a *memArchive) Stat(_ context.Context, bucket, object string) (service.ArchiveInfo, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	data, ok := a.objects[bucket+"/"+object]
+	if !ok {
+		return service.ArchiveInfo{}, service.ErrArchiveNotFound
+	}
+	return service.ArchiveInfo{Size: int64(len(data)), SHA256: a.sums[bucket+"/"+object], VersionID: a.versions[bucket+"/"+object]}, nil
+}
+
+func (a *memArchive) Copy(_ context.Context, srcBucket, srcObject, dstBucket, dstObject string) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	data, ok := a.objects[srcBucket+"/"+srcObject]
+	if !ok {
+		return service.ErrArchiveNotFound
+	}
+	a.objects[dstBucket+"/"+dstObject] = data
+	a.sums[dstBucket+"/"+dstObject] = a.sums[srcBucket+"/"+srcObject]
+	return nil
+}
+
+func (a *memArchive) Walk(_ context.Context, bucket string, fn func(string, int64) error) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for k, v := range a.objects {
+		if key, ok := strings.CutPrefix(k, bucket+"/"); ok {
+			if err := fn(key, int64(len(v))); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// countingReader records how much of a source has been read.
+type countingReader struct {
+	r io.Reader
+	n int
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += n
+	return n, err
+}
+
+func TestStreamUploadStoresAndHashes(t *testing.T) {
+	store := newMemStore("docs")
+	csv := []byte(strings.Repeat("id,name,city\n1,Ayşe,İzmir\n", 2000))
+
+	up, err := streamUpload(context.Background(), store, "docs", "a.csv", bytes.NewReader(csv), minio.PutObjectOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := store.get("docs", "a.csv"); !bytes.Equal(got, csv) {
+		t.Fatal("stored bytes differ from the upload")
+	}
+	want := sha256.Sum256(csv)
+	if up.SHA256 != hex.EncodeToString(want[:]) {
+		t.Errorf("SHA256 = %s", up.SHA256)
+	}
+	if up.Size != int64(len(csv)) {
+		t.Errorf("Size = %d, want %d", up.Size, len(csv))
+	}
+	if !strings.HasPrefix(up.ContentType, "text/plain") {
+		t.Errorf("ContentType = %q", up.ContentType)
+	}
+}
+
+// The streaming path holds the bucket's upload policy too: its MIME types on
+// the head, before anything is stored, and its byte limits on the stream.
+func TestStreamUploadFollowsTheBucketUploadPolicy(t *testing.T) {
+	loadPresetPolicy(t, `{"buckets": [
+		{"bucket": "docs", "upload": {"mime_types": ["application/pdf"]}},
+		{"bucket": "sheets", "upload": {"max_bytes": 1024}}
+	]}`)
+	store := newMemStore("docs", "sheets")
+	csv := []byte(strings.Repeat("id,name\n1,a\n", 200))
+
+	_, err := streamUpload(context.Background(), store, "docs", "a.csv", bytes.NewReader(csv), minio.PutObjectOptions{})
+	var ve *validator.FileValidationError
+	if !errors.As(err, &ve) || ve.Code != "INVALID_MIME_TYPE" {
+		t.Fatalf("docs: err = %v, want INVALID_MIME_TYPE", err)
+	}
+	_, err = streamUpload(context.Background(), store, "sheets", "a.csv", bytes.NewReader(csv), minio.PutObjectOptions{})
+	if !errors.As(err, &ve) || ve.Code != "FILE_TOO_LARGE" {
+		t.Fatalf("sheets: err = %v, want FILE_TOO_LARGE", err)
+	}
+	if keys := append(store.keys("docs"), store.keys("sheets")...); len(keys) != 0 {
+		t.Fatalf("refused uploads were stored: %v", keys)
+	}
+}
+
+// Rejected content is abandoned where it fails: nothing is stored and the rest
+// of the source is never read.
+func TestStreamUploadStopsAtInvalidContent(t *testing.T) {
+	store := newMemStore("docs")
+	src := &countingReader{r: bytes.NewReader(append([]byte("MZ\x90\x00\x03\x00\x00\x00"), bytes.Repeat([]byte{0xff}, 4<<20)...))}
+
+	_, err := streamUpload(context.Background(), store, "docs", "a.pdf", src, minio.PutObjectOptions{})
+	var ve *validator.FileValidationError
+	if !errors.As(err, &ve) || ve.Code != "INVALID_FILE_CONTENT" {
+		t.Fatalf("err = %v, want INVALID_FILE_CONTENT", err)
+	}
+	if src.n >= 4<<20 {
+		t.Fatalf("read %d bytes of a file refused in its first kilobyte", src.n)
+	}
+	if keys := store.keys("docs"); len(keys) != 0 {
+		t.Fatalf("stored %v", keys)
+	}
+}
+
+// A file whose problem is only visible at its end has been stored by then and
+// must be removed again.
+func TestStreamUploadRemovesWhatFailsAtTheEnd(t *testing.T) {
+	store := newMemStore("docs")
+	text := "select 'é';"[:len("select 'é")-1] // ends inside a two-byte character
+
+	if _, err := streamUpload(context.Background(), store, "docs", "q.sql", strings.NewReader(text), minio.PutObjectOptions{}); err == nil {
+		t.Fatal("truncated UTF-8 accepted")
+	}
+	if keys := store.keys("docs"); len(keys) != 0 {
+		t.Fatalf("stored %v", keys)
+	}
+}
+
+// An overwrite that fails validation at its end leaves the object it was to
+// replace as it was: the stream is staged, and only copied over the key once
+// it has passed.
+func TestStreamReplaceKeepsTheObjectOnRejection(t *testing.T) {
+	ctx := context.Background()
+	staging := service.TusStagingBucket()
+	store := newMemStore("docs", staging)
+	if _, err := store.PutObject(ctx, "docs", "q.sql", strings.NewReader("select 1;"), 9, minio.PutObjectOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	plan := overwritePlan{policy: overwriteAlways, replaced: true}
+
+	text := "select 'é';"[:len("select 'é")-1]
+	if _, err := streamReplace(ctx, store, "docs", "q.sql", strings.NewReader(text), plan, minio.PutObjectOptions{}); err == nil {
+		t.Fatal("truncated UTF-8 accepted")
+	}
+	if got, ok := store.get("docs", "q.sql"); !ok || string(got) != "select 1;" {
+		t.Fatalf("object = (%q, %v), want the one it was to replace", got, ok)
+	}
+
+	up, err := streamReplace(ctx, store, "docs", "q.sql", strings.NewReader("select 2;"), plan,
+		minio.PutObjectOptions{UserMetadata: map[string]string{"owner": "ops"}, UserTags: map[string]string{"team": "data"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, _ := store.StatObject(ctx, "docs", "q.sql", minio.StatObjectOptions{})
+	if got, _ := store.get("docs", "q.sql"); string(got) != "select 2;" || info.ETag != up.ETag || info.UserMetadata["owner"] != "ops" || info.UserTagCount != 1 {
+		t.Fatalf("object = %q, %+v", got, info)
+	}
+	if keys := store.keys(staging); len(keys) != 0 {
+		t.Fatalf("staging left behind: %v", keys)
+	}
+
+	// "if-match" is checked again before the copy.
+	plan = overwritePlan{policy: overwriteIfMatch, ifMatch: "stale", replaced: true}
+	if _, err := streamReplace(ctx, store, "docs", "q.sql", strings.NewReader("select 3;"), plan, minio.PutObjectOptions{}); putFailure(err) == nil {
+		t.Fatalf("err = %v, want a failed precondition", err)
+	}
+	if got, _ := store.get("docs", "q.sql"); string(got) != "select 2;" {
+		t.Fatalf("object = %q after a failed precondition", got)
+	}
+}
+
+// Two "never" uploads that both found the key free race through the streamed
+// path, and neither reaches the end of its stream before the other: only one
+// creates the key, and the other is a conflict, not an overwrite. The fake
+// store only honours a bare If-None-Match: *, which is what MinIO needs.
+func TestStreamUploadNeverRaceCreatesOnce(t *testing.T) {
+	ctx := context.Background()
+	store := newMemStore("docs")
+	img := image{}
+
+	var arrived sync.WaitGroup
+	arrived.Add(2)
+	errs := make([]error, 2)
+	var done sync.WaitGroup
+	for n, body := range []string{"id,name\n1,first\n", "id,name\n2,second\n"} {
+		plan, kerr := img.checkOverwrite(ctx, store, "docs", "a.csv", "never", "")
+		if kerr != nil {
+			t.Fatal(kerr)
+		}
+		done.Add(1)
+		go func(n int, body string, plan overwritePlan) {
+			defer done.Done()
+			r := &barrierReader{r: strings.NewReader(body), arrive: func() { arrived.Done(); arrived.Wait() }}
+			_, errs[n] = streamUpload(ctx, store, "docs", "a.csv", r, plan.options(minio.PutObjectOptions{}))
+		}(n, body, plan)
+	}
+	done.Wait()
+
+	won, lost := 0, 0
+	for _, err := range errs {
+		switch kerr := (overwritePlan{policy: overwriteNever}).failure(err); {
+		case err == nil:
+			won++
+		case kerr != nil && kerr.code == "KEY_EXISTS":
+			lost++
+		default:
+			t.Fatalf("err = %v", err)
+		}
+	}
+	if won != 1 || lost != 1 {
+		t.Fatalf("won %d, lost %d; want one of each", won, lost)
+	}
+	winner := "id,name\n1,first\n"
+	if errs[0] != nil {
+		winner = "id,name\n2,second\n"
+	}
+	if got, _ := store.get("docs", "a.csv"); string(got) != winner {
+		t.Fatalf("object = %q, want the winner's %q", got, winner)
+	}
+}
+
+// barrierReader calls arrive once, when r is exhausted, before reporting EOF.
+type barrierReader struct {
+	r      io.Reader
+	arrive func()
+	once   sync.Once
+}
+
+func (b *barrierReader) Read(p []byte) (int, error) {
+	n, err := b.r.Read(p)
+	if err == io.EOF {
+		b.once.Do(b.arrive)
+	}
+	return n, err
+}
+
+func TestStreamUploadEnforcesTheSizeLimit(t *testing.T) {
+	t.Setenv("MAX_FILE_SIZE", "1000")
+	store := newMemStore("docs")
+
+	_, err := streamUpload(context.Background(), store, "docs", "big.csv", strings.NewReader(strings.Repeat("a,b\n", 300)), minio.PutObjectOptions{})
+	var ve *validator.FileValidationError
+	if !errors.As(err, &ve) || ve.Code != "FILE_TOO_LARGE" {
+		t.Fatalf("err = %v, want FILE_TOO_LARGE", err)
+	}
+	if keys := store.keys("docs"); len(keys) != 0 {
+		t.Fatalf("stored %v", keys)
+	}
+}
+
+// The archive copy comes from MinIO, and is only reported as archived when it
+// is byte for byte what was uploaded.
+func TestArchiveFromStoreVerifiesTheReadBack(t *testing.T) {
+	store := newMemStore("docs")
+	archive := newMemArchive()
+	img := image{archive: archive}
+	csv := []byte("a,b\n1,2\n")
+
+	up, err := streamUpload(context.Background(), store, "docs", "a.csv", bytes.NewReader(csv), minio.PutObjectOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := img.archiveFromStore(context.Background(), store, "docs", "a.csv", up.SHA256, ""); got != "Archive Successfully Uploaded" {
+		t.Fatalf("result = %q", got)
+	}
+	if data, _, err := archive.Open(context.Background(), "docs", "a.csv"); err != nil {
+		t.Fatal(err)
+	} else if got, _ := io.ReadAll(data); !bytes.Equal(got, csv) {
+		t.Fatal("archived bytes differ")
+	}
+
+	if got := img.archiveFromStore(context.Background(), store, "docs", "a.csv", strings.Repeat("0", 64), ""); !strings.HasPrefix(got, "Archive Failed") {
+		t.Fatalf("mismatched read-back reported %q", got)
+	}
+}
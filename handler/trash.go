@@ -0,0 +1,229 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/minio/minio-go/v7"
+
+	"github.com/mstgnz/cdn/pkg/config"
+	"github.com/mstgnz/cdn/service"
+)
+
+// RestoreRequest is the body of POST /trash/:bucket/restore. IDs are trash
+// IDs as GET /trash/:bucket lists them. Overwrite is "never" (the default) or
+// "always", for a key that was written again since the delete.
+type RestoreRequest struct {
+	IDs       []string `json:"ids"`
+	Overwrite string   `json:"overwrite"`
+}
+
+// trashPage is one page of a bucket's trash.
+type trashPage struct {
+	Bucket      string              `json:"bucket"`
+	Prefix      string              `json:"prefix"`
+	Days        int                 `json:"days"`
+	Items       []service.TrashItem `json:"items"`
+	IsTruncated bool                `json:"is_truncated"`
+	NextToken   string              `json:"next_token,omitempty"`
+}
+
+// discard is how every delete removes an object: into the trash when the
+// bucket keeps one, for good otherwise. It returns the trash ID, or "" when
+// nothing went to the trash.
+func (i image) discard(ctx context.Context, store service.ObjectStore, bucket, key string) (string, error) {
+	if i.trash.InUse(bucket) {
+		return i.trash.Discard(ctx, bucket, key)
+	}
+	return "", store.RemoveObject(ctx, bucket, key, minio.RemoveObjectOptions{})
+}
+
+// trashBucket resolves the bucket of a trash request. When the request
+// cannot go on it has already been answered, and ok is false.
+//
+// The trash is listed and restored from whenever there is one, even for a
+// bucket whose policy has since turned it off: what was deleted before stays
+// restorable until it is purged.
+func (i image) trashBucket(c *fiber.Ctx) (bucket string, ok bool, err error) {
+	bucket, err = resolveBucket(c, c.Params("bucket"))
+	if err != nil {
+		return "", false, bucketForbidden(c)
+	}
+	if bucket == "" {
+		return "", false, service.Response(c, fiber.StatusBadRequest, false, "Bucket is required", nil)
+	}
+	if service.InternalBucket(bucket) {
+		return "", false, bucketReserved(c)
+	}
+	if !i.trash.Enabled() {
+		return "", false, respondKeyError(c, &keyError{fiber.StatusNotFound, "TRASH_DISABLED", "no bucket keeps a trash"})
+	}
+	return bucket, true, nil
+}
+
+// ListTrash lists what was deleted from a bucket and can still be restored, a
+// page at a time and oldest key first: prefix narrows it to keys that start
+// with it, limit and token page through it as they do on GET /objects.
+func (i image) ListTrash(c *fiber.Ctx) error {
+	bucket, ok, err := i.trashBucket(c)
+	if !ok {
+		return err
+	}
+	q, kerr := parseListQuery(c)
+	if kerr != nil {
+		return respondKeyError(c, kerr)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
+	defer cancel()
+
+	items, more, err := i.trash.List(ctx, bucket, q.prefix, q.after, q.limit)
+	if err != nil {
+		return respondKeyError(c, &keyError{fiber.StatusBadGateway, "STORAGE_ERROR", "could not list the trash: " + err.Error()})
+	}
+	page := trashPage{Bucket: bucket, Prefix: q.prefix, Days: config.TrashDaysFor(bucket), Items: items}
+	if more && len(items) > 0 {
+		page.IsTruncated = true
+		page.NextToken = encodeListToken(items[len(items)-1].ID)
+	}
+	return service.Response(c, fiber.StatusOK, true, "success", page)
+}
+
+// RestoreTrash puts trash items back under the keys they were deleted from.
+// Each ID is restored on its own, and the results say which were.
+func (i image) RestoreTrash(c *fiber.Ctx) error {
+	bucket, ok, err := i.trashBucket(c)
+	if !ok {
+		return err
+	}
+	var req RestoreRequest
+	if err := c.BodyParser(&req); err != nil {
+		return service.Response(c, fiber.StatusBadRequest, false, "invalid request body", nil)
+	}
+	if len(req.IDs) == 0 {
+		return service.Response(c, fiber.StatusBadRequest, false, "ids is required", nil)
+	}
+	maxBatch := config.GetEnvAsIntOrDefault("MAX_BATCH_FILES", 100)
+	if maxBatch > 0 && len(req.IDs) > maxBatch {
+		return service.Response(c, fiber.StatusBadRequest, false, fmt.Sprintf("Too many ids in one restore (max %d)", maxBatch), nil)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+
+	store := service.MinioStore{Client: i.minioClient}
+	results := make([]map[string]any, 0, len(req.IDs))
+	for _, id := range req.IDs {
+		data, kerr := i.restoreFromTrash(ctx, store, bucket, id, req.Overwrite)
+		if kerr != nil {
+			data = map[string]any{"id": id, "success": false, "code": kerr.code, "error": kerr.message}
+		}
+		results = append(results, data)
+	}
+	return service.Response(c, fiber.StatusOK, true, "Restore completed", results)
+}
+
+// restoreFromTrash copies a trash item back to its key and removes it from
+// the trash, with everything it was stored with: the copy keeps its content
+// type, metadata and tags as a move does.
+//
+// A key is taken when MinIO has an object under it, or when the archive holds
+// something else there; the archived copy of the very object being restored,
+// which a delete leaves in place, is not a conflict but the restore's own.
+// The restored object is archived when the archive does not hold it as it is.
+//
+// It is not indexed for dedup again. Whether it was a random-named upload,
+// which later uploads of the same bytes may share, or one under a key its
+// owner may overwrite, which they must not, is not recorded anywhere the
+// trash can read; it stays an object of its own, which costs only the space
+// sharing would have saved.
+func (i image) restoreFromTrash(ctx context.Context, store service.ObjectStore, bucket, id, overwrite string) (map[string]any, *keyError) {
+	key, _, ok := service.ParseTrashID(id)
+	if !ok || service.HasUnsafeObjectKey(id) {
+		return nil, &keyError{fiber.StatusBadRequest, "INVALID_TRASH_ID", "not a trash ID"}
+	}
+	switch overwrite {
+	case "", overwriteNever, overwriteAlways:
+	default:
+		return nil, &keyError{fiber.StatusBadRequest, "INVALID_OVERWRITE", "overwrite must be never or always"}
+	}
+
+	trashKey := i.trash.Key(bucket, id)
+	info, err := store.StatObject(ctx, i.trash.Bucket(), trashKey, minio.StatObjectOptions{})
+	if err != nil {
+		if minio.ToErrorResponse(err).Code == "NoSuchKey" {
+			return nil, &keyError{fiber.StatusNotFound, "TRASH_ITEM_NOT_FOUND", "no such item in the trash; it may have been restored or purged"}
+		}
+		return nil, &keyError{fiber.StatusBadGateway, "STORAGE_ERROR", err.Error()}
+	}
+	sum := info.UserMetadata[service.MetaSHA256]
+
+	// The archived copy of the very object being restored is the restore's
+	// own and not a conflict, so a key taken only by it is not taken.
+	plan, kerr := i.checkOverwrite(ctx, store, bucket, key, overwrite, "")
+	archivedAsIs := false
+	if plan.replaced {
+		if archivedAsIs = i.archivedAsIs(ctx, store, bucket, key, info.Size, sum); archivedAsIs {
+			plan.replaced, kerr = false, nil
+		}
+	}
+	if kerr != nil {
+		return nil, kerr
+	}
+
+	// As on a copy between keys, the policy is checked again right before
+	// the CopyObject, which takes no preconditions on the destination.
+	err = plan.recheck(ctx, store, bucket, key)
+	var copied minio.UploadInfo
+	if err == nil {
+		copied, err = store.CopyObject(ctx,
+			minio.CopyDestOptions{Bucket: bucket, Object: key},
+			minio.CopySrcOptions{Bucket: i.trash.Bucket(), Object: trashKey, MatchETag: info.ETag})
+	}
+	if err != nil {
+		if kerr := plan.failure(err); kerr != nil {
+			return nil, kerr
+		}
+		return nil, &keyError{fiber.StatusBadGateway, "STORAGE_ERROR", "could not restore the object: " + err.Error()}
+	}
+	i.afterStore(ctx, bucket, key, plan.replaced)
+
+	url := strings.TrimSuffix(config.GetEnvOrDefault("APP_URL", "http://localhost:9090"), "/")
+	data := map[string]any{
+		"id":          id,
+		"success":     true,
+		"bucket":      bucket,
+		"key":         key,
+		"etag":        copied.ETag,
+		"size":        info.Size,
+		"overwritten": plan.replaced,
+		"link":        url + "/" + bucket + "/" + key,
+	}
+	if !archivedAsIs {
+		if msg := i.archiveFromStore(ctx, store, bucket, key, sum, copied.VersionID); msg != "" {
+			data["archive"] = msg
+		}
+	}
+	// The object is back, so a failure here only leaves a copy in the trash
+	// for the purge job; it is reported, not retried.
+	if err := store.RemoveObject(ctx, i.trash.Bucket(), trashKey, minio.RemoveObjectOptions{}); err != nil {
+		data["trash_error"] = "could not remove the item from the trash: " + err.Error()
+	}
+	return data, nil
+}
+
+// archivedAsIs reports whether key is held only by the archive, with the size
+// and digest of the object being restored: the copy its delete left there.
+func (i image) archivedAsIs(ctx context.Context, store service.ObjectStore, bucket, key string, size int64, sum string) bool {
+	if sum == "" || i.archive == nil || !i.archive.Enabled() {
+		return false
+	}
+	if _, err := store.StatObject(ctx, bucket, key, minio.StatObjectOptions{}); minio.ToErrorResponse(err).Code != "NoSuchKey" {
+		return false
+	}
+	archived, err := i.archive.Stat(ctx, bucket, key)
+	return err == nil && archived.Size == size && archived.SHA256 == sum
+}
@@ -0,0 +1,174 @@
+package handler
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/minio/minio-go/v7"
+
+	"github.com/mstgnz/cdn/service"
+)
+
+func newTrashImage(t *testing.T) (image, *memStore, *memArchive, *recordingNotifier) {
+	t.Helper()
+	loadPresetPolicy(t, `{"buckets":[{"bucket":"photos","trash":{"days":7}}]}`)
+	store := newMemStore("photos", "scratch", service.TrashBucket())
+	trash, err := service.NewTrash(store)
+	if err != nil || trash == nil {
+		t.Fatalf("NewTrash = (%v, %v)", trash, err)
+	}
+	archive := newMemArchive()
+	notifier := &recordingNotifier{}
+	return image{archive: archive, notifier: notifier, trash: trash}, store, archive, notifier
+}
+
+// A delete from a bucket with a trash moves the object there, whole, and a
+// restore puts it back under its key with everything it was stored with.
+func TestTrashDeleteAndRestore(t *testing.T) {
+	ctx := context.Background()
+	img, store, _, _ := newTrashImage(t)
+	attrs, _ := newObjectAttrs(map[string]string{"alt": "A cat"}, map[string]string{"team": "web"})
+	if _, err := store.PutObject(ctx, "photos", "a/cat.png", bytes.NewReader([]byte("png")), 3,
+		attrs.options(minio.PutObjectOptions{ContentType: "image/png", UserMetadata: digestMeta("abc")})); err != nil {
+		t.Fatal(err)
+	}
+
+	id, err := img.discard(ctx, store, "photos", "a/cat.png")
+	if err != nil || id == "" {
+		t.Fatalf("discard = (%q, %v)", id, err)
+	}
+	if _, ok := store.get("photos", "a/cat.png"); ok {
+		t.Fatal("the deleted object is still in its bucket")
+	}
+	items, more, err := img.trash.List(ctx, "photos", "a/", "", 10)
+	if err != nil || more || len(items) != 1 || items[0].ID != id || items[0].Key != "a/cat.png" || items[0].Size != 3 {
+		t.Fatalf("List = (%+v, %v, %v)", items, more, err)
+	}
+
+	data, kerr := img.restoreFromTrash(ctx, store, "photos", id, "")
+	if kerr != nil {
+		t.Fatal(kerr)
+	}
+	if data["key"] != "a/cat.png" || data["overwritten"] != false {
+		t.Errorf("data = %v", data)
+	}
+	o, ok := store.object("photos", "a/cat.png")
+	if !ok || o.contentType != "image/png" || o.meta[service.MetaSHA256] != "abc" || userMeta(o.meta)["alt"] != "A cat" || o.tags["team"] != "web" {
+		t.Errorf("restored with %+v", o)
+	}
+	if keys := store.keys(service.TrashBucket()); len(keys) != 0 {
+		t.Errorf("trash after the restore: %v", keys)
+	}
+	if _, kerr := img.restoreFromTrash(ctx, store, "photos", id, ""); kerr == nil || kerr.code != "TRASH_ITEM_NOT_FOUND" {
+		t.Errorf("second restore: %v", kerr)
+	}
+}
+
+// A key written again since the delete is not replaced unless asked to be,
+// and when it is, its cached copies are purged as for any overwrite.
+func TestTrashRestoreOverAnExistingKey(t *testing.T) {
+	ctx := context.Background()
+	img, store, _, notifier := newTrashImage(t)
+	putObjects(t, store, "photos", "logo.png")
+	id, _ := img.discard(ctx, store, "photos", "logo.png")
+	putObjects(t, store, "photos", "logo.png")
+
+	if _, kerr := img.restoreFromTrash(ctx, store, "photos", id, ""); kerr == nil || kerr.code != "KEY_EXISTS" {
+		t.Fatalf("restore over a new object: %v", kerr)
+	}
+	data, kerr := img.restoreFromTrash(ctx, store, "photos", id, overwriteAlways)
+	if kerr != nil || data["overwritten"] != true {
+		t.Fatalf("overwrite=always: (%v, %v)", data, kerr)
+	}
+	if len(notifier.events) != 1 || notifier.events[0].Reason != service.PurgeOverwritten {
+		t.Errorf("upstream events = %+v", notifier.events)
+	}
+}
+
+// The delete left the object's archived copy where it was. That copy is the
+// restored object's own, so it neither blocks the restore nor is archived
+// again; an archived copy of something else is a conflict.
+func TestTrashRestoreAndTheArchive(t *testing.T) {
+	ctx := context.Background()
+	img, store, archive, _ := newTrashImage(t)
+	for key, sum := range map[string]string{"same.png": "abc", "other.png": "def"} {
+		if _, err := store.PutObject(ctx, "photos", key, bytes.NewReader([]byte("png")), 3, minio.PutObjectOptions{UserMetadata: digestMeta("abc")}); err != nil {
+			t.Fatal(err)
+		}
+		_ = archive.Put(ctx, "photos", key, bytes.NewReader([]byte("png")), sum, "")
+	}
+	same, _ := img.discard(ctx, store, "photos", "same.png")
+	other, _ := img.discard(ctx, store, "photos", "other.png")
+
+	data, kerr := img.restoreFromTrash(ctx, store, "photos", same, "")
+	if kerr != nil {
+		t.Fatal(kerr)
+	}
+	if _, archived := data["archive"]; archived {
+		t.Errorf("archived again: %v", data)
+	}
+	if _, kerr := img.restoreFromTrash(ctx, store, "photos", other, ""); kerr == nil || kerr.code != "KEY_EXISTS" {
+		t.Errorf("restore over a different archived object: %v", kerr)
+	}
+}
+
+func TestTrashOnlyWhereThePolicyKeepsOne(t *testing.T) {
+	ctx := context.Background()
+	img, store, _, _ := newTrashImage(t)
+	putObjects(t, store, "scratch", "tmp.png")
+	if id, err := img.discard(ctx, store, "scratch", "tmp.png"); err != nil || id != "" {
+		t.Fatalf("discard = (%q, %v)", id, err)
+	}
+	if _, ok := store.get("scratch", "tmp.png"); ok {
+		t.Error("not removed")
+	}
+	if keys := store.keys(service.TrashBucket()); len(keys) != 0 {
+		t.Errorf("trashed from a bucket without a trash: %v", keys)
+	}
+	for _, id := range []string{"tmp.png", "../photos/x.png~1", "x.png~soon"} {
+		if _, kerr := img.restoreFromTrash(ctx, store, "photos", id, ""); kerr == nil || kerr.code != "INVALID_TRASH_ID" {
+			t.Errorf("%q: %v", id, kerr)
+		}
+	}
+}
+
+// appearingStore has an object appear under a key once it has been stat'ed,
+// as an upload racing a restore would write it after the restore's check.
+type appearingStore struct {
+	*memStore
+	bucket, key string
+	stated      bool
+}
+
+func (s *appearingStore) StatObject(ctx context.Context, bucket, key string, opts minio.StatObjectOptions) (minio.ObjectInfo, error) {
+	if bucket == s.bucket && key == s.key {
+		if s.stated {
+			if _, err := s.memStore.PutObject(ctx, bucket, key, bytes.NewReader([]byte("new")), 3, minio.PutObjectOptions{}); err != nil {
+				return minio.ObjectInfo{}, err
+			}
+		}
+		s.stated = true
+	}
+	return s.memStore.StatObject(ctx, bucket, key, opts)
+}
+
+// A "never" restore checks the key again right before its copy, so an object
+// written there since the first check is not replaced.
+func TestTrashRestoreRechecksTheKey(t *testing.T) {
+	ctx := context.Background()
+	img, store, _, _ := newTrashImage(t)
+	putObjects(t, store, "photos", "logo.png")
+	id, _ := img.discard(ctx, store, "photos", "logo.png")
+
+	racing := &appearingStore{memStore: store, bucket: "photos", key: "logo.png"}
+	if _, kerr := img.restoreFromTrash(ctx, racing, "photos", id, ""); kerr == nil || kerr.code != "KEY_EXISTS" {
+		t.Fatalf("restore over an object written meanwhile: %v", kerr)
+	}
+	if got, _ := store.get("photos", "logo.png"); string(got) != "new" {
+		t.Errorf("the racing write was replaced with %q", got)
+	}
+	if keys := store.keys(service.TrashBucket()); len(keys) != 1 {
+		t.Errorf("trash after the refused restore: %v", keys)
+	}
+}
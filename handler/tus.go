@@ -0,0 +1,794 @@
+package handler
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"github.com/minio/minio-go/v7"
+	"github.com/rs/zerolog"
+
+	bucketname "github.com/mstgnz/cdn/pkg/bucket"
+	"github.com/mstgnz/cdn/pkg/config"
+	"github.com/mstgnz/cdn/pkg/observability"
+	"github.com/mstgnz/cdn/pkg/validator"
+	"github.com/mstgnz/cdn/service"
+)
+
+// tusVersion is the only protocol version spoken here.
+const tusVersion = "1.0.0"
+
+// tusExtensions are the extensions implemented on top of the core protocol.
+// Deferred length, checksums and concatenation are not.
+const tusExtensions = "creation,termination"
+
+// TusHandler serves resumable uploads under /tus/, following the tus 1.0 core
+// protocol with the creation and termination extensions (https://tus.io).
+type TusHandler interface {
+	Options(c *fiber.Ctx) error
+	Create(c *fiber.Ctx) error
+	Head(c *fiber.Ctx) error
+	Patch(c *fiber.Ctx) error
+	Terminate(c *fiber.Ctx) error
+
+	// EnsureBucket creates the staging bucket if it is missing.
+	EnsureBucket(ctx context.Context) error
+
+	// Start removes abandoned uploads on an interval until ctx is done.
+	Start(ctx context.Context)
+}
+
+// tusHandler exists because /upload is one multipart request read whole with
+// io.ReadAll. A phone on a flaky connection that drops at 90% of a 100MB video
+// starts again from zero, and usually drops again. Here the client sends the
+// file in chunks, asks where the server got to after a failure, and continues
+// from there.
+//
+// Each chunk is stored as its own object in the staging bucket, named by the
+// offset it starts at, next to a small JSON record of the upload. When the last
+// byte arrives the chunks are read back in order, and from then on the file
+// goes through exactly what UploadImage does with a multipart file: content
+// validation, the image check, a random object name under the requested path,
+// MinIO, presets, and the archive.
+//
+// Upload state lives in MinIO rather than in memory, so a restart or a
+// different replica can continue an upload. The per-upload lock is in process
+// only; two replicas accepting PATCHes for the same upload at the same moment
+// is a client bug, and the worst it can do is fail that upload.
+type tusHandler struct {
+	img     image
+	store   service.ObjectStore
+	staging string
+	maxSize int64
+	expiry  time.Duration
+	logger  zerolog.Logger
+	now     func() time.Time
+
+	locks [64]sync.Mutex
+}
+
+// tusUpload is the record kept next to an upload's chunks.
+type tusUpload struct {
+	ID        string    `json:"id"`
+	Bucket    string    `json:"bucket"`
+	Path      string    `json:"path,omitempty"`
+	Filename  string    `json:"filename"`
+	Length    int64     `json:"length"`
+	Offset    int64     `json:"offset"`
+	Metadata  string    `json:"metadata,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+
+	// Attrs are the metadata and tags from Upload-Metadata that the object is
+	// stored with. See objectAttrs.
+	Attrs objectAttrs `json:"attrs"`
+
+	// Set once the upload has been assembled into its bucket.
+	ObjectName string `json:"object_name,omitempty"`
+	Link       string `json:"link,omitempty"`
+	Archive    string `json:"archive,omitempty"`
+
+	// Reference is the dedup reference of an upload answered with an
+	// existing object, which a delete of this upload's copy passes back.
+	Reference string `json:"reference,omitempty"`
+}
+
+func (u *tusUpload) complete() bool { return u.ObjectName != "" }
+
+var errTusNotFound = errors.New("upload not found")
+
+// NewTusHandler shares the upload pipeline of images, which must come from
+// NewImage. store reaches MinIO for both the staging bucket and the final
+// object.
+func NewTusHandler(images Image, store service.ObjectStore) (TusHandler, error) {
+	img, ok := images.(*image)
+	if !ok {
+		return nil, fmt.Errorf("tus: images must come from NewImage")
+	}
+	staging := service.TusStagingBucket()
+	if err := bucketname.Validate(staging); err != nil {
+		return nil, fmt.Errorf("TUS_STAGING_BUCKET: %w", err)
+	}
+	return newTusHandler(*img, store, staging), nil
+}
+
+func newTusHandler(img image, store service.ObjectStore, staging string) *tusHandler {
+	hours := config.GetEnvAsIntOrDefault("TUS_EXPIRY_HOURS", 24)
+	if hours < 1 {
+		hours = 1
+	}
+	return &tusHandler{
+		img:     img,
+		store:   store,
+		staging: staging,
+		maxSize: int64(config.GetEnvAsIntOrDefault("MAX_FILE_SIZE", int(validator.DefaultMaxFileSize))),
+		expiry:  time.Duration(hours) * time.Hour,
+		logger:  observability.Logger(),
+		now:     time.Now,
+	}
+}
+
+func (t *tusHandler) EnsureBucket(ctx context.Context) error {
+	exists, err := t.store.BucketExists(ctx, t.staging)
+	if err != nil || exists {
+		return err
+	}
+	return t.store.MakeBucket(ctx, t.staging, minio.MakeBucketOptions{})
+}
+
+func tusInfoKey(id string) string     { return id + "/info" }
+func tusChunkPrefix(id string) string { return id + "/chunks/" }
+
+// tusChunkKey pads the offset so listing order is byte order.
+func tusChunkKey(id string, offset int64) string {
+	return fmt.Sprintf("%s%020d", tusChunkPrefix(id), offset)
+}
+
+func (t *tusHandler) lock(id string) func() {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(id))
+	m := &t.locks[h.Sum32()%uint32(len(t.locks))]
+	m.Lock()
+	return m.Unlock
+}
+
+// checkVersion enforces the one header every tus request but OPTIONS carries.
+func checkVersion(c *fiber.Ctx) bool {
+	c.Set("Tus-Resumable", tusVersion)
+	if c.Get("Tus-Resumable") == tusVersion {
+		return true
+	}
+	c.Set("Tus-Version", tusVersion)
+	return false
+}
+
+// Options answers capability discovery. It needs no token, like any other
+// OPTIONS request.
+func (t *tusHandler) Options(c *fiber.Ctx) error {
+	c.Set("Tus-Resumable", tusVersion)
+	c.Set("Tus-Version", tusVersion)
+	c.Set("Tus-Extension", tusExtensions)
+	c.Set("Tus-Max-Size", strconv.FormatInt(t.maxSize, 10))
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+// Create starts an upload. Upload-Metadata carries filename (or name), and
+// optionally bucket, path, alt, author, x-meta-* and tags with the meaning
+// they have on /upload.
+//
+// Everything that can be decided before a byte arrives is decided here: the
+// extension and declared size are checked and the bucket is resolved and
+// created, so a client does not send 100MB to learn its token is for another
+// bucket.
+func (t *tusHandler) Create(c *fiber.Ctx) error {
+	if !checkVersion(c) {
+		return service.Response(c, fiber.StatusPreconditionFailed, false, "unsupported Tus-Resumable version", nil)
+	}
+	if c.Get("Upload-Defer-Length") != "" {
+		return service.Response(c, fiber.StatusBadRequest, false, "Upload-Defer-Length is not supported; send Upload-Length", nil)
+	}
+	length, err := strconv.ParseInt(c.Get("Upload-Length"), 10, 64)
+	if err != nil || length < 1 {
+		return service.Response(c, fiber.StatusBadRequest, false, "Upload-Length must be a positive integer", nil)
+	}
+	if length > t.maxSize {
+		c.Set("Tus-Max-Size", strconv.FormatInt(t.maxSize, 10))
+		return service.Response(c, fiber.StatusRequestEntityTooLarge, false,
+			fmt.Sprintf("File size is too large. Maximum: %d bytes", t.maxSize),
+			map[string]string{"code": "FILE_TOO_LARGE"})
+	}
+
+	meta, err := parseUploadMetadata(c.Get("Upload-Metadata"))
+	if err != nil {
+		return service.Response(c, fiber.StatusBadRequest, false, err.Error(), nil)
+	}
+	filename := meta["filename"]
+	if filename == "" {
+		filename = meta["name"]
+	}
+	if filename == "" {
+		return service.Response(c, fiber.StatusBadRequest, false, "Upload-Metadata must include filename", nil)
+	}
+	attrs, kerr := fieldAttrs(meta)
+	if kerr != nil {
+		return respondKeyError(c, kerr)
+	}
+	if len(strings.Split(filename, ".")) < 2 {
+		return service.Response(c, fiber.StatusBadRequest, false, "File extension not found!", nil)
+	}
+	bucket, err := resolveBucket(c, meta["bucket"])
+	if err != nil {
+		return bucketForbidden(c)
+	}
+	if bucket == "" {
+		return service.Response(c, fiber.StatusBadRequest, false, "Bucket is required", nil)
+	}
+	if service.InternalBucket(bucket) {
+		return bucketReserved(c)
+	}
+	// Checked once the bucket is known, since its upload policy may narrow
+	// what the global allowlist accepts.
+	if err := validator.ValidateFile(&multipart.FileHeader{Filename: filename, Size: length}, bucket); err != nil {
+		if valErr, ok := err.(*validator.FileValidationError); ok {
+			return service.Response(c, fiber.StatusBadRequest, false, valErr.Message, map[string]string{
+				"code": valErr.Code,
+			})
+		}
+		return service.Response(c, fiber.StatusBadRequest, false, err.Error(), nil)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	// Same rule as UploadImage: only a bucket that does not exist yet is
+	// name-checked.
+	exists, err := t.store.BucketExists(ctx, bucket)
+	if err != nil {
+		return service.Response(c, fiber.StatusBadRequest, false, "bucket check failed: "+err.Error(), nil)
+	}
+	if !exists {
+		if err := bucketname.ValidateNew(bucket); err != nil {
+			return service.Response(c, fiber.StatusBadRequest, false, err.Error(), nil)
+		}
+		if err := t.store.MakeBucket(ctx, bucket, minio.MakeBucketOptions{}); err != nil {
+			return service.Response(c, fiber.StatusBadRequest, false, "Bucket Not Found And Not Created!", nil)
+		}
+	}
+
+	up := &tusUpload{
+		ID:        uuid.New().String(),
+		Bucket:    bucket,
+		Path:      strings.Trim(meta["path"], "/"),
+		Filename:  filename,
+		Length:    length,
+		Metadata:  c.Get("Upload-Metadata"),
+		Attrs:     attrs,
+		CreatedAt: t.now().UTC(),
+	}
+	if err := t.save(ctx, up); err != nil {
+		return service.Response(c, fiber.StatusInternalServerError, false, "could not create upload", nil)
+	}
+
+	base := strings.TrimSuffix(config.GetEnvOrDefault("APP_URL", "http://localhost:9090"), "/")
+	c.Set("Location", base+"/tus/"+up.ID)
+	return c.SendStatus(fiber.StatusCreated)
+}
+
+// Head reports how much of an upload the server has, which is where the client
+// resumes from.
+func (t *tusHandler) Head(c *fiber.Ctx) error {
+	if !checkVersion(c) {
+		return c.SendStatus(fiber.StatusPreconditionFailed)
+	}
+	c.Set("Cache-Control", "no-store")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	up, status := t.authorized(ctx, c)
+	if up == nil {
+		return c.SendStatus(status)
+	}
+	t.setUploadHeaders(c, up)
+	return c.SendStatus(fiber.StatusOK)
+}
+
+// Patch appends one chunk. The chunk that completes the upload also assembles
+// it, so the response to the last PATCH means the object exists.
+func (t *tusHandler) Patch(c *fiber.Ctx) error {
+	if !checkVersion(c) {
+		return service.Response(c, fiber.StatusPreconditionFailed, false, "unsupported Tus-Resumable version", nil)
+	}
+	if c.Get("Content-Type") != "application/offset+octet-stream" {
+		return service.Response(c, fiber.StatusUnsupportedMediaType, false, "Content-Type must be application/offset+octet-stream", nil)
+	}
+	offset, err := strconv.ParseInt(c.Get("Upload-Offset"), 10, 64)
+	if err != nil || offset < 0 {
+		return service.Response(c, fiber.StatusBadRequest, false, "Upload-Offset must be a non-negative integer", nil)
+	}
+
+	// Assembly reads every chunk back, so it gets longer than a request.
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+
+	unlock := t.lock(c.Params("id"))
+	defer unlock()
+
+	up, status := t.authorized(ctx, c)
+	if up == nil {
+		return service.Response(c, status, false, http.StatusText(status), nil)
+	}
+	if offset != up.Offset {
+		c.Set("Upload-Offset", strconv.FormatInt(up.Offset, 10))
+		return service.Response(c, fiber.StatusConflict, false, "Upload-Offset does not match the upload", nil)
+	}
+
+	body := c.Body()
+	if up.complete() {
+		if len(body) > 0 {
+			return service.Response(c, fiber.StatusConflict, false, "upload is already complete", nil)
+		}
+		t.setUploadHeaders(c, up)
+		return c.SendStatus(fiber.StatusNoContent)
+	}
+	if offset+int64(len(body)) > up.Length {
+		return service.Response(c, fiber.StatusRequestEntityTooLarge, false, "chunk runs past Upload-Length", nil)
+	}
+
+	if len(body) > 0 {
+		if _, err := t.store.PutObject(ctx, t.staging, tusChunkKey(up.ID, offset), bytes.NewReader(body), int64(len(body)),
+			minio.PutObjectOptions{ContentType: "application/octet-stream"}); err != nil {
+			return service.Response(c, fiber.StatusInternalServerError, false, "could not store chunk", nil)
+		}
+		up.Offset += int64(len(body))
+		if err := t.save(ctx, up); err != nil {
+			// The chunk is stored but not counted; the client resumes from
+			// the old offset and overwrites it under the same name.
+			return service.Response(c, fiber.StatusInternalServerError, false, "could not record chunk", nil)
+		}
+	}
+
+	if up.Offset == up.Length {
+		if f := t.finish(ctx, up); f != nil {
+			var data any
+			if f.code != "" {
+				data = map[string]string{"code": f.code}
+			}
+			return service.Response(c, f.status, false, f.message, data)
+		}
+	}
+
+	t.setUploadHeaders(c, up)
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+// Terminate abandons an upload and frees its chunks.
+func (t *tusHandler) Terminate(c *fiber.Ctx) error {
+	if !checkVersion(c) {
+		return service.Response(c, fiber.StatusPreconditionFailed, false, "unsupported Tus-Resumable version", nil)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	unlock := t.lock(c.Params("id"))
+	defer unlock()
+
+	up, status := t.authorized(ctx, c)
+	if up == nil {
+		return service.Response(c, status, false, http.StatusText(status), nil)
+	}
+	if err := t.removeAll(ctx, up.ID); err != nil {
+		return service.Response(c, fiber.StatusInternalServerError, false, "could not remove upload", nil)
+	}
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+// authorized loads the upload named in the URL and checks the caller may touch
+// it: a bucket token only reaches uploads into its own bucket. A nil upload
+// comes with the status to answer.
+func (t *tusHandler) authorized(ctx context.Context, c *fiber.Ctx) (*tusUpload, int) {
+	id := c.Params("id")
+	if _, err := uuid.Parse(id); err != nil {
+		return nil, fiber.StatusNotFound
+	}
+	up, err := t.load(ctx, id)
+	if errors.Is(err, errTusNotFound) {
+		return nil, fiber.StatusNotFound
+	}
+	if err != nil {
+		return nil, fiber.StatusInternalServerError
+	}
+	if _, err := resolveBucket(c, up.Bucket); err != nil {
+		return nil, fiber.StatusForbidden
+	}
+	return up, 0
+}
+
+func (t *tusHandler) setUploadHeaders(c *fiber.Ctx, up *tusUpload) {
+	c.Set("Upload-Offset", strconv.FormatInt(up.Offset, 10))
+	c.Set("Upload-Length", strconv.FormatInt(up.Length, 10))
+	if up.Metadata != "" {
+		c.Set("Upload-Metadata", up.Metadata)
+	}
+	// tus has no way to say where a finished upload ended up, so it is
+	// reported in headers a client can read after the last PATCH or any HEAD.
+	if up.complete() {
+		c.Set("X-Object-Name", up.ObjectName)
+		c.Set("X-Object-Link", up.Link)
+		if up.Reference != "" {
+			c.Set("X-Dedup-Reference", up.Reference)
+		}
+	}
+}
+
+// tusFailure is why the last PATCH could not produce an object.
+type tusFailure struct {
+	status  int
+	message string
+	code    string
+}
+
+// finish assembles a complete upload and stores it like UploadImage would. A
+// file that fails validation is removed and reported with the same codes
+// /upload uses, while a storage failure keeps the chunks so an empty PATCH at
+// the final offset can retry.
+//
+// The chunks are read through one reader and never concatenated in memory
+// except for an image, which has to be decoded whole anyway. Anything else is
+// read twice: once to validate, hash and scan it (checkStream), and once more
+// on its way into its bucket, hashed again so that what is stored is known to
+// be what was checked. The digest is stored with the object (digestMeta), so
+// it is deduplicated and its archived copy verified like any other upload's.
+func (t *tusHandler) finish(ctx context.Context, up *tusUpload) *tusFailure {
+	keys, err := t.chunkKeys(ctx, up)
+	if err != nil {
+		t.logger.Error().Err(err).Str("upload", up.ID).Msg("tus: assembling upload failed")
+		return &tusFailure{status: fiber.StatusInternalServerError, message: "could not assemble upload"}
+	}
+
+	reject := func(message string, code string) *tusFailure {
+		_ = t.removeAll(ctx, up.ID)
+		return &tusFailure{status: fiber.StatusBadRequest, message: message, code: code}
+	}
+	var (
+		content     []byte
+		sum         string
+		contentType string
+	)
+	if service.IsImageFile(up.Filename) {
+		r := t.chunkReader(ctx, keys)
+		content, err = io.ReadAll(r)
+		_ = r.Close()
+		if err == nil && int64(len(content)) != up.Length {
+			err = fmt.Errorf("assembled %d bytes, expected %d", len(content), up.Length)
+		}
+		if err != nil {
+			t.logger.Error().Err(err).Str("upload", up.ID).Msg("tus: assembling upload failed")
+			return &tusFailure{status: fiber.StatusInternalServerError, message: "could not assemble upload"}
+		}
+		if err := validator.ValidateContentFor(up.Bucket, content); err != nil {
+			if valErr, ok := err.(*validator.FileValidationError); ok {
+				return reject(valErr.Message, valErr.Code)
+			}
+			return reject(err.Error(), "INVALID_FILE_CONTENT")
+		}
+		width, height, err := t.img.validateImageContent(up.Filename, content)
+		if err != nil {
+			return reject("invalid image content", "INVALID_IMAGE_CONTENT")
+		}
+		if err := validator.ValidateImageFor(up.Bucket, width, height); err != nil {
+			valErr := err.(*validator.FileValidationError)
+			return reject(valErr.Message, valErr.Code)
+		}
+		// A scan without a verdict keeps the chunks, like a storage failure,
+		// so the client can retry the final PATCH once the scanner is back.
+		if kerr := t.img.scanUpload(ctx, up.Bucket, bytes.NewReader(content)); kerr != nil {
+			if kerr.status == fiber.StatusServiceUnavailable {
+				return &tusFailure{status: kerr.status, message: kerr.message, code: kerr.code}
+			}
+			return reject(kerr.message, kerr.code)
+		}
+		// tus has nowhere to ask for optimisation, so only a bucket that
+		// forces it gets it.
+		if validator.ForcedOptimize(up.Bucket) {
+			content, _, _ = t.img.maybeOptimize(content, service.DefaultOptimizeOptions())
+		}
+		digest := sha256.Sum256(content)
+		sum, contentType = hex.EncodeToString(digest[:]), http.DetectContentType(content)
+	} else {
+		r := t.chunkReader(ctx, keys)
+		checked, kerr := t.img.checkStream(ctx, up.Bucket, r, t.maxSize)
+		_ = r.Close()
+		if kerr != nil {
+			if kerr.status != fiber.StatusBadRequest {
+				return &tusFailure{status: kerr.status, message: kerr.message, code: kerr.code}
+			}
+			return reject(kerr.message, kerr.code)
+		}
+		if checked.Size != up.Length {
+			t.logger.Error().Str("upload", up.ID).Int64("size", checked.Size).Msg("tus: chunks do not add up to the upload")
+			return &tusFailure{status: fiber.StatusInternalServerError, message: "could not assemble upload"}
+		}
+		sum, contentType = checked.SHA256, checked.ContentType
+	}
+
+	base := strings.TrimSuffix(config.GetEnvOrDefault("APP_URL", "http://localhost:9090"), "/")
+	if up.Attrs.empty() && t.img.dedupApplies(up.Bucket, "") {
+		if existing, ref, ok := t.img.reuseDuplicate(ctx, t.store, up.Bucket, sum); ok {
+			up.ObjectName, up.Reference = existing, ref
+			up.Link = base + "/" + up.Bucket + "/" + existing
+			t.record(ctx, up)
+			return nil
+		}
+	}
+
+	parts := strings.Split(up.Filename, ".")
+	objectName := uuid.New().String() + "." + service.SanitizeObjectName(parts[len(parts)-1])
+	if up.Path != "" {
+		objectName = service.SanitizeObjectName(up.Path) + "/" + objectName
+	} else if tpl := config.KeyTemplateFor(up.Bucket); tpl != "" {
+		_, objectName = templatedName(tpl, parts[len(parts)-1], sum)
+	}
+
+	opts := up.Attrs.options(minio.PutObjectOptions{ContentType: contentType, UserMetadata: digestMeta(sum)})
+	var info minio.UploadInfo
+	if content != nil {
+		info, err = t.store.PutObject(ctx, up.Bucket, objectName, bytes.NewReader(content), int64(len(content)), opts)
+	} else {
+		info, err = t.storeChunks(ctx, up, keys, objectName, sum, opts)
+	}
+	if err != nil {
+		return &tusFailure{status: fiber.StatusInternalServerError, message: err.Error()}
+	}
+	t.img.forgetMissing(ctx, up.Bucket, objectName)
+	if up.Attrs.empty() {
+		t.img.claimDigest(ctx, up.Bucket, "", sum, objectName)
+	}
+	t.img.schedulePresets(t.store, up.Bucket, objectName, info.ETag)
+
+	up.ObjectName = objectName
+	up.Link = base + "/" + up.Bucket + "/" + objectName
+	if content != nil {
+		up.Archive = t.img.archiveObject(ctx, up.Bucket, objectName, bytes.NewReader(content), sum, info.VersionID)
+	} else {
+		up.Archive = t.img.archiveFromStore(ctx, t.store, up.Bucket, objectName, sum, info.VersionID)
+	}
+	t.record(ctx, up)
+	return nil
+}
+
+// record keeps the upload's record, now describing the result, so a client
+// whose final response was lost can still learn where the file went, and
+// drops the chunks. Expiry removes the record with everything else.
+func (t *tusHandler) record(ctx context.Context, up *tusUpload) {
+	if err := t.save(ctx, up); err != nil {
+		t.logger.Warn().Err(err).Str("upload", up.ID).Msg("tus: could not record the finished upload")
+	}
+	t.removeChunks(ctx, up.ID)
+}
+
+// storeChunks streams the chunks into the upload's bucket as objectName. They
+// are hashed again on the way: the chunks cannot change once the upload is
+// complete, but a stored object that is not what checkStream passed would be
+// stored unchecked, so one that differs is removed again rather than trusted.
+// objectName is a fresh random or content-derived name, so removing it
+// replaces nothing.
+func (t *tusHandler) storeChunks(ctx context.Context, up *tusUpload, keys []string, objectName, sum string, opts minio.PutObjectOptions) (minio.UploadInfo, error) {
+	r := t.chunkReader(ctx, keys)
+	defer r.Close()
+	hash := sha256.New()
+	opts.PartSize = uploadPartSize()
+	info, err := t.store.PutObject(ctx, up.Bucket, objectName, io.TeeReader(r, hash), up.Length, opts)
+	if err != nil {
+		return info, err
+	}
+	if got := hex.EncodeToString(hash.Sum(nil)); got != sum {
+		_ = t.store.RemoveObject(ctx, up.Bucket, objectName, minio.RemoveObjectOptions{})
+		return minio.UploadInfo{}, fmt.Errorf("the chunks changed while the upload was assembled")
+	}
+	return info, nil
+}
+
+// chunkKeys lists the upload's chunks in offset order. The offsets have to
+// tile the file exactly; anything else means a chunk was lost and the bytes
+// cannot be trusted.
+func (t *tusHandler) chunkKeys(ctx context.Context, up *tusUpload) ([]string, error) {
+	sizes := map[string]int64{}
+	var keys []string
+	for obj := range t.store.ListObjects(ctx, t.staging, minio.ListObjectsOptions{Prefix: tusChunkPrefix(up.ID), Recursive: true}) {
+		if obj.Err != nil {
+			return nil, obj.Err
+		}
+		keys = append(keys, obj.Key)
+		sizes[obj.Key] = obj.Size
+	}
+	sort.Strings(keys)
+
+	var next int64
+	for _, key := range keys {
+		start, err := strconv.ParseInt(strings.TrimPrefix(key, tusChunkPrefix(up.ID)), 10, 64)
+		if err != nil || start != next {
+			return nil, fmt.Errorf("chunk %s does not start at offset %d", key, next)
+		}
+		next += sizes[key]
+	}
+	if next != up.Length {
+		return nil, fmt.Errorf("chunks hold %d bytes, expected %d", next, up.Length)
+	}
+	return keys, nil
+}
+
+// chunkReader reads the chunks named by keys one after another as a single
+// stream, opening each only once the one before it is used up.
+func (t *tusHandler) chunkReader(ctx context.Context, keys []string) io.ReadCloser {
+	return &chunkReader{ctx: ctx, store: t.store, bucket: t.staging, keys: keys}
+}
+
+type chunkReader struct {
+	ctx    context.Context
+	store  service.ObjectStore
+	bucket string
+	keys   []string
+	cur    io.ReadCloser
+}
+
+func (r *chunkReader) Read(p []byte) (int, error) {
+	for {
+		if r.cur == nil {
+			if len(r.keys) == 0 {
+				return 0, io.EOF
+			}
+			rc, err := r.store.OpenObject(r.ctx, r.bucket, r.keys[0])
+			if err != nil {
+				return 0, err
+			}
+			r.cur, r.keys = rc, r.keys[1:]
+		}
+		n, err := r.cur.Read(p)
+		if errors.Is(err, io.EOF) {
+			_ = r.cur.Close()
+			r.cur = nil
+			if n == 0 {
+				continue
+			}
+			err = nil
+		}
+		return n, err
+	}
+}
+
+func (r *chunkReader) Close() error {
+	if r.cur == nil {
+		return nil
+	}
+	err := r.cur.Close()
+	r.cur = nil
+	return err
+}
+
+func (t *tusHandler) save(ctx context.Context, up *tusUpload) error {
+	data, err := json.Marshal(up)
+	if err != nil {
+		return err
+	}
+	_, err = t.store.PutObject(ctx, t.staging, tusInfoKey(up.ID), bytes.NewReader(data), int64(len(data)),
+		minio.PutObjectOptions{ContentType: "application/json"})
+	return err
+}
+
+func (t *tusHandler) load(ctx context.Context, id string) (*tusUpload, error) {
+	if _, err := t.store.StatObject(ctx, t.staging, tusInfoKey(id), minio.StatObjectOptions{}); err != nil {
+		if minio.ToErrorResponse(err).Code == "NoSuchKey" {
+			return nil, errTusNotFound
+		}
+		return nil, err
+	}
+	rc, err := t.store.OpenObject(ctx, t.staging, tusInfoKey(id))
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+
+	var up tusUpload
+	if err := json.NewDecoder(io.LimitReader(rc, 64<<10)).Decode(&up); err != nil {
+		return nil, err
+	}
+	return &up, nil
+}
+
+func (t *tusHandler) removeChunks(ctx context.Context, id string) {
+	for obj := range t.store.ListObjects(ctx, t.staging, minio.ListObjectsOptions{Prefix: tusChunkPrefix(id), Recursive: true}) {
+		if obj.Err == nil {
+			_ = t.store.RemoveObject(ctx, t.staging, obj.Key, minio.RemoveObjectOptions{})
+		}
+	}
+}
+
+func (t *tusHandler) removeAll(ctx context.Context, id string) error {
+	t.removeChunks(ctx, id)
+	err := t.store.RemoveObject(ctx, t.staging, tusInfoKey(id), minio.RemoveObjectOptions{})
+	if err != nil && minio.ToErrorResponse(err).Code != "NoSuchKey" {
+		return err
+	}
+	return nil
+}
+
+func (t *tusHandler) Start(ctx context.Context) {
+	go func() {
+		ticker := time.NewTicker(time.Hour)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if n := t.expire(ctx); n > 0 {
+					t.logger.Info().Int("uploads", n).Msg("tus: removed expired uploads")
+				}
+			}
+		}
+	}()
+}
+
+// expire removes uploads whose record has not changed for TUS_EXPIRY_HOURS.
+// The record is rewritten on every chunk, so its age is the time since the
+// client last made progress.
+func (t *tusHandler) expire(ctx context.Context) int {
+	cutoff := t.now().Add(-t.expiry)
+	var stale []string
+	for obj := range t.store.ListObjects(ctx, t.staging, minio.ListObjectsOptions{Recursive: true}) {
+		if obj.Err != nil {
+			continue
+		}
+		if id, ok := strings.CutSuffix(obj.Key, "/info"); ok && obj.LastModified.Before(cutoff) {
+			stale = append(stale, id)
+		}
+		// A download staged for its hash (storeStreamedByHash) is removed as
+		// soon as it is copied; one is only left here by a crash.
+		if strings.HasPrefix(obj.Key, hashStagingPrefix) && obj.LastModified.Before(cutoff) {
+			_ = t.store.RemoveObject(ctx, t.staging, obj.Key, minio.RemoveObjectOptions{})
+		}
+	}
+	for _, id := range stale {
+		unlock := t.lock(id)
+		_ = t.removeAll(ctx, id)
+		unlock()
+	}
+	return len(stale)
+}
+
+// parseUploadMetadata decodes "key base64value,key2 base64value2". A key may
+// appear without a value.
+func parseUploadMetadata(header string) (map[string]string, error) {
+	meta := map[string]string{}
+	if strings.TrimSpace(header) == "" {
+		return meta, nil
+	}
+	for _, pair := range strings.Split(header, ",") {
+		key, encoded, _ := strings.Cut(strings.TrimSpace(pair), " ")
+		if key == "" {
+			return nil, fmt.Errorf("Upload-Metadata has an empty key")
+		}
+		value, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("Upload-Metadata value for %q is not base64", key)
+		}
+		meta[key] = string(value)
+	}
+	return meta, nil
+}
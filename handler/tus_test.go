@@ -0,0 +1,318 @@
+package handler
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+
+	"github.com/mstgnz/cdn/service"
+)
+
+const tusStaging = "tus-staging"
+
+// newTusApp wires the tus routes the way main does. A request carrying
+// X-Test-Bucket is treated as coming from that bucket's scoped token.
+func newTusApp(store *memStore) (*fiber.App, *tusHandler) {
+	h := newTusHandler(image{imageService: &service.ImageService{}}, store, tusStaging)
+	app := fiber.New()
+	app.Use(func(c *fiber.Ctx) error {
+		if b := c.Get("X-Test-Bucket"); b != "" {
+			service.StorePrincipal(c, service.Principal{Scoped: true, Bucket: b})
+		}
+		return c.Next()
+	})
+	app.Options("/tus/", h.Options)
+	app.Post("/tus/", h.Create)
+	app.Head("/tus/:id", h.Head)
+	app.Patch("/tus/:id", h.Patch)
+	app.Delete("/tus/:id", h.Terminate)
+	return app, h
+}
+
+func tusReq(t *testing.T, app *fiber.App, method, target string, headers map[string]string, body []byte) *http.Response {
+	t.Helper()
+	req := httptest.NewRequest(method, target, bytes.NewReader(body))
+	req.Header.Set("Tus-Resumable", tusVersion)
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := app.Test(req, -1)
+	if err != nil {
+		t.Fatalf("%s %s: %v", method, target, err)
+	}
+	return resp
+}
+
+func tusMeta(pairs ...string) string {
+	var out []string
+	for i := 0; i+1 < len(pairs); i += 2 {
+		out = append(out, pairs[i]+" "+base64.StdEncoding.EncodeToString([]byte(pairs[i+1])))
+	}
+	return strings.Join(out, ",")
+}
+
+// createUpload starts an upload and returns its path, /tus/<id>.
+func createUpload(t *testing.T, app *fiber.App, length int, meta string) string {
+	t.Helper()
+	resp := tusReq(t, app, http.MethodPost, "/tus/", map[string]string{
+		"Upload-Length":   strconv.Itoa(length),
+		"Upload-Metadata": meta,
+	}, nil)
+	if resp.StatusCode != fiber.StatusCreated {
+		t.Fatalf("create status = %d, want 201: %+v", resp.StatusCode, decodeBody(t, resp))
+	}
+	loc := resp.Header.Get("Location")
+	i := strings.Index(loc, "/tus/")
+	if i < 0 {
+		t.Fatalf("Location %q has no /tus/ path", loc)
+	}
+	return loc[i:]
+}
+
+func patchChunk(t *testing.T, app *fiber.App, path string, offset int, chunk []byte, extra map[string]string) *http.Response {
+	t.Helper()
+	headers := map[string]string{
+		"Content-Type":  "application/offset+octet-stream",
+		"Upload-Offset": strconv.Itoa(offset),
+	}
+	for k, v := range extra {
+		headers[k] = v
+	}
+	return tusReq(t, app, http.MethodPatch, path, headers, chunk)
+}
+
+func TestTusOptionsAdvertisesCapabilities(t *testing.T) {
+	app, _ := newTusApp(newMemStore(tusStaging))
+	req := httptest.NewRequest(http.MethodOptions, "/tus/", nil)
+	resp, err := app.Test(req, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != fiber.StatusNoContent {
+		t.Fatalf("status = %d, want 204", resp.StatusCode)
+	}
+	if got := resp.Header.Get("Tus-Extension"); got != "creation,termination" {
+		t.Errorf("Tus-Extension = %q", got)
+	}
+	if resp.Header.Get("Tus-Max-Size") == "" {
+		t.Error("Tus-Max-Size missing")
+	}
+}
+
+func TestTusRejectsOtherProtocolVersions(t *testing.T) {
+	app, _ := newTusApp(newMemStore(tusStaging))
+	resp := tusReq(t, app, http.MethodPost, "/tus/", map[string]string{
+		"Tus-Resumable": "0.2.2",
+		"Upload-Length": "10",
+	}, nil)
+	if resp.StatusCode != fiber.StatusPreconditionFailed {
+		t.Fatalf("status = %d, want 412", resp.StatusCode)
+	}
+	if resp.Header.Get("Tus-Version") != tusVersion {
+		t.Errorf("Tus-Version = %q", resp.Header.Get("Tus-Version"))
+	}
+}
+
+// The whole point: an upload interrupted part way resumes from the offset the
+// server reports, and the assembled object is byte-identical to the file.
+func TestTusResumesAndAssembles(t *testing.T) {
+	store := newMemStore(tusStaging, "photos")
+	app, _ := newTusApp(store)
+	file := pngFixture(t, 64, 48)
+	path := createUpload(t, app, len(file), tusMeta("filename", "cat.png", "bucket", "photos", "path", "pets"))
+
+	half := len(file) / 2
+	if resp := patchChunk(t, app, path, 0, file[:half], nil); resp.StatusCode != fiber.StatusNoContent {
+		t.Fatalf("first chunk status = %d", resp.StatusCode)
+	}
+
+	// The client lost track; it asks where to continue.
+	resp := tusReq(t, app, http.MethodHead, path, nil, nil)
+	if got := resp.Header.Get("Upload-Offset"); got != strconv.Itoa(half) {
+		t.Fatalf("Upload-Offset = %q, want %d", got, half)
+	}
+
+	// Resending from zero is a conflict, not a silent duplicate.
+	if resp := patchChunk(t, app, path, 0, file[:half], nil); resp.StatusCode != fiber.StatusConflict {
+		t.Fatalf("stale offset status = %d, want 409", resp.StatusCode)
+	}
+
+	resp = patchChunk(t, app, path, half, file[half:], nil)
+	if resp.StatusCode != fiber.StatusNoContent {
+		t.Fatalf("last chunk status = %d: %+v", resp.StatusCode, decodeBody(t, resp))
+	}
+	name := resp.Header.Get("X-Object-Name")
+	if !strings.HasPrefix(name, "pets/") || !strings.HasSuffix(name, ".png") {
+		t.Fatalf("X-Object-Name = %q, want pets/<uuid>.png", name)
+	}
+	if got, ok := store.get("photos", name); !ok || !bytes.Equal(got, file) {
+		t.Fatal("assembled object differs from the uploaded file")
+	}
+	for _, k := range store.keys(tusStaging) {
+		if strings.Contains(k, "/chunks/") {
+			t.Fatalf("chunk %s left in staging after assembly", k)
+		}
+	}
+
+	// A client whose final response was lost can still find the object.
+	resp = tusReq(t, app, http.MethodHead, path, nil, nil)
+	if resp.Header.Get("X-Object-Name") != name {
+		t.Fatalf("HEAD after completion reports %q", resp.Header.Get("X-Object-Name"))
+	}
+}
+
+func TestTusRejectsInvalidContentAndDropsTheUpload(t *testing.T) {
+	store := newMemStore(tusStaging, "photos")
+	app, _ := newTusApp(store)
+	junk := []byte("MZ\x90\x00 definitely not a png, but named like one")
+	path := createUpload(t, app, len(junk), tusMeta("filename", "x.png", "bucket", "photos"))
+
+	resp := patchChunk(t, app, path, 0, junk, nil)
+	if resp.StatusCode != fiber.StatusBadRequest {
+		t.Fatalf("status = %d, want 400", resp.StatusCode)
+	}
+	if keys := store.keys("photos"); len(keys) != 0 {
+		t.Fatalf("invalid content was stored: %v", keys)
+	}
+	if keys := store.keys(tusStaging); len(keys) != 0 {
+		t.Fatalf("rejected upload left staging objects: %v", keys)
+	}
+}
+
+func TestTusCreateChecksBeforeAnyByteIsSent(t *testing.T) {
+	app, _ := newTusApp(newMemStore(tusStaging, "photos"))
+	for name, tc := range map[string]struct {
+		headers map[string]string
+		want    int
+	}{
+		"no length":         {map[string]string{"Upload-Metadata": tusMeta("filename", "a.png", "bucket", "photos")}, 400},
+		"deferred length":   {map[string]string{"Upload-Defer-Length": "1", "Upload-Metadata": tusMeta("filename", "a.png", "bucket", "photos")}, 400},
+		"too large":         {map[string]string{"Upload-Length": "999999999999", "Upload-Metadata": tusMeta("filename", "a.png", "bucket", "photos")}, 413},
+		"no filename":       {map[string]string{"Upload-Length": "10", "Upload-Metadata": tusMeta("bucket", "photos")}, 400},
+		"bad extension":     {map[string]string{"Upload-Length": "10", "Upload-Metadata": tusMeta("filename", "a.exe", "bucket", "photos")}, 400},
+		"no bucket":         {map[string]string{"Upload-Length": "10", "Upload-Metadata": tusMeta("filename", "a.png")}, 400},
+		"staging bucket":    {map[string]string{"Upload-Length": "10", "Upload-Metadata": tusMeta("filename", "a.png", "bucket", service.TusStagingBucket())}, 400},
+		"other token's one": {map[string]string{"Upload-Length": "10", "X-Test-Bucket": "docs", "Upload-Metadata": tusMeta("filename", "a.png", "bucket", "photos")}, 403},
+	} {
+		t.Run(name, func(t *testing.T) {
+			resp := tusReq(t, app, http.MethodPost, "/tus/", tc.headers, nil)
+			if resp.StatusCode != tc.want {
+				t.Fatalf("status = %d, want %d", resp.StatusCode, tc.want)
+			}
+		})
+	}
+}
+
+func TestTusScopedTokenCannotTouchAnotherBucketsUpload(t *testing.T) {
+	app, _ := newTusApp(newMemStore(tusStaging, "photos"))
+	path := createUpload(t, app, 10, tusMeta("filename", "a.png", "bucket", "photos"))
+
+	if resp := patchChunk(t, app, path, 0, []byte("0123456789"), map[string]string{"X-Test-Bucket": "docs"}); resp.StatusCode != fiber.StatusForbidden {
+		t.Fatalf("PATCH status = %d, want 403", resp.StatusCode)
+	}
+	if resp := tusReq(t, app, http.MethodDelete, path, map[string]string{"X-Test-Bucket": "docs"}, nil); resp.StatusCode != fiber.StatusForbidden {
+		t.Fatalf("DELETE status = %d, want 403", resp.StatusCode)
+	}
+}
+
+func TestTusTerminateRemovesEverything(t *testing.T) {
+	store := newMemStore(tusStaging, "photos")
+	app, _ := newTusApp(store)
+	path := createUpload(t, app, 10, tusMeta("filename", "a.png", "bucket", "photos"))
+	patchChunk(t, app, path, 0, []byte("01234"), nil)
+
+	if resp := tusReq(t, app, http.MethodDelete, path, nil, nil); resp.StatusCode != fiber.StatusNoContent {
+		t.Fatalf("status = %d, want 204", resp.StatusCode)
+	}
+	if keys := store.keys(tusStaging); len(keys) != 0 {
+		t.Fatalf("terminated upload left %v", keys)
+	}
+	if resp := tusReq(t, app, http.MethodHead, path, nil, nil); resp.StatusCode != fiber.StatusNotFound {
+		t.Fatalf("HEAD after terminate = %d, want 404", resp.StatusCode)
+	}
+}
+
+func TestTusExpiresAbandonedUploads(t *testing.T) {
+	store := newMemStore(tusStaging, "photos")
+	app, h := newTusApp(store)
+	old := createUpload(t, app, 10, tusMeta("filename", "a.png", "bucket", "photos"))
+	patchChunk(t, app, old, 0, []byte("01234"), nil)
+
+	store.now = func() time.Time { return time.Now().Add(48 * time.Hour) }
+	h.now = store.now
+	fresh := createUpload(t, app, 10, tusMeta("filename", "b.png", "bucket", "photos"))
+
+	if n := h.expire(context.Background()); n != 1 {
+		t.Fatalf("expired %d uploads, want 1", n)
+	}
+	for _, k := range store.keys(tusStaging) {
+		if strings.HasPrefix(k, strings.TrimPrefix(old, "/tus/")) {
+			t.Fatalf("abandoned upload object %s survived", k)
+		}
+	}
+	if resp := tusReq(t, app, http.MethodHead, fresh, nil, nil); resp.StatusCode != fiber.StatusOK {
+		t.Fatalf("fresh upload HEAD = %d, want 200", resp.StatusCode)
+	}
+}
+
+// A file that is not an image is assembled as a stream over its chunks and
+// stored with its digest, like every other upload; an image is too.
+func TestTusStreamsNonImagesAndStoresTheirDigest(t *testing.T) {
+	store := newMemStore(tusStaging, "docs")
+	app, _ := newTusApp(store)
+	file := []byte(strings.Repeat("a plain text line, resumable upload\n", 64))
+	path := createUpload(t, app, len(file), tusMeta("filename", "notes.csv", "bucket", "docs"))
+
+	third := len(file) / 3
+	for _, part := range [][2]int{{0, third}, {third, 2 * third}, {2 * third, len(file)}} {
+		resp := patchChunk(t, app, path, part[0], file[part[0]:part[1]], nil)
+		if resp.StatusCode != fiber.StatusNoContent {
+			t.Fatalf("chunk at %d: status = %d: %+v", part[0], resp.StatusCode, decodeBody(t, resp))
+		}
+	}
+	name := tusReq(t, app, http.MethodHead, path, nil, nil).Header.Get("X-Object-Name")
+	o, ok := store.object("docs", name)
+	if !ok || !bytes.Equal(o.data, file) {
+		t.Fatalf("stored %q as %q", name, o.data)
+	}
+	if want := sha256Hex(file); o.meta[service.MetaSHA256] != want {
+		t.Errorf("digest = %q, want %q", o.meta[service.MetaSHA256], want)
+	}
+
+	image := pngFixture(t, 32, 24)
+	path = createUpload(t, app, len(image), tusMeta("filename", "cat.png", "bucket", "docs"))
+	resp := patchChunk(t, app, path, 0, image, nil)
+	if resp.StatusCode != fiber.StatusNoContent {
+		t.Fatalf("image status = %d", resp.StatusCode)
+	}
+	if o, _ := store.object("docs", resp.Header.Get("X-Object-Name")); o.meta[service.MetaSHA256] != sha256Hex(image) {
+		t.Errorf("image digest = %q", o.meta[service.MetaSHA256])
+	}
+}
+
+// A streamed file the validator refuses part way is dropped, chunks and all,
+// without anything reaching its bucket.
+func TestTusRejectsAStreamedFile(t *testing.T) {
+	store := newMemStore(tusStaging, "docs")
+	app, _ := newTusApp(store)
+	file := append([]byte(strings.Repeat("text\n", 200)), 0xff, 0xfe, 0x00, 0x01)
+	path := createUpload(t, app, len(file), tusMeta("filename", "notes.csv", "bucket", "docs"))
+
+	if resp := patchChunk(t, app, path, 0, file, nil); resp.StatusCode != fiber.StatusBadRequest {
+		t.Fatalf("status = %d, want 400", resp.StatusCode)
+	}
+	if keys := store.keys("docs"); len(keys) != 0 {
+		t.Fatalf("refused file was stored: %v", keys)
+	}
+	if keys := store.keys(tusStaging); len(keys) != 0 {
+		t.Fatalf("refused upload left staging objects: %v", keys)
+	}
+}
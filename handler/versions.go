@@ -0,0 +1,225 @@
+package handler
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/minio/minio-go/v7"
+
+	"github.com/mstgnz/cdn/pkg/config"
+	"github.com/mstgnz/cdn/service"
+)
+
+// VersionRestoreRequest is the body of POST /versions/:bucket/restore.
+// VersionID is a version of Key as GET /versions/:bucket/* lists it.
+type VersionRestoreRequest struct {
+	Key       string `json:"key"`
+	VersionID string `json:"version_id"`
+}
+
+// objectVersion is one version of an object. A delete marker has no size or
+// ETag: it is the record of a delete, not an object. Archived is set on the
+// version the archive holds a copy of, when the archive recorded one.
+type objectVersion struct {
+	VersionID    string    `json:"version_id"`
+	IsLatest     bool      `json:"is_latest"`
+	DeleteMarker bool      `json:"delete_marker"`
+	Size         int64     `json:"size"`
+	ETag         string    `json:"etag,omitempty"`
+	LastModified time.Time `json:"last_modified"`
+	Archived     bool      `json:"archived"`
+}
+
+// versionPage is the history of one key, newest first.
+type versionPage struct {
+	Bucket      string          `json:"bucket"`
+	Key         string          `json:"key"`
+	Versions    []objectVersion `json:"versions"`
+	IsTruncated bool            `json:"is_truncated"`
+}
+
+// versionKey checks the bucket and key of a version request. When the
+// request cannot go on it has already been answered, and ok is false.
+func versionKey(c *fiber.Ctx, bucket, key string) (string, bool, error) {
+	bucket, err := resolveBucket(c, bucket)
+	if err != nil {
+		return "", false, bucketForbidden(c)
+	}
+	if bucket == "" {
+		return "", false, service.Response(c, fiber.StatusBadRequest, false, "Bucket is required", nil)
+	}
+	if service.InternalBucket(bucket) {
+		return "", false, bucketReserved(c)
+	}
+	if key == "" || service.HasUnsafeObjectKey(key) {
+		return "", false, respondKeyError(c, &keyError{fiber.StatusBadRequest, "INVALID_KEY", "invalid object key"})
+	}
+	return bucket, true, nil
+}
+
+// ListVersions lists the versions MinIO keeps of one key, newest first, up to
+// limit of them. A bucket without versioning has one version per object, with
+// the ID "null", and a deleted object none.
+func (i image) ListVersions(c *fiber.Ctx) error {
+	key := c.Params("*")
+	bucket, ok, err := versionKey(c, c.Params("bucket"), key)
+	if !ok {
+		return err
+	}
+	limit := defaultListLimit
+	if raw := c.Query("limit"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n < 1 || n > maxListLimit {
+			return respondKeyError(c, listError("INVALID_LIMIT", "limit must be between 1 and "+strconv.Itoa(maxListLimit)))
+		}
+		limit = n
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
+	defer cancel()
+
+	page, err := i.listVersions(ctx, service.MinioStore{Client: i.minioClient}, bucket, key, limit)
+	if err != nil {
+		return respondKeyError(c, &keyError{fiber.StatusBadGateway, "STORAGE_ERROR", "could not list the versions: " + err.Error()})
+	}
+	if len(page.Versions) == 0 {
+		return respondKeyError(c, &keyError{fiber.StatusNotFound, "OBJECT_NOT_FOUND", "no versions of this object"})
+	}
+	return service.Response(c, fiber.StatusOK, true, "success", page)
+}
+
+// listVersions reads the versions of key out of a versioned listing under it
+// as a prefix. Keys that only start with key sort after it, so the first one
+// of those ends the history.
+func (i image) listVersions(ctx context.Context, store service.ObjectStore, bucket, key string, limit int) (versionPage, error) {
+	page := versionPage{Bucket: bucket, Key: key, Versions: []objectVersion{}}
+	archivedVersion := ""
+	if i.archive != nil && i.archive.Enabled() {
+		if archived, err := i.archive.Stat(ctx, bucket, key); err == nil {
+			archivedVersion = archived.VersionID
+		}
+	}
+
+	for info := range store.ListObjects(ctx, bucket, minio.ListObjectsOptions{
+		Prefix:       key,
+		Recursive:    true,
+		WithVersions: true,
+	}) {
+		if info.Err != nil {
+			return versionPage{}, info.Err
+		}
+		if info.Key != key {
+			break
+		}
+		if len(page.Versions) == limit {
+			page.IsTruncated = true
+			break
+		}
+		v := objectVersion{
+			VersionID:    info.VersionID,
+			IsLatest:     info.IsLatest,
+			DeleteMarker: info.IsDeleteMarker,
+			LastModified: info.LastModified.UTC(),
+			Archived:     archivedVersion != "" && info.VersionID == archivedVersion,
+		}
+		if !info.IsDeleteMarker {
+			v.Size = info.Size
+			v.ETag = info.ETag
+		}
+		page.Versions = append(page.Versions, v)
+	}
+	return page, nil
+}
+
+// RestoreVersion makes an earlier version of an object its current one.
+func (i image) RestoreVersion(c *fiber.Ctx) error {
+	var req VersionRestoreRequest
+	if err := c.BodyParser(&req); err != nil {
+		return service.Response(c, fiber.StatusBadRequest, false, "invalid request body", nil)
+	}
+	bucket, ok, err := versionKey(c, c.Params("bucket"), req.Key)
+	if !ok {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+
+	data, kerr := i.restoreVersion(ctx, service.MinioStore{Client: i.minioClient}, bucket, req.Key, req.VersionID)
+	if kerr != nil {
+		return respondKeyError(c, kerr)
+	}
+	return service.Response(c, fiber.StatusOK, true, "success", data)
+}
+
+// restoreVersion copies a version of key over the key, MinIO's way of
+// bringing a version back: the copy becomes a new current version, and what
+// was current stays in the history, so a restore is itself undone by
+// restoring again. The copy keeps the version's content type, metadata and
+// tags, and is conditional on its ETag like a copy between keys.
+//
+// Restoring the version that is already current changes nothing. Otherwise
+// the key's caches are purged as for any overwrite, and the new version is
+// archived, since the archive holds one copy per key and that has to be of
+// the bytes the key now serves.
+func (i image) restoreVersion(ctx context.Context, store service.ObjectStore, bucket, key, versionID string) (map[string]any, *keyError) {
+	if versionID == "" {
+		return nil, &keyError{fiber.StatusBadRequest, "INVALID_VERSION_ID", "version_id is required"}
+	}
+	info, err := store.StatObject(ctx, bucket, key, minio.StatObjectOptions{VersionID: versionID})
+	if err != nil {
+		switch minio.ToErrorResponse(err).Code {
+		case "NoSuchKey", "NoSuchVersion":
+			return nil, &keyError{fiber.StatusNotFound, "VERSION_NOT_FOUND", "no such version of this object"}
+		case "MethodNotAllowed":
+			return nil, &keyError{fiber.StatusBadRequest, "VERSION_IS_DELETE_MARKER", "the version is a delete marker; restore the version before it"}
+		case "InvalidArgument":
+			return nil, &keyError{fiber.StatusBadRequest, "INVALID_VERSION_ID", "not a version ID"}
+		}
+		return nil, &keyError{fiber.StatusBadGateway, "STORAGE_ERROR", err.Error()}
+	}
+
+	url := strings.TrimSuffix(config.GetEnvOrDefault("APP_URL", "http://localhost:9090"), "/")
+	data := map[string]any{
+		"bucket":        bucket,
+		"key":           key,
+		"restored_from": versionID,
+		"size":          info.Size,
+		"link":          url + "/" + bucket + "/" + key,
+	}
+
+	replaced := false
+	if current, err := store.StatObject(ctx, bucket, key, minio.StatObjectOptions{}); err == nil {
+		if current.VersionID == versionID {
+			data["version_id"] = versionID
+			data["etag"] = current.ETag
+			data["overwritten"] = false
+			return data, nil
+		}
+		replaced = true
+	} else if minio.ToErrorResponse(err).Code != "NoSuchKey" {
+		return nil, &keyError{fiber.StatusBadGateway, "STORAGE_ERROR", "could not check the current version: " + err.Error()}
+	}
+
+	copied, err := store.CopyObject(ctx,
+		minio.CopyDestOptions{Bucket: bucket, Object: key},
+		minio.CopySrcOptions{Bucket: bucket, Object: key, VersionID: versionID, MatchETag: info.ETag})
+	if err != nil {
+		if kerr := putFailure(err); kerr != nil {
+			return nil, kerr
+		}
+		return nil, &keyError{fiber.StatusBadGateway, "STORAGE_ERROR", "could not restore the version: " + err.Error()}
+	}
+	i.afterStore(ctx, bucket, key, replaced)
+
+	data["version_id"] = copied.VersionID
+	data["etag"] = copied.ETag
+	data["overwritten"] = replaced
+	if msg := i.archiveFromStore(ctx, store, bucket, key, info.UserMetadata[service.MetaSHA256], copied.VersionID); msg != "" {
+		data["archive"] = msg
+	}
+	return data, nil
+}
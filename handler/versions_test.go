@@ -0,0 +1,124 @@
+package handler
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/minio/minio-go/v7"
+
+	"github.com/mstgnz/cdn/service"
+)
+
+func newVersionedImage(t *testing.T) (image, *memStore, *memArchive, *recordingNotifier) {
+	t.Helper()
+	store := newMemStore("photos")
+	store.versionBucket("photos")
+	archive := newMemArchive()
+	notifier := &recordingNotifier{}
+	return image{archive: archive, notifier: notifier}, store, archive, notifier
+}
+
+func putVersion(t *testing.T, store *memStore, key, body string) string {
+	t.Helper()
+	info, err := store.PutObject(context.Background(), "photos", key, bytes.NewReader([]byte(body)), int64(len(body)),
+		minio.PutObjectOptions{ContentType: "image/png", UserMetadata: digestMeta(body + "-sum")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return info.VersionID
+}
+
+// An overwrite keeps the previous bytes as a version, and restoring it makes
+// a new current version of them, purged and archived like any overwrite.
+func TestVersionRestoreOverwrites(t *testing.T) {
+	ctx := context.Background()
+	img, store, archive, notifier := newVersionedImage(t)
+	first := putVersion(t, store, "logo.png", "one")
+	second := putVersion(t, store, "logo.png", "two")
+	putVersion(t, store, "logo.png.bak", "other key")
+
+	page, err := img.listVersions(ctx, store, "photos", "logo.png", 10)
+	if err != nil || len(page.Versions) != 2 || page.IsTruncated {
+		t.Fatalf("listVersions = (%+v, %v)", page, err)
+	}
+	if v := page.Versions[0]; v.VersionID != second || !v.IsLatest || v.Size != 3 {
+		t.Errorf("newest = %+v", v)
+	}
+	if v := page.Versions[1]; v.VersionID != first || v.IsLatest {
+		t.Errorf("oldest = %+v", v)
+	}
+	if page, _ := img.listVersions(ctx, store, "photos", "logo.png", 1); len(page.Versions) != 1 || !page.IsTruncated {
+		t.Errorf("limit 1 = %+v", page)
+	}
+
+	data, kerr := img.restoreVersion(ctx, store, "photos", "logo.png", first)
+	if kerr != nil {
+		t.Fatal(kerr)
+	}
+	if data["overwritten"] != true || data["restored_from"] != first || data["version_id"] == first {
+		t.Errorf("data = %v", data)
+	}
+	if got, _ := store.get("photos", "logo.png"); string(got) != "one" {
+		t.Errorf("current = %q, want one", got)
+	}
+	if len(notifier.events) != 1 || notifier.events[0].Reason != service.PurgeOverwritten {
+		t.Errorf("upstream events = %+v", notifier.events)
+	}
+	archived, err := archive.Stat(ctx, "photos", "logo.png")
+	if err != nil || archived.VersionID != data["version_id"] || archived.SHA256 != "one-sum" {
+		t.Errorf("archived = (%+v, %v)", archived, err)
+	}
+
+	page, _ = img.listVersions(ctx, store, "photos", "logo.png", 10)
+	if len(page.Versions) != 3 || !page.Versions[0].Archived || page.Versions[1].Archived {
+		t.Errorf("after the restore = %+v", page.Versions)
+	}
+}
+
+// A delete leaves a delete marker, which is not itself restorable; the
+// version under it brings the object back.
+func TestVersionRestoreAfterDelete(t *testing.T) {
+	ctx := context.Background()
+	img, store, _, notifier := newVersionedImage(t)
+	kept := putVersion(t, store, "a/cat.png", "cat")
+	if err := store.RemoveObject(ctx, "photos", "a/cat.png", minio.RemoveObjectOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	page, err := img.listVersions(ctx, store, "photos", "a/cat.png", 10)
+	if err != nil || len(page.Versions) != 2 {
+		t.Fatalf("listVersions = (%+v, %v)", page, err)
+	}
+	marker := page.Versions[0]
+	if !marker.DeleteMarker || !marker.IsLatest || marker.ETag != "" {
+		t.Fatalf("latest = %+v", marker)
+	}
+
+	for id, code := range map[string]string{marker.VersionID: "VERSION_IS_DELETE_MARKER", "v999": "VERSION_NOT_FOUND", "": "INVALID_VERSION_ID"} {
+		if _, kerr := img.restoreVersion(ctx, store, "photos", "a/cat.png", id); kerr == nil || kerr.code != code {
+			t.Errorf("restore %q: %v, want %s", id, kerr, code)
+		}
+	}
+
+	data, kerr := img.restoreVersion(ctx, store, "photos", "a/cat.png", kept)
+	if kerr != nil || data["overwritten"] != false {
+		t.Fatalf("restore = (%v, %v)", data, kerr)
+	}
+	if got, ok := store.get("photos", "a/cat.png"); !ok || string(got) != "cat" {
+		t.Errorf("current = (%q, %v)", got, ok)
+	}
+	if len(notifier.events) != 0 {
+		t.Errorf("a restore over nothing purged: %+v", notifier.events)
+	}
+
+	// The version now current is the restore's copy; restoring it again is a
+	// no-op rather than yet another version.
+	again, kerr := img.restoreVersion(ctx, store, "photos", "a/cat.png", data["version_id"].(string))
+	if kerr != nil || again["overwritten"] != false {
+		t.Fatalf("restore of the current version = (%v, %v)", again, kerr)
+	}
+	if page, _ := img.listVersions(ctx, store, "photos", "a/cat.png", 10); len(page.Versions) != 3 {
+		t.Errorf("versions = %+v", page.Versions)
+	}
+}
@@ -0,0 +1,302 @@
+package handler
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/minio/minio-go/v7"
+
+	"github.com/mstgnz/cdn/pkg/config"
+	"github.com/mstgnz/cdn/pkg/validator"
+	"github.com/mstgnz/cdn/service"
+)
+
+// zipRatioFloor is the entry size below which the compression ratio is not
+// checked. Small files of repeated bytes legitimately compress a thousandfold,
+// and a bomb is only a bomb once it is big.
+const zipRatioFloor = 1 << 20
+
+// zipLimits bound what one archive may expand into. Every limit is enforced on
+// the bytes actually decompressed, not only on the sizes the archive declares:
+// the declared sizes are written by whoever built the archive.
+type zipLimits struct {
+	maxEntries int
+	maxTotal   int64 // all entries, uncompressed
+	maxEntry   int64 // one entry, uncompressed; MAX_FILE_SIZE
+	maxRatio   int64 // uncompressed:compressed, per entry above zipRatioFloor
+}
+
+func zipLimitsFromEnv() zipLimits {
+	return zipLimits{
+		maxEntries: config.GetEnvAsIntOrDefault("ZIP_MAX_ENTRIES", 1000),
+		maxTotal:   int64(config.GetEnvAsIntOrDefault("ZIP_MAX_TOTAL_MB", 1024)) << 20,
+		maxEntry:   int64(config.GetEnvAsIntOrDefault("MAX_FILE_SIZE", int(validator.DefaultMaxFileSize))),
+		maxRatio:   int64(config.GetEnvAsIntOrDefault("ZIP_MAX_RATIO", 100)),
+	}
+}
+
+func zipError(code, message string) *validator.FileValidationError {
+	return &validator.FileValidationError{Code: code, Message: message}
+}
+
+// openZip opens an uploaded archive and checks it as a whole, before a byte of
+// it is decompressed: the entry count, and the total its entries declare. An
+// archive that fails either is refused outright rather than half imported.
+func openZip(r io.ReaderAt, size int64, lim zipLimits) (*zip.Reader, *validator.FileValidationError) {
+	zr, err := zip.NewReader(r, size)
+	if err != nil {
+		return nil, zipError("INVALID_ZIP", "not a readable zip archive")
+	}
+	if len(zr.File) > lim.maxEntries {
+		return nil, zipError("ZIP_TOO_MANY_ENTRIES", fmt.Sprintf("the archive has %d entries; at most %d are imported", len(zr.File), lim.maxEntries))
+	}
+	var declared uint64
+	for _, f := range zr.File {
+		declared += f.UncompressedSize64
+		if declared > uint64(lim.maxTotal) {
+			return nil, zipError("ZIP_TOO_LARGE", fmt.Sprintf("the archive expands to more than %d bytes", lim.maxTotal))
+		}
+	}
+	return zr, nil
+}
+
+// zipEntryPath is an entry's name as a relative object key, or an error when
+// the name tries to leave the prefix it is extracted into: an absolute path, a
+// drive letter, or a ".." segment, which is the zip-slip class. Nothing is
+// written to a filesystem here, but the key decides where the object lands, so
+// the rule is the same.
+func zipEntryPath(name string) (string, error) {
+	name = strings.ReplaceAll(name, `\`, "/")
+	if strings.HasPrefix(name, "/") || (len(name) > 1 && name[1] == ':') {
+		return "", zipError("UNSAFE_PATH", "entry path is absolute")
+	}
+	for _, seg := range strings.Split(name, "/") {
+		if seg == ".." {
+			return "", zipError("UNSAFE_PATH", "entry path leaves the archive")
+		}
+	}
+	clean := path.Clean(name)
+	if clean == "." || clean == "" {
+		return "", zipError("UNSAFE_PATH", "entry has no name")
+	}
+	return clean, nil
+}
+
+// readZipEntry decompresses one entry, stopping at whichever limit comes first:
+// the per-file size, what is left of the archive's total in budget, or the
+// ratio. budget is reduced by what was read.
+func readZipEntry(f *zip.File, lim zipLimits, budget *int64) ([]byte, error) {
+	limit := lim.maxEntry
+	if *budget < limit {
+		limit = *budget
+	}
+	ratioLimit := int64(-1)
+	if lim.maxRatio > 0 {
+		ratioLimit = int64(f.CompressedSize64) * lim.maxRatio
+		if ratioLimit < zipRatioFloor {
+			ratioLimit = zipRatioFloor
+		}
+		if ratioLimit < limit {
+			limit = ratioLimit
+		}
+	}
+
+	rc, err := f.Open()
+	if err != nil {
+		return nil, zipError("INVALID_ZIP", "entry cannot be read: "+err.Error())
+	}
+	defer rc.Close()
+	content, err := io.ReadAll(io.LimitReader(rc, limit+1))
+	*budget -= int64(len(content))
+	if err != nil {
+		// archive/zip reports an entry longer than it declared, or one whose
+		// checksum is wrong, as zip.ErrFormat or zip.ErrChecksum.
+		return nil, zipError("INVALID_ZIP", "entry cannot be read: "+err.Error())
+	}
+	if int64(len(content)) > limit {
+		switch {
+		case limit == ratioLimit:
+			return nil, zipError("ZIP_BOMB", fmt.Sprintf("entry expands more than %d times", lim.maxRatio))
+		case limit == lim.maxEntry:
+			return nil, zipError("FILE_TOO_LARGE", fmt.Sprintf("File size is too large. Maximum: %d bytes", lim.maxEntry))
+		default:
+			return nil, zipError("ZIP_TOO_LARGE", fmt.Sprintf("the archive expands to more than %d bytes", lim.maxTotal))
+		}
+	}
+	return content, nil
+}
+
+// UploadZip imports the files of an uploaded .zip into a bucket, under path
+// and keeping each file's path inside the archive, instead of storing the
+// archive itself.
+//
+// Each entry is an upload of its own: it goes through the extension and size
+// checks, ValidateFileContent, the image check and the bucket's upload policy
+// and, with optimize, the same optimisation as /upload, and it is stored under
+// its path as a caller-chosen key, so overwrite applies as it does to a key on
+// /upload. One entry failing does not stop the others. The answer lists every entry in archive order, in
+// the shape of BatchUpload's.
+//
+// Entries are decompressed one at a time and each is held in memory only
+// while it is stored, so the memory an import needs is that of its largest
+// file, not of the archive expanded.
+func (i image) UploadZip(c *fiber.Ctx) error {
+	ctx := context.Background()
+
+	file, err := c.FormFile("file")
+	if file == nil || err != nil {
+		return service.Response(c, fiber.StatusBadRequest, false, "File Not Found!", nil)
+	}
+	bucket, err := resolveBucket(c, c.FormValue("bucket"))
+	if err != nil {
+		return bucketForbidden(c)
+	}
+	if bucket == "" {
+		return service.Response(c, fiber.StatusBadRequest, false, "Bucket is required", nil)
+	}
+	if service.InternalBucket(bucket) {
+		return bucketReserved(c)
+	}
+	if !strings.EqualFold(filepath.Ext(file.Filename), ".zip") {
+		return service.Response(c, fiber.StatusBadRequest, false, "file must be a .zip archive", map[string]string{
+			"code": "INVALID_FILE_FORMAT",
+		})
+	}
+
+	archive, err := file.Open()
+	if err != nil {
+		return service.Response(c, fiber.StatusBadRequest, false, err.Error(), nil)
+	}
+	defer archive.Close()
+
+	lim := zipLimitsFromEnv()
+	zr, verr := openZip(archive, file.Size, lim)
+	if verr != nil {
+		return service.Response(c, fiber.StatusBadRequest, false, verr.Message, map[string]string{
+			"code": verr.Code,
+		})
+	}
+
+	// Checked once the archive is known to be worth opening, so a bad archive
+	// is reported as such without a storage round trip.
+	exists, err := i.minioClient.BucketExists(ctx, bucket)
+	if err != nil || !exists {
+		return service.Response(c, fiber.StatusBadRequest, false, "Bucket not found", nil)
+	}
+
+	prefix := c.FormValue("path")
+	overwrite := c.FormValue("overwrite")
+	optimize := c.FormValue("optimize") == "true"
+	// Metadata and tags apply to every file of the archive.
+	attrs, kerr := formAttrs(c)
+	if kerr != nil {
+		return respondKeyError(c, kerr)
+	}
+
+	budget := lim.maxTotal
+	results := make([]map[string]any, 0, len(zr.File))
+	for _, entry := range zr.File {
+		// Folders are implied by the keys, and macOS resource forks are not
+		// files anybody put in the archive.
+		if entry.FileInfo().IsDir() || strings.HasPrefix(entry.Name, "__MACOSX/") {
+			continue
+		}
+		results = append(results, i.importZipEntry(ctx, bucket, prefix, overwrite, optimize, attrs, entry, lim, &budget))
+	}
+
+	return service.Response(c, fiber.StatusOK, true, "Zip import completed", results)
+}
+
+// importZipEntry stores one entry and reports on it.
+func (i image) importZipEntry(ctx context.Context, bucket, prefix, overwrite string, optimize bool, attrs objectAttrs, entry *zip.File, lim zipLimits, budget *int64) map[string]any {
+	result := map[string]any{"filename": entry.Name}
+	fail := func(err error) map[string]any {
+		result["success"] = false
+		result["error"] = err.Error()
+		var valErr *validator.FileValidationError
+		var kerr *keyError
+		switch {
+		case errors.As(err, &valErr):
+			result["error"] = valErr.Message
+			result["code"] = valErr.Code
+		case errors.As(err, &kerr):
+			result["code"] = kerr.code
+		}
+		return result
+	}
+
+	if entry.Mode()&os.ModeSymlink != 0 {
+		return fail(zipError("UNSAFE_PATH", "symbolic links are not imported"))
+	}
+	rel, err := zipEntryPath(entry.Name)
+	if err != nil {
+		return fail(err)
+	}
+	if err := validator.ValidateFile(&multipart.FileHeader{Filename: rel, Size: int64(entry.UncompressedSize64)}, bucket); err != nil {
+		return fail(err)
+	}
+	content, err := readZipEntry(entry, lim, budget)
+	if err != nil {
+		return fail(err)
+	}
+	if err := validator.ValidateContentFor(bucket, content); err != nil {
+		return fail(err)
+	}
+	if kerr := i.scanUpload(ctx, bucket, bytes.NewReader(content)); kerr != nil {
+		return fail(kerr)
+	}
+	if service.IsImageFile(rel) {
+		width, height, err := i.validateImageContent(rel, content)
+		if err != nil {
+			return fail(zipError("INVALID_IMAGE_CONTENT", "invalid image content"))
+		}
+		if err := validator.ValidateImageFor(bucket, width, height); err != nil {
+			return fail(err)
+		}
+		if optimize || validator.ForcedOptimize(bucket) {
+			content, _, _ = i.maybeOptimize(content, service.DefaultOptimizeOptions())
+		}
+	}
+
+	ext := strings.TrimPrefix(filepath.Ext(rel), ".")
+	_, objectName, plan, kerr := i.keyedUpload(ctx, bucket, prefix, rel, ext, overwrite, "")
+	if kerr != nil {
+		return fail(kerr)
+	}
+	digest := sha256.Sum256(content)
+	sum := hex.EncodeToString(digest[:])
+	info, err := i.minioClient.PutObject(ctx, bucket, objectName, bytes.NewReader(content), int64(len(content)),
+		plan.options(attrs.options(minio.PutObjectOptions{ContentType: http.DetectContentType(content), UserMetadata: digestMeta(sum)})))
+	if err != nil {
+		if kerr := plan.failure(err); kerr != nil {
+			return fail(kerr)
+		}
+		return fail(err)
+	}
+	// An entry is stored under its own path, a key the archive chose, so it
+	// is neither deduplicated nor indexed for dedup (see dedupApplies).
+	i.afterStore(ctx, bucket, objectName, plan.replaced)
+	i.schedulePresets(service.MinioStore{Client: i.minioClient}, bucket, objectName, info.ETag)
+	if msg := i.archiveObject(ctx, bucket, objectName, bytes.NewReader(content), sum, info.VersionID); msg != "" {
+		result["archive"] = msg
+	}
+
+	result["success"] = true
+	result["object_name"] = objectName
+	result["size"] = len(content)
+	result["overwritten"] = plan.replaced
+	return result
+}
@@ -0,0 +1,158 @@
+package handler
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+
+	"github.com/mstgnz/cdn/pkg/validator"
+)
+
+// buildZip returns an archive of the given entries, deflated.
+func buildZip(t *testing.T, entries map[string][]byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	w := zip.NewWriter(&buf)
+	for name, data := range entries {
+		f, err := w.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := f.Write(data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func zipCode(err error) string {
+	if verr, ok := err.(*validator.FileValidationError); ok {
+		return verr.Code
+	}
+	return ""
+}
+
+func TestZipEntryPath(t *testing.T) {
+	for name, want := range map[string]string{
+		"a.png":            "a.png",
+		"dir/sub/b.jpg":    "dir/sub/b.jpg",
+		"./dir//c.png":     "dir/c.png",
+		`win\path\d.png`:   "win/path/d.png",
+		"../evil.png":      "",
+		"dir/../../e.png":  "",
+		`..\evil.png`:      "",
+		"/etc/passwd.png":  "",
+		`C:\Windows\f.png`: "",
+		"":                 "",
+	} {
+		got, err := zipEntryPath(name)
+		if want == "" {
+			if zipCode(err) != "UNSAFE_PATH" {
+				t.Errorf("%q: accepted as %q (%v)", name, got, err)
+			}
+			continue
+		}
+		if err != nil || got != want {
+			t.Errorf("%q = (%q, %v), want %q", name, got, err, want)
+		}
+	}
+}
+
+// The archive's own claims are checked before anything is decompressed.
+func TestOpenZipLimits(t *testing.T) {
+	archive := buildZip(t, map[string][]byte{"a.txt": []byte("a"), "b.txt": []byte("b"), "c.txt": bytes.Repeat([]byte("c"), 100)})
+	r := bytes.NewReader(archive)
+
+	if _, err := openZip(r, r.Size(), zipLimits{maxEntries: 10, maxTotal: 1 << 20}); err != nil {
+		t.Fatalf("within limits: %v", err)
+	}
+	if _, err := openZip(r, r.Size(), zipLimits{maxEntries: 2, maxTotal: 1 << 20}); err == nil || err.Code != "ZIP_TOO_MANY_ENTRIES" {
+		t.Errorf("entry count: %v", err)
+	}
+	if _, err := openZip(r, r.Size(), zipLimits{maxEntries: 10, maxTotal: 50}); err == nil || err.Code != "ZIP_TOO_LARGE" {
+		t.Errorf("declared total: %v", err)
+	}
+	junk := bytes.NewReader([]byte("not a zip"))
+	if _, err := openZip(junk, junk.Size(), zipLimits{maxEntries: 10, maxTotal: 1 << 20}); err == nil || err.Code != "INVALID_ZIP" {
+		t.Errorf("junk: %v", err)
+	}
+}
+
+// Limits hold on the bytes actually decompressed: a highly compressible entry
+// is stopped by the ratio, and the archive's total is shared by its entries.
+func TestReadZipEntryLimits(t *testing.T) {
+	zeros := bytes.Repeat([]byte{0}, 4<<20)
+	archive := buildZip(t, map[string][]byte{"bomb.bin": zeros, "small.txt": bytes.Repeat([]byte("x"), 1000)})
+	r := bytes.NewReader(archive)
+	zr, verr := openZip(r, r.Size(), zipLimits{maxEntries: 10, maxTotal: 1 << 30})
+	if verr != nil {
+		t.Fatal(verr)
+	}
+	files := map[string]*zip.File{}
+	for _, f := range zr.File {
+		files[f.Name] = f
+	}
+	lim := zipLimits{maxEntries: 10, maxTotal: 1 << 30, maxEntry: 1 << 30, maxRatio: 100}
+
+	budget := lim.maxTotal
+	if _, err := readZipEntry(files["bomb.bin"], lim, &budget); zipCode(err) != "ZIP_BOMB" {
+		t.Errorf("4 MiB of zeros: %v", err)
+	}
+	budget = lim.maxTotal
+	if data, err := readZipEntry(files["small.txt"], lim, &budget); err != nil || len(data) != 1000 || budget != lim.maxTotal-1000 {
+		t.Errorf("small entry: %d bytes, budget %d, %v", len(data), budget, err)
+	}
+
+	lim.maxRatio = 0
+	budget = 500
+	if _, err := readZipEntry(files["small.txt"], lim, &budget); zipCode(err) != "ZIP_TOO_LARGE" {
+		t.Errorf("past the total: %v", err)
+	}
+	lim.maxEntry, budget = 999, lim.maxTotal
+	if _, err := readZipEntry(files["small.txt"], lim, &budget); zipCode(err) != "FILE_TOO_LARGE" {
+		t.Errorf("past MAX_FILE_SIZE: %v", err)
+	}
+}
+
+// Whole-archive failures are answered before the bucket is looked up.
+func TestUploadZipRefusesBadArchives(t *testing.T) {
+	t.Setenv("ZIP_MAX_ENTRIES", "2")
+	h := NewImage(nil, nil, nil, nil, nil, nil, nil, nil, nil, nil, nil)
+	app := fiber.New()
+	app.Post("/upload/zip", h.UploadZip)
+
+	three := buildZip(t, map[string][]byte{"a.txt": []byte("a"), "b.txt": []byte("b"), "c.txt": []byte("c")})
+	for name, tc := range map[string]struct {
+		filename string
+		data     []byte
+		code     string
+	}{
+		"not a zip name":   {"photos.tar", three, "INVALID_FILE_FORMAT"},
+		"not a zip":        {"photos.zip", []byte("PK but not really"), "INVALID_ZIP"},
+		"too many entries": {"photos.zip", three, "ZIP_TOO_MANY_ENTRIES"},
+	} {
+		body, contentType := multipartForm(t, map[string]string{"bucket": "photos"}, "file", tc.filename, tc.data)
+		req := httptest.NewRequest(fiber.MethodPost, "/upload/zip", body)
+		req.Header.Set(fiber.HeaderContentType, contentType)
+		resp, err := app.Test(req, -1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		raw, _ := io.ReadAll(resp.Body)
+		var out struct {
+			Data map[string]string `json:"data"`
+		}
+		_ = json.Unmarshal(raw, &out)
+		if resp.StatusCode != fiber.StatusBadRequest || out.Data["code"] != tc.code {
+			t.Errorf("%s: status %d %s", name, resp.StatusCode, raw)
+		}
+	}
+}
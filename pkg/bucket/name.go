@@ -12,6 +12,39 @@ import (
 // ErrInvalidName is returned for any name that does not satisfy namePattern.
 var ErrInvalidName = errors.New("invalid bucket name: must be 3-63 characters of lowercase letters, digits or '-', starting and ending with a letter or digit")
 
+// ErrReservedName is returned by ValidateNew for a name in reservedNames.
+var ErrReservedName = errors.New("invalid bucket name: the name is reserved for an API route")
+
+// reservedNames are the first path segments of the service's own routes. The
+// public read and delete routes are /:bucket/*, and the API routes are
+// registered ahead of them so they are not read as objects; the cost is that a
+// bucket with one of these names would have part or all of it shadowed (GET
+// /meta/x/y.png is a metadata lookup, not the object x/y.png in "meta"). They
+// are refused when a bucket is created rather than rejected everywhere: a
+// bucket that already exists under such a name predates the route and keeps
+// whatever part of it still answers.
+//
+// Names shorter than three characters (ws) are left out, since namePattern
+// already refuses them.
+var reservedNames = map[string]bool{
+	"archive":  true,
+	"aws":      true,
+	"batch":    true,
+	"cache":    true,
+	"health":   true,
+	"jobs":     true,
+	"meta":     true,
+	"metrics":  true,
+	"minio":    true,
+	"monitor":  true,
+	"objects":  true,
+	"resize":   true,
+	"trash":    true,
+	"tus":      true,
+	"upload":   true,
+	"versions": true,
+}
+
 // namePattern is intentionally stricter than the S3/MinIO grammar: dots are
 // rejected too. A dot buys nothing here and invites confusion with path
 // segments (a bucket literally named ".." would otherwise be spellable), and
@@ -28,3 +61,22 @@ func Validate(name string) error {
 	}
 	return nil
 }
+
+// Reserved reports whether name is the first path segment of one of the
+// service's routes (see reservedNames).
+func Reserved(name string) bool {
+	return reservedNames[name]
+}
+
+// ValidateNew is Validate for a bucket about to be created: on top of the
+// name rules, it refuses the names the service's routes use, which a new
+// bucket would not be fully reachable under.
+func ValidateNew(name string) error {
+	if err := Validate(name); err != nil {
+		return err
+	}
+	if Reserved(name) {
+		return ErrReservedName
+	}
+	return nil
+}
@@ -64,3 +64,24 @@ func TestValidateLengthBoundaries(t *testing.T) {
 		t.Error("64-character name accepted, want rejection")
 	}
 }
+
+// TestValidateNewRefusesRouteNames covers the names the API routes shadow:
+// they stay valid for a bucket that already exists, but cannot be created.
+func TestValidateNewRefusesRouteNames(t *testing.T) {
+	for _, name := range []string{"meta", "objects", "trash", "versions", "jobs", "tus", "batch"} {
+		if err := Validate(name); err != nil {
+			t.Errorf("Validate(%q) = %v, want nil", name, err)
+		}
+		if err := ValidateNew(name); err != ErrReservedName {
+			t.Errorf("ValidateNew(%q) = %v, want ErrReservedName", name, err)
+		}
+	}
+	for _, name := range []string{"tedarik", "metadata", "my-trash"} {
+		if err := ValidateNew(name); err != nil {
+			t.Errorf("ValidateNew(%q) = %v, want nil", name, err)
+		}
+	}
+	if err := ValidateNew("ab"); err != ErrInvalidName {
+		t.Errorf("ValidateNew(%q) = %v, want ErrInvalidName", "ab", err)
+	}
+}
@@ -0,0 +1,648 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/textproto"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/google/uuid"
+
+	"github.com/mstgnz/cdn/pkg/bucket"
+)
+
+// BucketPolicy is one entry of the bucket policy file: the settings that differ
+// from one bucket to the next rather than from one deployment to the next.
+//
+// Every section is optional, and a missing section means "behave as a bucket
+// with no policy", which is exactly how every bucket behaved before the file
+// existed.
+type BucketPolicy struct {
+	Bucket string `json:"bucket"`
+
+	// Cache decides the Cache-Control and extra response headers sent with
+	// objects served from this bucket.
+	Cache *CachePolicy `json:"cache,omitempty"`
+
+	// Presets are the sizes generated in the background as soon as an image
+	// is uploaded, so the first visitor does not pay for the decode. A bucket
+	// entry's presets replace the defaults' rather than adding to them.
+	Presets []Preset `json:"presets,omitempty"`
+
+	// KeyTemplate lays out the keys of uploads that give neither a path nor a
+	// key. A bucket entry's template replaces the defaults'. See KeyTemplate.
+	KeyTemplate KeyTemplate `json:"key_template,omitempty"`
+
+	// Dedup stores each distinct content once: an upload whose bytes are
+	// already in the bucket gets the existing object's link. A pointer so a
+	// bucket entry can turn off what the defaults turn on.
+	Dedup *bool `json:"dedup,omitempty"`
+
+	// MalwareScan decides what an upload to the bucket does when CLAMD_ADDR is
+	// set: "fail_closed" scans it and refuses it when the scanner cannot be
+	// reached, "fail_open" scans it and stores it anyway in that case, "off"
+	// does not scan. Empty falls back to the defaults, then to fail_closed.
+	MalwareScan string `json:"malware_scan,omitempty"`
+
+	// Upload narrows what may be uploaded to the bucket. A bucket entry's
+	// section replaces the defaults' whole. See UploadPolicy.
+	Upload *UploadPolicy `json:"upload,omitempty"`
+
+	// Trash keeps deleted objects for a while instead of removing them at
+	// once. A bucket entry's section replaces the defaults' whole. See
+	// TrashPolicy.
+	Trash *TrashPolicy `json:"trash,omitempty"`
+}
+
+// TrashPolicy turns a bucket's deletes into moves to the trash, from which an
+// object can be restored until the purge job removes it for good. It is what
+// stands between a mis-scripted batch delete and a restore from backups.
+type TrashPolicy struct {
+	// Days a deleted object is kept before it is purged. 0 turns the trash
+	// off, which is how a bucket entry opts out of a trash the defaults turn
+	// on.
+	Days int `json:"days"`
+}
+
+// maxTrashDays bounds TrashPolicy.Days. A trash kept for longer than ten
+// years is an archive, and there is one of those already.
+const maxTrashDays = 3650
+
+// UploadPolicy is what a bucket accepts, on top of the process-wide checks:
+// the extension allowlist, MAX_FILE_SIZE and the content signature still apply
+// to every bucket, and a policy can only narrow them. An avatar bucket can be
+// held to small JPEG, PNG and WebP images; it cannot be opened to .exe.
+//
+// Every field is optional and zero means "no limit of this kind".
+type UploadPolicy struct {
+	// Extensions the bucket accepts, with or without the dot. Each must be on
+	// the global allowlist, which is checked at boot.
+	Extensions []string `json:"extensions,omitempty"`
+
+	// MimeTypes the bucket accepts, matched against the type sniffed from the
+	// content, never the one the client sent. "image/*" matches a family.
+	MimeTypes []string `json:"mime_types,omitempty"`
+
+	MinBytes int64 `json:"min_bytes,omitempty"`
+	MaxBytes int64 `json:"max_bytes,omitempty"`
+
+	// Pixel limits of raster images, as uploaded. Vector images (SVG) have no
+	// pixel size and are not held to them.
+	MinWidth  uint `json:"min_width,omitempty"`
+	MaxWidth  uint `json:"max_width,omitempty"`
+	MinHeight uint `json:"min_height,omitempty"`
+	MaxHeight uint `json:"max_height,omitempty"`
+
+	// Aspect ratio limits, as width divided by height: 1 is square, 1.7778 is
+	// 16:9.
+	MinAspectRatio float64 `json:"min_aspect_ratio,omitempty"`
+	MaxAspectRatio float64 `json:"max_aspect_ratio,omitempty"`
+
+	// Optimize stores every image optimised, as if each upload had asked for
+	// it.
+	Optimize bool `json:"optimize,omitempty"`
+
+	// MaxResizeDimension caps the width and height the bucket's images can be
+	// resized to, on a URL or at upload, below MAX_RESIZE_DIMENSION. Every
+	// distinct size a URL asks for is decoded and cached once, so a bucket of
+	// thumbnails has no reason to offer 4096-pixel ones to whoever asks.
+	MaxResizeDimension uint `json:"max_resize_dimension,omitempty"`
+}
+
+// Malware scan modes of a bucket policy. See BucketPolicy.MalwareScan.
+const (
+	MalwareScanOff        = "off"
+	MalwareScanFailOpen   = "fail_open"
+	MalwareScanFailClosed = "fail_closed"
+)
+
+// Preset is one eagerly generated size. Its dimensions are exactly what a
+// client puts in the URL (/w:300/h:200/... or ?width=300&height=200) to get it;
+// leaving one out keeps the aspect ratio, as it does in the URL.
+type Preset struct {
+	Name   string `json:"name"`
+	Width  uint   `json:"width,omitempty"`
+	Height uint   `json:"height,omitempty"`
+}
+
+// BucketPolicyConfig is the on-disk shape of the bucket policy file.
+//
+// Defaults applies to every bucket that does not say otherwise, including
+// buckets with no entry at all. Its bucket field must be left empty.
+type BucketPolicyConfig struct {
+	// Comment is free text for whoever edits the file, as in the token
+	// template. Declared so that refusing unknown fields does not refuse it.
+	Comment any `json:"_comment,omitempty"`
+
+	Defaults BucketPolicy   `json:"defaults"`
+	Buckets  []BucketPolicy `json:"buckets"`
+}
+
+// CachePolicy holds separate directives for originals and for transformed
+// variants, because the two age differently: an original under a UUID name never
+// changes, while a variant is only as good as the code that produced it and a
+// resize fix has to be able to reach clients in days, not a year.
+type CachePolicy struct {
+	Original *CacheDirectives `json:"original,omitempty"`
+	Variant  *CacheDirectives `json:"variant,omitempty"`
+
+	// Rules narrow the policy to part of the bucket. The most specific rule that
+	// defines a block for the kind being served wins; see CacheDirectivesFor.
+	Rules []CacheRule `json:"rules,omitempty"`
+}
+
+// CacheRule applies its directives to the keys it matches.
+type CacheRule struct {
+	// Prefix matches keys that start with it. Empty matches every key, which is
+	// only useful together with UUIDNamed.
+	Prefix string `json:"prefix,omitempty"`
+
+	// UUIDNamed restricts the rule to keys whose file name starts with a UUID,
+	// which is every name the upload endpoints generate. Content under such a
+	// name is never replaced, so it is the one place a year-long immutable
+	// policy is safe without knowing anything else about the bucket.
+	UUIDNamed bool `json:"uuid_named,omitempty"`
+
+	Original *CacheDirectives `json:"original,omitempty"`
+	Variant  *CacheDirectives `json:"variant,omitempty"`
+}
+
+// CacheDirectives is one Cache-Control policy plus any extra headers to send
+// alongside it. Ages are in seconds. A nil age is left out of the header rather
+// than sent as zero, because max-age=0 is a policy of its own.
+type CacheDirectives struct {
+	MaxAge               *int              `json:"max_age,omitempty"`
+	SMaxAge              *int              `json:"s_maxage,omitempty"`
+	StaleWhileRevalidate *int              `json:"stale_while_revalidate,omitempty"`
+	Immutable            bool              `json:"immutable,omitempty"`
+	Headers              map[string]string `json:"headers,omitempty"`
+}
+
+// CacheControl renders the directives as a Cache-Control value. Empty when the
+// block only carries extra headers.
+func (d *CacheDirectives) CacheControl() string {
+	if d == nil {
+		return ""
+	}
+
+	var parts []string
+	if d.MaxAge != nil {
+		parts = append(parts, "max-age="+strconv.Itoa(*d.MaxAge))
+	}
+	if d.SMaxAge != nil {
+		parts = append(parts, "s-maxage="+strconv.Itoa(*d.SMaxAge))
+	}
+	if d.StaleWhileRevalidate != nil {
+		parts = append(parts, "stale-while-revalidate="+strconv.Itoa(*d.StaleWhileRevalidate))
+	}
+	if d.Immutable {
+		parts = append(parts, "immutable")
+	}
+	if len(parts) == 0 {
+		return ""
+	}
+
+	// Everything served here is public by construction: GET needs no token.
+	return "public, " + strings.Join(parts, ", ")
+}
+
+// reservedResponseHeaders are set by the read path itself, and several of them
+// carry its security guarantees: the sniffed Content-Type, nosniff, and the SVG
+// sandbox CSP. A policy file able to override them could undo the stored-XSS
+// defences with one line of JSON, so they are refused at load time.
+// Cache-Control is here because it has its own fields.
+var reservedResponseHeaders = map[string]struct{}{
+	"Cache-Control":           {},
+	"Content-Type":            {},
+	"Content-Length":          {},
+	"Content-Encoding":        {},
+	"Content-Security-Policy": {},
+	"X-Content-Type-Options":  {},
+	"Transfer-Encoding":       {},
+	"Connection":              {},
+	"Set-Cookie":              {},
+}
+
+// bucketPolicies maps a bucket name to its policy. Like bucketTokens it is
+// populated before the server accepts requests and read-only from then on.
+var (
+	bucketPolicies = map[string]BucketPolicy{}
+	policyDefaults BucketPolicy
+)
+
+// LoadBucketPolicies reads the bucket policy file and returns how many bucket
+// entries it defines.
+//
+// It draws the same line LoadBucketTokens does. A missing or empty file is "no
+// policies yet" and boots with none; a file with content that cannot be parsed
+// or does not validate stops boot, because the operator wrote a policy and
+// believes it is in force.
+func LoadBucketPolicies(path string) (int, error) {
+	bucketPolicies = map[string]BucketPolicy{}
+	policyDefaults = BucketPolicy{}
+
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, nil
+		}
+		return 0, fmt.Errorf("read bucket policy file %q: %w", path, err)
+	}
+	if len(bytes.TrimSpace(raw)) == 0 {
+		return 0, nil
+	}
+
+	// Unknown fields are refused: a misspelt "max_age" would otherwise load
+	// cleanly and silently serve without the policy the operator wrote.
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.DisallowUnknownFields()
+
+	var cfg BucketPolicyConfig
+	if err := dec.Decode(&cfg); err != nil {
+		return 0, fmt.Errorf("parse bucket policy file %q: %w", path, err)
+	}
+
+	if cfg.Defaults.Bucket != "" {
+		return 0, fmt.Errorf("bucket policy file %q: defaults must not name a bucket", path)
+	}
+	if err := cfg.Defaults.validate(); err != nil {
+		return 0, fmt.Errorf("bucket policy file %q defaults: %w", path, err)
+	}
+
+	loaded := make(map[string]BucketPolicy, len(cfg.Buckets))
+	for idx, entry := range cfg.Buckets {
+		entry.Bucket = strings.TrimSpace(entry.Bucket)
+		if err := bucket.Validate(entry.Bucket); err != nil {
+			return 0, fmt.Errorf("bucket policy file %q entry %d: %w", path, idx, err)
+		}
+		if _, duplicate := loaded[entry.Bucket]; duplicate {
+			return 0, fmt.Errorf("bucket policy file %q entry %d: duplicate bucket %q", path, idx, entry.Bucket)
+		}
+		if err := entry.validate(); err != nil {
+			return 0, fmt.Errorf("bucket policy file %q entry %d (bucket %q): %w", path, idx, entry.Bucket, err)
+		}
+		loaded[entry.Bucket] = entry
+	}
+
+	// Presets and the resize limit can come from different places, a bucket's
+	// presets and the defaults' limit or the other way round, so they are
+	// checked against each other once both are known.
+	if err := validatePresets(cfg.Defaults.Presets, maxResizeDimension(cfg.Defaults.Upload)); err != nil {
+		return 0, fmt.Errorf("bucket policy file %q defaults: %w", path, err)
+	}
+	for idx, entry := range cfg.Buckets {
+		presets, upload := entry.Presets, entry.Upload
+		if len(presets) == 0 {
+			presets = cfg.Defaults.Presets
+		}
+		if upload == nil {
+			upload = cfg.Defaults.Upload
+		}
+		if err := validatePresets(presets, maxResizeDimension(upload)); err != nil {
+			return 0, fmt.Errorf("bucket policy file %q entry %d (bucket %q): %w", path, idx, entry.Bucket, err)
+		}
+	}
+
+	bucketPolicies = loaded
+	policyDefaults = cfg.Defaults
+	return len(loaded), nil
+}
+
+// BucketPolicyFor returns the policy entry for a bucket and whether one exists.
+// Defaults are not folded in; each section decides how it falls back.
+func BucketPolicyFor(name string) (BucketPolicy, bool) {
+	p, ok := bucketPolicies[name]
+	return p, ok
+}
+
+// PresetsFor returns the sizes to generate on upload to a bucket: its own
+// presets when its entry lists any, otherwise the defaults'.
+func PresetsFor(bucketName string) []Preset {
+	if p, ok := bucketPolicies[bucketName]; ok && len(p.Presets) > 0 {
+		return p.Presets
+	}
+	return policyDefaults.Presets
+}
+
+// DedupFor reports whether uploads to a bucket are deduplicated: its own
+// setting when its entry has one, otherwise the defaults'.
+func DedupFor(bucketName string) bool {
+	if p, ok := bucketPolicies[bucketName]; ok && p.Dedup != nil {
+		return *p.Dedup
+	}
+	return policyDefaults.Dedup != nil && *policyDefaults.Dedup
+}
+
+// DedupConfigured reports whether any bucket can be deduplicated, so the
+// digest index is only set up where it will be used.
+func DedupConfigured() bool {
+	if policyDefaults.Dedup != nil && *policyDefaults.Dedup {
+		return true
+	}
+	for _, p := range bucketPolicies {
+		if p.Dedup != nil && *p.Dedup {
+			return true
+		}
+	}
+	return false
+}
+
+// UploadPolicyFor returns the upload policy of a bucket: its own section when
+// its entry has one, otherwise the defaults', otherwise nil.
+func UploadPolicyFor(bucketName string) *UploadPolicy {
+	if p, ok := bucketPolicies[bucketName]; ok && p.Upload != nil {
+		return p.Upload
+	}
+	return policyDefaults.Upload
+}
+
+// MaxResizeDimensionFor returns the largest width or height an image of the
+// bucket may be resized to: MAX_RESIZE_DIMENSION, narrowed by the bucket's
+// upload policy. 0 means no limit. "" is a resize that stores nothing, held to
+// the defaults like a bucket without an entry.
+func MaxResizeDimensionFor(bucketName string) int {
+	return maxResizeDimension(UploadPolicyFor(bucketName))
+}
+
+func maxResizeDimension(u *UploadPolicy) int {
+	maxDim := GetEnvAsIntOrDefault("MAX_RESIZE_DIMENSION", 4096)
+	if maxDim < 0 {
+		maxDim = 0
+	}
+	if u != nil && u.MaxResizeDimension > 0 && (maxDim == 0 || int(u.MaxResizeDimension) < maxDim) {
+		maxDim = int(u.MaxResizeDimension)
+	}
+	return maxDim
+}
+
+// UploadPolicies returns every upload policy in the file by where it was set,
+// "defaults" or the bucket's name, for checks that need the whole set.
+func UploadPolicies() map[string]*UploadPolicy {
+	out := map[string]*UploadPolicy{}
+	if policyDefaults.Upload != nil {
+		out["defaults"] = policyDefaults.Upload
+	}
+	for name, p := range bucketPolicies {
+		if p.Upload != nil {
+			out[name] = p.Upload
+		}
+	}
+	return out
+}
+
+// TrashDaysFor returns how many days deleted objects of a bucket are kept in
+// the trash: its own section when its entry has one, otherwise the defaults'.
+// 0 means deletes remove objects at once.
+func TrashDaysFor(bucketName string) int {
+	if p, ok := bucketPolicies[bucketName]; ok && p.Trash != nil {
+		return p.Trash.Days
+	}
+	if policyDefaults.Trash != nil {
+		return policyDefaults.Trash.Days
+	}
+	return 0
+}
+
+// TrashConfigured reports whether any bucket keeps a trash, so the trash
+// bucket and its purge job are only set up where they will be used.
+func TrashConfigured() bool {
+	if policyDefaults.Trash != nil && policyDefaults.Trash.Days > 0 {
+		return true
+	}
+	for _, p := range bucketPolicies {
+		if p.Trash != nil && p.Trash.Days > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// MalwareScanFor returns the scan mode of uploads to a bucket: its own when
+// its entry sets one, otherwise the defaults', otherwise fail_closed. Whether a
+// scanner is configured at all is not this function's concern.
+func MalwareScanFor(bucketName string) string {
+	if p, ok := bucketPolicies[bucketName]; ok && p.MalwareScan != "" {
+		return p.MalwareScan
+	}
+	if policyDefaults.MalwareScan != "" {
+		return policyDefaults.MalwareScan
+	}
+	return MalwareScanFailClosed
+}
+
+// CacheDirectivesFor picks the cache directives for one served object, or nil
+// when nothing is configured for it, in which case no Cache-Control is sent.
+//
+// The most specific match wins whole, with no field-by-field merging, so the
+// block an operator reads in the file is exactly what is sent. Specificity runs:
+// a bucket's rules, then the bucket itself, then the defaults' rules, then the
+// defaults. Among rules, the longest prefix wins and a uuid_named rule beats an
+// otherwise equal one; only rules that define a block for the kind being served
+// (original or variant) are considered.
+func CacheDirectivesFor(bucketName, key string, variant bool) *CacheDirectives {
+	if p, ok := bucketPolicies[bucketName]; ok {
+		if d := p.Cache.pick(key, variant); d != nil {
+			return d
+		}
+	}
+	return policyDefaults.Cache.pick(key, variant)
+}
+
+func (cp *CachePolicy) pick(key string, variant bool) *CacheDirectives {
+	if cp == nil {
+		return nil
+	}
+
+	var best *CacheDirectives
+	bestLen, bestUUID := -1, false
+	for _, r := range cp.Rules {
+		d := r.Original
+		if variant {
+			d = r.Variant
+		}
+		if d == nil || !r.matches(key) {
+			continue
+		}
+		longer := len(r.Prefix) > bestLen
+		tieWon := len(r.Prefix) == bestLen && r.UUIDNamed && !bestUUID
+		if longer || tieWon {
+			best, bestLen, bestUUID = d, len(r.Prefix), r.UUIDNamed
+		}
+	}
+	if best != nil {
+		return best
+	}
+
+	if variant {
+		return cp.Variant
+	}
+	return cp.Original
+}
+
+func (r CacheRule) matches(key string) bool {
+	if !strings.HasPrefix(key, r.Prefix) {
+		return false
+	}
+	return !r.UUIDNamed || IsUUIDNamed(key)
+}
+
+// IsUUIDNamed reports whether the file name part of key starts with a UUID, as
+// every name the upload endpoints generate does ("<uuid>.<ext>" for single
+// uploads, "<uuid>_<original name>" for batch uploads).
+func IsUUIDNamed(key string) bool {
+	name := path.Base(key)
+	if len(name) < 36 {
+		return false
+	}
+	if _, err := uuid.Parse(name[:36]); err != nil {
+		return false
+	}
+	return len(name) == 36 || name[36] == '.' || name[36] == '_'
+}
+
+func (p BucketPolicy) validate() error {
+	if err := validatePresets(p.Presets, 0); err != nil {
+		return err
+	}
+	if err := p.KeyTemplate.validate(); err != nil {
+		return fmt.Errorf("key_template: %w", err)
+	}
+	if err := p.Upload.validate(); err != nil {
+		return fmt.Errorf("upload: %w", err)
+	}
+	if p.Trash != nil && (p.Trash.Days < 0 || p.Trash.Days > maxTrashDays) {
+		return fmt.Errorf("trash.days must be between 0 and %d, got %d", maxTrashDays, p.Trash.Days)
+	}
+	switch p.MalwareScan {
+	case "", MalwareScanOff, MalwareScanFailOpen, MalwareScanFailClosed:
+	default:
+		return fmt.Errorf("malware_scan %q must be off, fail_open or fail_closed", p.MalwareScan)
+	}
+	if p.Cache == nil {
+		return nil
+	}
+	if err := p.Cache.Original.validate(); err != nil {
+		return fmt.Errorf("cache.original: %w", err)
+	}
+	if err := p.Cache.Variant.validate(); err != nil {
+		return fmt.Errorf("cache.variant: %w", err)
+	}
+	for idx, r := range p.Cache.Rules {
+		if r.Prefix == "" && !r.UUIDNamed {
+			return fmt.Errorf("cache.rules[%d]: a rule needs a prefix or uuid_named, otherwise it is the bucket policy itself", idx)
+		}
+		if r.Original == nil && r.Variant == nil {
+			return fmt.Errorf("cache.rules[%d]: defines neither original nor variant", idx)
+		}
+		if err := r.Original.validate(); err != nil {
+			return fmt.Errorf("cache.rules[%d].original: %w", idx, err)
+		}
+		if err := r.Variant.validate(); err != nil {
+			return fmt.Errorf("cache.rules[%d].variant: %w", idx, err)
+		}
+	}
+	return nil
+}
+
+func (d *CacheDirectives) validate() error {
+	if d == nil {
+		return nil
+	}
+	for name, v := range map[string]*int{
+		"max_age":                d.MaxAge,
+		"s_maxage":               d.SMaxAge,
+		"stale_while_revalidate": d.StaleWhileRevalidate,
+	} {
+		if v != nil && *v < 0 {
+			return fmt.Errorf("%s must not be negative", name)
+		}
+	}
+	for name, value := range d.Headers {
+		if !validHeaderName(name) {
+			return fmt.Errorf("header %q is not a valid header name", name)
+		}
+		if _, reserved := reservedResponseHeaders[textproto.CanonicalMIMEHeaderKey(name)]; reserved {
+			return fmt.Errorf("header %q is set by the service itself and cannot be overridden", name)
+		}
+		if strings.ContainsAny(value, "\r\n") {
+			return fmt.Errorf("header %q has a line break in its value", name)
+		}
+	}
+	return nil
+}
+
+func (u *UploadPolicy) validate() error {
+	if u == nil {
+		return nil
+	}
+	for idx, ext := range u.Extensions {
+		if ext = strings.TrimPrefix(ext, "."); ext == "" || strings.ContainsAny(ext, "./ ") {
+			return fmt.Errorf("extensions[%d]: %q is not an extension", idx, u.Extensions[idx])
+		}
+	}
+	for idx, mt := range u.MimeTypes {
+		major, minor, ok := strings.Cut(mt, "/")
+		if !ok || major == "" || minor == "" || major == "*" || strings.ContainsAny(mt, "; ") {
+			return fmt.Errorf("mime_types[%d]: %q is not a media type or type/*", idx, mt)
+		}
+	}
+	switch {
+	case u.MinBytes < 0 || u.MaxBytes < 0:
+		return fmt.Errorf("byte limits must not be negative")
+	case u.MaxBytes > 0 && u.MinBytes > u.MaxBytes:
+		return fmt.Errorf("min_bytes is above max_bytes")
+	case u.MaxWidth > 0 && u.MinWidth > u.MaxWidth:
+		return fmt.Errorf("min_width is above max_width")
+	case u.MaxHeight > 0 && u.MinHeight > u.MaxHeight:
+		return fmt.Errorf("min_height is above max_height")
+	case u.MinAspectRatio < 0 || u.MaxAspectRatio < 0:
+		return fmt.Errorf("aspect ratio limits must not be negative")
+	case u.MaxAspectRatio > 0 && u.MinAspectRatio > u.MaxAspectRatio:
+		return fmt.Errorf("min_aspect_ratio is above max_aspect_ratio")
+	}
+	return nil
+}
+
+// validatePresets refuses presets that could never be requested. The read path
+// clamps every dimension to the bucket's resize limit, so a larger preset
+// would be generated, stored, and then missed by every URL that asks for it.
+// A maxDim of 0 checks everything but the size.
+func validatePresets(presets []Preset, maxDim int) error {
+	names := make(map[string]struct{}, len(presets))
+	for idx, pr := range presets {
+		if pr.Name == "" || strings.Trim(pr.Name, "abcdefghijklmnopqrstuvwxyz0123456789-_") != "" {
+			return fmt.Errorf("presets[%d]: name %q must be lowercase letters, digits, '-' or '_'", idx, pr.Name)
+		}
+		if _, dup := names[pr.Name]; dup {
+			return fmt.Errorf("presets[%d]: duplicate name %q", idx, pr.Name)
+		}
+		names[pr.Name] = struct{}{}
+		if pr.Width == 0 && pr.Height == 0 {
+			return fmt.Errorf("presets[%d] (%s): needs a width, a height, or both", idx, pr.Name)
+		}
+		if maxDim > 0 && (pr.Width > uint(maxDim) || pr.Height > uint(maxDim)) {
+			return fmt.Errorf("presets[%d] (%s): larger than the resize limit (%d), so no URL could request it", idx, pr.Name, maxDim)
+		}
+	}
+	return nil
+}
+
+// validHeaderName accepts RFC 7230 token characters only.
+func validHeaderName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, r := range name {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+		case strings.ContainsRune("!#$%&'*+-.^_`|~", r):
+		default:
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,275 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writePolicyFile(t *testing.T, body string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "buckets.json")
+	if err := os.WriteFile(path, []byte(body), 0o600); err != nil {
+		t.Fatalf("write policy file: %v", err)
+	}
+	return path
+}
+
+// loadPolicies loads body and resets the package state when the test ends, so
+// one test's policies never leak into another's lookups.
+func loadPolicies(t *testing.T, body string) {
+	t.Helper()
+	t.Cleanup(func() { _, _ = LoadBucketPolicies(filepath.Join(t.TempDir(), "absent.json")) })
+	if _, err := LoadBucketPolicies(writePolicyFile(t, body)); err != nil {
+		t.Fatalf("load: %v", err)
+	}
+}
+
+const uuidKey = "2026/05/3f2b8c1e-9a4d-4c7e-8f10-2b3c4d5e6f70.jpg"
+
+func TestLoadBucketPoliciesAbsentOrEmptyMeansNone(t *testing.T) {
+	for name, path := range map[string]string{
+		"missing": filepath.Join(t.TempDir(), "nope.json"),
+		"empty":   writePolicyFile(t, "  \n"),
+		"no keys": writePolicyFile(t, "{}"),
+	} {
+		t.Run(name, func(t *testing.T) {
+			n, err := LoadBucketPolicies(path)
+			if err != nil || n != 0 {
+				t.Fatalf("got (%d, %v), want (0, nil)", n, err)
+			}
+			if d := CacheDirectivesFor("photos", "a.jpg", false); d != nil {
+				t.Fatalf("directives without a policy file: %+v", d)
+			}
+		})
+	}
+}
+
+// The shipped template has to load as-is: it is what operators copy.
+func TestBucketPolicyTemplateLoads(t *testing.T) {
+	t.Cleanup(func() { _, _ = LoadBucketPolicies(filepath.Join(t.TempDir(), "absent.json")) })
+	if _, err := LoadBucketPolicies("../../config/buckets.template.json"); err != nil {
+		t.Fatalf("template does not load: %v", err)
+	}
+}
+
+func TestLoadBucketPoliciesRejectsWhatWouldSilentlyNotApply(t *testing.T) {
+	cases := map[string]string{
+		"unparseable":         `{"buckets": [`,
+		"misspelt field":      `{"buckets":[{"bucket":"photos","cache":{"original":{"maxage":60}}}]}`,
+		"invalid bucket":      `{"buckets":[{"bucket":"Not_Valid"}]}`,
+		"duplicate bucket":    `{"buckets":[{"bucket":"photos"},{"bucket":"photos"}]}`,
+		"defaults name one":   `{"defaults":{"bucket":"photos"}}`,
+		"negative age":        `{"buckets":[{"bucket":"photos","cache":{"variant":{"max_age":-1}}}]}`,
+		"rule without match":  `{"buckets":[{"bucket":"photos","cache":{"rules":[{"original":{"max_age":1}}]}}]}`,
+		"rule without block":  `{"buckets":[{"bucket":"photos","cache":{"rules":[{"prefix":"a/"}]}}]}`,
+		"reserved header":     `{"buckets":[{"bucket":"photos","cache":{"original":{"headers":{"content-type":"text/html"}}}}]}`,
+		"csp override":        `{"defaults":{"cache":{"original":{"headers":{"Content-Security-Policy":"default-src *"}}}}}`,
+		"header injection":    `{"buckets":[{"bucket":"photos","cache":{"original":{"headers":{"X-Note":"a\r\nSet-Cookie: x"}}}}]}`,
+		"bad header name":     `{"buckets":[{"bucket":"photos","cache":{"original":{"headers":{"X Note":"a"}}}}]}`,
+		"preset no size":      `{"buckets":[{"bucket":"photos","presets":[{"name":"thumb"}]}]}`,
+		"preset bad name":     `{"buckets":[{"bucket":"photos","presets":[{"name":"Thumb Big","width":100}]}]}`,
+		"preset duplicate":    `{"defaults":{"presets":[{"name":"t","width":100},{"name":"t","width":200}]}}`,
+		"preset too large":    `{"buckets":[{"bucket":"photos","presets":[{"name":"huge","width":99999}]}]}`,
+		"template not unique": `{"buckets":[{"bucket":"photos","key_template":"{yyyy}/{sha256:8}.{ext}"}]}`,
+		"template no ext":     `{"defaults":{"key_template":"{uuid}"}}`,
+		"template unknown":    `{"defaults":{"key_template":"{user}/{uuid}.{ext}"}}`,
+		"template traversal":  `{"defaults":{"key_template":"../{uuid}.{ext}"}}`,
+		"template bad char":   `{"defaults":{"key_template":"a b/{uuid}.{ext}"}}`,
+		"template length":     `{"defaults":{"key_template":"{sha256:65}/{uuid}.{ext}"}}`,
+		"malware scan mode":   `{"buckets":[{"bucket":"photos","malware_scan":"sometimes"}]}`,
+		"upload extension":    `{"buckets":[{"bucket":"docs","upload":{"extensions":["tar.gz"]}}]}`,
+		"upload mime type":    `{"buckets":[{"bucket":"docs","upload":{"mime_types":["*/*"]}}]}`,
+		"upload byte range":   `{"buckets":[{"bucket":"docs","upload":{"min_bytes":10,"max_bytes":5}}]}`,
+		"upload width range":  `{"buckets":[{"bucket":"avatars","upload":{"min_width":512,"max_width":64}}]}`,
+		"upload ratio range":  `{"buckets":[{"bucket":"avatars","upload":{"min_aspect_ratio":2,"max_aspect_ratio":1}}]}`,
+		"preset over limit":   `{"buckets":[{"bucket":"avatars","presets":[{"name":"big","width":1024}],"upload":{"max_resize_dimension":512}}]}`,
+		"default preset over": `{"defaults":{"presets":[{"name":"big","width":1024}]},"buckets":[{"bucket":"avatars","upload":{"max_resize_dimension":512}}]}`,
+		"trash negative days": `{"defaults":{"trash":{"days":-1}}}`,
+		"trash too long":      `{"buckets":[{"bucket":"photos","trash":{"days":36500}}]}`,
+	}
+	for name, body := range cases {
+		t.Run(name, func(t *testing.T) {
+			if _, err := LoadBucketPolicies(writePolicyFile(t, body)); err == nil {
+				t.Fatal("accepted, want a load error")
+			}
+		})
+	}
+}
+
+func TestCacheDirectivesForPrecedence(t *testing.T) {
+	loadPolicies(t, `{
+		"defaults": {"cache": {
+			"original": {"max_age": 60},
+			"variant":  {"max_age": 30}
+		}},
+		"buckets": [{
+			"bucket": "photos",
+			"cache": {
+				"original": {"max_age": 3600},
+				"rules": [
+					{"uuid_named": true, "original": {"max_age": 31536000, "immutable": true}},
+					{"prefix": "avatars/", "original": {"max_age": 300}, "variant": {"max_age": 120, "stale_while_revalidate": 60}},
+					{"prefix": "avatars/", "uuid_named": true, "original": {"max_age": 900}}
+				]
+			}
+		}]
+	}`)
+
+	cases := []struct {
+		name    string
+		bucket  string
+		key     string
+		variant bool
+		want    string
+	}{
+		{"bucket original", "photos", "logo.png", false, "public, max-age=3600"},
+		{"uuid upload is immutable", "photos", uuidKey, false, "public, max-age=31536000, immutable"},
+		{"batch upload name counts as uuid", "photos", "3f2b8c1e-9a4d-4c7e-8f10-2b3c4d5e6f70_logo.png", false, "public, max-age=31536000, immutable"},
+		{"longer prefix beats uuid rule", "photos", "avatars/user-1.png", false, "public, max-age=300"},
+		{"uuid breaks a prefix tie", "photos", "avatars/3f2b8c1e-9a4d-4c7e-8f10-2b3c4d5e6f70.png", false, "public, max-age=900"},
+		{"variant from prefix rule", "photos", "avatars/user-1.png", true, "public, max-age=120, stale-while-revalidate=60"},
+		// The uuid rule defines no variant block, and photos has none either, so
+		// the defaults answer rather than the original's year-long policy.
+		{"variant falls back to defaults", "photos", uuidKey, true, "public, max-age=30"},
+		{"unlisted bucket uses defaults", "docs", "a.pdf", false, "public, max-age=60"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			got := CacheDirectivesFor(tc.bucket, tc.key, tc.variant).CacheControl()
+			if got != tc.want {
+				t.Errorf("Cache-Control = %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestCacheDirectivesHeadersOnly(t *testing.T) {
+	loadPolicies(t, `{"buckets":[{"bucket":"photos","cache":{"original":{"headers":{"Timing-Allow-Origin":"*"}}}}]}`)
+
+	d := CacheDirectivesFor("photos", "a.jpg", false)
+	if d == nil {
+		t.Fatal("no directives")
+	}
+	if cc := d.CacheControl(); cc != "" {
+		t.Errorf("Cache-Control = %q, want none for a headers-only block", cc)
+	}
+	if d.Headers["Timing-Allow-Origin"] != "*" {
+		t.Errorf("headers = %v", d.Headers)
+	}
+}
+
+func TestIsUUIDNamed(t *testing.T) {
+	for key, want := range map[string]bool{
+		uuidKey:                                true,
+		"3f2b8c1e-9a4d-4c7e-8f10-2b3c4d5e6f70": true,
+		"3f2b8c1e-9a4d-4c7e-8f10-2b3c4d5e6f70_a.pdf":     true,
+		"3f2b8c1e-9a4d-4c7e-8f10-2b3c4d5e6f70/photo.jpg": false,
+		"3f2b8c1e-9a4d-4c7e-8f10-2b3c4d5e6f70x.jpg":      false,
+		"photo.jpg":                      false,
+		strings.Repeat("z", 40) + ".jpg": false,
+	} {
+		if got := IsUUIDNamed(key); got != want {
+			t.Errorf("IsUUIDNamed(%q) = %v, want %v", key, got, want)
+		}
+	}
+}
+
+func TestPresetsForPrefersTheBucketsOwn(t *testing.T) {
+	loadPolicies(t, `{
+		"defaults": {"presets": [{"name": "thumb", "width": 150}]},
+		"buckets": [
+			{"bucket": "photos", "presets": [{"name": "card", "width": 600, "height": 400}]},
+			{"bucket": "docs"}
+		]
+	}`)
+
+	if p := PresetsFor("photos"); len(p) != 1 || p[0].Name != "card" {
+		t.Errorf("photos presets = %+v, want only its own", p)
+	}
+	if p := PresetsFor("docs"); len(p) != 1 || p[0].Name != "thumb" {
+		t.Errorf("docs presets = %+v, want the defaults", p)
+	}
+	if p := PresetsFor("unlisted"); len(p) != 1 || p[0].Name != "thumb" {
+		t.Errorf("unlisted presets = %+v, want the defaults", p)
+	}
+}
+
+func TestMalwareScanForFallsBack(t *testing.T) {
+	if got := MalwareScanFor("photos"); got != MalwareScanFailClosed {
+		t.Errorf("without a policy file: %q", got)
+	}
+	loadPolicies(t, `{
+		"defaults": {"malware_scan": "fail_open"},
+		"buckets": [{"bucket": "photos", "malware_scan": "off"}, {"bucket": "docs"}]
+	}`)
+	for bucket, want := range map[string]string{"photos": MalwareScanOff, "docs": MalwareScanFailOpen, "unlisted": MalwareScanFailOpen} {
+		if got := MalwareScanFor(bucket); got != want {
+			t.Errorf("%s: %q, want %q", bucket, got, want)
+		}
+	}
+}
+
+// A bucket's upload section replaces the defaults' whole, like its presets.
+func TestUploadPolicyForFallsBack(t *testing.T) {
+	if UploadPolicyFor("docs") != nil {
+		t.Fatal("a policy without a policy file")
+	}
+	loadPolicies(t, `{
+		"defaults": {"upload": {"max_bytes": 1048576}},
+		"buckets": [
+			{"bucket": "docs", "upload": {"extensions": ["pdf"], "mime_types": ["application/pdf"]}},
+			{"bucket": "photos"}
+		]
+	}`)
+	if p := UploadPolicyFor("docs"); p == nil || p.MaxBytes != 0 || len(p.Extensions) != 1 {
+		t.Errorf("docs: %+v, want its own section only", p)
+	}
+	for _, bucket := range []string{"photos", "unlisted"} {
+		if p := UploadPolicyFor(bucket); p == nil || p.MaxBytes != 1048576 {
+			t.Errorf("%s: %+v, want the defaults", bucket, p)
+		}
+	}
+	if got := UploadPolicies(); len(got) != 2 || got["docs"] == nil || got["defaults"] == nil {
+		t.Errorf("UploadPolicies: %v", got)
+	}
+}
+
+// A bucket's resize limit narrows MAX_RESIZE_DIMENSION and never widens it.
+func TestMaxResizeDimensionForNarrowsTheGlobalLimit(t *testing.T) {
+	t.Setenv("MAX_RESIZE_DIMENSION", "4096")
+	loadPolicies(t, `{
+		"defaults": {"upload": {"max_resize_dimension": 2048}},
+		"buckets": [
+			{"bucket": "avatars", "upload": {"max_resize_dimension": 256}},
+			{"bucket": "posters", "upload": {"max_resize_dimension": 8192}},
+			{"bucket": "docs", "upload": {"extensions": ["pdf"]}}
+		]
+	}`)
+	for bucket, want := range map[string]int{"avatars": 256, "posters": 4096, "docs": 4096, "unlisted": 2048, "": 2048} {
+		if got := MaxResizeDimensionFor(bucket); got != want {
+			t.Errorf("%q: %d, want %d", bucket, got, want)
+		}
+	}
+}
+
+// A bucket entry can opt out of a trash the defaults turn on, and the trash is
+// configured as long as one bucket keeps one.
+func TestTrashDaysForFallsBack(t *testing.T) {
+	if TrashConfigured() || TrashDaysFor("photos") != 0 {
+		t.Fatal("a trash without a policy file")
+	}
+	loadPolicies(t, `{
+		"defaults": {"trash": {"days": 30}},
+		"buckets": [{"bucket": "photos", "trash": {"days": 7}}, {"bucket": "scratch", "trash": {"days": 0}}]
+	}`)
+	for bucket, want := range map[string]int{"photos": 7, "scratch": 0, "unlisted": 30} {
+		if got := TrashDaysFor(bucket); got != want {
+			t.Errorf("%s: %d, want %d", bucket, got, want)
+		}
+	}
+	if !TrashConfigured() {
+		t.Error("TrashConfigured = false")
+	}
+}
@@ -0,0 +1,175 @@
+package config
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// KeyTemplate lays out the keys of uploads the caller did not name, e.g.
+// "{yyyy}/{mm}/{dd}/{uuid}.{ext}" or "{sha256:2}/{sha256}.{ext}".
+//
+// Without one every upload lands at the top of its bucket as "<uuid>.<ext>",
+// which in a busy bucket is one prefix with millions of keys: slow to list,
+// and impossible to give a lifecycle rule or a cache rule by age or shard.
+//
+// Placeholders:
+//
+//	{yyyy} {mm} {dd}   the upload date, UTC
+//	{uuid}             a random UUID
+//	{sha256}           the hex SHA-256 of the stored bytes
+//	{sha256:N}         its first N characters, 1 to 64
+//	{ext}              the file's extension
+//
+// Everything else is literal and limited to letters, digits, '-', '_', '.'
+// and '/'.
+type KeyTemplate string
+
+// KeyValues is what a template is expanded with.
+type KeyValues struct {
+	Time   time.Time
+	UUID   string
+	SHA256 string
+	Ext    string
+}
+
+// keyToken is one piece of a parsed template: literal text, or a placeholder
+// name with its length for {sha256:N} (zero meaning all of it).
+type keyToken struct {
+	literal string
+	field   string
+	n       int
+}
+
+// KeyTemplateFor returns the key template for uploads to a bucket: its own when
+// its entry has one, otherwise the defaults'. Empty means "<uuid>.<ext>".
+func KeyTemplateFor(bucketName string) KeyTemplate {
+	if p, ok := bucketPolicies[bucketName]; ok && p.KeyTemplate != "" {
+		return p.KeyTemplate
+	}
+	return policyDefaults.KeyTemplate
+}
+
+// NeedsSHA256 reports whether expanding the template needs the content's hash,
+// which an upload only has once it has read all of its bytes.
+func (t KeyTemplate) NeedsSHA256() bool {
+	tokens, _ := t.parse()
+	for _, tok := range tokens {
+		if tok.field == "sha256" {
+			return true
+		}
+	}
+	return false
+}
+
+// Expand renders the template. It is only ever called on a template that
+// loaded, so a parse error cannot happen here.
+func (t KeyTemplate) Expand(v KeyValues) string {
+	tokens, _ := t.parse()
+	utc := v.Time.UTC()
+
+	var b strings.Builder
+	for _, tok := range tokens {
+		switch tok.field {
+		case "":
+			b.WriteString(tok.literal)
+		case "yyyy":
+			fmt.Fprintf(&b, "%04d", utc.Year())
+		case "mm":
+			fmt.Fprintf(&b, "%02d", int(utc.Month()))
+		case "dd":
+			fmt.Fprintf(&b, "%02d", utc.Day())
+		case "uuid":
+			b.WriteString(v.UUID)
+		case "ext":
+			b.WriteString(v.Ext)
+		case "sha256":
+			sum := v.SHA256
+			if tok.n > 0 && tok.n < len(sum) {
+				sum = sum[:tok.n]
+			}
+			b.WriteString(sum)
+		}
+	}
+	return b.String()
+}
+
+func (t KeyTemplate) parse() ([]keyToken, error) {
+	var tokens []keyToken
+	rest := string(t)
+	for rest != "" {
+		open := strings.IndexByte(rest, '{')
+		if open < 0 {
+			tokens = append(tokens, keyToken{literal: rest})
+			break
+		}
+		if open > 0 {
+			tokens = append(tokens, keyToken{literal: rest[:open]})
+		}
+		end := strings.IndexByte(rest[open:], '}')
+		if end < 0 {
+			return nil, fmt.Errorf("unclosed placeholder in %q", string(t))
+		}
+		name := rest[open+1 : open+end]
+		rest = rest[open+end+1:]
+
+		tok := keyToken{field: name}
+		if field, n, ok := strings.Cut(name, ":"); ok {
+			length, err := strconv.Atoi(n)
+			if field != "sha256" || err != nil || length < 1 || length > 64 {
+				return nil, fmt.Errorf("placeholder {%s}: only {sha256:N} takes a length, 1 to 64", name)
+			}
+			tok = keyToken{field: field, n: length}
+		}
+		switch tok.field {
+		case "yyyy", "mm", "dd", "uuid", "sha256", "ext":
+		default:
+			return nil, fmt.Errorf("unknown placeholder {%s}", name)
+		}
+		tokens = append(tokens, tok)
+	}
+	return tokens, nil
+}
+
+// validate refuses templates that would produce keys the rest of the service
+// cannot live with. The name has to be unique, or two uploads would share a
+// key; it has to end in the file's extension, because the read path decides
+// from the extension whether to resize or sandbox what it serves; and it has
+// to be a clean relative key, like everything the upload paths write.
+func (t KeyTemplate) validate() error {
+	if t == "" {
+		return nil
+	}
+	tokens, err := t.parse()
+	if err != nil {
+		return err
+	}
+
+	unique := false
+	for _, tok := range tokens {
+		if tok.field == "uuid" || (tok.field == "sha256" && tok.n == 0) {
+			unique = true
+		}
+		for _, r := range tok.literal {
+			if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || strings.ContainsRune("-_./", r)) {
+				return fmt.Errorf("%q: literal %q may only hold letters, digits, '-', '_', '.' and '/'", string(t), r)
+			}
+		}
+	}
+	if !unique {
+		return fmt.Errorf("%q: needs {uuid} or a full {sha256} so that two uploads cannot share a key", string(t))
+	}
+	if !strings.HasSuffix(string(t), ".{ext}") {
+		return fmt.Errorf("%q: must end in .{ext}", string(t))
+	}
+	if strings.HasPrefix(string(t), "/") || strings.Contains(string(t), "//") {
+		return fmt.Errorf("%q: must be a relative key without empty segments", string(t))
+	}
+	for _, seg := range strings.Split(string(t), "/") {
+		if seg == "." || seg == ".." {
+			return fmt.Errorf("%q: must not contain '.' or '..' segments", string(t))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,56 @@
+package config
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestKeyTemplateExpand(t *testing.T) {
+	v := KeyValues{
+		Time:   time.Date(2026, 3, 7, 23, 30, 0, 0, time.FixedZone("UTC+3", 3*3600)),
+		UUID:   "3f2b8c1e-9a4d-4c7e-8f10-2b3c4d5e6f70",
+		SHA256: strings.Repeat("ab", 32),
+		Ext:    "png",
+	}
+	for tpl, want := range map[KeyTemplate]string{
+		"{yyyy}/{mm}/{dd}/{uuid}.{ext}":   "2026/03/07/3f2b8c1e-9a4d-4c7e-8f10-2b3c4d5e6f70.png", // the date is UTC
+		"{sha256:2}/{sha256}.{ext}":       "ab/" + strings.Repeat("ab", 32) + ".png",
+		"uploads/{sha256:4}-{uuid}.{ext}": "uploads/abab-3f2b8c1e-9a4d-4c7e-8f10-2b3c4d5e6f70.png",
+	} {
+		if err := tpl.validate(); err != nil {
+			t.Fatalf("%s: %v", tpl, err)
+		}
+		if got := tpl.Expand(v); got != want {
+			t.Errorf("%s = %q, want %q", tpl, got, want)
+		}
+	}
+}
+
+func TestKeyTemplateNeedsSHA256(t *testing.T) {
+	if KeyTemplate("{yyyy}/{uuid}.{ext}").NeedsSHA256() {
+		t.Error("a date template asks for the hash")
+	}
+	if !KeyTemplate("{sha256:2}/{uuid}.{ext}").NeedsSHA256() {
+		t.Error("a shard prefix does not ask for the hash")
+	}
+}
+
+func TestKeyTemplateForFallsBackToDefaults(t *testing.T) {
+	loadPolicies(t, `{
+		"defaults": {"key_template": "{yyyy}/{mm}/{uuid}.{ext}"},
+		"buckets": [
+			{"bucket": "media", "key_template": "{sha256:2}/{sha256}.{ext}"},
+			{"bucket": "docs"}
+		]
+	}`)
+	for bucket, want := range map[string]KeyTemplate{
+		"media":    "{sha256:2}/{sha256}.{ext}",
+		"docs":     "{yyyy}/{mm}/{uuid}.{ext}",
+		"no-entry": "{yyyy}/{mm}/{uuid}.{ext}",
+	} {
+		if got := KeyTemplateFor(bucket); got != want {
+			t.Errorf("%s: %q, want %q", bucket, got, want)
+		}
+	}
+}
@@ -0,0 +1,254 @@
+package middleware
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+
+	"github.com/mstgnz/cdn/pkg/config"
+	"github.com/mstgnz/cdn/pkg/observability"
+	"github.com/mstgnz/cdn/service"
+)
+
+// IdempotencyKeyHeader is the request header naming a retryable operation, and
+// IdempotentReplayedHeader marks a response that was answered from the store.
+const (
+	IdempotencyKeyHeader     = "Idempotency-Key"
+	IdempotentReplayedHeader = "Idempotent-Replayed"
+)
+
+// maxIdempotencyKeyLen bounds the key a client may send. UUIDs and ULIDs fit
+// with room to spare; anything longer is more likely a mistake than a key.
+const maxIdempotencyKeyLen = 255
+
+// idempotencyRecord is what is kept per key: the fingerprint of the request
+// that claimed it and, once that request finished, the response it got.
+type idempotencyRecord struct {
+	Fingerprint string `json:"fingerprint"`
+	Done        bool   `json:"done"`
+	Status      int    `json:"status,omitempty"`
+	ContentType string `json:"content_type,omitempty"`
+	Body        []byte `json:"body,omitempty"`
+}
+
+// Idempotency makes the upload endpoints safe to retry.
+//
+// Every upload mints a fresh object name, so a client that timed out and tried
+// again, which is what mobile clients do on every flaky connection, stored the
+// same file twice and only ever learned about the second copy. With an
+// Idempotency-Key the first request's response is kept in Redis for
+// IDEMPOTENCY_TTL_HOURS (default 24), and a retry with the same key and the
+// same request gets that response back, with Idempotent-Replayed: true, instead
+// of a second upload.
+//
+// Keys are scoped per principal, so two tenants choosing the same key never
+// see each other's responses. Reusing a key for a different request is refused
+// with 422 IDEMPOTENCY_KEY_REUSED rather than answered with the wrong
+// response, and a retry that arrives while the first request is still running
+// gets 409 IDEMPOTENCY_IN_PROGRESS, since running it too is exactly the
+// duplicate this exists to prevent. A claim whose request never finishes, a
+// crashed replica say, lapses after IDEMPOTENCY_LOCK_SECONDS (default 300).
+//
+// Responses of 500 and above are not kept: they describe this server at that
+// moment, not the request, and the retry deserves a real attempt. Neither is
+// anything when Redis is unavailable; the request then runs as if it had no
+// key, because refusing uploads over a cache outage is the worse failure.
+//
+// It must run after the auth middleware, whose principal it scopes keys to.
+func Idempotency(cache service.CacheService) fiber.Handler {
+	ttl := time.Duration(config.GetEnvAsIntOrDefault("IDEMPOTENCY_TTL_HOURS", 24)) * time.Hour
+	lock := time.Duration(config.GetEnvAsIntOrDefault("IDEMPOTENCY_LOCK_SECONDS", 300)) * time.Second
+	log := observability.Logger()
+
+	return func(c *fiber.Ctx) error {
+		key := c.Get(IdempotencyKeyHeader)
+		if key == "" || cache == nil || ttl <= 0 {
+			return c.Next()
+		}
+		if !validIdempotencyKey(key) {
+			return service.Response(c, fiber.StatusBadRequest, false, "Idempotency-Key must be 1 to 255 printable ASCII characters", map[string]string{
+				"code": "INVALID_IDEMPOTENCY_KEY",
+			})
+		}
+
+		fingerprint, err := requestFingerprint(c)
+		if err != nil {
+			return service.Response(c, fiber.StatusBadRequest, false, "Invalid form data", nil)
+		}
+		storeKey := idempotencyStoreKey(service.PrincipalFrom(c), key)
+
+		claim, _ := json.Marshal(idempotencyRecord{Fingerprint: fingerprint})
+		claimed, err := cache.SetNX(storeKey, claim, lock)
+		if err != nil {
+			log.Warn().Err(err).Msg("idempotency: store unavailable; running the request without its key")
+			observability.IdempotencyRequests.WithLabelValues("unavailable").Inc()
+			return c.Next()
+		}
+		if !claimed {
+			return replay(c, cache, storeKey, fingerprint)
+		}
+
+		if err := c.Next(); err != nil {
+			_ = cache.Delete(storeKey)
+			return err
+		}
+
+		status := c.Response().StatusCode()
+		if status >= fiber.StatusInternalServerError {
+			_ = cache.Delete(storeKey)
+			observability.IdempotencyRequests.WithLabelValues("not_stored").Inc()
+			return nil
+		}
+		record, _ := json.Marshal(idempotencyRecord{
+			Fingerprint: fingerprint,
+			Done:        true,
+			Status:      status,
+			ContentType: string(c.Response().Header.ContentType()),
+			Body:        c.Response().Body(),
+		})
+		if err := cache.Set(storeKey, record, ttl); err != nil {
+			// The upload happened; only the retry protection is lost. Dropping
+			// the claim lets a retry run rather than wait out the lock.
+			_ = cache.Delete(storeKey)
+			log.Warn().Err(err).Msg("idempotency: could not store the response")
+			observability.IdempotencyRequests.WithLabelValues("not_stored").Inc()
+			return nil
+		}
+		observability.IdempotencyRequests.WithLabelValues("stored").Inc()
+		return nil
+	}
+}
+
+// replay answers a request whose key was already claimed.
+func replay(c *fiber.Ctx, cache service.CacheService, storeKey, fingerprint string) error {
+	raw, err := cache.Get(storeKey)
+	var record idempotencyRecord
+	if err == nil {
+		err = json.Unmarshal(raw, &record)
+	}
+	if errors.Is(err, service.ErrCacheMiss) {
+		// The claim lapsed between the two calls. Rare enough that asking the
+		// client to retry is simpler than racing for it again.
+		return inProgress(c)
+	}
+	if err != nil {
+		return service.Response(c, fiber.StatusServiceUnavailable, false, "could not read the stored response for this Idempotency-Key", nil)
+	}
+	if record.Fingerprint != fingerprint {
+		observability.IdempotencyRequests.WithLabelValues("mismatch").Inc()
+		return service.Response(c, fiber.StatusUnprocessableEntity, false, "Idempotency-Key was already used for a different request", map[string]string{
+			"code": "IDEMPOTENCY_KEY_REUSED",
+		})
+	}
+	if !record.Done {
+		return inProgress(c)
+	}
+
+	observability.IdempotencyRequests.WithLabelValues("replayed").Inc()
+	c.Set(IdempotentReplayedHeader, "true")
+	if record.ContentType != "" {
+		c.Set(fiber.HeaderContentType, record.ContentType)
+	}
+	return c.Status(record.Status).Send(record.Body)
+}
+
+func inProgress(c *fiber.Ctx) error {
+	observability.IdempotencyRequests.WithLabelValues("in_progress").Inc()
+	c.Set(fiber.HeaderRetryAfter, "1")
+	return service.Response(c, fiber.StatusConflict, false, "a request with this Idempotency-Key is still in progress", map[string]string{
+		"code": "IDEMPOTENCY_IN_PROGRESS",
+	})
+}
+
+func validIdempotencyKey(key string) bool {
+	if len(key) > maxIdempotencyKeyLen {
+		return false
+	}
+	for i := 0; i < len(key); i++ {
+		if key[i] < 0x21 || key[i] > 0x7e {
+			return false
+		}
+	}
+	return true
+}
+
+// idempotencyStoreKey is the Redis key for one principal's key. Both parts are
+// hashed, so whatever a client puts in the header cannot reach outside the
+// namespace or collide with another principal's.
+func idempotencyStoreKey(p service.Principal, key string) string {
+	scope := "general"
+	if p.Scoped {
+		scope = "bucket:" + p.Bucket
+	}
+	sum := sha256.Sum256([]byte(scope + "\x00" + key))
+	return service.CacheNamespace() + ":idempotency:" + hex.EncodeToString(sum[:])
+}
+
+// requestFingerprint identifies a request by what it asks for, so a retry
+// matches its original and a different request under the same key does not.
+//
+// A multipart body is fingerprinted by its fields and the contents of its
+// files rather than by its bytes: the boundary is random, and a client that
+// rebuilds the form to retry sends a different one every time. Anything else
+// is fingerprinted by its raw body.
+func requestFingerprint(c *fiber.Ctx) (string, error) {
+	h := sha256.New()
+	write := func(parts ...string) {
+		for _, part := range parts {
+			h.Write([]byte(strconv.Itoa(len(part))))
+			h.Write([]byte{':'})
+			h.Write([]byte(part))
+		}
+	}
+	write(c.Method(), c.Path())
+
+	if !strings.HasPrefix(string(c.Request().Header.ContentType()), fiber.MIMEMultipartForm) {
+		write("body")
+		h.Write(c.Body())
+		return hex.EncodeToString(h.Sum(nil)), nil
+	}
+	form, err := c.MultipartForm()
+	if err != nil {
+		return "", err
+	}
+
+	names := make([]string, 0, len(form.Value))
+	for name := range form.Value {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		write("value", name)
+		write(form.Value[name]...)
+	}
+
+	names = names[:0]
+	for name := range form.File {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		for _, file := range form.File[name] {
+			f, err := file.Open()
+			if err != nil {
+				return "", err
+			}
+			sum := sha256.New()
+			_, err = io.Copy(sum, f)
+			_ = f.Close()
+			if err != nil {
+				return "", err
+			}
+			write("file", name, file.Filename, hex.EncodeToString(sum.Sum(nil)))
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
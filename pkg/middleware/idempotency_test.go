@@ -0,0 +1,206 @@
+package middleware
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+
+	"github.com/mstgnz/cdn/service"
+)
+
+// memCache is the slice of the cache the idempotency store uses, in memory.
+type memCache struct {
+	service.CacheService
+	mu     sync.Mutex
+	values map[string][]byte
+}
+
+func newMemCache() *memCache { return &memCache{values: map[string][]byte{}} }
+
+func (m *memCache) Get(key string) ([]byte, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	v, ok := m.values[key]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", service.ErrCacheMiss, key)
+	}
+	return v, nil
+}
+
+func (m *memCache) Set(key string, value []byte, _ time.Duration) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.values[key] = value
+	return nil
+}
+
+func (m *memCache) SetNX(key string, value []byte, _ time.Duration) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.values[key]; ok {
+		return false, nil
+	}
+	m.values[key] = value
+	return true, nil
+}
+
+func (m *memCache) Delete(key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.values, key)
+	return nil
+}
+
+// idempotentApp serves /upload behind the middleware, as the principal named
+// by the X-Test-Bucket header, and counts how often the upload really ran.
+func idempotentApp(cache service.CacheService, status int) (*fiber.App, *int) {
+	runs := 0
+	app := fiber.New()
+	app.Post("/upload", func(c *fiber.Ctx) error {
+		if b := c.Get("X-Test-Bucket"); b != "" {
+			service.StorePrincipal(c, service.Principal{Scoped: true, Bucket: b})
+		}
+		return c.Next()
+	}, Idempotency(cache), func(c *fiber.Ctx) error {
+		runs++
+		return c.Status(status).JSON(fiber.Map{"run": runs, "name": c.FormValue("name")})
+	})
+	return app, &runs
+}
+
+// send posts a multipart upload. multipart.NewWriter picks a fresh random
+// boundary every time, as a client rebuilding its form for a retry would.
+func send(t *testing.T, app *fiber.App, key, bucket, name, content string) (int, string, bool) {
+	t.Helper()
+	var body bytes.Buffer
+	w := multipart.NewWriter(&body)
+	_ = w.WriteField("name", name)
+	part, _ := w.CreateFormFile("file", "a.txt")
+	_, _ = part.Write([]byte(content))
+	_ = w.Close()
+	req := httptest.NewRequest(fiber.MethodPost, "/upload", &body)
+	req.Header.Set(fiber.HeaderContentType, w.FormDataContentType())
+	if key != "" {
+		req.Header.Set(IdempotencyKeyHeader, key)
+	}
+	if bucket != "" {
+		req.Header.Set("X-Test-Bucket", bucket)
+	}
+	resp, err := app.Test(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw, _ := io.ReadAll(resp.Body)
+	return resp.StatusCode, string(raw), resp.Header.Get(IdempotentReplayedHeader) == "true"
+}
+
+// A retry with the same key and the same form, under a new boundary, gets the
+// first response back and the upload does not run again.
+func TestIdempotencyReplaysTheFirstResponse(t *testing.T) {
+	app, runs := idempotentApp(newMemCache(), fiber.StatusCreated)
+
+	status, first, replayed := send(t, app, "k-1", "", "cat", "bytes")
+	if status != fiber.StatusCreated || replayed {
+		t.Fatalf("first = %d %s replayed=%v", status, first, replayed)
+	}
+	status, second, replayed := send(t, app, "k-1", "", "cat", "bytes")
+	if status != fiber.StatusCreated || !replayed || second != first {
+		t.Fatalf("retry = %d %s replayed=%v, want %s", status, second, replayed, first)
+	}
+	if *runs != 1 {
+		t.Fatalf("upload ran %d times", *runs)
+	}
+
+	send(t, app, "", "", "cat", "bytes")
+	send(t, app, "", "", "cat", "bytes")
+	if *runs != 3 {
+		t.Fatalf("requests without a key were deduplicated: %d runs", *runs)
+	}
+}
+
+func TestIdempotencyRefusesAReusedKey(t *testing.T) {
+	app, runs := idempotentApp(newMemCache(), fiber.StatusCreated)
+	send(t, app, "k-1", "", "cat", "bytes")
+
+	for _, change := range [][2]string{{"dog", "bytes"}, {"cat", "other bytes"}} {
+		status, body, _ := send(t, app, "k-1", "", change[0], change[1])
+		var got struct {
+			Data map[string]string `json:"data"`
+		}
+		_ = json.Unmarshal([]byte(body), &got)
+		if status != fiber.StatusUnprocessableEntity || got.Data["code"] != "IDEMPOTENCY_KEY_REUSED" {
+			t.Fatalf("changed %v: %d %s", change, status, body)
+		}
+	}
+	if *runs != 1 {
+		t.Fatalf("upload ran %d times", *runs)
+	}
+}
+
+// Keys belong to the principal: the same key from another bucket's token is
+// another request.
+func TestIdempotencyKeysArePerPrincipal(t *testing.T) {
+	app, runs := idempotentApp(newMemCache(), fiber.StatusCreated)
+	send(t, app, "k-1", "photos", "cat", "bytes")
+	if _, _, replayed := send(t, app, "k-1", "docs", "cat", "bytes"); replayed {
+		t.Fatal("one principal was answered with another's response")
+	}
+	if *runs != 2 {
+		t.Fatalf("upload ran %d times", *runs)
+	}
+}
+
+func TestIdempotencyWhileTheFirstRequestRuns(t *testing.T) {
+	cache := newMemCache()
+	app, runs := idempotentApp(cache, fiber.StatusCreated)
+
+	// Claim the key with this exact request's fingerprint, as a request still
+	// in flight would have.
+	send(t, app, "k-1", "", "cat", "bytes")
+	for k, v := range cache.values {
+		var rec idempotencyRecord
+		_ = json.Unmarshal(v, &rec)
+		claim, _ := json.Marshal(idempotencyRecord{Fingerprint: rec.Fingerprint})
+		cache.values[k] = claim
+	}
+
+	status, body, _ := send(t, app, "k-1", "", "cat", "bytes")
+	if status != fiber.StatusConflict || !strings.Contains(body, "IDEMPOTENCY_IN_PROGRESS") {
+		t.Fatalf("in flight = %d %s", status, body)
+	}
+	if *runs != 1 {
+		t.Fatalf("upload ran %d times", *runs)
+	}
+}
+
+// A server error is not the answer to the request, so a retry runs it again.
+func TestIdempotencyDoesNotKeepServerErrors(t *testing.T) {
+	cache := newMemCache()
+	app, runs := idempotentApp(cache, fiber.StatusServiceUnavailable)
+	send(t, app, "k-1", "", "cat", "bytes")
+	send(t, app, "k-1", "", "cat", "bytes")
+	if *runs != 2 || len(cache.values) != 0 {
+		t.Fatalf("runs=%d stored=%d", *runs, len(cache.values))
+	}
+}
+
+func TestIdempotencyRejectsMalformedKeys(t *testing.T) {
+	app, runs := idempotentApp(newMemCache(), fiber.StatusCreated)
+	for _, key := range []string{"has space", strings.Repeat("k", 256)} {
+		if status, _, _ := send(t, app, key, "", "cat", "bytes"); status != fiber.StatusBadRequest {
+			t.Errorf("key %q: status %d", key, status)
+		}
+	}
+	if *runs != 0 {
+		t.Fatalf("upload ran %d times", *runs)
+	}
+}
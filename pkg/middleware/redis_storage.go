@@ -1,6 +1,7 @@
 package middleware
 
 import (
+	"context"
 	"errors"
 	"regexp"
 	"strings"
@@ -27,6 +28,13 @@ func sanitizeKey(key string) string {
 	return key
 }
 
+// rateLimitPrefix keeps the limiter's counters in their own part of the cache
+// namespace, so Reset can clear them without touching anything else and a purge
+// of derived images can never reset anybody's rate limit.
+func rateLimitPrefix() string {
+	return service.CacheNamespace() + ":ratelimit:"
+}
+
 // RedisStorage implements fiber.Storage interface for Redis
 type RedisStorage struct {
 	cache service.CacheService
@@ -49,7 +57,7 @@ func NewRedisStorage() (*RedisStorage, error) {
 // by definition: passing the miss up as an error both violated the contract and
 // meant every rate-limited request produced a log line.
 func (r *RedisStorage) Get(key string) ([]byte, error) {
-	val, err := r.cache.Get(sanitizeKey(key))
+	val, err := r.cache.Get(rateLimitPrefix() + sanitizeKey(key))
 	if errors.Is(err, service.ErrCacheMiss) {
 		return nil, nil
 	}
@@ -58,17 +66,19 @@ func (r *RedisStorage) Get(key string) ([]byte, error) {
 
 // Set stores a value in Redis
 func (r *RedisStorage) Set(key string, val []byte, exp time.Duration) error {
-	return r.cache.Set(sanitizeKey(key), val, exp)
+	return r.cache.Set(rateLimitPrefix()+sanitizeKey(key), val, exp)
 }
 
 // Delete removes a value from Redis
 func (r *RedisStorage) Delete(key string) error {
-	return r.cache.Delete(sanitizeKey(key))
+	return r.cache.Delete(rateLimitPrefix() + sanitizeKey(key))
 }
 
-// Reset clears all values from Redis
+// Reset clears the limiter's own keys. It used to call FLUSHALL, which took the
+// cached images and anything else sharing the Redis database with it.
 func (r *RedisStorage) Reset() error {
-	return r.cache.FlushAll()
+	_, err := r.cache.DeletePrefix(context.Background(), rateLimitPrefix())
+	return err
 }
 
 // Close closes the Redis connection
@@ -1,6 +1,7 @@
 package middleware
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"testing"
@@ -19,12 +20,18 @@ type stubCache struct {
 func (s stubCache) Get(string) ([]byte, error)              { return s.val, s.err }
 func (s stubCache) Set(string, []byte, time.Duration) error { return nil }
 func (s stubCache) Delete(string) error                     { return nil }
-func (s stubCache) FlushAll() error                         { return nil }
 func (s stubCache) Close() error                            { return nil }
+func (s stubCache) SetNX(string, []byte, time.Duration) (bool, error) {
+	return true, nil
+}
 func (s stubCache) GetResizedImage(string, string, uint, uint) ([]byte, error) {
 	return nil, nil
 }
 func (s stubCache) SetResizedImage(string, string, uint, uint, []byte) error { return nil }
+func (s stubCache) PurgeVariants(context.Context, service.PurgeScope) (int, error) {
+	return 0, nil
+}
+func (s stubCache) DeletePrefix(context.Context, string) (int, error) { return 0, nil }
 
 // fiber's Storage contract says a missing key is (nil, nil), not an error. This
 // adapter backs the rate limiter, where the first request from any client IP is
@@ -65,3 +72,29 @@ func TestRedisStorageReturnsHitValue(t *testing.T) {
 		t.Fatalf("want cached, got %q", val)
 	}
 }
+
+// resetRecorder captures what Reset asks the cache to delete.
+type resetRecorder struct {
+	stubCache
+	prefixes *[]string
+}
+
+func (r resetRecorder) DeletePrefix(_ context.Context, prefix string) (int, error) {
+	*r.prefixes = append(*r.prefixes, prefix)
+	return 0, nil
+}
+
+// Reset used to FLUSHALL, which also dropped every cached image. It has to stay
+// inside the limiter's own namespace.
+func TestRedisStorageResetOnlyClearsLimiterKeys(t *testing.T) {
+	t.Setenv("CACHE_KEY_PREFIX", "cdn-test")
+	var prefixes []string
+	s := &RedisStorage{cache: resetRecorder{prefixes: &prefixes}}
+
+	if err := s.Reset(); err != nil {
+		t.Fatalf("Reset: %v", err)
+	}
+	if len(prefixes) != 1 || prefixes[0] != "cdn-test:ratelimit:" {
+		t.Fatalf("Reset deleted %q, want only the limiter prefix", prefixes)
+	}
+}
@@ -172,6 +172,41 @@ var (
 		[]string{"operation"},
 	)
 
+	// In-process tier in front of the Redis variant cache. Kept apart from the
+	// cache_* families above so a RAM hit is never mistaken for a Redis one.
+	MemoryCacheRequests = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "cdn_memory_cache_requests_total",
+			Help: "Lookups in the in-process variant cache, by result (hit, miss)",
+		},
+		[]string{"result"},
+	)
+
+	MemoryCacheBytes = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "cdn_memory_cache_bytes",
+			Help: "Bytes currently held by the in-process variant cache",
+		},
+	)
+
+	MemoryCacheEvictions = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "cdn_memory_cache_evictions_total",
+			Help: "Entries removed from the in-process variant cache, by reason (budget, expired, purged)",
+		},
+		[]string{"reason"},
+	)
+
+	// Negative lookups: objects found in neither tier, remembered briefly so a
+	// scanner's random keys stop costing one archive request each.
+	NegativeCacheSaved = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "cdn_negative_cache_archive_lookups_saved_total",
+			Help: "Archive lookups skipped because the object was recently found missing, by layer (memory, redis)",
+		},
+		[]string{"layer"},
+	)
+
 	// Circuit Breaker metrics
 	CircuitBreakerState = promauto.NewGaugeVec(
 		prometheus.GaugeOpts{
@@ -204,6 +239,80 @@ var (
 		},
 		[]string{"name", "result"},
 	)
+
+	// Upstream purge metrics. Counted per object, not per webhook call, so the
+	// number reads as "URLs still cached upstream that should not be".
+	UpstreamPurgeFailures = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "cdn_upstream_purge_failures_total",
+			Help: "Objects whose upstream cache purge was not delivered, by reason (dropped, rejected, exhausted)",
+		},
+		[]string{"reason"},
+	)
+
+	// IdempotencyRequests counts upload requests that carried an
+	// Idempotency-Key, by what became of them (stored, replayed, in_progress,
+	// mismatch, not_stored, unavailable).
+	IdempotencyRequests = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "cdn_idempotency_requests_total",
+			Help: "Upload requests with an Idempotency-Key, by outcome",
+		},
+		[]string{"outcome"},
+	)
+
+	// Background job metrics. Submitted and finished are counted separately so
+	// the difference reads as the backlog.
+	JobsSubmitted = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "cdn_jobs_submitted_total",
+			Help: "Background jobs accepted, by kind",
+		},
+		[]string{"kind"},
+	)
+
+	JobsFinished = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "cdn_jobs_finished_total",
+			Help: "Background jobs finished, by kind and final state (succeeded, failed)",
+		},
+		[]string{"kind", "state"},
+	)
+
+	JobCallbacks = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "cdn_job_callbacks_total",
+			Help: "Job completion callbacks, by outcome (delivered, failed)",
+		},
+		[]string{"outcome"},
+	)
+
+	// Malware scanning. Verdicts are counted per file scanned; bypassed counts
+	// the files a fail_open bucket stored unscanned because clamd could not
+	// answer, which is the number to alert on.
+	MalwareScans = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "cdn_malware_scans_total",
+			Help: "Files sent to the malware scanner, by verdict (clean, infected, error)",
+		},
+		[]string{"verdict"},
+	)
+
+	MalwareScanDuration = promauto.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "cdn_malware_scan_duration_seconds",
+			Help:    "Time to scan one file, by verdict",
+			Buckets: []float64{.01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30},
+		},
+		[]string{"verdict"},
+	)
+
+	MalwareScanBypassed = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "cdn_malware_scan_bypassed_total",
+			Help: "Uploads stored unscanned because the scanner failed and their bucket fails open",
+		},
+	)
 )
 
 // MetricsHandler exposes the Prometheus metrics in the standard exposition
@@ -2,6 +2,7 @@ package validator
 
 import (
 	"fmt"
+	"math"
 	"mime/multipart"
 	"path/filepath"
 	"strings"
@@ -115,16 +116,40 @@ func (e *FileValidationError) Error() string {
 	return fmt.Sprintf("%s: %s", e.Code, e.Message)
 }
 
-// ValidateFile performs file validation
-func ValidateFile(file *multipart.FileHeader) error {
+// ValidateFile performs file validation: the process-wide size and extension
+// checks, then those of the upload policy of bucket, the bucket the file is
+// going to. See policy.go.
+func ValidateFile(file *multipart.FileHeader, bucket string) error {
+	return ValidateFileUpTo(file, bucket, int64(config.GetEnvAsIntOrDefault("MAX_FILE_SIZE", int(DefaultMaxFileSize))))
+}
+
+// ValidateFileUpTo is ValidateFile with maxSize in place of MAX_FILE_SIZE, for
+// uploads that never pass through the API's body limit.
+func ValidateFileUpTo(file *multipart.FileHeader, bucket string, maxSize int64) error {
+	if err := validateFileGlobal(file, maxSize); err != nil {
+		return err
+	}
+	return validateNameFor(bucket, file.Filename, file.Size)
+}
+
+// ValidateName is ValidateFile without any size limit, for a file whose size
+// was accepted when it was stored, as an object copied within its bucket was.
+// The name is new, so the extension checks still apply.
+func ValidateName(filename, bucket string) error {
+	if err := validateFileGlobal(&multipart.FileHeader{Filename: filename}, math.MaxInt64); err != nil {
+		return err
+	}
+	return ValidateExtensionFor(bucket, filename)
+}
+
+func validateFileGlobal(file *multipart.FileHeader, maxSize int64) error {
 	// Check if file validation is enabled
 	if !config.GetEnvAsBoolOrDefault("VALIDATE_FILE", true) {
 		return nil
 	}
 
 	// File size check
-	maxSize := config.GetEnvAsIntOrDefault("MAX_FILE_SIZE", int(DefaultMaxFileSize))
-	if file.Size > int64(maxSize) {
+	if file.Size > maxSize {
 		return &FileValidationError{
 			Code:    "FILE_TOO_LARGE",
 			Message: fmt.Sprintf("File size is too large. Maximum: %d bytes", maxSize),
@@ -198,6 +223,13 @@ func isValidFileContent(content []byte) bool {
 		return isValidUTF8Text(content)
 	}
 
+	return matchesSignature(content) || isValidUTF8Text(content)
+}
+
+// matchesSignature reports whether content opens with the signature of one of
+// the binary formats on the allowlist. Only the first 12 bytes are ever looked
+// at, which is what lets ContentValidator decide on a stream's head.
+func matchesSignature(content []byte) bool {
 	// mp4, mov, 3gp, heic, heif and avif are all ISO base media files, and none of
 	// them has a fixed signature at offset 0. What identifies them is the literal
 	// "ftyp" at offset 4; the four bytes before it are that box's *length*, which
@@ -244,8 +276,9 @@ func isValidFileContent(content []byte) bool {
 		}
 	}
 
-	// If no magic number matches, check if it's valid UTF-8 text (for SQL files)
-	return isValidUTF8Text(content)
+	// If no magic number matches, the caller checks for UTF-8 text (for SQL
+	// files)
+	return false
 }
 
 // isISOBaseMedia reports whether content is an ISO base media file (ISO/IEC
@@ -169,7 +169,7 @@ func TestValidateFileAcceptsSupportedExtensions(t *testing.T) {
 
 	for _, tc := range cases {
 		t.Run(tc.filename+" as "+tc.contentType, func(t *testing.T) {
-			if err := ValidateFile(header(tc.filename, tc.contentType, 1024)); err != nil {
+			if err := ValidateFile(header(tc.filename, tc.contentType, 1024), ""); err != nil {
 				t.Fatalf("a supported upload was rejected: %v", err)
 			}
 		})
@@ -184,7 +184,7 @@ func TestValidateFileRejectsDangerousExtensions(t *testing.T) {
 		"tool.exe", "config.xml", "note.txt", "data.json",
 	} {
 		t.Run(filename, func(t *testing.T) {
-			err := ValidateFile(header(filename, "application/octet-stream", 1024))
+			err := ValidateFile(header(filename, "application/octet-stream", 1024), "")
 			if err == nil {
 				t.Fatalf("%s was accepted by the extension allowlist", filename)
 			}
@@ -198,10 +198,10 @@ func TestValidateFileRejectsDangerousExtensions(t *testing.T) {
 // A double extension has to be judged on the last one, since that is what a
 // server or browser would act on.
 func TestValidateFileJudgesTheFinalExtension(t *testing.T) {
-	if err := ValidateFile(header("invoice.pdf.php", "application/pdf", 1024)); err == nil {
+	if err := ValidateFile(header("invoice.pdf.php", "application/pdf", 1024), ""); err == nil {
 		t.Fatal("invoice.pdf.php was accepted; only the final extension counts")
 	}
-	if err := ValidateFile(header("archive.php.zip", "application/zip", 1024)); err != nil {
+	if err := ValidateFile(header("archive.php.zip", "application/zip", 1024), ""); err != nil {
 		t.Fatalf("archive.php.zip should be judged on .zip: %v", err)
 	}
 }
@@ -209,11 +209,11 @@ func TestValidateFileJudgesTheFinalExtension(t *testing.T) {
 // Case is not a way around the allowlist.
 func TestValidateFileIgnoresExtensionCase(t *testing.T) {
 	for _, filename := range []string{"REPORT.DOCX", "Data.Csv", "BUNDLE.Zip"} {
-		if err := ValidateFile(header(filename, "application/octet-stream", 1024)); err != nil {
+		if err := ValidateFile(header(filename, "application/octet-stream", 1024), ""); err != nil {
 			t.Errorf("%s was rejected: %v", filename, err)
 		}
 	}
-	if err := ValidateFile(header("SHELL.PHP", "application/octet-stream", 1024)); err == nil {
+	if err := ValidateFile(header("SHELL.PHP", "application/octet-stream", 1024), ""); err == nil {
 		t.Error("SHELL.PHP was accepted")
 	}
 }
@@ -222,7 +222,7 @@ func TestValidateFileIgnoresExtensionCase(t *testing.T) {
 func TestValidateFileRejectsOversizedUpload(t *testing.T) {
 	t.Setenv("MAX_FILE_SIZE", "1024")
 
-	err := ValidateFile(header("big.pdf", "application/pdf", 2048))
+	err := ValidateFile(header("big.pdf", "application/pdf", 2048), "")
 	if err == nil {
 		t.Fatal("an oversized upload was accepted")
 	}
@@ -236,7 +236,7 @@ func TestValidateFileRejectsOversizedUpload(t *testing.T) {
 func TestValidationCanBeDisabled(t *testing.T) {
 	t.Setenv("VALIDATE_FILE", "false")
 
-	if err := ValidateFile(header("shell.php", "application/x-httpd-php", 1024)); err != nil {
+	if err := ValidateFile(header("shell.php", "application/x-httpd-php", 1024), ""); err != nil {
 		t.Errorf("extension check still ran with VALIDATE_FILE=false: %v", err)
 	}
 	if err := ValidateFileContent([]byte{0x7F, 0x45, 0x4C, 0x46, 0x00}); err != nil {
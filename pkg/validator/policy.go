@@ -0,0 +1,199 @@
+package validator
+
+import (
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/mstgnz/cdn/pkg/config"
+)
+
+// The bucket upload policies of config.UploadPolicy are enforced here, in three
+// places because what they limit becomes known at three different times: the
+// name and declared size when the upload is announced (ValidateFile), the
+// bytes once they are read (ValidateContentFor, or ValidateMimeFor on a
+// stream's head), and the pixels once an image is decoded (ValidateImageFor).
+//
+// Unlike the process-wide checks they do not switch off with
+// VALIDATE_FILE=false. That switch exists for deployments whose callers are
+// trusted; a bucket policy is the operator saying what one bucket is for, and
+// nothing a caller does should get around it.
+
+// CheckUploadPolicies refuses policies that could never accept what they list:
+// an extension the global allowlist does not have would be refused before the
+// bucket policy is even asked. Call it at boot, after the policy file is
+// loaded.
+func CheckUploadPolicies() error {
+	policies := config.UploadPolicies()
+	names := make([]string, 0, len(policies))
+	for name := range policies {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		for _, ext := range policies[name].Extensions {
+			if !AllowedFileFormats[normalizeExt(ext)] {
+				return fmt.Errorf("bucket policy %s: upload extension %q is not on the global allowlist", name, ext)
+			}
+		}
+	}
+	return nil
+}
+
+// validateNameFor applies a bucket's extension and byte limits to an
+// announced upload.
+func validateNameFor(bucket, filename string, size int64) error {
+	if err := ValidateExtensionFor(bucket, filename); err != nil {
+		return err
+	}
+	if policy := config.UploadPolicyFor(bucket); policy != nil {
+		return validateSizeFor(policy, size)
+	}
+	return nil
+}
+
+// ValidateExtensionFor checks filename's extension against the bucket's, for
+// an upload whose name is only decided once it is read, as a URL import's is.
+func ValidateExtensionFor(bucket, filename string) error {
+	policy := config.UploadPolicyFor(bucket)
+	if policy == nil || len(policy.Extensions) == 0 {
+		return nil
+	}
+	ext := strings.ToLower(filepath.Ext(filename))
+	for _, e := range policy.Extensions {
+		if normalizeExt(e) == ext {
+			return nil
+		}
+	}
+	return &FileValidationError{
+		Code:    "INVALID_FILE_FORMAT",
+		Message: fmt.Sprintf("This bucket does not accept %s files. Allowed formats: %s", extOrNone(ext), strings.Join(policy.Extensions, ", ")),
+	}
+}
+
+func validateSizeFor(policy *config.UploadPolicy, size int64) error {
+	if policy.MaxBytes > 0 && size > policy.MaxBytes {
+		return &FileValidationError{
+			Code:    "FILE_TOO_LARGE",
+			Message: fmt.Sprintf("File size is too large for this bucket. Maximum: %d bytes", policy.MaxBytes),
+		}
+	}
+	if policy.MinBytes > 0 && size < policy.MinBytes {
+		return &FileValidationError{
+			Code:    "FILE_TOO_SMALL",
+			Message: fmt.Sprintf("File size is too small for this bucket. Minimum: %d bytes", policy.MinBytes),
+		}
+	}
+	return nil
+}
+
+// ValidateContentFor is ValidateFileContent plus ValidateBytesFor, for an
+// upload whose bytes are all in memory.
+func ValidateContentFor(bucket string, content []byte) error {
+	if err := ValidateFileContent(content); err != nil {
+		return err
+	}
+	return ValidateBytesFor(bucket, content)
+}
+
+// ValidateBytesFor holds content to the bucket's byte limits and MIME types
+// alone, for a path that does its own content checks.
+func ValidateBytesFor(bucket string, content []byte) error {
+	policy := config.UploadPolicyFor(bucket)
+	if policy == nil {
+		return nil
+	}
+	if err := validateSizeFor(policy, int64(len(content))); err != nil {
+		return err
+	}
+	return ValidateMimeFor(bucket, content)
+}
+
+// ValidateMimeFor checks the type sniffed from the start of a file against the
+// bucket's MIME types. head needs to be no longer than http.DetectContentType
+// reads, 512 bytes.
+func ValidateMimeFor(bucket string, head []byte) error {
+	policy := config.UploadPolicyFor(bucket)
+	if policy == nil || len(policy.MimeTypes) == 0 {
+		return nil
+	}
+	sniffed, _, _ := strings.Cut(http.DetectContentType(head), ";")
+	for _, allowed := range policy.MimeTypes {
+		if family, ok := strings.CutSuffix(allowed, "/*"); (ok && strings.HasPrefix(sniffed, family+"/")) || allowed == sniffed {
+			return nil
+		}
+	}
+	return &FileValidationError{
+		Code:    "INVALID_MIME_TYPE",
+		Message: fmt.Sprintf("This bucket does not accept %s content. Allowed types: %s", sniffed, strings.Join(policy.MimeTypes, ", ")),
+	}
+}
+
+// ValidateImageFor checks a decoded image's size against the bucket's pixel
+// and aspect ratio limits. Zero dimensions mean the size is not known (an SVG),
+// and pass.
+func ValidateImageFor(bucket string, width, height uint) error {
+	policy := config.UploadPolicyFor(bucket)
+	if policy == nil || width == 0 || height == 0 {
+		return nil
+	}
+	if (policy.MinWidth > 0 && width < policy.MinWidth) || (policy.MinHeight > 0 && height < policy.MinHeight) ||
+		(policy.MaxWidth > 0 && width > policy.MaxWidth) || (policy.MaxHeight > 0 && height > policy.MaxHeight) {
+		return &FileValidationError{
+			Code:    "INVALID_IMAGE_DIMENSIONS",
+			Message: fmt.Sprintf("Image is %dx%d; this bucket accepts %s", width, height, dimensionRange(policy)),
+		}
+	}
+	ratio := float64(width) / float64(height)
+	if (policy.MinAspectRatio > 0 && ratio < policy.MinAspectRatio) || (policy.MaxAspectRatio > 0 && ratio > policy.MaxAspectRatio) {
+		return &FileValidationError{
+			Code:    "INVALID_ASPECT_RATIO",
+			Message: fmt.Sprintf("Image aspect ratio %.4g is outside what this bucket accepts (%s)", ratio, ratioRange(policy)),
+		}
+	}
+	return nil
+}
+
+// ForcedOptimize reports whether the bucket stores every image optimised.
+func ForcedOptimize(bucket string) bool {
+	policy := config.UploadPolicyFor(bucket)
+	return policy != nil && policy.Optimize
+}
+
+func normalizeExt(ext string) string {
+	return "." + strings.ToLower(strings.TrimPrefix(ext, "."))
+}
+
+func extOrNone(ext string) string {
+	if ext == "" {
+		return "extension-less"
+	}
+	return ext
+}
+
+func dimensionRange(p *config.UploadPolicy) string {
+	bound := func(lo, hi uint) string {
+		switch {
+		case lo > 0 && hi > 0:
+			return fmt.Sprintf("%d-%d", lo, hi)
+		case lo > 0:
+			return fmt.Sprintf("at least %d", lo)
+		case hi > 0:
+			return fmt.Sprintf("at most %d", hi)
+		}
+		return "any"
+	}
+	return fmt.Sprintf("width %s, height %s", bound(p.MinWidth, p.MaxWidth), bound(p.MinHeight, p.MaxHeight))
+}
+
+func ratioRange(p *config.UploadPolicy) string {
+	switch {
+	case p.MinAspectRatio > 0 && p.MaxAspectRatio > 0:
+		return fmt.Sprintf("%.4g-%.4g", p.MinAspectRatio, p.MaxAspectRatio)
+	case p.MinAspectRatio > 0:
+		return fmt.Sprintf("at least %.4g", p.MinAspectRatio)
+	}
+	return fmt.Sprintf("at most %.4g", p.MaxAspectRatio)
+}
@@ -0,0 +1,149 @@
+package validator
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/mstgnz/cdn/pkg/config"
+)
+
+// Bucket upload policies only ever narrow the global checks: a bucket without
+// one behaves exactly as before, and one with a policy refuses what the policy
+// leaves out with the same error type the global checks use.
+
+func loadUploadPolicies(t *testing.T, body string) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "buckets.json")
+	if err := os.WriteFile(path, []byte(body), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := config.LoadBucketPolicies(path); err != nil {
+		t.Fatalf("load policies: %v", err)
+	}
+	t.Cleanup(func() { _, _ = config.LoadBucketPolicies(filepath.Join(t.TempDir(), "absent.json")) })
+}
+
+const avatarsAndDocs = `{"buckets": [
+	{"bucket": "avatars", "upload": {
+		"extensions": ["jpg", ".png", "webp"], "mime_types": ["image/*"], "max_bytes": 4096,
+		"min_width": 64, "max_width": 1024, "min_height": 64, "max_height": 1024,
+		"min_aspect_ratio": 0.5, "max_aspect_ratio": 2, "optimize": true
+	}},
+	{"bucket": "docs", "upload": {"extensions": ["pdf"], "mime_types": ["application/pdf"], "min_bytes": 8}}
+]}`
+
+func policyCode(err error) string {
+	if err == nil {
+		return ""
+	}
+	if valErr, ok := err.(*FileValidationError); ok {
+		return valErr.Code
+	}
+	return err.Error()
+}
+
+func TestValidateFileAppliesTheBucketPolicy(t *testing.T) {
+	loadUploadPolicies(t, avatarsAndDocs)
+	cases := []struct {
+		bucket, name string
+		size         int64
+		want         string
+	}{
+		{"avatars", "me.PNG", 2048, ""},
+		{"avatars", "me.gif", 2048, "INVALID_FILE_FORMAT"},
+		{"avatars", "me.jpg", 8192, "FILE_TOO_LARGE"},
+		{"docs", "cv.pdf", 4, "FILE_TOO_SMALL"},
+		{"docs", "cv.docx", 100, "INVALID_FILE_FORMAT"},
+		// No policy: only the global allowlist.
+		{"photos", "me.gif", 2048, ""},
+		// The global allowlist still comes first.
+		{"docs", "cv.exe", 100, "INVALID_FILE_FORMAT"},
+	}
+	for _, tc := range cases {
+		err := ValidateFile(header(tc.name, "application/octet-stream", tc.size), tc.bucket)
+		if got := policyCode(err); got != tc.want {
+			t.Errorf("%s %s (%d bytes): %q, want %q", tc.bucket, tc.name, tc.size, got, tc.want)
+		}
+	}
+}
+
+// The policy does not switch off with VALIDATE_FILE.
+func TestUploadPolicyOutlivesValidateFileFalse(t *testing.T) {
+	loadUploadPolicies(t, avatarsAndDocs)
+	t.Setenv("VALIDATE_FILE", "false")
+	if got := policyCode(ValidateFile(header("me.gif", "image/gif", 10), "avatars")); got != "INVALID_FILE_FORMAT" {
+		t.Errorf("extension: %q", got)
+	}
+	if got := policyCode(ValidateContentFor("docs", []byte("plain text, not a pdf"))); got != "INVALID_MIME_TYPE" {
+		t.Errorf("content: %q", got)
+	}
+}
+
+func TestValidateContentForSniffsTheMimeType(t *testing.T) {
+	loadUploadPolicies(t, avatarsAndDocs)
+	if err := ValidateContentFor("docs", append(pdfSig, "rest of the document"...)); err != nil {
+		t.Errorf("pdf: %v", err)
+	}
+	if got := policyCode(ValidateContentFor("docs", []byte("%PD"))); got != "FILE_TOO_SMALL" {
+		t.Errorf("short file: %q", got)
+	}
+	// A PNG named anything is still image/png, which image/* covers.
+	if err := ValidateMimeFor("avatars", pngSig); err != nil {
+		t.Errorf("png: %v", err)
+	}
+	if got := policyCode(ValidateMimeFor("avatars", pdfSig)); got != "INVALID_MIME_TYPE" {
+		t.Errorf("pdf as an avatar: %q", got)
+	}
+}
+
+func TestValidateImageForChecksPixels(t *testing.T) {
+	loadUploadPolicies(t, avatarsAndDocs)
+	cases := []struct {
+		w, h uint
+		want string
+	}{
+		{256, 256, ""},
+		{32, 32, "INVALID_IMAGE_DIMENSIONS"},
+		{2048, 512, "INVALID_IMAGE_DIMENSIONS"},
+		{1000, 40, "INVALID_IMAGE_DIMENSIONS"},
+		{1000, 400, "INVALID_ASPECT_RATIO"},
+		{100, 300, "INVALID_ASPECT_RATIO"},
+		// Unknown size (an SVG) is not held to pixel limits.
+		{0, 0, ""},
+	}
+	for _, tc := range cases {
+		if got := policyCode(ValidateImageFor("avatars", tc.w, tc.h)); got != tc.want {
+			t.Errorf("%dx%d: %q, want %q", tc.w, tc.h, got, tc.want)
+		}
+	}
+	if !ForcedOptimize("avatars") || ForcedOptimize("docs") {
+		t.Error("ForcedOptimize does not follow the policy")
+	}
+}
+
+func TestContentValidatorForHoldsTheStreamToTheBucket(t *testing.T) {
+	loadUploadPolicies(t, avatarsAndDocs)
+	v := NewContentValidatorFor("avatars")
+	_, err := v.Write([]byte(strings.Repeat("a", 5000)))
+	if got := policyCode(err); got != "FILE_TOO_LARGE" {
+		t.Errorf("past max_bytes: %q", got)
+	}
+	v = NewContentValidatorFor("docs")
+	_, _ = v.Write([]byte("abc"))
+	if got := policyCode(v.Close()); got != "FILE_TOO_SMALL" {
+		t.Errorf("under min_bytes: %q", got)
+	}
+}
+
+func TestCheckUploadPoliciesRefusesUnknownExtensions(t *testing.T) {
+	loadUploadPolicies(t, avatarsAndDocs)
+	if err := CheckUploadPolicies(); err != nil {
+		t.Fatalf("allowlisted extensions: %v", err)
+	}
+	loadUploadPolicies(t, `{"buckets": [{"bucket": "tools", "upload": {"extensions": ["exe"]}}]}`)
+	if err := CheckUploadPolicies(); err == nil || !strings.Contains(err.Error(), "tools") {
+		t.Fatalf("exe: %v", err)
+	}
+}
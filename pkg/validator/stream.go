@@ -0,0 +1,151 @@
+package validator
+
+import (
+	"fmt"
+
+	"github.com/mstgnz/cdn/pkg/config"
+)
+
+// signatureLen is how much of a file matchesSignature needs to see.
+const signatureLen = 12
+
+// ContentValidator is ValidateFileContent for a stream. Write the file through
+// it (an io.TeeReader is the usual way) and call Close at the end; the verdict
+// is the one ValidateFileContent would give the same bytes.
+//
+// It exists so that a large upload never has to be held in memory just to be
+// checked. The binary signatures only look at the first 12 bytes, and the text
+// fallback is a byte-at-a-time UTF-8 walk, so nothing but the head and a few
+// bytes of decoder state is kept.
+//
+// Write fails as soon as the outcome is certain: past MAX_FILE_SIZE, or once a
+// head that matches no signature is followed by something that is not text.
+// Returning the error from Write is what stops a tee mid-upload, so a rejected
+// file is abandoned where it fails instead of being streamed to the end first.
+type ContentValidator struct {
+	enabled bool
+	max     int64
+	policy  *config.UploadPolicy // the bucket's byte limits, applied even when !enabled
+	n       int64
+	head    []byte
+	err     error
+
+	// UTF-8 text state, for files no signature matches.
+	need   int  // continuation bytes still expected
+	notTxt bool // invalid UTF-8 or a NUL byte seen
+}
+
+// NewContentValidator reads VALIDATE_FILE and MAX_FILE_SIZE the same way
+// ValidateFileContent does.
+func NewContentValidator() *ContentValidator {
+	return &ContentValidator{
+		enabled: config.GetEnvAsBoolOrDefault("VALIDATE_FILE", true),
+		max:     int64(config.GetEnvAsIntOrDefault("MAX_FILE_SIZE", int(DefaultMaxFileSize))),
+		head:    make([]byte, 0, signatureLen),
+	}
+}
+
+// NewContentValidatorFor is NewContentValidator that also holds the stream to
+// the byte limits of bucket's upload policy, as ValidateContentFor does.
+func NewContentValidatorFor(bucket string) *ContentValidator {
+	v := NewContentValidator()
+	v.policy = config.UploadPolicyFor(bucket)
+	return v
+}
+
+// NewContentValidatorUpTo is NewContentValidatorFor with max in place of
+// MAX_FILE_SIZE, as ValidateFileUpTo is ValidateFile's.
+func NewContentValidatorUpTo(bucket string, max int64) *ContentValidator {
+	v := NewContentValidatorFor(bucket)
+	v.max = max
+	return v
+}
+
+// Size is how many bytes have been written.
+func (v *ContentValidator) Size() int64 { return v.n }
+
+// Head is the start of the file, at most 12 bytes.
+func (v *ContentValidator) Head() []byte { return v.head }
+
+func (v *ContentValidator) Write(p []byte) (int, error) {
+	if v.err != nil {
+		return 0, v.err
+	}
+	v.n += int64(len(p))
+	if v.policy != nil && v.policy.MaxBytes > 0 && v.n > v.policy.MaxBytes {
+		v.err = validateSizeFor(v.policy, v.n)
+		return 0, v.err
+	}
+	if !v.enabled {
+		return len(p), nil
+	}
+	if v.n > v.max {
+		v.err = &FileValidationError{
+			Code:    "FILE_TOO_LARGE",
+			Message: fmt.Sprintf("File size is too large. Maximum: %d bytes", v.max),
+		}
+		return 0, v.err
+	}
+
+	if room := signatureLen - len(v.head); room > 0 {
+		v.head = append(v.head, p[:min(room, len(p))]...)
+	}
+	if !v.notTxt {
+		v.scanText(p)
+	}
+
+	if v.notTxt && len(v.head) == signatureLen && !matchesSignature(v.head) {
+		v.err = &FileValidationError{Code: "INVALID_FILE_CONTENT", Message: "Invalid file content"}
+		return 0, v.err
+	}
+	return len(p), nil
+}
+
+// scanText continues isValidUTF8Text across writes. The one difference is that
+// a multi-byte sequence may be split between two of them, which is what need
+// carries over.
+func (v *ContentValidator) scanText(p []byte) {
+	for _, b := range p {
+		switch {
+		case v.need > 0:
+			if b&0xC0 != 0x80 {
+				v.notTxt = true
+				return
+			}
+			v.need--
+		case b == 0:
+			v.notTxt = true
+			return
+		case b < 0x80:
+		case b&0xE0 == 0xC0:
+			v.need = 1
+		case b&0xF0 == 0xE0:
+			v.need = 2
+		case b&0xF8 == 0xF0:
+			v.need = 3
+		default:
+			v.notTxt = true
+			return
+		}
+	}
+}
+
+// Close gives the final verdict: nil, or the *FileValidationError that
+// ValidateFileContent would have returned.
+func (v *ContentValidator) Close() error {
+	if v.err == nil && v.policy != nil {
+		v.err = validateSizeFor(v.policy, v.n)
+	}
+	if v.err != nil || !v.enabled {
+		return v.err
+	}
+	text := !v.notTxt && v.need == 0
+	ok := text
+	if v.n >= 4 {
+		ok = text || matchesSignature(v.head)
+	}
+	if !ok {
+		v.err = &FileValidationError{Code: "INVALID_FILE_CONTENT", Message: "Invalid file content"}
+	}
+	return v.err
+}
@@ -0,0 +1,94 @@
+package validator
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+)
+
+// streamVerdict writes content through a ContentValidator in chunks of size
+// step and returns the error it settles on.
+func streamVerdict(content []byte, step int) error {
+	v := NewContentValidator()
+	for off := 0; off < len(content); off += step {
+		end := min(off+step, len(content))
+		if _, err := v.Write(content[off:end]); err != nil {
+			return err
+		}
+	}
+	return v.Close()
+}
+
+func code(err error) string {
+	var fe *FileValidationError
+	if errors.As(err, &fe) {
+		return fe.Code
+	}
+	if err != nil {
+		return err.Error()
+	}
+	return ""
+}
+
+// The stream has to agree with the buffered check on every input, however the
+// bytes are split: a disagreement is either a file one upload path takes and
+// the other refuses, or a bypass.
+func TestContentValidatorAgreesWithValidateFileContent(t *testing.T) {
+	cases := map[string][]byte{
+		"empty":                {},
+		"short text":           []byte("ab"),
+		"short binary":         {0x00, 0x01},
+		"bmp too short to say": {0x42, 0x4D, 0x00},
+		"png":                  pad(pngSig, 200),
+		"pdf":                  pad(pdfSig, 50),
+		"zip":                  pad(zipSig, 50),
+		"ole":                  pad(oleSig, 50),
+		"mp4":                  pad(isoBMFF(0x20, "isom"), 100),
+		"csv":                  []byte("name,city\nAyşe,İzmir\nJosé,São Paulo\n"),
+		"emoji":                []byte(strings.Repeat("🙂 ok ", 20)),
+		"nul in text":          []byte("select 1;\x00select 2;"),
+		"broken utf-8":         []byte("caf\xc3\x28 au lait, then much more text"),
+		"cut-off utf-8":        []byte("trailing é"[:len("trailing é")-1]),
+		"executable":           pad([]byte("MZ\x90\x00\x03\x00\x00\x00"), 100),
+		"elf":                  pad([]byte("\x7fELF\x02\x01\x01\x00"), 100),
+	}
+	for name, content := range cases {
+		want := code(ValidateFileContent(content))
+		for _, step := range []int{1, 2, 3, 5, 11, 13, 4096} {
+			if got := code(streamVerdict(content, step)); got != want {
+				t.Errorf("%s in writes of %d: stream says %q, buffered says %q", name, step, got, want)
+			}
+		}
+	}
+}
+
+// A file that is neither a known format nor text is refused on the write that
+// proves it, not after the rest of it has been read.
+func TestContentValidatorStopsEarly(t *testing.T) {
+	junk := append([]byte("MZ\x90\x00\x03\x00\x00\x00\x04\x00\x00\x00"), bytes.Repeat([]byte{0xff}, 1<<20)...)
+	v := NewContentValidator()
+	n, err := io.Copy(v, io.LimitReader(bytes.NewReader(junk), int64(len(junk))))
+	if code(err) != "INVALID_FILE_CONTENT" {
+		t.Fatalf("err = %v, want INVALID_FILE_CONTENT", err)
+	}
+	if n >= int64(len(junk)) {
+		t.Fatalf("read all %d bytes before refusing", n)
+	}
+}
+
+func TestContentValidatorEnforcesTheSizeLimit(t *testing.T) {
+	t.Setenv("MAX_FILE_SIZE", "100")
+	if got := code(streamVerdict(bytes.Repeat([]byte("a"), 100), 7)); got != "" {
+		t.Fatalf("exactly at the limit: %q", got)
+	}
+	if got := code(streamVerdict(bytes.Repeat([]byte("a"), 101), 7)); got != "FILE_TOO_LARGE" {
+		t.Fatalf("over the limit: %q, want FILE_TOO_LARGE", got)
+	}
+
+	t.Setenv("VALIDATE_FILE", "false")
+	if got := code(streamVerdict(pad([]byte("MZ"), 500), 7)); got != "" {
+		t.Fatalf("validation off still refused: %q", got)
+	}
+}
@@ -2,8 +2,11 @@ package service
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"fmt"
+	"hash"
 	"io"
 	"sort"
 	"strings"
@@ -53,16 +56,31 @@ type Archive interface {
 	// interface returns ErrArchiveDisabled when it is false.
 	Enabled() bool
 
-	// Put writes an object to the archive tier.
-	Put(ctx context.Context, bucket, object string, body io.Reader) error
+	// Put writes an object to the archive tier. sum, when not empty, is the
+	// hex SHA-256 the caller expects body to have: it is recorded with the
+	// archived copy, and a body that turns out to hash to anything else fails
+	// the write rather than leaving a copy that claims a digest it does not
+	// have. version, when not empty, is the MinIO version ID of the object
+	// body was read from, recorded the same way so a versioned bucket can tell
+	// which of its versions the archive holds.
+	Put(ctx context.Context, bucket, object string, body io.Reader, sum, version string) error
 
 	// Open returns the archived object's contents and size. The caller owns the
 	// reader and must close it.
 	Open(ctx context.Context, bucket, object string) (io.ReadCloser, int64, error)
 
-	// Stat returns the archived object's size without transferring it. This is
-	// the proof the retention job requires before deleting the MinIO copy.
-	Stat(ctx context.Context, bucket, object string) (int64, error)
+	// Stat returns the archived object's size, and the digest it was archived
+	// with, without transferring it. This is the proof the retention job
+	// requires before deleting the MinIO copy.
+	Stat(ctx context.Context, bucket, object string) (ArchiveInfo, error)
+
+	// Copy copies an archived object to another key, possibly of another local
+	// bucket, inside the archive, and checks the copy's size and digest against
+	// the source before reporting success. The destination has to be in scope,
+	// as for Put; ErrArchiveNotFound means there was nothing archived to copy.
+	//
+	// There is deliberately no Delete to go with it: see the retention job.
+	Copy(ctx context.Context, srcBucket, srcObject, dstBucket, dstObject string) error
 
 	// Reachable reports whether objects from this local bucket have somewhere to
 	// go: it resolves the destination and checks it exists and is writable.
@@ -96,6 +114,37 @@ type Archive interface {
 	Walk(ctx context.Context, bucket string, fn func(key string, size int64) error) error
 }
 
+// ArchiveInfo is what the archive knows about one object without reading it.
+type ArchiveInfo struct {
+	Size int64
+
+	// SHA256 is the hex digest the object was archived with, or empty for
+	// copies written before digests were recorded, or by a caller that did not
+	// know one.
+	SHA256 string
+
+	// VersionID is the MinIO version the archived copy was made from, or
+	// empty when the bucket was not versioned or the copy predates recording
+	// it.
+	VersionID string
+}
+
+// archiveMetaSHA256 is the S3 user metadata key the digest is stored under.
+// S3 lower-cases metadata keys, so this is also how it reads back.
+const archiveMetaSHA256 = "sha256"
+
+// archiveMetaVersion is the S3 user metadata key the MinIO version ID of an
+// archived copy is stored under.
+const archiveMetaVersion = "source-version-id"
+
+// ErrArchiveDigestMismatch means a body handed to Put did not hash to the
+// digest it was put with.
+var ErrArchiveDigestMismatch = errors.New("archive: content does not match its sha256")
+
+// ErrArchiveCopyMismatch means a copy made by Copy did not read back with the
+// source's size and digest.
+var ErrArchiveCopyMismatch = errors.New("archive: copy does not match its source")
+
 var (
 	// ErrArchiveDisabled means no AWS credentials were configured. This is a
 	// normal state, not a failure: the project is deployed by people who run it
@@ -275,7 +324,14 @@ func (a *archive) resolve(bucket, object string) (string, string) {
 	return bucket, object
 }
 
-func (a *archive) Put(ctx context.Context, bucket, object string, body io.Reader) error {
+// Put writes an object, recording sum with it when there is one.
+//
+// The digest is checked on the bytes as they are read for the upload, and a
+// mismatch is returned from the body's last Read. That makes the uploader
+// abandon the write, single-part or multipart, so S3 never holds a copy whose
+// recorded digest is wrong: VerifyArchived trusts that digest, and a wrong one
+// would let the retention job delete the only good copy.
+func (a *archive) Put(ctx context.Context, bucket, object string, body io.Reader, sum, version string) error {
 	if !a.enabled {
 		return ErrArchiveDisabled
 	}
@@ -283,13 +339,75 @@ func (a *archive) Put(ctx context.Context, bucket, object string, body io.Reader
 		return ErrArchiveNotInScope
 	}
 
+	var metadata map[string]string
+	if sum != "" {
+		metadata = map[string]string{archiveMetaSHA256: sum}
+		body = &digestReader{r: body, h: sha256.New(), want: sum}
+	}
+	if version != "" {
+		if metadata == nil {
+			metadata = map[string]string{}
+		}
+		metadata[archiveMetaVersion] = version
+	}
+
 	s3Bucket, s3Key := a.resolve(bucket, object)
-	if _, err := a.aws.S3PutObject(ctx, s3Bucket, s3Key, body); err != nil {
+	if _, err := a.aws.S3PutObject(ctx, s3Bucket, s3Key, body, metadata); err != nil {
 		return fmt.Errorf("archive put %s/%s: %w", s3Bucket, s3Key, err)
 	}
 	return nil
 }
 
+// Copy copies server-side, so the bytes never pass through this service, and
+// then proves the copy the way the retention job proves an archived object:
+// by its size and the digest recorded with it. S3 copies metadata along with
+// the bytes, so a copy of an object archived with a digest carries the same
+// one; a copy that does not is reported rather than left to be trusted.
+func (a *archive) Copy(ctx context.Context, srcBucket, srcObject, dstBucket, dstObject string) error {
+	if !a.enabled {
+		return ErrArchiveDisabled
+	}
+	if !a.InScope(dstBucket) {
+		return ErrArchiveNotInScope
+	}
+
+	src, err := a.Stat(ctx, srcBucket, srcObject)
+	if err != nil {
+		return err
+	}
+	s3SrcBucket, s3SrcKey := a.resolve(srcBucket, srcObject)
+	s3DstBucket, s3DstKey := a.resolve(dstBucket, dstObject)
+	if err := a.aws.S3CopyObject(ctx, s3SrcBucket, s3SrcKey, s3DstBucket, s3DstKey); err != nil {
+		return fmt.Errorf("archive copy %s/%s to %s/%s: %w", s3SrcBucket, s3SrcKey, s3DstBucket, s3DstKey, err)
+	}
+
+	dst, err := a.Stat(ctx, dstBucket, dstObject)
+	if err != nil {
+		return fmt.Errorf("archive copy %s/%s: cannot verify: %w", s3DstBucket, s3DstKey, err)
+	}
+	if dst.Size != src.Size || dst.SHA256 != src.SHA256 {
+		return fmt.Errorf("archive copy %s/%s: %w", s3DstBucket, s3DstKey, ErrArchiveCopyMismatch)
+	}
+	return nil
+}
+
+// digestReader hashes what passes through it and turns EOF into
+// ErrArchiveDigestMismatch when the total does not match want.
+type digestReader struct {
+	r    io.Reader
+	h    hash.Hash
+	want string
+}
+
+func (d *digestReader) Read(p []byte) (int, error) {
+	n, err := d.r.Read(p)
+	d.h.Write(p[:n])
+	if errors.Is(err, io.EOF) && hex.EncodeToString(d.h.Sum(nil)) != d.want {
+		return n, ErrArchiveDigestMismatch
+	}
+	return n, err
+}
+
 func (a *archive) Open(ctx context.Context, bucket, object string) (io.ReadCloser, int64, error) {
 	if !a.enabled {
 		return nil, 0, ErrArchiveDisabled
@@ -382,27 +500,27 @@ func (a *archive) Walk(ctx context.Context, bucket string, fn func(key string, s
 	})
 }
 
-func (a *archive) Stat(ctx context.Context, bucket, object string) (int64, error) {
+func (a *archive) Stat(ctx context.Context, bucket, object string) (ArchiveInfo, error) {
 	if !a.enabled {
-		return 0, ErrArchiveDisabled
+		return ArchiveInfo{}, ErrArchiveDisabled
 	}
 
 	s3Bucket, s3Key := a.resolve(bucket, object)
 	out, err := a.aws.S3HeadObject(ctx, s3Bucket, s3Key)
 	if err != nil {
 		if isNotFound(err) {
-			return 0, ErrArchiveNotFound
+			return ArchiveInfo{}, ErrArchiveNotFound
 		}
-		return 0, fmt.Errorf("archive stat %s/%s: %w", s3Bucket, s3Key, err)
+		return ArchiveInfo{}, fmt.Errorf("archive stat %s/%s: %w", s3Bucket, s3Key, err)
 	}
 
 	if out.ContentLength == nil {
 		// Treat an unreported size as unproven rather than as zero. The retention
 		// job compares sizes, and a zero here would make every object look like a
 		// mismatch, which fails safe, but saying so plainly is clearer.
-		return 0, fmt.Errorf("archive stat %s/%s: no content length reported", s3Bucket, s3Key)
+		return ArchiveInfo{}, fmt.Errorf("archive stat %s/%s: no content length reported", s3Bucket, s3Key)
 	}
-	return *out.ContentLength, nil
+	return ArchiveInfo{Size: *out.ContentLength, SHA256: out.Metadata[archiveMetaSHA256], VersionID: out.Metadata[archiveMetaVersion]}, nil
 }
 
 // isNotFound recognises the two shapes S3 uses for a missing object: HeadObject
@@ -3,6 +3,8 @@ package service
 import (
 	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"io"
 	"strings"
@@ -14,7 +16,7 @@ import (
 	s3types "github.com/aws/aws-sdk-go-v2/service/s3/types"
 )
 
-// fakeAws implements only the three S3 calls the archive makes. Embedding the
+// fakeAws implements only the S3 calls the archive makes. Embedding the
 // interface means any other method panics if it is ever called, which is the
 // point: it keeps the fake honest about what the archive actually depends on.
 type fakeAws struct {
@@ -23,9 +25,11 @@ type fakeAws struct {
 	putBucket string
 	putKey    string
 	putBody   []byte
+	putMeta   map[string]string
 	putErr    error
 
 	headSize int64
+	headMeta map[string]string
 	headErr  error
 
 	getBody []byte
@@ -34,6 +38,11 @@ type fakeAws struct {
 	headBucket    string
 	headBucketErr error
 
+	copied  [4]string // source bucket and key, destination bucket and key
+	copyErr error
+	// copyMeta, when set, is what the copy reads back with instead of headMeta.
+	copyMeta map[string]string
+
 	// createdBucket stays empty unless something calls a create, which is the
 	// point: nothing should.
 	createdBucket string
@@ -44,7 +53,7 @@ func (f *fakeAws) S3HeadBucket(_ context.Context, bucket string) error {
 	return f.headBucketErr
 }
 
-func (f *fakeAws) S3PutObject(_ context.Context, bucket, key string, body io.Reader) (*manager.UploadOutput, error) {
+func (f *fakeAws) S3PutObject(_ context.Context, bucket, key string, body io.Reader, metadata map[string]string) (*manager.UploadOutput, error) {
 	if f.putErr != nil {
 		return nil, f.putErr
 	}
@@ -52,7 +61,7 @@ func (f *fakeAws) S3PutObject(_ context.Context, bucket, key string, body io.Rea
 	if err != nil {
 		return nil, err
 	}
-	f.putBucket, f.putKey, f.putBody = bucket, key, b
+	f.putBucket, f.putKey, f.putBody, f.putMeta = bucket, key, b, metadata
 	return &manager.UploadOutput{}, nil
 }
 
@@ -61,7 +70,10 @@ func (f *fakeAws) S3HeadObject(_ context.Context, bucket, key string) (*s3.HeadO
 		return nil, f.headErr
 	}
 	f.putBucket, f.putKey = bucket, key
-	return &s3.HeadObjectOutput{ContentLength: aws.Int64(f.headSize)}, nil
+	if f.copyMeta != nil && f.copied[2] == bucket && f.copied[3] == key {
+		return &s3.HeadObjectOutput{ContentLength: aws.Int64(f.headSize), Metadata: f.copyMeta}, nil
+	}
+	return &s3.HeadObjectOutput{ContentLength: aws.Int64(f.headSize), Metadata: f.headMeta}, nil
 }
 
 func (f *fakeAws) S3GetObject(_ context.Context, bucket, key string) (*s3.GetObjectOutput, error) {
@@ -75,6 +87,14 @@ func (f *fakeAws) S3GetObject(_ context.Context, bucket, key string) (*s3.GetObj
 	}, nil
 }
 
+func (f *fakeAws) S3CopyObject(_ context.Context, srcBucket, srcKey, dstBucket, dstKey string) error {
+	if f.copyErr != nil {
+		return f.copyErr
+	}
+	f.copied = [4]string{srcBucket, srcKey, dstBucket, dstKey}
+	return nil
+}
+
 // enableArchiveEnv sets the three variables that make the archive consider
 // itself configured.
 func enableArchiveEnv(t *testing.T) {
@@ -101,7 +121,7 @@ func TestArchiveDisabledWithoutCredentials(t *testing.T) {
 	}
 
 	// Every operation must refuse cleanly rather than reaching for AWS.
-	if err := a.Put(context.Background(), "b", "o", strings.NewReader("x")); !errors.Is(err, ErrArchiveDisabled) {
+	if err := a.Put(context.Background(), "b", "o", strings.NewReader("x"), "", ""); !errors.Is(err, ErrArchiveDisabled) {
 		t.Fatalf("Put: want ErrArchiveDisabled, got %v", err)
 	}
 	if _, _, err := a.Open(context.Background(), "b", "o"); !errors.Is(err, ErrArchiveDisabled) {
@@ -273,7 +293,7 @@ func TestArchiveExplicitOffSwitchBeatsValidCredentials(t *testing.T) {
 	// And it must refuse the same way as an unconfigured archive, so callers have
 	// one condition to handle rather than two.
 	f := &fakeAws{}
-	if err := NewArchive(f).Put(context.Background(), "b", "o", strings.NewReader("x")); !errors.Is(err, ErrArchiveDisabled) {
+	if err := NewArchive(f).Put(context.Background(), "b", "o", strings.NewReader("x"), "", ""); !errors.Is(err, ErrArchiveDisabled) {
 		t.Fatalf("Put: want ErrArchiveDisabled, got %v", err)
 	}
 	if f.putKey != "" {
@@ -287,7 +307,7 @@ func TestArchivePutUsesBucketParityByDefault(t *testing.T) {
 	enableArchiveEnv(t)
 	f := &fakeAws{}
 
-	if err := NewArchive(f).Put(context.Background(), "photos", "2024/cat.jpg", strings.NewReader("bytes")); err != nil {
+	if err := NewArchive(f).Put(context.Background(), "photos", "2024/cat.jpg", strings.NewReader("bytes"), "", ""); err != nil {
 		t.Fatalf("Put: %v", err)
 	}
 
@@ -309,7 +329,7 @@ func TestArchivePutUsesSingleBucketWithPrefix(t *testing.T) {
 	t.Setenv("ARCHIVE_BUCKET", "cold-store")
 	f := &fakeAws{}
 
-	if err := NewArchive(f).Put(context.Background(), "photos", "2024/cat.jpg", strings.NewReader("bytes")); err != nil {
+	if err := NewArchive(f).Put(context.Background(), "photos", "2024/cat.jpg", strings.NewReader("bytes"), "", ""); err != nil {
 		t.Fatalf("Put: %v", err)
 	}
 
@@ -408,7 +428,7 @@ func TestArchiveReadResolvesToTheSameLocationAsWrite(t *testing.T) {
 			f := &fakeAws{getBody: []byte("original bytes")}
 			a := NewArchive(f)
 
-			if err := a.Put(context.Background(), bucket, object, strings.NewReader("original bytes")); err != nil {
+			if err := a.Put(context.Background(), bucket, object, strings.NewReader("original bytes"), "", ""); err != nil {
 				t.Fatalf("Put: %v", err)
 			}
 			wroteTo := f.putBucket + "|" + f.putKey
@@ -520,7 +540,7 @@ func TestArchiveScope(t *testing.T) {
 		t.Setenv("ARCHIVE_ONLY_BUCKETS", "photos")
 
 		f := &fakeAws{}
-		err := NewArchive(f).Put(context.Background(), "videos", "clip.mp4", strings.NewReader("x"))
+		err := NewArchive(f).Put(context.Background(), "videos", "clip.mp4", strings.NewReader("x"), "", "")
 
 		if !errors.Is(err, ErrArchiveNotInScope) {
 			t.Fatalf("want ErrArchiveNotInScope, got %v", err)
@@ -566,7 +586,7 @@ func TestArchiveScope(t *testing.T) {
 		if !before.InScope("dos") {
 			t.Fatal("dos should have been in scope")
 		}
-		if err := before.Put(context.Background(), "dos", "2025/invoice.pdf", strings.NewReader("archived last year")); err != nil {
+		if err := before.Put(context.Background(), "dos", "2025/invoice.pdf", strings.NewReader("archived last year"), "", ""); err != nil {
 			t.Fatalf("Put: %v", err)
 		}
 		archivedAt := f.putBucket + "|" + f.putKey
@@ -580,7 +600,7 @@ func TestArchiveScope(t *testing.T) {
 		}
 
 		// New writes stop, as intended.
-		if err := after.Put(context.Background(), "dos", "2026/new.pdf", strings.NewReader("x")); !errors.Is(err, ErrArchiveNotInScope) {
+		if err := after.Put(context.Background(), "dos", "2026/new.pdf", strings.NewReader("x"), "", ""); !errors.Is(err, ErrArchiveNotInScope) {
 			t.Fatalf("a write to an out-of-scope bucket was accepted: %v", err)
 		}
 
@@ -612,11 +632,98 @@ func TestArchiveScope(t *testing.T) {
 func TestArchiveStatReturnsSize(t *testing.T) {
 	enableArchiveEnv(t)
 
-	size, err := NewArchive(&fakeAws{headSize: 4096}).Stat(context.Background(), "b", "o")
+	info, err := NewArchive(&fakeAws{headSize: 4096}).Stat(context.Background(), "b", "o")
 	if err != nil {
 		t.Fatalf("Stat: %v", err)
 	}
-	if size != 4096 {
-		t.Errorf("size: want 4096, got %d", size)
+	if info.Size != 4096 || info.SHA256 != "" {
+		t.Errorf("stat: want 4096 bytes without a digest, got %+v", info)
+	}
+}
+
+// A digest given to Put is stored with the copy and read back by Stat; a body
+// that does not hash to it fails the write instead of being archived under a
+// digest it does not have.
+func TestArchivePutRecordsAndChecksTheDigest(t *testing.T) {
+	enableArchiveEnv(t)
+	sum := sha256.Sum256([]byte("bytes"))
+	digest := hex.EncodeToString(sum[:])
+
+	f := &fakeAws{}
+	if err := NewArchive(f).Put(context.Background(), "photos", "cat.jpg", strings.NewReader("bytes"), digest, ""); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	if f.putMeta["sha256"] != digest {
+		t.Errorf("metadata: got %v", f.putMeta)
+	}
+
+	err := NewArchive(&fakeAws{}).Put(context.Background(), "photos", "cat.jpg", strings.NewReader("other bytes"), digest, "")
+	if !errors.Is(err, ErrArchiveDigestMismatch) {
+		t.Fatalf("mismatched body: want ErrArchiveDigestMismatch, got %v", err)
+	}
+
+	info, err := NewArchive(&fakeAws{headSize: 5, headMeta: f.putMeta}).Stat(context.Background(), "photos", "cat.jpg")
+	if err != nil || info.SHA256 != digest {
+		t.Fatalf("Stat = (%+v, %v)", info, err)
+	}
+}
+
+// The MinIO version an archived copy was made from is stored with it, and
+// nothing is stored when there is none.
+func TestArchivePutRecordsTheVersion(t *testing.T) {
+	enableArchiveEnv(t)
+
+	f := &fakeAws{}
+	if err := NewArchive(f).Put(context.Background(), "photos", "cat.jpg", strings.NewReader("bytes"), "", "3f2c-v1"); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	if f.putMeta[archiveMetaVersion] != "3f2c-v1" || len(f.putMeta) != 1 {
+		t.Errorf("metadata: got %v", f.putMeta)
+	}
+	info, err := NewArchive(&fakeAws{headSize: 5, headMeta: f.putMeta}).Stat(context.Background(), "photos", "cat.jpg")
+	if err != nil || info.VersionID != "3f2c-v1" {
+		t.Fatalf("Stat = (%+v, %v)", info, err)
+	}
+
+	f = &fakeAws{}
+	if err := NewArchive(f).Put(context.Background(), "photos", "cat.jpg", strings.NewReader("bytes"), "", ""); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	if len(f.putMeta) != 0 {
+		t.Errorf("metadata without a version: got %v", f.putMeta)
+	}
+}
+
+// Copy stays inside S3, between the two resolved locations, and is only
+// reported done once the copy reads back with the source's size and digest.
+func TestArchiveCopyVerifiesTheCopy(t *testing.T) {
+	enableArchiveEnv(t)
+	t.Setenv("ARCHIVE_BUCKET", "cold-store")
+	meta := map[string]string{"sha256": "abc"}
+
+	f := &fakeAws{headSize: 5, headMeta: meta}
+	if err := NewArchive(f).Copy(context.Background(), "photos", "2024/cat.jpg", "pets", "cat.jpg"); err != nil {
+		t.Fatalf("Copy: %v", err)
+	}
+	if f.copied != [4]string{"cold-store", "photos/2024/cat.jpg", "cold-store", "pets/cat.jpg"} {
+		t.Errorf("copied %v", f.copied)
+	}
+
+	f = &fakeAws{headSize: 5, headMeta: meta, copyMeta: map[string]string{}}
+	if err := NewArchive(f).Copy(context.Background(), "photos", "cat.jpg", "photos", "dog.jpg"); !errors.Is(err, ErrArchiveCopyMismatch) {
+		t.Errorf("copy without the digest: want ErrArchiveCopyMismatch, got %v", err)
+	}
+
+	f = &fakeAws{headErr: &s3types.NotFound{}}
+	if err := NewArchive(f).Copy(context.Background(), "photos", "cat.jpg", "photos", "dog.jpg"); !errors.Is(err, ErrArchiveNotFound) {
+		t.Errorf("nothing archived: want ErrArchiveNotFound, got %v", err)
+	}
+	if f.copied != [4]string{} {
+		t.Errorf("copied a missing object: %v", f.copied)
+	}
+
+	t.Setenv(envArchiveOnlyBuckets, "photos")
+	if err := NewArchive(&fakeAws{headSize: 5}).Copy(context.Background(), "photos", "cat.jpg", "scratch", "cat.jpg"); !errors.Is(err, ErrArchiveNotInScope) {
+		t.Errorf("destination out of scope: want ErrArchiveNotInScope, got %v", err)
 	}
 }
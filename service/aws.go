@@ -5,7 +5,9 @@ import (
 	"context"
 	"fmt"
 	"io"
+	"net/url"
 	"os"
+	"strings"
 	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
@@ -34,11 +36,12 @@ type AwsService interface {
 	GlacierInventoryRetrieval(vaultName string) (*glacier.InitiateJobOutput, error)
 	GlacierDownloadToMinio(vaultName, jobId, targetBucket, targetPath string) error
 	GlacierDownloadToLocal(vaultName, jobId, localPath string) error
-	S3PutObject(ctx context.Context, bucketName string, objectName string, fileBuffer io.Reader) (*manager.UploadOutput, error)
+	S3PutObject(ctx context.Context, bucketName string, objectName string, fileBuffer io.Reader, metadata map[string]string) (*manager.UploadOutput, error)
 	S3HeadObject(ctx context.Context, bucketName, objectName string) (*s3.HeadObjectOutput, error)
 	S3HeadBucket(ctx context.Context, bucketName string) error
 	S3ListObjects(ctx context.Context, bucketName, prefix string, fn func(key string, size int64) error) error
 	S3GetObject(ctx context.Context, bucketName, objectName string) (*s3.GetObjectOutput, error)
+	S3CopyObject(ctx context.Context, srcBucket, srcObject, dstBucket, dstObject string) error
 	ListBuckets() ([]s3types.Bucket, error)
 	BucketExists(bucketName string) bool
 	DeleteObjects(bucketName string, objectKeys []string) error
@@ -80,13 +83,17 @@ func NewAwsService() AwsService {
 //
 // Two AWS billing rules are worth knowing before tuning this: objects under
 // 128 KB are billed as 128 KB, and deleting before 90 days is billed as 90 days.
-func (as *awsService) S3PutObject(ctx context.Context, bucketName string, objectName string, fileBuffer io.Reader) (*manager.UploadOutput, error) {
+//
+// metadata is stored as x-amz-meta-* and comes back from S3HeadObject; it is
+// how the archive records the digest of what it was given.
+func (as *awsService) S3PutObject(ctx context.Context, bucketName string, objectName string, fileBuffer io.Reader, metadata map[string]string) (*manager.UploadOutput, error) {
 	client := s3.NewFromConfig(as.cfg)
 	uploader := manager.NewUploader(client)
 	return uploader.Upload(ctx, &s3.PutObjectInput{
 		Bucket:       aws.String(bucketName),
 		Key:          aws.String(objectName),
 		Body:         fileBuffer,
+		Metadata:     metadata,
 		StorageClass: s3types.StorageClassGlacierIr,
 	})
 }
@@ -159,6 +166,33 @@ func (as *awsService) S3GetObject(ctx context.Context, bucketName, objectName st
 	})
 }
 
+// S3CopyObject copies an object inside S3 without transferring it, keeping its
+// metadata (and so its recorded digest) and writing the copy to the same
+// storage class S3PutObject uses: a copy does not inherit the source's class,
+// and would otherwise land in STANDARD. A single copy is limited to 5 GB,
+// far above any upload this service accepts.
+func (as *awsService) S3CopyObject(ctx context.Context, srcBucket, srcObject, dstBucket, dstObject string) error {
+	client := s3.NewFromConfig(as.cfg)
+	_, err := client.CopyObject(ctx, &s3.CopyObjectInput{
+		Bucket:            aws.String(dstBucket),
+		Key:               aws.String(dstObject),
+		CopySource:        aws.String(copySource(srcBucket, srcObject)),
+		MetadataDirective: s3types.MetadataDirectiveCopy,
+		StorageClass:      s3types.StorageClassGlacierIr,
+	})
+	return err
+}
+
+// copySource is the x-amz-copy-source of an object: bucket and key, URL
+// encoded segment by segment so the separators stay separators.
+func copySource(bucket, object string) string {
+	segments := strings.Split(object, "/")
+	for i, seg := range segments {
+		segments[i] = url.PathEscape(seg)
+	}
+	return bucket + "/" + strings.Join(segments, "/")
+}
+
 func (as *awsService) ListBuckets() ([]s3types.Bucket, error) {
 	client := s3.NewFromConfig(as.cfg)
 	result, err := client.ListBuckets(context.TODO(), &s3.ListBucketsInput{})
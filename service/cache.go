@@ -2,8 +2,10 @@ package service
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"strings"
 	"sync/atomic"
 	"time"
 
@@ -16,10 +18,15 @@ import (
 type CacheService interface {
 	Get(key string) ([]byte, error)
 	Set(key string, value []byte, expiration time.Duration) error
+	// SetNX stores value only when key does not exist, and reports whether it
+	// did. It is the one atomic claim the cache offers, for callers that need
+	// exactly one of several concurrent requests to go ahead.
+	SetNX(key string, value []byte, expiration time.Duration) (bool, error)
 	Delete(key string) error
 	GetResizedImage(bucket, path string, width, height uint) ([]byte, error)
 	SetResizedImage(bucket, path string, width, height uint, data []byte) error
-	FlushAll() error
+	PurgeVariants(ctx context.Context, scope PurgeScope) (int, error)
+	DeletePrefix(ctx context.Context, prefix string) (int, error)
 	Close() error
 }
 
@@ -184,6 +191,20 @@ func (c *redisCache) Set(key string, value []byte, expiration time.Duration) err
 	return err
 }
 
+func (c *redisCache) SetNX(key string, value []byte, expiration time.Duration) (bool, error) {
+	start := time.Now()
+	ok, err := c.client.SetNX(context.Background(), key, value, expiration).Result()
+
+	status := "success"
+	if err != nil {
+		status = "error"
+		c.logger.Error().Err(err).Str("key", key).Msg("Cache setnx failed")
+	}
+	observability.CacheOperations.WithLabelValues("setnx", status).Inc()
+	observability.CacheOperationDuration.WithLabelValues("setnx", status).Observe(time.Since(start).Seconds())
+	return ok, err
+}
+
 func (c *redisCache) Delete(key string) error {
 	start := time.Now()
 	ctx := context.Background()
@@ -207,40 +228,251 @@ func (c *redisCache) Delete(key string) error {
 	return err
 }
 
-func (c *redisCache) GetResizedImage(bucket, path string, width, height uint) ([]byte, error) {
-	key := fmt.Sprintf("resize:%s:%s:%d:%d", bucket, path, width, height)
-	return c.Get(key)
+// Derived images are stored one Redis hash per source object, under
+// "<namespace>:variant:<bucket>:<key>", with one field per size ("100x100").
+//
+// The layout is what makes invalidation cheap where it is frequent. Deleting an
+// object has to drop every size that was ever served for it, and with one string
+// key per size that is a SCAN over the whole keyspace on every DELETE request.
+// With a hash it is a single DEL. The price is that all sizes of one object
+// share an expiry, which each new size pushes out again; for a cache of things
+// that can be recomputed that is the right way round.
+//
+// The object key is the tail of the Redis key, unescaped, so "everything under
+// photos/2026/" is exactly the Redis keys starting with the variant prefix plus
+// "photos/2026/". Bucket names cannot contain a colon, so the bucket part can
+// never run into the key part.
+const (
+	variantTTL = 24 * time.Hour
+
+	// purgeScanCount is the COUNT hint per SCAN round. It bounds how long any one
+	// round holds Redis, not how many keys a purge may remove.
+	purgeScanCount = 500
+)
+
+// CacheNamespace is the prefix every key this service writes starts with.
+// Sharing one Redis between deployments, or with anything else, is safe only
+// while each of them stays inside its own namespace, and scoped purges rely on
+// that too.
+func CacheNamespace() string {
+	return config.GetEnvOrDefault("CACHE_KEY_PREFIX", "cdn")
 }
 
-func (c *redisCache) SetResizedImage(bucket, path string, width, height uint, data []byte) error {
-	key := fmt.Sprintf("resize:%s:%s:%d:%d", bucket, path, width, height)
-	// Cache for 24 hours
-	return c.Set(key, data, 24*time.Hour)
+func variantPrefix(bucket string) string {
+	return CacheNamespace() + ":variant:" + bucket + ":"
 }
 
-func (c *redisCache) FlushAll() error {
+func variantField(width, height uint) string {
+	return fmt.Sprintf("%dx%d", width, height)
+}
+
+func (c *redisCache) GetResizedImage(bucket, path string, width, height uint) ([]byte, error) {
 	start := time.Now()
-	ctx := context.Background()
+	key := variantPrefix(bucket) + path
+	var err error
+	var miss bool
+
+	defer func() {
+		status := "hit"
+		switch {
+		case miss:
+			status = "miss"
+		case err != nil:
+			status = "error"
+		}
+		observability.CacheOperations.WithLabelValues("get_variant", status).Inc()
+		observability.CacheOperationDuration.WithLabelValues("get_variant", status).Observe(time.Since(start).Seconds())
+
+		if err != nil && !miss {
+			c.logger.Error().Err(err).Str("key", key).Msg("Cache variant get failed")
+		}
+	}()
+
+	val, err := c.client.HGet(context.Background(), key, variantField(width, height)).Bytes()
+	if errors.Is(err, redis.Nil) {
+		miss = true
+		return nil, fmt.Errorf("%w: %s", ErrCacheMiss, key)
+	}
+	return val, err
+}
+
+func (c *redisCache) SetResizedImage(bucket, path string, width, height uint, data []byte) error {
+	start := time.Now()
+	key := variantPrefix(bucket) + path
 	var err error
 
 	defer func() {
-		duration := time.Since(start).Seconds()
 		status := "success"
 		if err != nil {
 			status = "error"
 		}
-		observability.CacheOperations.WithLabelValues("flush_all", status).Inc()
-		observability.CacheOperationDuration.WithLabelValues("flush_all", status).Observe(duration)
+		observability.CacheOperations.WithLabelValues("set_variant", status).Inc()
+		observability.CacheOperationDuration.WithLabelValues("set_variant", status).Observe(time.Since(start).Seconds())
 
 		if err != nil {
-			c.logger.Error().Err(err).Msg("Cache flush_all failed")
+			c.logger.Error().Err(err).Str("key", key).Msg("Cache variant set failed")
 		}
 	}()
 
-	err = c.client.FlushAll(ctx).Err()
+	ctx := context.Background()
+	_, err = c.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.HSet(ctx, key, variantField(width, height), data)
+		pipe.Expire(ctx, key, variantTTL)
+		return nil
+	})
 	return err
 }
 
+// PurgeScope names the derived-image entries a purge removes. Bucket is always
+// required; Key and Prefix are mutually exclusive, and leaving both empty purges
+// the whole bucket.
+type PurgeScope struct {
+	Bucket string `json:"bucket"`
+	Key    string `json:"key,omitempty"`
+	Prefix string `json:"prefix,omitempty"`
+}
+
+// Validate reports a scope that cannot be purged as written.
+func (s PurgeScope) Validate() error {
+	if s.Bucket == "" {
+		return errors.New("bucket is required")
+	}
+	if strings.Contains(s.Bucket, ":") {
+		return errors.New("bucket name must not contain ':'")
+	}
+	if s.Key != "" && s.Prefix != "" {
+		return errors.New("key and prefix are mutually exclusive")
+	}
+	return nil
+}
+
+// PurgeVariants removes cached derived images in scope and returns how many
+// source objects had entries removed.
+//
+// An exact key is one DEL, which is what the delete endpoints call on every
+// request. Bucket and prefix purges walk the namespace with SCAN rather than
+// KEYS, so a large purge costs many short rounds instead of one long block of
+// Redis, and neither touches anything outside the variant namespace. Before
+// this existed the only tool was FlushAll, which also dropped every rate limiter
+// counter and so reset everyone's limits as a side effect of clearing images.
+func (c *redisCache) PurgeVariants(ctx context.Context, scope PurgeScope) (int, error) {
+	if err := scope.Validate(); err != nil {
+		return 0, err
+	}
+
+	// Other replicas may hold the same variants in memory (see NewMemoryTier).
+	// Telling them costs one PUBLISH, and is done whatever the delete below
+	// finds, because an entry can outlive its Redis copy in a replica's memory.
+	c.publishPurge(ctx, scope)
+
+	prefix := variantPrefix(scope.Bucket)
+	if scope.Key != "" {
+		start := time.Now()
+		n, err := c.client.Del(ctx, prefix+scope.Key).Result()
+		c.observePurge(start, err, prefix+scope.Key)
+		return int(n), err
+	}
+	return c.DeletePrefix(ctx, prefix+scope.Prefix)
+}
+
+func purgeChannel() string {
+	return CacheNamespace() + ":purge"
+}
+
+func (c *redisCache) publishPurge(ctx context.Context, scope PurgeScope) {
+	msg, err := json.Marshal(scope)
+	if err == nil {
+		err = c.client.Publish(ctx, purgeChannel(), msg).Err()
+	}
+	if err != nil {
+		c.logger.Warn().Err(err).
+			Str("bucket", scope.Bucket).
+			Msg("purge broadcast failed; other replicas keep their in-memory copies until the memory TTL")
+	}
+}
+
+// SubscribePurges implements PurgeSubscriber. go-redis re-subscribes on its own
+// after a dropped connection; purges published while it was down are missed,
+// and the memory TTL is what bounds that.
+func (c *redisCache) SubscribePurges(ctx context.Context, fn func(PurgeScope)) {
+	sub := c.client.Subscribe(ctx, purgeChannel())
+	go func() {
+		defer sub.Close()
+		ch := sub.Channel()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case msg, ok := <-ch:
+				if !ok {
+					return
+				}
+				var scope PurgeScope
+				if err := json.Unmarshal([]byte(msg.Payload), &scope); err != nil || scope.Validate() != nil {
+					c.logger.Warn().Str("payload", msg.Payload).Msg("ignoring malformed purge broadcast")
+					continue
+				}
+				fn(scope)
+			}
+		}
+	}()
+}
+
+// DeletePrefix removes every key starting with prefix and returns how many it
+// removed. The prefix is matched literally: glob characters in it are escaped,
+// because object keys may legitimately contain them.
+func (c *redisCache) DeletePrefix(ctx context.Context, prefix string) (int, error) {
+	start := time.Now()
+	pattern := escapeGlob(prefix) + "*"
+	deleted := 0
+	var err error
+	defer func() { c.observePurge(start, err, pattern) }()
+
+	var cursor uint64
+	for {
+		var keys []string
+		keys, cursor, err = c.client.Scan(ctx, cursor, pattern, purgeScanCount).Result()
+		if err != nil {
+			return deleted, err
+		}
+		if len(keys) > 0 {
+			// UNLINK frees the values off the main thread; variant hashes hold
+			// whole images and a bucket purge may drop thousands of them.
+			var n int64
+			n, err = c.client.Unlink(ctx, keys...).Result()
+			deleted += int(n)
+			if err != nil {
+				return deleted, err
+			}
+		}
+		if cursor == 0 {
+			return deleted, nil
+		}
+	}
+}
+
+func (c *redisCache) observePurge(start time.Time, err error, target string) {
+	status := "success"
+	if err != nil {
+		status = "error"
+		c.logger.Error().Err(err).Str("target", target).Msg("Cache purge failed")
+	}
+	observability.CacheOperations.WithLabelValues("purge", status).Inc()
+	observability.CacheOperationDuration.WithLabelValues("purge", status).Observe(time.Since(start).Seconds())
+}
+
+// escapeGlob makes s match only itself in a Redis MATCH pattern.
+func escapeGlob(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		if strings.ContainsRune(`*?[]\`, r) {
+			b.WriteByte('\\')
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
 func (c *redisCache) Close() error {
 	start := time.Now()
 	var err error
@@ -1,6 +1,7 @@
 package service
 
 import (
+	"context"
 	"testing"
 	"time"
 )
@@ -137,3 +138,107 @@ func TestCacheService(t *testing.T) {
 		}
 	})
 }
+
+func TestPurgeScopeValidate(t *testing.T) {
+	for name, tc := range map[string]struct {
+		scope PurgeScope
+		ok    bool
+	}{
+		"bucket":         {PurgeScope{Bucket: "photos"}, true},
+		"exact key":      {PurgeScope{Bucket: "photos", Key: "a.jpg"}, true},
+		"prefix":         {PurgeScope{Bucket: "photos", Prefix: "2026/"}, true},
+		"no bucket":      {PurgeScope{Key: "a.jpg"}, false},
+		"key and prefix": {PurgeScope{Bucket: "photos", Key: "a.jpg", Prefix: "a"}, false},
+		// A colon would let the bucket part reach into another bucket's keys.
+		"colon in bucket": {PurgeScope{Bucket: "photos:2026"}, false},
+	} {
+		t.Run(name, func(t *testing.T) {
+			if err := tc.scope.Validate(); (err == nil) != tc.ok {
+				t.Fatalf("Validate() = %v, want ok=%v", err, tc.ok)
+			}
+		})
+	}
+}
+
+func TestEscapeGlobMatchesLiterally(t *testing.T) {
+	if got := escapeGlob(`a*b?[c]\d`); got != `a\*b\?\[c\]\\d` {
+		t.Fatalf("escapeGlob = %q", got)
+	}
+}
+
+// The purge has to reach every size of the object it names and nothing else:
+// not a neighbouring key that shares a prefix, not another bucket, and not the
+// rate limiter's counters that live in the same database.
+func TestPurgeVariantsIsScoped(t *testing.T) {
+	cache, err := NewCacheService()
+	if err != nil {
+		t.Skipf("Redis not available (%v); start it (docker compose up -d redis) to run this test", err)
+	}
+	defer cache.Close()
+	t.Setenv("CACHE_KEY_PREFIX", "cdn-purge-test")
+	ctx := context.Background()
+
+	seed := func() {
+		for _, v := range []struct {
+			bucket, key string
+			w           uint
+		}{
+			{"photos", "2026/a.jpg", 100},
+			{"photos", "2026/a.jpg", 200},
+			{"photos", "2026/a.jpg.bak", 100},
+			{"photos", "2025/b.jpg", 100},
+			{"photos", "odd[1]*.jpg", 100},
+			{"docs", "2026/a.jpg", 100},
+		} {
+			if err := cache.SetResizedImage(v.bucket, v.key, v.w, v.w, []byte("x")); err != nil {
+				t.Fatalf("seed: %v", err)
+			}
+		}
+		if err := cache.Set("cdn-purge-test:ratelimit:1.2.3.4", []byte("7"), time.Minute); err != nil {
+			t.Fatalf("seed limiter: %v", err)
+		}
+	}
+	cached := func(bucket, key string) bool {
+		_, err := cache.GetResizedImage(bucket, key, 100, 100)
+		return err == nil
+	}
+	t.Cleanup(func() { _, _ = cache.DeletePrefix(ctx, "cdn-purge-test:") })
+
+	seed()
+	if n, err := cache.PurgeVariants(ctx, PurgeScope{Bucket: "photos", Key: "2026/a.jpg"}); err != nil || n != 1 {
+		t.Fatalf("exact purge = (%d, %v), want (1, nil)", n, err)
+	}
+	if cached("photos", "2026/a.jpg") {
+		t.Error("exact purge left the object's variants")
+	}
+	if _, err := cache.GetResizedImage("photos", "2026/a.jpg", 200, 200); err == nil {
+		t.Error("exact purge left another size of the same object")
+	}
+	if !cached("photos", "2026/a.jpg.bak") {
+		t.Error("exact purge removed a key that only shares a prefix")
+	}
+
+	seed()
+	if n, err := cache.PurgeVariants(ctx, PurgeScope{Bucket: "photos", Prefix: "2026/"}); err != nil || n != 2 {
+		t.Fatalf("prefix purge = (%d, %v), want (2, nil)", n, err)
+	}
+	if !cached("photos", "2025/b.jpg") || !cached("docs", "2026/a.jpg") {
+		t.Error("prefix purge reached outside its prefix")
+	}
+
+	// Glob characters in a prefix are literal.
+	if n, _ := cache.PurgeVariants(ctx, PurgeScope{Bucket: "photos", Prefix: "odd["}); n != 1 {
+		t.Errorf("literal prefix purge removed %d, want 1", n)
+	}
+
+	seed()
+	if n, err := cache.PurgeVariants(ctx, PurgeScope{Bucket: "photos"}); err != nil || n != 4 {
+		t.Fatalf("bucket purge = (%d, %v), want (4, nil)", n, err)
+	}
+	if !cached("docs", "2026/a.jpg") {
+		t.Error("bucket purge reached another bucket")
+	}
+	if _, err := cache.Get("cdn-purge-test:ratelimit:1.2.3.4"); err != nil {
+		t.Errorf("bucket purge touched the rate limiter: %v", err)
+	}
+}
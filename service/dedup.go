@@ -0,0 +1,327 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/minio/minio-go/v7"
+	"github.com/rs/zerolog"
+
+	"github.com/mstgnz/cdn/pkg/bucket"
+	"github.com/mstgnz/cdn/pkg/config"
+	"github.com/mstgnz/cdn/pkg/observability"
+)
+
+// MetaSHA256 is the user metadata key under which an upload records the
+// SHA-256 of its bytes. minio-go hands it back under the same name.
+const MetaSHA256 = "Sha256"
+
+// dedupWriteAttempts bounds the retries of an index update that lost a race.
+const dedupWriteAttempts = 5
+
+// ErrDedupStale is returned when an index entry no longer describes the object
+// the caller meant: it was released, or now names another object.
+var ErrDedupStale = errors.New("dedup: index entry changed")
+
+// DedupEntry is the index record of one distinct content in one bucket.
+//
+// Every reference is named so that it can only be given back once: a delete
+// that is retried, or repeated by a client that did not see the first answer,
+// would otherwise count down the references of uploads that never asked for
+// anything, and the last holder's link would go with them. Original is the
+// upload that stored the object, which a delete naming no reference gives
+// back; Holders are the uploads answered with it, each by the reference its
+// answer carried. Refs is their total, kept for whoever reads the index.
+type DedupEntry struct {
+	Object   string    `json:"object"`
+	Refs     int       `json:"refs"`
+	Original bool      `json:"original"`
+	Holders  []string  `json:"holders,omitempty"`
+	Created  time.Time `json:"created"`
+}
+
+// count brings Refs up to date with the references held.
+func (e *DedupEntry) count() {
+	e.Refs = len(e.Holders)
+	if e.Original {
+		e.Refs++
+	}
+}
+
+// DedupIndex maps the SHA-256 of stored bytes to the object holding them, per
+// bucket, and counts the uploads that were answered with that object.
+//
+// The index lives in MinIO, in its own bucket, one small JSON object per
+// digest under "<bucket>/<h2>/<h>". Redis would be quicker but is a cache here
+// and is allowed to forget; an index that forgets a reference count turns a
+// delete by one uploader into a 404 for everybody else, which is the one thing
+// this must never do.
+//
+// Updates are read-modify-write. Within a process they are serialised per
+// digest; across replicas every write is conditional on what was read, and
+// retried when it loses: If-None-Match: * where there was no entry, If-Match
+// on the ETag where there was one. Two replicas storing the same new content
+// at the same instant therefore cannot both claim it; the one that loses
+// keeps an ordinary, unindexed object, which is a missed saving, not a lost
+// file.
+//
+// An entry whose last reference goes is not deleted but overwritten with a
+// tombstone, an entry with no references, because MinIO has no conditional
+// delete. An unconditional one would remove whatever the entry had become
+// since it was read, such as a reference another replica just added to an
+// upload it answered, whose object the caller is then told to delete. A
+// tombstone reads as no entry, and the next claim writes over it by its ETag.
+//
+// A nil *DedupIndex is valid and disabled, so callers need no checks.
+type DedupIndex struct {
+	store  ObjectStore
+	bucket string
+	logger zerolog.Logger
+	locks  [64]sync.Mutex
+	now    func() time.Time
+}
+
+// DedupIndexBucket is the bucket the digest index is kept in.
+func DedupIndexBucket() string {
+	return config.GetEnvOrDefault("DEDUP_INDEX_BUCKET", "cdn-dedup-index")
+}
+
+// NewDedupIndex returns the digest index, or nil when no bucket policy turns
+// deduplication on.
+func NewDedupIndex(store ObjectStore) (*DedupIndex, error) {
+	if !config.DedupConfigured() {
+		return nil, nil
+	}
+	name := DedupIndexBucket()
+	if err := bucket.Validate(name); err != nil {
+		return nil, fmt.Errorf("DEDUP_INDEX_BUCKET: %w", err)
+	}
+	return &DedupIndex{store: store, bucket: name, logger: observability.Logger(), now: time.Now}, nil
+}
+
+// Enabled reports whether there is an index at all.
+func (d *DedupIndex) Enabled() bool {
+	return d != nil
+}
+
+// EnsureBucket creates the index bucket on first boot.
+func (d *DedupIndex) EnsureBucket(ctx context.Context) error {
+	if d == nil {
+		return nil
+	}
+	exists, err := d.store.BucketExists(ctx, d.bucket)
+	if err != nil || exists {
+		return err
+	}
+	return d.store.MakeBucket(ctx, d.bucket, minio.MakeBucketOptions{})
+}
+
+func dedupKey(bucketName, sum string) string {
+	return bucketName + "/" + sum[:2] + "/" + sum
+}
+
+func (d *DedupIndex) lock(key string) func() {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(key))
+	m := &d.locks[h.Sum32()%uint32(len(d.locks))]
+	m.Lock()
+	return m.Unlock
+}
+
+// Lookup returns the entry for a digest, if there is one.
+func (d *DedupIndex) Lookup(ctx context.Context, bucketName, sum string) (DedupEntry, bool, error) {
+	if d == nil || len(sum) < 2 {
+		return DedupEntry{}, false, nil
+	}
+	entry, _, found, err := d.read(ctx, dedupKey(bucketName, sum))
+	return entry, found, err
+}
+
+// Claim records object as the holder of a digest with one reference. It
+// reports false, and changes nothing, when the digest is already claimed.
+func (d *DedupIndex) Claim(ctx context.Context, bucketName, sum, object string) (bool, error) {
+	claimed := false
+	err := d.update(ctx, bucketName, sum, func(entry *DedupEntry, found bool) (bool, error) {
+		// Set on every attempt: a write that lost to another claim is retried
+		// and finds the entry.
+		claimed = !found
+		if found {
+			return false, nil
+		}
+		*entry = DedupEntry{Object: object, Refs: 1, Original: true, Created: d.now().UTC()}
+		return true, nil
+	})
+	return claimed, err
+}
+
+// AddRef counts one more upload answered with object and returns the
+// reference it holds, for the upload's answer, and the new count. ErrDedupStale
+// means the entry went away or moved on meanwhile.
+func (d *DedupIndex) AddRef(ctx context.Context, bucketName, sum, object string) (string, int, error) {
+	ref := uuid.New().String()
+	refs := 0
+	err := d.update(ctx, bucketName, sum, func(entry *DedupEntry, found bool) (bool, error) {
+		if !found || entry.Object != object {
+			return false, ErrDedupStale
+		}
+		entry.Holders = append(entry.Holders, ref)
+		entry.count()
+		refs = entry.Refs
+		return true, nil
+	})
+	return ref, refs, err
+}
+
+// Release gives back the reference ref to object, "" for the upload that
+// stored it, and returns how many are left. A reference that is not held,
+// because it was given back already or never existed, changes nothing. At zero
+// the entry is cleared and the object is the caller's to delete.
+// ErrDedupStale means the index does not count references to object, so a
+// delete is an ordinary delete.
+func (d *DedupIndex) Release(ctx context.Context, bucketName, sum, object, ref string) (int, error) {
+	refs := 0
+	err := d.update(ctx, bucketName, sum, func(entry *DedupEntry, found bool) (bool, error) {
+		if !found || entry.Object != object {
+			return false, ErrDedupStale
+		}
+		refs = entry.Refs
+		if ref == "" {
+			if !entry.Original {
+				return false, nil
+			}
+			entry.Original = false
+		} else {
+			held := slices.Index(entry.Holders, ref)
+			if held < 0 {
+				return false, nil
+			}
+			entry.Holders = slices.Delete(entry.Holders, held, held+1)
+		}
+		entry.count()
+		refs = entry.Refs
+		return true, nil
+	})
+	return refs, err
+}
+
+// Drop removes the entry for a digest when it still names object. It is for
+// entries whose object has gone without going through Release.
+func (d *DedupIndex) Drop(ctx context.Context, bucketName, sum, object string) error {
+	return d.update(ctx, bucketName, sum, func(entry *DedupEntry, found bool) (bool, error) {
+		if !found || entry.Object != object {
+			return false, nil
+		}
+		entry.Refs = 0
+		return true, nil
+	})
+}
+
+// Detach removes the entry for a digest when it names object and at most one
+// upload holds it, so the object is no longer handed out, and returns how many
+// held it. Held by more, the entry is left as it is. It is for an object about
+// to stop being what its entry promises, content the next upload can be
+// answered with: one whose metadata changes no longer matches uploads that
+// carried none. Checking the count and removing the entry are one conditional
+// write, so a reference added meanwhile makes it look again.
+func (d *DedupIndex) Detach(ctx context.Context, bucketName, sum, object string) (int, error) {
+	refs := 0
+	err := d.update(ctx, bucketName, sum, func(entry *DedupEntry, found bool) (bool, error) {
+		refs = 0
+		if !found || entry.Object != object {
+			return false, nil
+		}
+		refs = entry.Refs
+		if refs > 1 {
+			return false, nil
+		}
+		entry.Refs = 0
+		return true, nil
+	})
+	if errors.Is(err, ErrDedupStale) {
+		return 0, nil
+	}
+	return refs, err
+}
+
+// update applies fn to the entry for a digest and writes the result when fn
+// asks for it; an entry left with no references is written as a tombstone.
+func (d *DedupIndex) update(ctx context.Context, bucketName, sum string, fn func(entry *DedupEntry, found bool) (bool, error)) error {
+	if d == nil || len(sum) < 2 {
+		return ErrDedupStale
+	}
+	key := dedupKey(bucketName, sum)
+	unlock := d.lock(key)
+	defer unlock()
+
+	for attempt := 0; attempt < dedupWriteAttempts; attempt++ {
+		entry, etag, found, err := d.read(ctx, key)
+		if err != nil {
+			return err
+		}
+		write, err := fn(&entry, found)
+		if err != nil || !write {
+			return err
+		}
+		if entry.Refs <= 0 {
+			entry = DedupEntry{}
+		}
+
+		body, err := json.Marshal(entry)
+		if err != nil {
+			return err
+		}
+		opts := minio.PutObjectOptions{ContentType: "application/json"}
+		if etag != "" {
+			opts.SetMatchETag(etag)
+		} else {
+			opts.SetMatchETagExcept("*")
+		}
+		_, err = d.store.PutObject(ctx, d.bucket, key, bytes.NewReader(body), int64(len(body)), opts)
+		if err == nil {
+			return nil
+		}
+		if minio.ToErrorResponse(err).Code != "PreconditionFailed" {
+			return err
+		}
+		d.logger.Debug().Str("key", key).Msg("dedup: index entry changed under an update, retrying")
+	}
+	return fmt.Errorf("dedup: index entry %s kept changing", key)
+}
+
+// read returns the entry under key and the ETag to write it back with. A
+// tombstone has an ETag but is not found.
+func (d *DedupIndex) read(ctx context.Context, key string) (DedupEntry, string, bool, error) {
+	info, err := d.store.StatObject(ctx, d.bucket, key, minio.StatObjectOptions{})
+	if err != nil {
+		if minio.ToErrorResponse(err).Code == "NoSuchKey" {
+			return DedupEntry{}, "", false, nil
+		}
+		return DedupEntry{}, "", false, err
+	}
+	rc, err := d.store.OpenObject(ctx, d.bucket, key)
+	if err != nil {
+		return DedupEntry{}, "", false, err
+	}
+	defer rc.Close()
+	raw, err := io.ReadAll(rc)
+	if err != nil {
+		return DedupEntry{}, "", false, err
+	}
+	var entry DedupEntry
+	if err := json.Unmarshal(raw, &entry); err != nil {
+		return DedupEntry{}, "", false, fmt.Errorf("dedup: index entry %s: %w", key, err)
+	}
+	if entry.Refs <= 0 {
+		return DedupEntry{}, info.ETag, false, nil
+	}
+	return entry, info.ETag, true, nil
+}
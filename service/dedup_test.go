@@ -0,0 +1,164 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"strings"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+
+	"github.com/mstgnz/cdn/pkg/config"
+)
+
+func loadDedupPolicy(t *testing.T, body string) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "buckets.json")
+	if err := os.WriteFile(path, []byte(body), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := config.LoadBucketPolicies(path); err != nil {
+		t.Fatalf("load policies: %v", err)
+	}
+	t.Cleanup(func() { _, _ = config.LoadBucketPolicies(filepath.Join(t.TempDir(), "absent.json")) })
+}
+
+// No bucket asks for dedup, so there is no index and no bucket to create; and
+// a user bucket that happens to share the index's name is left alone.
+func TestDedupIndexOnlyWhenAPolicyAsksForIt(t *testing.T) {
+	if d, err := NewDedupIndex(&fakeStore{}); d != nil || err != nil {
+		t.Fatalf("without a policy: (%v, %v)", d, err)
+	}
+	if InternalBucket(DedupIndexBucket()) {
+		t.Fatal("index bucket reserved while dedup is off")
+	}
+
+	loadDedupPolicy(t, `{"buckets":[{"bucket":"logos","dedup":true},{"bucket":"photos","dedup":false}]}`)
+	d, err := NewDedupIndex(&fakeStore{})
+	if err != nil || !d.Enabled() {
+		t.Fatalf("with a policy: (%v, %v)", d, err)
+	}
+	if !InternalBucket(DedupIndexBucket()) {
+		t.Fatal("index bucket is not internal")
+	}
+	if !config.DedupFor("logos") || config.DedupFor("photos") || config.DedupFor("other") {
+		t.Fatal("DedupFor does not follow the policy")
+	}
+}
+
+func TestDedupIndexRejectsAnInvalidBucketName(t *testing.T) {
+	loadDedupPolicy(t, `{"defaults":{"dedup":true}}`)
+	t.Setenv("DEDUP_INDEX_BUCKET", "Not_A_Bucket")
+	if _, err := NewDedupIndex(&fakeStore{}); err == nil {
+		t.Fatal("accepted an invalid index bucket")
+	}
+}
+
+// racingStore makes the first stat of each of n callers wait for all of them,
+// so every replica reads an index entry before any writes it back.
+type racingStore struct {
+	*jobStore
+	arrived sync.WaitGroup
+}
+
+func newRacingStore(n int) *racingStore {
+	s := &racingStore{jobStore: newJobStore()}
+	s.arrived.Add(n)
+	return s
+}
+
+func (s *racingStore) StatObject(ctx context.Context, bucket, key string, opts minio.StatObjectOptions) (minio.ObjectInfo, error) {
+	info, err := s.jobStore.StatObject(ctx, bucket, key, opts)
+	if w, ok := ctx.Value(raceArrival{}).(*sync.Once); ok {
+		w.Do(func() { s.arrived.Done(); s.arrived.Wait() })
+	}
+	return info, err
+}
+
+type raceArrival struct{}
+
+// replicas runs fn once per replica, each with an index of its own, so the
+// in-process lock does not serialise them, and waits for all of them.
+func replicas(store ObjectStore, fns ...func(ctx context.Context, d *DedupIndex)) {
+	var done sync.WaitGroup
+	for _, fn := range fns {
+		d := &DedupIndex{store: store, bucket: "index", now: time.Now}
+		ctx := context.WithValue(context.Background(), raceArrival{}, new(sync.Once))
+		done.Add(1)
+		go func() {
+			defer done.Done()
+			fn(ctx, d)
+		}()
+	}
+	done.Wait()
+}
+
+// Two replicas that both find a digest unclaimed cannot both claim it: the
+// entry is created with If-None-Match: *.
+func TestDedupClaimIsCreatedOnce(t *testing.T) {
+	store := newRacingStore(2)
+	sum := strings.Repeat("ab", 32)
+	claimed := make([]bool, 2)
+	claim := func(n int, object string) func(context.Context, *DedupIndex) {
+		return func(ctx context.Context, d *DedupIndex) {
+			ok, err := d.Claim(ctx, "logos", sum, object)
+			if err != nil {
+				t.Error(err)
+			}
+			claimed[n] = ok
+		}
+	}
+	replicas(store, claim(0, "a.png"), claim(1, "b.png"))
+
+	if claimed[0] == claimed[1] {
+		t.Fatalf("claimed = %v, want exactly one", claimed)
+	}
+	winner := map[bool]string{true: "a.png", false: "b.png"}[claimed[0]]
+	d := &DedupIndex{store: store.jobStore, bucket: "index", now: time.Now}
+	if entry, found, _ := d.Lookup(context.Background(), "logos", sum); !found || entry.Object != winner || entry.Refs != 1 {
+		t.Fatalf("entry = %+v, %v; want %s with one reference", entry, found, winner)
+	}
+}
+
+// The last reference going races another replica adding one. Whichever
+// writes second sees the first: either the release leaves a reference and
+// the object stays, or the entry was cleared and the new upload is told so,
+// and stores its own copy. Never both, which would delete the object the new
+// upload was answered with.
+func TestDedupReleaseToZeroDoesNotDropANewReference(t *testing.T) {
+	store := newRacingStore(2)
+	sum := strings.Repeat("cd", 32)
+	d := &DedupIndex{store: store.jobStore, bucket: "index", now: time.Now}
+	if ok, err := d.Claim(context.Background(), "logos", sum, "a.png"); !ok || err != nil {
+		t.Fatal(ok, err)
+	}
+
+	var left int
+	var releaseErr, addErr error
+	replicas(store,
+		func(ctx context.Context, d *DedupIndex) { left, releaseErr = d.Release(ctx, "logos", sum, "a.png", "") },
+		func(ctx context.Context, d *DedupIndex) { _, _, addErr = d.AddRef(ctx, "logos", sum, "a.png") },
+	)
+	if releaseErr != nil {
+		t.Fatal(releaseErr)
+	}
+	entry, found, _ := d.Lookup(context.Background(), "logos", sum)
+	switch {
+	case addErr == nil && left == 1 && found && entry.Refs == 1:
+	case errors.Is(addErr, ErrDedupStale) && left == 0 && !found:
+	default:
+		t.Fatalf("release left %d, add err %v, entry %+v (found %v)", left, addErr, entry, found)
+	}
+
+	// A cleared entry is a tombstone the next claim writes over.
+	if !found {
+		if ok, err := d.Claim(context.Background(), "logos", sum, "b.png"); !ok || err != nil {
+			t.Fatalf("claim over a tombstone = (%v, %v)", ok, err)
+		}
+	}
+}
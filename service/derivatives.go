@@ -0,0 +1,397 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/rs/zerolog"
+
+	"github.com/mstgnz/cdn/pkg/bucket"
+	"github.com/mstgnz/cdn/pkg/config"
+	"github.com/mstgnz/cdn/pkg/observability"
+)
+
+// Derivative objects carry the source they were made from, so a scoped purge
+// can find them and so whoever browses the bucket can tell what they are.
+const (
+	derivativeMetaBucket = "Source-Bucket"
+	derivativeMetaKey    = "Source-Key"
+)
+
+// DerivativeStore keeps generated variants as objects in a dedicated MinIO
+// bucket.
+//
+// Redis holds variants for a day and only as many as fit in memory, which is
+// fine for the hot set and useless for the long tail: a catalogue page visited
+// once a week decodes every thumbnail on it every time. Disk is the cheap tier
+// for that, and MinIO is already the disk.
+//
+// Keys are deterministic: "<bucket>/<h2>/<h>/<params>-<etag>", where h is the
+// SHA-256 of the source key. The ETag makes a replaced source miss rather than
+// serve its predecessor's thumbnails, so correctness does not depend on every
+// overwrite path remembering to purge. Hashing the key keeps one source's
+// derivatives under one prefix no matter what characters the key contains,
+// which is what makes cleanup on delete a single listing.
+//
+// The bucket is capped in bytes by an eviction job that removes the least
+// recently used derivatives first. MinIO records no access time, so a hit
+// rewrites the object's metadata at most once per DERIVATIVES_TOUCH_HOURS to
+// move its LastModified forward; recency is therefore known to within that
+// resolution, which is plenty for deciding what to throw away.
+//
+// A nil *DerivativeStore is valid and disabled, so callers need no checks.
+type DerivativeStore struct {
+	store      ObjectStore
+	bucket     string
+	maxBytes   int64
+	interval   time.Duration
+	touchAfter time.Duration
+	logger     zerolog.Logger
+
+	// writes bounds background writes. A burst of first requests must not
+	// become an unbounded number of goroutines each holding an image; a write
+	// that finds no slot is skipped and happens on a later request.
+	writes chan struct{}
+	now    func() time.Time
+}
+
+// DerivativesBucket is the configured derivative bucket, or "" when the store
+// is off. Jobs that walk every bucket use it to leave this one alone.
+func DerivativesBucket() string {
+	return strings.TrimSpace(config.GetEnvOrDefault("DERIVATIVES_BUCKET", ""))
+}
+
+// NewDerivativeStore reads its configuration from the environment. It returns
+// nil, and no error, when DERIVATIVES_BUCKET is unset.
+func NewDerivativeStore(store ObjectStore) (*DerivativeStore, error) {
+	name := DerivativesBucket()
+	if name == "" {
+		return nil, nil
+	}
+	if err := bucket.Validate(name); err != nil {
+		return nil, fmt.Errorf("DERIVATIVES_BUCKET: %w", err)
+	}
+
+	maxMB := config.GetEnvAsIntOrDefault("DERIVATIVES_MAX_MB", 10240)
+	if maxMB < 1 {
+		return nil, fmt.Errorf("DERIVATIVES_MAX_MB must be positive, got %d", maxMB)
+	}
+	minutes := config.GetEnvAsIntOrDefault("DERIVATIVES_EVICT_INTERVAL_MINUTES", 60)
+	if minutes < 1 {
+		minutes = 1
+	}
+	touchHours := config.GetEnvAsIntOrDefault("DERIVATIVES_TOUCH_HOURS", 24)
+	if touchHours < 1 {
+		touchHours = 1
+	}
+
+	return &DerivativeStore{
+		store:      store,
+		bucket:     name,
+		maxBytes:   int64(maxMB) << 20,
+		interval:   time.Duration(minutes) * time.Minute,
+		touchAfter: time.Duration(touchHours) * time.Hour,
+		logger:     observability.Logger(),
+		writes:     make(chan struct{}, 4),
+		now:        time.Now,
+	}, nil
+}
+
+// Enabled reports whether derivatives are stored at all.
+func (d *DerivativeStore) Enabled() bool {
+	return d != nil
+}
+
+// Bucket is the bucket derivatives are written to.
+func (d *DerivativeStore) Bucket() string {
+	if d == nil {
+		return ""
+	}
+	return d.bucket
+}
+
+// EnsureBucket creates the derivative bucket when it does not exist yet.
+func (d *DerivativeStore) EnsureBucket(ctx context.Context) error {
+	if !d.Enabled() {
+		return nil
+	}
+	exists, err := d.store.BucketExists(ctx, d.bucket)
+	if err != nil {
+		return err
+	}
+	if exists {
+		return nil
+	}
+	return d.store.MakeBucket(ctx, d.bucket, minio.MakeBucketOptions{})
+}
+
+// DerivativeKey is the object key a variant of bucket/key is stored under.
+func DerivativeKey(srcBucket, srcKey, params, etag string) string {
+	return derivativePrefix(srcBucket, srcKey) + params + "-" + cleanETag(etag)
+}
+
+func derivativePrefix(srcBucket, srcKey string) string {
+	sum := sha256.Sum256([]byte(srcKey))
+	h := hex.EncodeToString(sum[:])
+	return srcBucket + "/" + h[:2] + "/" + h + "/"
+}
+
+// cleanETag keeps an ETag usable inside a key. MinIO's are hex, with a "-N"
+// suffix for multipart uploads; quotes and anything else are dropped.
+func cleanETag(etag string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= '0' && r <= '9', r >= 'a' && r <= 'f', r >= 'A' && r <= 'F', r == '-':
+			return r
+		}
+		return -1
+	}, etag)
+}
+
+// Get returns a stored variant. An empty etag always misses: without it there
+// is no way to know the derivative was made from the bytes being served now,
+// which is the case for objects served from the archive.
+func (d *DerivativeStore) Get(ctx context.Context, srcBucket, srcKey string, width, height uint, etag string) ([]byte, bool) {
+	if !d.Enabled() || cleanETag(etag) == "" {
+		return nil, false
+	}
+
+	key := DerivativeKey(srcBucket, srcKey, variantField(width, height), etag)
+	info, err := d.store.StatObject(ctx, d.bucket, key, minio.StatObjectOptions{})
+	if err != nil {
+		observability.CacheOperations.WithLabelValues("get_derivative", "miss").Inc()
+		return nil, false
+	}
+	rc, err := d.store.OpenObject(ctx, d.bucket, key)
+	if err != nil {
+		observability.CacheOperations.WithLabelValues("get_derivative", "error").Inc()
+		return nil, false
+	}
+	defer rc.Close()
+	data, err := io.ReadAll(rc)
+	if err != nil || len(data) == 0 {
+		observability.CacheOperations.WithLabelValues("get_derivative", "error").Inc()
+		return nil, false
+	}
+	observability.CacheOperations.WithLabelValues("get_derivative", "hit").Inc()
+
+	if d.now().Sub(info.LastModified) > d.touchAfter {
+		d.background(func() { d.touch(srcBucket, srcKey, key) })
+	}
+	return data, true
+}
+
+// Put stores a variant in the background and returns at once. The response
+// that produced the variant has no reason to wait for disk. When the
+// background slots are all busy the write is skipped; the variant is simply
+// recomputed on a later miss.
+func (d *DerivativeStore) Put(srcBucket, srcKey string, width, height uint, etag string, data []byte) {
+	if !d.Enabled() || cleanETag(etag) == "" || len(data) == 0 {
+		return
+	}
+	d.background(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		defer cancel()
+		_ = d.Store(ctx, srcBucket, srcKey, width, height, etag, data)
+	})
+}
+
+// Store writes a variant and waits for it. It is for callers that are already
+// off the request path and must not lose the write to a busy moment, such as
+// the eager preset generation that runs after an upload. A disabled store, an
+// empty ETag or empty data is a no-op rather than an error.
+func (d *DerivativeStore) Store(ctx context.Context, srcBucket, srcKey string, width, height uint, etag string, data []byte) error {
+	if !d.Enabled() || cleanETag(etag) == "" || len(data) == 0 {
+		return nil
+	}
+	key := DerivativeKey(srcBucket, srcKey, variantField(width, height), etag)
+	_, err := d.store.PutObject(ctx, d.bucket, key, bytes.NewReader(data), int64(len(data)), minio.PutObjectOptions{
+		ContentType:  http.DetectContentType(data),
+		UserMetadata: derivativeMeta(srcBucket, srcKey),
+	})
+	status := "success"
+	if err != nil {
+		status = "error"
+		d.logger.Warn().Err(err).Str("key", key).Msg("derivative write failed; the variant is recomputed next time")
+	}
+	observability.CacheOperations.WithLabelValues("set_derivative", status).Inc()
+	return err
+}
+
+func (d *DerivativeStore) background(fn func()) {
+	select {
+	case d.writes <- struct{}{}:
+		go func() {
+			defer func() { <-d.writes }()
+			fn()
+		}()
+	default:
+	}
+}
+
+func derivativeMeta(srcBucket, srcKey string) map[string]string {
+	return map[string]string{derivativeMetaBucket: srcBucket, derivativeMetaKey: srcKey}
+}
+
+// touch moves a derivative's LastModified to now by copying it onto itself.
+func (d *DerivativeStore) touch(srcBucket, srcKey, key string) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	_, err := d.store.CopyObject(ctx,
+		minio.CopyDestOptions{Bucket: d.bucket, Object: key, ReplaceMetadata: true, UserMetadata: derivativeMeta(srcBucket, srcKey)},
+		minio.CopySrcOptions{Bucket: d.bucket, Object: key},
+	)
+	if err != nil {
+		d.logger.Debug().Err(err).Str("key", key).Msg("derivative touch failed; it may be evicted as if unused")
+	}
+}
+
+// Purge removes stored derivatives in scope and returns how many it removed.
+//
+// An exact key and a whole bucket are one listing each. A prefix cannot be
+// answered from keys, because those are hashed, so the bucket's derivatives are
+// listed with their metadata and matched on the source key they record.
+func (d *DerivativeStore) Purge(ctx context.Context, scope PurgeScope) (int, error) {
+	if !d.Enabled() {
+		return 0, nil
+	}
+	if err := scope.Validate(); err != nil {
+		return 0, err
+	}
+
+	opts := minio.ListObjectsOptions{Recursive: true, Prefix: scope.Bucket + "/"}
+	if scope.Key != "" {
+		opts.Prefix = derivativePrefix(scope.Bucket, scope.Key)
+	}
+	byPrefix := scope.Key == "" && scope.Prefix != ""
+	opts.WithMetadata = byPrefix
+
+	removed := 0
+	for obj := range d.store.ListObjects(ctx, d.bucket, opts) {
+		if obj.Err != nil {
+			return removed, obj.Err
+		}
+		if byPrefix && !strings.HasPrefix(metaValue(obj.UserMetadata, derivativeMetaKey), scope.Prefix) {
+			continue
+		}
+		if err := d.store.RemoveObject(ctx, d.bucket, obj.Key, minio.RemoveObjectOptions{}); err != nil {
+			return removed, err
+		}
+		removed++
+	}
+	return removed, nil
+}
+
+// metaValue finds a user metadata value whatever case and prefix the listing
+// returned it under; MinIO reports listing metadata with the X-Amz-Meta- prefix
+// and StatObject without it.
+func metaValue(meta map[string]string, name string) string {
+	for k, v := range meta {
+		k = strings.TrimPrefix(strings.ToLower(k), "x-amz-meta-")
+		if k == strings.ToLower(name) {
+			return v
+		}
+	}
+	return ""
+}
+
+// EvictionStats summarises one pass of the eviction job.
+type EvictionStats struct {
+	Scanned    int
+	Bytes      int64
+	Removed    int
+	BytesFreed int64
+}
+
+// Start runs the eviction job on its interval until ctx is cancelled.
+func (d *DerivativeStore) Start(ctx context.Context) {
+	if !d.Enabled() {
+		return
+	}
+	d.logger.Info().
+		Str("bucket", d.bucket).
+		Int64("max_bytes", d.maxBytes).
+		Dur("interval", d.interval).
+		Msg("derivative store enabled")
+
+	go func() {
+		ticker := time.NewTicker(d.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				stats, err := d.Evict(ctx)
+				ev := d.logger.Info()
+				if err != nil {
+					ev = d.logger.Error().Err(err)
+				}
+				ev.Int("scanned", stats.Scanned).
+					Int64("bytes", stats.Bytes).
+					Int("removed", stats.Removed).
+					Int64("bytes_freed", stats.BytesFreed).
+					Msg("derivative eviction finished")
+			}
+		}
+	}()
+}
+
+// Evict brings the bucket back under its cap, least recently used first.
+//
+// It goes down to 90% of the cap rather than to the cap itself, so a bucket
+// sitting at its limit is not trimmed by a handful of objects on every pass.
+// Derivatives can always be regenerated, so the only cost of evicting the wrong
+// one is a decode.
+func (d *DerivativeStore) Evict(ctx context.Context) (EvictionStats, error) {
+	var stats EvictionStats
+	if !d.Enabled() {
+		return stats, nil
+	}
+
+	type entry struct {
+		key  string
+		size int64
+		used time.Time
+	}
+	var entries []entry
+	for obj := range d.store.ListObjects(ctx, d.bucket, minio.ListObjectsOptions{Recursive: true}) {
+		if obj.Err != nil {
+			return stats, obj.Err
+		}
+		entries = append(entries, entry{obj.Key, obj.Size, obj.LastModified})
+		stats.Bytes += obj.Size
+	}
+	stats.Scanned = len(entries)
+	if stats.Bytes <= d.maxBytes {
+		return stats, nil
+	}
+
+	sort.Slice(entries, func(a, b int) bool { return entries[a].used.Before(entries[b].used) })
+	target := d.maxBytes / 10 * 9
+	remaining := stats.Bytes
+	for _, e := range entries {
+		if remaining <= target {
+			break
+		}
+		if err := ctx.Err(); err != nil {
+			return stats, err
+		}
+		if err := d.store.RemoveObject(ctx, d.bucket, e.key, minio.RemoveObjectOptions{}); err != nil {
+			return stats, err
+		}
+		remaining -= e.size
+		stats.Removed++
+		stats.BytesFreed += e.size
+	}
+	return stats, nil
+}
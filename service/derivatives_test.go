@@ -0,0 +1,200 @@
+package service
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+)
+
+func newTestDerivatives(t *testing.T, store ObjectStore, maxMB string) *DerivativeStore {
+	t.Helper()
+	t.Setenv("DERIVATIVES_BUCKET", "cdn-derivatives")
+	t.Setenv("DERIVATIVES_MAX_MB", maxMB)
+	d, err := NewDerivativeStore(store)
+	if err != nil || d == nil {
+		t.Fatalf("NewDerivativeStore = (%v, %v)", d, err)
+	}
+	return d
+}
+
+// waitFor polls for background work; derivative writes never block a response.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestDerivativeKeyIsDeterministicAndGroupsBySource(t *testing.T) {
+	a := DerivativeKey("photos", "2026/a.jpg", "100x100", `"abc123"`)
+	if a != DerivativeKey("photos", "2026/a.jpg", "100x100", "abc123") {
+		t.Fatal("same inputs produced different keys")
+	}
+	if a == DerivativeKey("photos", "2026/a.jpg", "100x100", "def456") {
+		t.Fatal("a replaced source (new ETag) would hit its predecessor's derivative")
+	}
+	prefix := derivativePrefix("photos", "2026/a.jpg")
+	if !strings.HasPrefix(a, prefix) || !strings.HasPrefix(DerivativeKey("photos", "2026/a.jpg", "50x50", "x1"), prefix) {
+		t.Fatal("derivatives of one source are not under one prefix")
+	}
+	// A key that merely extends another must not share its prefix, or deleting
+	// a.jpg would take a.jpg/b.jpg's derivatives with it.
+	if strings.HasPrefix(DerivativeKey("photos", "2026/a.jpg/b.jpg", "100x100", "abc"), prefix) {
+		t.Fatal("derivative prefixes of different sources overlap")
+	}
+}
+
+func TestDerivativeStoreDisabled(t *testing.T) {
+	t.Setenv("DERIVATIVES_BUCKET", "")
+	d, err := NewDerivativeStore(&fakeStore{})
+	if err != nil || d != nil {
+		t.Fatalf("unset bucket = (%v, %v), want (nil, nil)", d, err)
+	}
+	// Every method has to be safe on the nil store handlers are given.
+	if _, ok := d.Get(context.Background(), "photos", "a.jpg", 1, 1, "abc"); ok {
+		t.Error("disabled store hit")
+	}
+	d.Put("photos", "a.jpg", 1, 1, "abc", []byte("x"))
+	if n, err := d.Purge(context.Background(), PurgeScope{Bucket: "photos"}); n != 0 || err != nil {
+		t.Errorf("disabled purge = (%d, %v)", n, err)
+	}
+
+	t.Setenv("DERIVATIVES_BUCKET", "Not_A_Bucket")
+	if _, err := NewDerivativeStore(&fakeStore{}); err == nil {
+		t.Error("an invalid bucket name was accepted")
+	}
+}
+
+func TestDerivativeStoreRoundTrip(t *testing.T) {
+	store := &fakeStore{contents: map[string][]byte{}}
+	d := newTestDerivatives(t, store, "10")
+	ctx := context.Background()
+
+	d.Put("photos", "a.jpg", 100, 100, "abc", []byte("thumb"))
+	key := "cdn-derivatives/" + DerivativeKey("photos", "a.jpg", "100x100", "abc")
+	waitFor(t, "the derivative write", func() bool {
+		store.mu.Lock()
+		defer store.mu.Unlock()
+		return store.contents[key] != nil
+	})
+
+	got, ok := d.Get(ctx, "photos", "a.jpg", 100, 100, "abc")
+	if !ok || string(got) != "thumb" {
+		t.Fatalf("Get = (%q, %v)", got, ok)
+	}
+	if _, ok := d.Get(ctx, "photos", "a.jpg", 100, 100, "changed"); ok {
+		t.Error("hit under a different source ETag")
+	}
+	if _, ok := d.Get(ctx, "photos", "a.jpg", 100, 100, ""); ok {
+		t.Error("hit without an ETag; archived sources must always miss")
+	}
+
+	// The fake reports no LastModified, so the hit above is "old" and has to
+	// have been touched forward for the eviction job.
+	waitFor(t, "the touch", func() bool {
+		store.mu.Lock()
+		defer store.mu.Unlock()
+		return len(store.copied) > 0
+	})
+}
+
+func TestDerivativeStorePurgeIsScoped(t *testing.T) {
+	keyA := DerivativeKey("photos", "2026/a.jpg", "100x100", "e1")
+	keyA2 := DerivativeKey("photos", "2026/a.jpg", "50x50", "e1")
+	keyB := DerivativeKey("photos", "2025/b.jpg", "100x100", "e2")
+	keyOther := DerivativeKey("docs", "2026/a.jpg", "100x100", "e3")
+	meta := func(key string) map[string]string {
+		return map[string]string{"X-Amz-Meta-Source-Key": key}
+	}
+	newStore := func() *fakeStore {
+		return &fakeStore{objects: map[string][]minio.ObjectInfo{"cdn-derivatives": {
+			{Key: keyA, UserMetadata: meta("2026/a.jpg")},
+			{Key: keyA2, UserMetadata: meta("2026/a.jpg")},
+			{Key: keyB, UserMetadata: meta("2025/b.jpg")},
+			{Key: keyOther, UserMetadata: meta("2026/a.jpg")},
+		}}}
+	}
+	ctx := context.Background()
+
+	for name, tc := range map[string]struct {
+		scope PurgeScope
+		want  []string
+	}{
+		"exact key": {PurgeScope{Bucket: "photos", Key: "2026/a.jpg"}, []string{keyA, keyA2}},
+		"prefix":    {PurgeScope{Bucket: "photos", Prefix: "2025/"}, []string{keyB}},
+		"bucket":    {PurgeScope{Bucket: "photos"}, []string{keyA, keyA2, keyB}},
+	} {
+		t.Run(name, func(t *testing.T) {
+			store := newStore()
+			d := newTestDerivatives(t, store, "10")
+			n, err := d.Purge(ctx, tc.scope)
+			if err != nil || n != len(tc.want) {
+				t.Fatalf("Purge = (%d, %v), want %d", n, err, len(tc.want))
+			}
+			removed := strings.Join(store.removedKeys(), ",")
+			for _, k := range tc.want {
+				if !strings.Contains(removed, k) {
+					t.Errorf("%s not removed", k)
+				}
+			}
+		})
+	}
+}
+
+func TestDerivativeEvictionRemovesLeastRecentlyUsedFirst(t *testing.T) {
+	now := time.Now()
+	mb := int64(1 << 20)
+	store := &fakeStore{objects: map[string][]minio.ObjectInfo{"cdn-derivatives": {
+		{Key: "recent", Size: mb, LastModified: now},
+		{Key: "oldest", Size: mb, LastModified: now.Add(-72 * time.Hour)},
+		{Key: "older", Size: mb, LastModified: now.Add(-48 * time.Hour)},
+		{Key: "old", Size: mb, LastModified: now.Add(-24 * time.Hour)},
+	}}}
+	// 4 MB stored against a 3 MB cap: trimming to 90% (2.7 MB) takes two.
+	d := newTestDerivatives(t, store, "3")
+
+	stats, err := d.Evict(context.Background())
+	if err != nil {
+		t.Fatalf("Evict: %v", err)
+	}
+	got := store.removedKeys()
+	if len(got) != 2 || got[0] != "cdn-derivatives/older" || got[1] != "cdn-derivatives/oldest" {
+		t.Fatalf("removed %v, want the two least recently used", got)
+	}
+	if stats.Scanned != 4 || stats.Removed != 2 || stats.BytesFreed != 2*mb {
+		t.Errorf("stats = %+v", stats)
+	}
+
+	// Under the cap nothing goes.
+	store.removed = nil
+	store.objects["cdn-derivatives"] = store.objects["cdn-derivatives"][:1]
+	if _, err := d.Evict(context.Background()); err != nil || len(store.removed) != 0 {
+		t.Fatalf("evicted under the cap: %v (%v)", store.removed, err)
+	}
+}
+
+func TestRetentionSkipsDerivativeBucket(t *testing.T) {
+	t.Setenv("DERIVATIVES_BUCKET", "cdn-derivatives")
+	old := time.Now().Add(-400 * 24 * time.Hour)
+	store := &fakeStore{
+		buckets: []string{"photos", "cdn-derivatives"},
+		objects: map[string][]minio.ObjectInfo{
+			"cdn-derivatives": {{Key: "x", Size: 10, LastModified: old}},
+		},
+	}
+	archive := &fakeArchive{enabled: true, sizes: map[string]int64{"cdn-derivatives/x": 10}}
+
+	if _, err := newTestRetention(t, store, archive, 365, false).RunOnce(context.Background(), time.Now()); err != nil {
+		t.Fatalf("RunOnce: %v", err)
+	}
+	if len(store.removed) != 0 {
+		t.Fatalf("retention swept the derivative bucket: %v", store.removed)
+	}
+}
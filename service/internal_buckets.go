@@ -0,0 +1,26 @@
+package service
+
+import "github.com/mstgnz/cdn/pkg/config"
+
+// TusStagingBucket names the bucket resumable uploads keep their chunks in
+// until the last one arrives and the object is assembled into its real bucket.
+func TusStagingBucket() string {
+	return config.GetEnvOrDefault("TUS_STAGING_BUCKET", "cdn-tus-staging")
+}
+
+// InternalBucket reports whether a bucket holds the service's own working data
+// rather than anybody's objects. Such buckets are never archived or swept:
+// everything in them is either regenerable or temporary, and each has its own
+// cleanup.
+func InternalBucket(name string) bool {
+	if name == "" {
+		return false
+	}
+	if name == DerivativesBucket() || name == TusStagingBucket() || name == JobsBucket() {
+		return true
+	}
+	if config.TrashConfigured() && name == TrashBucket() {
+		return true
+	}
+	return config.DedupConfigured() && name == DedupIndexBucket()
+}
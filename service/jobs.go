@@ -0,0 +1,559 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/minio/minio-go/v7"
+	"github.com/rs/zerolog"
+
+	"github.com/mstgnz/cdn/pkg/bucket"
+	"github.com/mstgnz/cdn/pkg/config"
+	"github.com/mstgnz/cdn/pkg/observability"
+	"github.com/mstgnz/cdn/pkg/validator"
+)
+
+// JobState is where a job is in its life.
+type JobState string
+
+const (
+	JobQueued    JobState = "queued"
+	JobRunning   JobState = "running"
+	JobSucceeded JobState = "succeeded"
+	JobFailed    JobState = "failed"
+)
+
+// Finished reports whether the state is final.
+func (s JobState) Finished() bool {
+	return s == JobSucceeded || s == JobFailed
+}
+
+// ErrJobNotFound is returned for an ID the queue has no record of.
+var ErrJobNotFound = errors.New("job not found")
+
+// ErrJobLost is what a checkpoint returns once another replica has claimed the
+// job, having taken this one's run for dead.
+var ErrJobLost = errors.New("job claimed by another replica")
+
+// jobMetaState is the user metadata key each record carries its state under,
+// so a sweep can tell finished jobs from pending ones without reading them.
+const jobMetaState = "State"
+
+// Job is one unit of background work and everything known about it. It is
+// what the status endpoint shows and what a callback receives.
+type Job struct {
+	ID    string   `json:"id"`
+	Kind  string   `json:"kind"`
+	State JobState `json:"state"`
+
+	// Owner is the scope of the principal that submitted the job; see
+	// JobOwner. Only that principal, or the general token, may read it.
+	Owner string `json:"owner"`
+
+	// Params is the request, as the job kind's handler defines it.
+	Params json.RawMessage `json:"params,omitempty"`
+
+	// Progress, for jobs made of several items.
+	Total  int `json:"total"`
+	Done   int `json:"done"`
+	Failed int `json:"failed"`
+
+	Result json.RawMessage `json:"result,omitempty"`
+	Error  string          `json:"error,omitempty"`
+
+	// CallbackURL is POSTed the finished job, and Callback says how that went:
+	// "delivered", or "failed: " and the reason.
+	CallbackURL string `json:"callback_url,omitempty"`
+	Callback    string `json:"callback,omitempty"`
+
+	Attempts   int        `json:"attempts"`
+	CreatedAt  time.Time  `json:"created_at"`
+	UpdatedAt  time.Time  `json:"updated_at"`
+	StartedAt  *time.Time `json:"started_at,omitempty"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+
+	// etag is that of the record as last read or written, for the conditional
+	// write that keeps two replicas from running the same job.
+	etag string
+}
+
+// JobOwner is the owner a job submitted by p is recorded under.
+func JobOwner(p Principal) string {
+	if p.Scoped {
+		return "bucket:" + p.Bucket
+	}
+	return "general"
+}
+
+// VisibleTo reports whether p may see the job. The general token sees every
+// job; a bucket-scoped token only those it submitted itself.
+func (j *Job) VisibleTo(p Principal) bool {
+	return !p.Scoped || j.Owner == JobOwner(p)
+}
+
+// JobFunc runs one job. It may record progress and partial results on job and
+// call checkpoint to persist them, which also tells the other replicas the job
+// is still alive: a job whose record goes JOB_STALE_MINUTES without a
+// checkpoint is taken to be abandoned and run again elsewhere, so a long step
+// has to checkpoint as it goes, not only between steps. Its error, if any,
+// fails the job.
+//
+// checkpoint returns ErrJobLost when another replica has claimed the job
+// meanwhile. ctx is cancelled at the same moment, so work that only watches
+// ctx stops as well; either way the function should return at once, since
+// nothing it does from then on is recorded.
+type JobFunc func(ctx context.Context, job *Job, checkpoint func() error) error
+
+// JobsBucket is the bucket job records are kept in.
+func JobsBucket() string {
+	return config.GetEnvOrDefault("JOBS_BUCKET", "cdn-jobs")
+}
+
+// JobQueue runs work that should not hold a request open, such as fetching a
+// URL from an origin slower than any client will wait for.
+//
+// Jobs are kept in MinIO, one JSON record per job in their own bucket, for the
+// same reason the dedup index is: a queue that lives in memory or in Redis
+// loses its work on a restart, and a client holding a job ID it can never
+// resolve is worse off than one whose request simply failed. Submit writes the
+// record before it answers, so an accepted job is never lost, only delayed.
+//
+// Workers take jobs from an in-process channel that Submit feeds, and a sweep
+// every minute picks up whatever that missed: jobs submitted while the channel
+// was full, jobs whose replica went away before running them, and running jobs
+// whose record has not been touched for JOB_STALE_MINUTES because the replica
+// running them died. Claiming a job is a write with If-Match on the record's
+// ETag, so when several replicas reach for the same one exactly one gets it. A
+// job is given up on after JOB_MAX_ATTEMPTS claims, so one that crashes its
+// worker cannot keep doing so.
+//
+// Finished records are removed after JOBS_RETENTION_HOURS; until then their
+// status can be read.
+type JobQueue struct {
+	store       ObjectStore
+	bucket      string
+	workers     int
+	stale       time.Duration
+	retain      time.Duration
+	maxAttempts int
+	secret      string
+	client      *http.Client
+	logger      zerolog.Logger
+	now         func() time.Time
+
+	mu       sync.RWMutex
+	handlers map[string]JobFunc
+	ready    chan string
+}
+
+// NewJobQueue returns the queue configured by the environment. A JOBS_BUCKET
+// that cannot be a bucket name is an error.
+func NewJobQueue(store ObjectStore) (*JobQueue, error) {
+	name := JobsBucket()
+	if err := bucket.Validate(name); err != nil {
+		return nil, fmt.Errorf("JOBS_BUCKET: %w", err)
+	}
+	workers := config.GetEnvAsIntOrDefault("JOB_WORKERS", 4)
+	if workers < 1 {
+		workers = 1
+	}
+	stale := config.GetEnvAsIntOrDefault("JOB_STALE_MINUTES", 10)
+	if stale < 1 {
+		stale = 1
+	}
+	retain := config.GetEnvAsIntOrDefault("JOBS_RETENTION_HOURS", 72)
+	if retain < 1 {
+		retain = 1
+	}
+	attempts := config.GetEnvAsIntOrDefault("JOB_MAX_ATTEMPTS", 3)
+	if attempts < 1 {
+		attempts = 1
+	}
+	timeout := config.GetEnvAsIntOrDefault("JOB_CALLBACK_TIMEOUT_SECONDS", 10)
+	return &JobQueue{
+		store:       store,
+		bucket:      name,
+		workers:     workers,
+		stale:       time.Duration(stale) * time.Minute,
+		retain:      time.Duration(retain) * time.Hour,
+		maxAttempts: attempts,
+		secret:      config.GetEnvOrDefault("JOB_CALLBACK_SECRET", ""),
+		// Callback URLs are given by clients, so they are fetched like
+		// /upload-url fetches: no private or metadata addresses.
+		client:   validator.NewSafeHTTPClient(time.Duration(timeout) * time.Second),
+		logger:   observability.Logger(),
+		now:      time.Now,
+		handlers: map[string]JobFunc{},
+		ready:    make(chan string, 1024),
+	}, nil
+}
+
+// EnsureBucket creates the jobs bucket on first boot.
+func (q *JobQueue) EnsureBucket(ctx context.Context) error {
+	exists, err := q.store.BucketExists(ctx, q.bucket)
+	if err != nil || exists {
+		return err
+	}
+	return q.store.MakeBucket(ctx, q.bucket, minio.MakeBucketOptions{})
+}
+
+// Handle registers the function that runs jobs of one kind. Register every
+// kind before Start; a job of a kind nobody handles fails.
+func (q *JobQueue) Handle(kind string, fn JobFunc) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.handlers[kind] = fn
+}
+
+func jobKey(id string) string { return id + ".json" }
+
+// Submit records a new job and queues it. job supplies the kind, owner,
+// params, total and callback; everything else is set here. The callback URL
+// must pass the same checks as a URL to upload from.
+func (q *JobQueue) Submit(ctx context.Context, job Job) (Job, error) {
+	if job.CallbackURL != "" {
+		if err := validator.ValidateUploadURL(job.CallbackURL); err != nil {
+			return Job{}, fmt.Errorf("callback_url: %w", err)
+		}
+	}
+	now := q.now().UTC()
+	job.ID = uuid.NewString()
+	job.State = JobQueued
+	job.CreatedAt = now
+	job.Attempts, job.Done, job.Failed = 0, 0, 0
+	job.Result, job.Error, job.Callback = nil, "", ""
+	job.StartedAt, job.FinishedAt, job.etag = nil, nil, ""
+	if err := q.save(ctx, &job); err != nil {
+		return Job{}, err
+	}
+	observability.JobsSubmitted.WithLabelValues(job.Kind).Inc()
+	q.enqueue(job.ID)
+	return job, nil
+}
+
+// enqueue hands a job to the local workers. A full channel is not an error:
+// the record is written, and the next sweep finds it.
+func (q *JobQueue) enqueue(id string) {
+	select {
+	case q.ready <- id:
+	default:
+	}
+}
+
+// Get returns a job's record. IDs are UUIDs; anything else is not found rather
+// than a key looked up in the bucket.
+func (q *JobQueue) Get(ctx context.Context, id string) (Job, error) {
+	if _, err := uuid.Parse(id); err != nil {
+		return Job{}, ErrJobNotFound
+	}
+	job, err := q.read(ctx, id)
+	if err != nil {
+		return Job{}, err
+	}
+	return *job, nil
+}
+
+// Start runs the workers and the sweep until ctx is done.
+func (q *JobQueue) Start(ctx context.Context) {
+	for w := 0; w < q.workers; w++ {
+		go func() {
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case id := <-q.ready:
+					q.run(ctx, id)
+				}
+			}
+		}()
+	}
+	go func() {
+		q.sweep(ctx)
+		ticker := time.NewTicker(time.Minute)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				q.sweep(ctx)
+			}
+		}
+	}()
+	q.logger.Info().Int("workers", q.workers).Str("bucket", q.bucket).Msg("job queue started")
+}
+
+// run claims a job and runs it to the end.
+//
+// The job runs under a context of its own, cancelled when a checkpoint finds
+// the record rewritten by someone else: that is a replica that found the job
+// stale and claimed it, and from then on that replica's run is the one that
+// counts. This one stops, records nothing and calls nobody back, instead of
+// doing the same work a second time and then failing to record it.
+func (q *JobQueue) run(ctx context.Context, id string) {
+	job, claimed, err := q.claim(ctx, id)
+	if err != nil {
+		q.logger.Warn().Err(err).Str("job", id).Msg("jobs: could not claim job")
+		return
+	}
+	if !claimed {
+		return
+	}
+
+	q.mu.RLock()
+	fn := q.handlers[job.Kind]
+	q.mu.RUnlock()
+
+	jobCtx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+	checkpoint := func() error {
+		if context.Cause(jobCtx) == ErrJobLost {
+			return ErrJobLost
+		}
+		err := q.save(jobCtx, job)
+		if err == nil {
+			return nil
+		}
+		if minio.ToErrorResponse(err).Code == "PreconditionFailed" {
+			cancel(ErrJobLost)
+			return ErrJobLost
+		}
+		// Anything else is MinIO having a bad moment; the next checkpoint
+		// tries again, and the work is not lost meanwhile.
+		q.logger.Warn().Err(err).Str("job", job.ID).Msg("jobs: could not record progress")
+		return nil
+	}
+
+	var runErr error
+	if fn == nil {
+		runErr = fmt.Errorf("no handler for job kind %q", job.Kind)
+	} else {
+		runErr = fn(jobCtx, job, checkpoint)
+	}
+	if context.Cause(jobCtx) == ErrJobLost {
+		q.logger.Warn().Str("job", job.ID).Msg("jobs: another replica claimed the job; this run stops")
+		return
+	}
+	if ctx.Err() != nil {
+		// Shutting down. The record still says running; once it is stale a
+		// sweep, here after the restart or on another replica, runs it again.
+		return
+	}
+	if runErr != nil {
+		job.State, job.Error = JobFailed, runErr.Error()
+	} else {
+		job.State = JobSucceeded
+	}
+	q.finish(ctx, job)
+}
+
+// claim marks a job running, if it is free to run: queued, or running with a
+// record nobody has touched for the stale interval. It reports false when the
+// job is not free or another replica claimed it first.
+func (q *JobQueue) claim(ctx context.Context, id string) (*Job, bool, error) {
+	job, err := q.read(ctx, id)
+	if errors.Is(err, ErrJobNotFound) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	now := q.now().UTC()
+	switch {
+	case job.State == JobQueued:
+	case job.State == JobRunning && now.Sub(job.UpdatedAt) > q.stale:
+		q.logger.Warn().Str("job", id).Int("attempts", job.Attempts).Msg("jobs: resuming a job its worker abandoned")
+	default:
+		return nil, false, nil
+	}
+
+	job.Attempts++
+	if job.Attempts > q.maxAttempts {
+		job.State = JobFailed
+		job.Error = fmt.Sprintf("abandoned after %d attempts", q.maxAttempts)
+		q.finish(ctx, job)
+		return nil, false, nil
+	}
+	job.State = JobRunning
+	job.StartedAt = &now
+	if err := q.save(ctx, job); err != nil {
+		if minio.ToErrorResponse(err).Code == "PreconditionFailed" {
+			return nil, false, nil
+		}
+		return nil, false, err
+	}
+	return job, true, nil
+}
+
+// finish records a job's final state and then delivers its callback.
+func (q *JobQueue) finish(ctx context.Context, job *Job) {
+	now := q.now().UTC()
+	job.FinishedAt = &now
+	if err := q.save(ctx, job); err != nil {
+		// Lost the record to a replica that presumed this one dead; its run is
+		// the one that counts now.
+		q.logger.Warn().Err(err).Str("job", job.ID).Msg("jobs: could not record the result")
+		return
+	}
+	observability.JobsFinished.WithLabelValues(job.Kind, string(job.State)).Inc()
+	if job.CallbackURL == "" {
+		return
+	}
+	job.Callback = q.deliver(ctx, job)
+	if err := q.save(ctx, job); err != nil {
+		q.logger.Warn().Err(err).Str("job", job.ID).Msg("jobs: could not record the callback outcome")
+	}
+}
+
+// errCallbackRejected marks a callback answer retrying cannot fix.
+var errCallbackRejected = errors.New("callback rejected")
+
+// deliver POSTs the finished job to its callback URL and says how that went.
+// Network errors, 5xx and 429 are retried with backoff, like purge webhooks;
+// any other 4xx is the receiver refusing the payload.
+//
+// With JOB_CALLBACK_SECRET set the body is signed, X-CDN-Signature being
+// "sha256=" and the hex HMAC-SHA256 of the body under the secret, so a
+// receiver can tell a callback from this service from anybody else's POST.
+func (q *JobQueue) deliver(ctx context.Context, job *Job) string {
+	body, err := json.Marshal(job)
+	if err != nil {
+		return "failed: " + err.Error()
+	}
+	for attempt := 0; ; attempt++ {
+		err = q.post(ctx, job, body)
+		if err == nil || errors.Is(err, errCallbackRejected) || attempt >= 2 {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			return "failed: " + ctx.Err().Error()
+		case <-time.After(time.Second << attempt):
+		}
+	}
+	if err != nil {
+		observability.JobCallbacks.WithLabelValues("failed").Inc()
+		q.logger.Warn().Err(err).Str("job", job.ID).Msg("jobs: callback not delivered")
+		return "failed: " + err.Error()
+	}
+	observability.JobCallbacks.WithLabelValues("delivered").Inc()
+	return "delivered"
+}
+
+func (q *JobQueue) post(ctx context.Context, job *Job, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, job.CallbackURL, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("%w: %v", errCallbackRejected, err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-CDN-Job-Id", job.ID)
+	if q.secret != "" {
+		mac := hmac.New(sha256.New, []byte(q.secret))
+		mac.Write(body)
+		req.Header.Set("X-CDN-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+
+	resp, err := q.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return nil
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+		return fmt.Errorf("callback answered %d", resp.StatusCode)
+	default:
+		return fmt.Errorf("%w: status %d", errCallbackRejected, resp.StatusCode)
+	}
+}
+
+// sweep queues the pending jobs the workers have not been handed, and removes
+// finished ones past retention. It returns how many it queued.
+func (q *JobQueue) sweep(ctx context.Context) int {
+	now := q.now()
+	queued := 0
+	for obj := range q.store.ListObjects(ctx, q.bucket, minio.ListObjectsOptions{Recursive: true}) {
+		if obj.Err != nil {
+			q.logger.Warn().Err(obj.Err).Msg("jobs: sweep could not list jobs")
+			return queued
+		}
+		id, ok := strings.CutSuffix(obj.Key, ".json")
+		if !ok {
+			continue
+		}
+		info, err := q.store.StatObject(ctx, q.bucket, obj.Key, minio.StatObjectOptions{})
+		if err != nil {
+			continue
+		}
+		state := JobState(info.UserMetadata[jobMetaState])
+		switch {
+		case state.Finished():
+			if now.Sub(info.LastModified) > q.retain {
+				_ = q.store.RemoveObject(ctx, q.bucket, obj.Key, minio.RemoveObjectOptions{})
+			}
+		case state == JobRunning && now.Sub(info.LastModified) <= q.stale:
+			// Being worked on.
+		default:
+			q.enqueue(id)
+			queued++
+		}
+	}
+	return queued
+}
+
+func (q *JobQueue) save(ctx context.Context, job *Job) error {
+	job.UpdatedAt = q.now().UTC()
+	body, err := json.Marshal(job)
+	if err != nil {
+		return err
+	}
+	opts := minio.PutObjectOptions{
+		ContentType:  "application/json",
+		UserMetadata: map[string]string{jobMetaState: string(job.State)},
+	}
+	if job.etag != "" {
+		opts.SetMatchETag(job.etag)
+	}
+	info, err := q.store.PutObject(ctx, q.bucket, jobKey(job.ID), bytes.NewReader(body), int64(len(body)), opts)
+	if err != nil {
+		return err
+	}
+	job.etag = info.ETag
+	return nil
+}
+
+func (q *JobQueue) read(ctx context.Context, id string) (*Job, error) {
+	info, err := q.store.StatObject(ctx, q.bucket, jobKey(id), minio.StatObjectOptions{})
+	if err != nil {
+		if minio.ToErrorResponse(err).Code == "NoSuchKey" {
+			return nil, ErrJobNotFound
+		}
+		return nil, err
+	}
+	rc, err := q.store.OpenObject(ctx, q.bucket, jobKey(id))
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	var job Job
+	if err := json.NewDecoder(io.LimitReader(rc, 16<<20)).Decode(&job); err != nil {
+		return nil, fmt.Errorf("jobs: record %s: %w", id, err)
+	}
+	job.etag = info.ETag
+	return &job, nil
+}
@@ -0,0 +1,323 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+)
+
+// jobStore is an ObjectStore with the one thing the queue depends on that
+// fakeStore does not model: ETags that change on every write, and puts that
+// honour If-Match and If-None-Match: *.
+type jobStore struct {
+	ObjectStore
+	mu      sync.Mutex
+	objects map[string]jobObject
+	version int
+}
+
+type jobObject struct {
+	data     []byte
+	etag     string
+	meta     map[string]string
+	modified time.Time
+}
+
+func newJobStore() *jobStore { return &jobStore{objects: map[string]jobObject{}} }
+
+func (s *jobStore) PutObject(_ context.Context, bucket, key string, r io.Reader, _ int64, opts minio.PutObjectOptions) (minio.UploadInfo, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return minio.UploadInfo{}, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	cur, exists := s.objects[bucket+"/"+key]
+	if want := opts.Header().Get("If-Match"); want != "" && want != `"`+cur.etag+`"` || opts.Header().Get("If-None-Match") == "*" && exists {
+		return minio.UploadInfo{}, minio.ErrorResponse{Code: "PreconditionFailed"}
+	}
+	s.version++
+	etag := "v" + strconv.Itoa(s.version)
+	s.objects[bucket+"/"+key] = jobObject{data: data, etag: etag, meta: opts.UserMetadata, modified: time.Now()}
+	return minio.UploadInfo{Bucket: bucket, Key: key, ETag: etag}, nil
+}
+
+func (s *jobStore) StatObject(_ context.Context, bucket, key string, _ minio.StatObjectOptions) (minio.ObjectInfo, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	o, ok := s.objects[bucket+"/"+key]
+	if !ok {
+		return minio.ObjectInfo{}, minio.ErrorResponse{Code: "NoSuchKey"}
+	}
+	return minio.ObjectInfo{Key: key, ETag: o.etag, UserMetadata: o.meta, LastModified: o.modified}, nil
+}
+
+func (s *jobStore) OpenObject(_ context.Context, bucket, key string) (io.ReadCloser, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	o, ok := s.objects[bucket+"/"+key]
+	if !ok {
+		return nil, minio.ErrorResponse{Code: "NoSuchKey"}
+	}
+	return io.NopCloser(bytes.NewReader(o.data)), nil
+}
+
+func (s *jobStore) ListObjects(_ context.Context, bucket string, _ minio.ListObjectsOptions) <-chan minio.ObjectInfo {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ch := make(chan minio.ObjectInfo, len(s.objects))
+	for k := range s.objects {
+		if key, ok := strings.CutPrefix(k, bucket+"/"); ok {
+			ch <- minio.ObjectInfo{Key: key}
+		}
+	}
+	close(ch)
+	return ch
+}
+
+func (s *jobStore) RemoveObject(_ context.Context, bucket, key string, _ minio.RemoveObjectOptions) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.objects, bucket+"/"+key)
+	return nil
+}
+
+// age backdates a record, as if nothing had written it for d.
+func (s *jobStore) age(bucket, key string, d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	o := s.objects[bucket+"/"+key]
+	o.modified = o.modified.Add(-d)
+	s.objects[bucket+"/"+key] = o
+}
+
+func newTestJobQueue(t *testing.T) (*JobQueue, *jobStore) {
+	t.Helper()
+	store := newJobStore()
+	q, err := NewJobQueue(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return q, store
+}
+
+// A job runs once, its handler's progress is kept, and its callback is POSTed
+// the finished job, signed when a secret is configured.
+func TestJobQueueRunsAJobAndCallsBack(t *testing.T) {
+	t.Setenv("UPLOAD_URL_ALLOW_PRIVATE", "true")
+	t.Setenv("JOB_CALLBACK_SECRET", "s3cret")
+
+	delivered := make(chan Job, 1)
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		mac := hmac.New(sha256.New, []byte("s3cret"))
+		mac.Write(body)
+		if r.Header.Get("X-CDN-Signature") != "sha256="+hex.EncodeToString(mac.Sum(nil)) {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		var job Job
+		_ = json.Unmarshal(body, &job)
+		delivered <- job
+	}))
+	defer receiver.Close()
+
+	q, _ := newTestJobQueue(t)
+	q.Handle("echo", func(_ context.Context, job *Job, checkpoint func() error) error {
+		job.Done = job.Total
+		job.Result = json.RawMessage(`{"ok":true}`)
+		return checkpoint()
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	job, err := q.Submit(ctx, Job{Kind: "echo", Owner: "bucket:photos", Total: 2, CallbackURL: receiver.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	q.Start(ctx)
+
+	select {
+	case got := <-delivered:
+		if got.ID != job.ID || got.State != JobSucceeded || got.Done != 2 || string(got.Result) != `{"ok":true}` {
+			t.Fatalf("callback got %+v", got)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no callback")
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		stored, err := q.Get(ctx, job.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stored.Callback == "delivered" {
+			if stored.Attempts != 1 || stored.FinishedAt == nil {
+				t.Fatalf("stored %+v", stored)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("callback outcome not recorded: %+v", stored)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// Callback URLs are held to the upload URL rules.
+func TestJobQueueRefusesAPrivateCallback(t *testing.T) {
+	q, _ := newTestJobQueue(t)
+	if _, err := q.Submit(context.Background(), Job{Kind: "echo", CallbackURL: "http://169.254.169.254/latest"}); err == nil {
+		t.Fatal("accepted a metadata-address callback")
+	}
+}
+
+// Two replicas reaching for one job: the conditional write lets exactly one
+// run it. A running job nobody has touched for the stale interval is taken
+// over, and one that keeps being abandoned is given up on.
+func TestJobQueueClaims(t *testing.T) {
+	q, _ := newTestJobQueue(t)
+	ctx := context.Background()
+	job, err := q.Submit(ctx, Job{Kind: "echo"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	first, err := q.read(ctx, job.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok, err := q.claim(ctx, job.ID); !ok || err != nil {
+		t.Fatalf("claim = (%v, %v)", ok, err)
+	}
+	// The other replica read the record before the claim and writes after it.
+	first.State = JobRunning
+	if err := q.save(ctx, first); minio.ToErrorResponse(err).Code != "PreconditionFailed" {
+		t.Fatalf("stale write = %v", err)
+	}
+	if _, ok, _ := q.claim(ctx, job.ID); ok {
+		t.Fatal("claimed a job that is running")
+	}
+
+	q.now = func() time.Time { return time.Now().Add(q.stale + time.Minute) }
+	for attempt := 2; attempt <= q.maxAttempts; attempt++ {
+		if _, ok, err := q.claim(ctx, job.ID); !ok || err != nil {
+			t.Fatalf("attempt %d: claim = (%v, %v)", attempt, ok, err)
+		}
+		now := q.now()
+		q.now = func() time.Time { return now.Add(q.stale + time.Minute) }
+	}
+	if _, ok, _ := q.claim(ctx, job.ID); ok {
+		t.Fatal("claimed past JOB_MAX_ATTEMPTS")
+	}
+	stored, _ := q.Get(ctx, job.ID)
+	if stored.State != JobFailed || stored.Error == "" {
+		t.Fatalf("abandoned job = %+v", stored)
+	}
+}
+
+// A worker whose job was taken over while it ran is told so at its next
+// checkpoint, has its context cancelled, and leaves the record to the replica
+// that took over instead of finishing it.
+func TestJobQueueStopsAJobWhoseClaimWasLost(t *testing.T) {
+	q, _ := newTestJobQueue(t)
+	ctx := context.Background()
+	var afterLoss error
+	var cancelled bool
+	q.Handle("slow", func(jobCtx context.Context, job *Job, checkpoint func() error) error {
+		if err := checkpoint(); err != nil {
+			t.Errorf("first checkpoint = %v", err)
+		}
+		// Another replica found the job stale and claimed it.
+		other, err := q.read(ctx, job.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		other.Attempts++
+		if err := q.save(ctx, other); err != nil {
+			t.Fatal(err)
+		}
+		job.Done = 1
+		afterLoss = checkpoint()
+		cancelled = jobCtx.Err() != nil
+		return afterLoss
+	})
+	job, err := q.Submit(ctx, Job{Kind: "slow"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-q.ready
+
+	q.run(ctx, job.ID)
+	if !errors.Is(afterLoss, ErrJobLost) || !cancelled {
+		t.Fatalf("checkpoint after the loss = %v, context cancelled = %v", afterLoss, cancelled)
+	}
+	stored, _ := q.Get(ctx, job.ID)
+	if stored.State != JobRunning || stored.FinishedAt != nil || stored.Done != 0 || stored.Attempts != 2 {
+		t.Fatalf("the lost run wrote over the record: %+v", stored)
+	}
+}
+
+// The sweep queues what is pending, leaves what is being worked on, and
+// removes finished records past retention.
+func TestJobQueueSweep(t *testing.T) {
+	q, store := newTestJobQueue(t)
+	ctx := context.Background()
+	submit := func(state JobState, age time.Duration) string {
+		job, err := q.Submit(ctx, Job{Kind: "echo"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		<-q.ready
+		stored, _ := q.read(ctx, job.ID)
+		stored.State = state
+		if err := q.save(ctx, stored); err != nil {
+			t.Fatal(err)
+		}
+		store.age(q.bucket, jobKey(job.ID), age)
+		return job.ID
+	}
+	queued := submit(JobQueued, 0)
+	orphaned := submit(JobRunning, q.stale+time.Minute)
+	submit(JobRunning, 0)
+	expired := submit(JobSucceeded, q.retain+time.Hour)
+	kept := submit(JobFailed, time.Hour)
+
+	if n := q.sweep(ctx); n != 2 {
+		t.Fatalf("sweep queued %d jobs", n)
+	}
+	got := map[string]bool{<-q.ready: true, <-q.ready: true}
+	if !got[queued] || !got[orphaned] {
+		t.Fatalf("queued %v", got)
+	}
+	if _, err := q.Get(ctx, expired); err != ErrJobNotFound {
+		t.Fatalf("expired job: %v", err)
+	}
+	if _, err := q.Get(ctx, kept); err != nil {
+		t.Fatalf("recent job: %v", err)
+	}
+}
+
+func TestJobVisibility(t *testing.T) {
+	job := Job{Owner: JobOwner(Principal{Scoped: true, Bucket: "photos"})}
+	if !job.VisibleTo(Principal{}) || !job.VisibleTo(Principal{Scoped: true, Bucket: "photos"}) {
+		t.Fatal("hidden from its owner or the general token")
+	}
+	if job.VisibleTo(Principal{Scoped: true, Bucket: "docs"}) {
+		t.Fatal("visible to another bucket's token")
+	}
+}
@@ -0,0 +1,160 @@
+package service
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/mstgnz/cdn/pkg/config"
+	"github.com/mstgnz/cdn/pkg/observability"
+)
+
+// clamdChunkSize is how much of a file goes into one INSTREAM chunk. clamd
+// accepts any size up to its StreamMaxLength; 64 KiB keeps the copy buffer
+// small without making the chunk headers matter.
+const clamdChunkSize = 64 << 10
+
+// MalwareVerdict is what the scanner made of one file.
+type MalwareVerdict struct {
+	Infected bool
+	// Signature names what was found, as clamd reports it
+	// ("Win.Test.EICAR_HDB-1"). Empty for a clean file.
+	Signature string
+}
+
+// ErrScannerUnavailable wraps every failure to get a verdict: clamd not
+// reachable, timing out, or answering with an error of its own (a stream over
+// its StreamMaxLength is one). Whether the upload goes ahead is the bucket's
+// malware_scan mode's call, not the scanner's.
+var ErrScannerUnavailable = errors.New("malware scanner unavailable")
+
+// MalwareScanner streams files to clamd over its INSTREAM command before they
+// are stored.
+//
+// ValidateFileContent only looks at magic bytes, which says a file is a PDF or
+// a ZIP, not that the macro or the executable inside it is harmless; the
+// public can upload Office documents and archives here. clamd is the scanner
+// most deployments already run, and its TCP protocol is small enough to speak
+// directly rather than through a client library:
+//
+//	zINSTREAM\0  then  <uint32 BE length><bytes>...  then  <uint32 0>
+//
+// answered by one NUL-terminated line: "stream: OK", "stream: <name> FOUND" or
+// "<message> ERROR".
+//
+// Each scan opens its own connection, as clamd expects of INSTREAM. A nil
+// *MalwareScanner is valid and scans nothing, so callers need no checks.
+type MalwareScanner struct {
+	addr    string
+	timeout time.Duration
+	dialer  net.Dialer
+}
+
+// NewMalwareScanner returns the scanner configured by CLAMD_ADDR (host:port),
+// or nil when it is unset. CLAMD_TIMEOUT_SECONDS bounds one scan from dial to
+// verdict.
+func NewMalwareScanner() *MalwareScanner {
+	addr := strings.TrimSpace(config.GetEnvOrDefault("CLAMD_ADDR", ""))
+	if addr == "" {
+		return nil
+	}
+	return &MalwareScanner{
+		addr:    addr,
+		timeout: time.Duration(config.GetEnvAsIntOrDefault("CLAMD_TIMEOUT_SECONDS", 30)) * time.Second,
+	}
+}
+
+// Enabled reports whether uploads to bucket are scanned: a scanner is
+// configured and the bucket's malware_scan mode is not off.
+func (s *MalwareScanner) Enabled(bucket string) bool {
+	return s != nil && config.MalwareScanFor(bucket) != config.MalwareScanOff
+}
+
+// Scan sends r to clamd and returns its verdict. Every failure to get one
+// wraps ErrScannerUnavailable. The verdict and its latency are recorded.
+func (s *MalwareScanner) Scan(ctx context.Context, r io.Reader) (MalwareVerdict, error) {
+	if s == nil {
+		return MalwareVerdict{}, nil
+	}
+	start := time.Now()
+	verdict, err := s.scan(ctx, r)
+	label := "clean"
+	switch {
+	case err != nil:
+		label = "error"
+	case verdict.Infected:
+		label = "infected"
+	}
+	observability.MalwareScans.WithLabelValues(label).Inc()
+	observability.MalwareScanDuration.WithLabelValues(label).Observe(time.Since(start).Seconds())
+	return verdict, err
+}
+
+func (s *MalwareScanner) scan(ctx context.Context, r io.Reader) (MalwareVerdict, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+
+	conn, err := s.dialer.DialContext(ctx, "tcp", s.addr)
+	if err != nil {
+		return MalwareVerdict{}, fmt.Errorf("%w: %v", ErrScannerUnavailable, err)
+	}
+	defer conn.Close()
+	deadline, _ := ctx.Deadline()
+	_ = conn.SetDeadline(deadline)
+
+	if err := writeInstream(conn, r); err != nil {
+		return MalwareVerdict{}, fmt.Errorf("%w: %v", ErrScannerUnavailable, err)
+	}
+	reply, err := bufio.NewReader(conn).ReadString(0)
+	if err != nil {
+		return MalwareVerdict{}, fmt.Errorf("%w: reading the verdict: %v", ErrScannerUnavailable, err)
+	}
+	return parseClamdReply(strings.TrimRight(reply, "\x00\n"))
+}
+
+// writeInstream sends the INSTREAM command, r in chunks, and the terminator.
+func writeInstream(w io.Writer, r io.Reader) error {
+	if _, err := io.WriteString(w, "zINSTREAM\x00"); err != nil {
+		return err
+	}
+	buf := make([]byte, 4+clamdChunkSize)
+	for {
+		n, rerr := io.ReadFull(r, buf[4:])
+		if n > 0 {
+			binary.BigEndian.PutUint32(buf[:4], uint32(n))
+			if _, err := w.Write(buf[:4+n]); err != nil {
+				return err
+			}
+		}
+		if errors.Is(rerr, io.EOF) || errors.Is(rerr, io.ErrUnexpectedEOF) {
+			break
+		}
+		if rerr != nil {
+			return fmt.Errorf("reading the upload: %w", rerr)
+		}
+	}
+	_, err := w.Write([]byte{0, 0, 0, 0})
+	return err
+}
+
+// parseClamdReply reads one INSTREAM answer. Anything but OK or FOUND, the
+// size-limit error included, is a scan that did not happen.
+func parseClamdReply(reply string) (MalwareVerdict, error) {
+	body := strings.TrimSpace(strings.TrimPrefix(reply, "stream:"))
+	switch {
+	case body == "OK":
+		return MalwareVerdict{}, nil
+	case strings.HasSuffix(body, " FOUND"):
+		return MalwareVerdict{Infected: true, Signature: strings.TrimSuffix(body, " FOUND")}, nil
+	case strings.HasSuffix(body, "ERROR"):
+		return MalwareVerdict{}, fmt.Errorf("%w: clamd: %s", ErrScannerUnavailable, body)
+	default:
+		return MalwareVerdict{}, fmt.Errorf("%w: unexpected clamd reply %q", ErrScannerUnavailable, reply)
+	}
+}
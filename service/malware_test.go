@@ -0,0 +1,122 @@
+package service
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+)
+
+// eicar is the standard antivirus test file, split so this source is not
+// itself flagged.
+var eicar = `X5O!P%@AP[4\PZX54(P^)7CC)7}$` + `EICAR-STANDARD-ANTIVIRUS-TEST-FILE!$H+H*`
+
+// standInClamd answers INSTREAM the way clamd does: FOUND for anything with
+// the EICAR string in it, OK otherwise, or reply when it is set. Every stream
+// it received is sent on the returned channel.
+func standInClamd(t *testing.T, reply string) (string, <-chan []byte) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	streams := make(chan []byte, 8)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+				r := bufio.NewReader(conn)
+				if cmd, err := r.ReadString(0); err != nil || cmd != "zINSTREAM\x00" {
+					_, _ = io.WriteString(conn, "UNKNOWN COMMAND\x00")
+					return
+				}
+				var data []byte
+				for {
+					var size uint32
+					if err := binary.Read(r, binary.BigEndian, &size); err != nil {
+						return
+					}
+					if size == 0 {
+						break
+					}
+					chunk := make([]byte, size)
+					if _, err := io.ReadFull(r, chunk); err != nil {
+						return
+					}
+					data = append(data, chunk...)
+				}
+				streams <- data
+				answer := reply
+				if answer == "" {
+					answer = "stream: OK"
+					if bytes.Contains(data, []byte("EICAR-STANDARD-ANTIVIRUS-TEST-FILE")) {
+						answer = "stream: Win.Test.EICAR_HDB-1 FOUND"
+					}
+				}
+				_, _ = io.WriteString(conn, answer+"\x00")
+			}(conn)
+		}
+	}()
+	return ln.Addr().String(), streams
+}
+
+func TestMalwareScannerVerdicts(t *testing.T) {
+	addr, streams := standInClamd(t, "")
+	t.Setenv("CLAMD_ADDR", addr)
+	s := NewMalwareScanner()
+	ctx := context.Background()
+
+	// Larger than one chunk, so the stream has to be reassembled.
+	clean := bytes.Repeat([]byte("harmless "), clamdChunkSize/4)
+	verdict, err := s.Scan(ctx, bytes.NewReader(clean))
+	if err != nil || verdict.Infected {
+		t.Fatalf("clean file: %+v, %v", verdict, err)
+	}
+	if got := <-streams; !bytes.Equal(got, clean) {
+		t.Fatalf("clamd received %d bytes, sent %d", len(got), len(clean))
+	}
+
+	verdict, err = s.Scan(ctx, strings.NewReader(eicar))
+	if err != nil || !verdict.Infected || verdict.Signature != "Win.Test.EICAR_HDB-1" {
+		t.Fatalf("EICAR: %+v, %v", verdict, err)
+	}
+}
+
+// Anything but a verdict is ErrScannerUnavailable, for the bucket's mode to
+// decide on.
+func TestMalwareScannerWithoutAVerdict(t *testing.T) {
+	addr, _ := standInClamd(t, "INSTREAM size limit exceeded. ERROR")
+	t.Setenv("CLAMD_ADDR", addr)
+	if _, err := NewMalwareScanner().Scan(context.Background(), strings.NewReader("x")); !errors.Is(err, ErrScannerUnavailable) {
+		t.Fatalf("clamd error reply: %v", err)
+	}
+
+	ln, _ := net.Listen("tcp", "127.0.0.1:0")
+	closed := ln.Addr().String()
+	ln.Close()
+	t.Setenv("CLAMD_ADDR", closed)
+	if _, err := NewMalwareScanner().Scan(context.Background(), strings.NewReader("x")); !errors.Is(err, ErrScannerUnavailable) {
+		t.Fatalf("nothing listening: %v", err)
+	}
+}
+
+func TestMalwareScannerDisabled(t *testing.T) {
+	t.Setenv("CLAMD_ADDR", "")
+	s := NewMalwareScanner()
+	if s != nil || s.Enabled("photos") {
+		t.Fatal("enabled without CLAMD_ADDR")
+	}
+	if verdict, err := s.Scan(context.Background(), strings.NewReader(eicar)); err != nil || verdict.Infected {
+		t.Fatalf("nil scanner: %+v, %v", verdict, err)
+	}
+}
@@ -0,0 +1,192 @@
+package service
+
+import (
+	"container/list"
+	"context"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mstgnz/cdn/pkg/config"
+	"github.com/mstgnz/cdn/pkg/observability"
+)
+
+// PurgeSubscriber is implemented by a cache that can tell every replica about a
+// purge made on any one of them. The Redis cache does, over pub/sub.
+type PurgeSubscriber interface {
+	// SubscribePurges calls fn for every purge published by any replica,
+	// this one included, until ctx is done.
+	SubscribePurges(ctx context.Context, fn func(PurgeScope))
+}
+
+// memoryTier keeps the hottest resized variants in process memory, in front of
+// the shared cache it wraps. Everything but the variant methods passes straight
+// through.
+//
+// A Redis hit still costs a network round trip and a copy of the whole image
+// per request, and for a thumbnail that is on every page that is most of the
+// cost of serving it. A small LRU removes both for the few hundred entries that
+// take most of the traffic.
+//
+// Staleness is bounded two ways. A purge, whether from the API or from a
+// delete, is applied here directly and, when the wrapped cache supports it,
+// broadcast so every other replica drops its copy too. The TTL is the backstop
+// for a broadcast that was missed, which is why it is short: it is how long a
+// replica can serve a variant the rest of the fleet has already forgotten.
+type memoryTier struct {
+	CacheService
+
+	mu       sync.Mutex
+	entries  map[string]*list.Element
+	order    *list.List // front is most recently used
+	used     int64
+	budget   int64
+	maxEntry int64
+	ttl      time.Duration
+	now      func() time.Time
+}
+
+type memoryEntry struct {
+	id      string
+	bucket  string
+	object  string
+	data    []byte
+	expires time.Time
+}
+
+// NewMemoryTier wraps inner with an in-process LRU sized from the environment:
+// MEMORY_CACHE_MB of variant bytes, each kept at most MEMORY_CACHE_TTL_SECONDS.
+// A zero budget returns inner unchanged.
+//
+// ctx bounds the purge subscription, so it should live as long as the server.
+func NewMemoryTier(ctx context.Context, inner CacheService) CacheService {
+	budget := int64(config.GetEnvAsIntOrDefault("MEMORY_CACHE_MB", 64)) << 20
+	ttl := time.Duration(config.GetEnvAsIntOrDefault("MEMORY_CACHE_TTL_SECONDS", 60)) * time.Second
+	if inner == nil || budget <= 0 || ttl <= 0 {
+		return inner
+	}
+
+	m := newMemoryTier(inner, budget, ttl)
+	if sub, ok := inner.(PurgeSubscriber); ok {
+		sub.SubscribePurges(ctx, m.purgeLocal)
+	}
+	return m
+}
+
+func newMemoryTier(inner CacheService, budget int64, ttl time.Duration) *memoryTier {
+	return &memoryTier{
+		CacheService: inner,
+		entries:      make(map[string]*list.Element),
+		order:        list.New(),
+		budget:       budget,
+		// One original-sized "variant" must not be able to flush every
+		// thumbnail; anything bigger than this is left to Redis.
+		maxEntry: budget / 8,
+		ttl:      ttl,
+		now:      time.Now,
+	}
+}
+
+func memoryID(bucket, object string, width, height uint) string {
+	return bucket + "\x00" + object + "\x00" + variantField(width, height)
+}
+
+// GetResizedImage answers from memory when it can and fills memory from the
+// wrapped cache when it cannot. The returned slice is shared between requests
+// and must not be modified.
+func (m *memoryTier) GetResizedImage(bucket, object string, width, height uint) ([]byte, error) {
+	id := memoryID(bucket, object, width, height)
+
+	m.mu.Lock()
+	if el, ok := m.entries[id]; ok {
+		e := el.Value.(*memoryEntry)
+		if m.now().Before(e.expires) {
+			m.order.MoveToFront(el)
+			m.mu.Unlock()
+			observability.MemoryCacheRequests.WithLabelValues("hit").Inc()
+			return e.data, nil
+		}
+		m.remove(el, "expired")
+	}
+	m.mu.Unlock()
+	observability.MemoryCacheRequests.WithLabelValues("miss").Inc()
+
+	data, err := m.CacheService.GetResizedImage(bucket, object, width, height)
+	if err == nil && len(data) > 0 {
+		m.store(id, bucket, object, data)
+	}
+	return data, err
+}
+
+func (m *memoryTier) SetResizedImage(bucket, object string, width, height uint, data []byte) error {
+	m.store(memoryID(bucket, object, width, height), bucket, object, data)
+	return m.CacheService.SetResizedImage(bucket, object, width, height, data)
+}
+
+// PurgeVariants drops matching entries here before the wrapped cache, so this
+// replica is consistent even when the broadcast or Redis itself fails.
+func (m *memoryTier) PurgeVariants(ctx context.Context, scope PurgeScope) (int, error) {
+	if err := scope.Validate(); err != nil {
+		return 0, err
+	}
+	m.purgeLocal(scope)
+	return m.CacheService.PurgeVariants(ctx, scope)
+}
+
+func (m *memoryTier) purgeLocal(scope PurgeScope) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for el := m.order.Front(); el != nil; {
+		next := el.Next()
+		if e := el.Value.(*memoryEntry); scope.covers(e.bucket, e.object) {
+			m.remove(el, "purged")
+		}
+		el = next
+	}
+}
+
+func (m *memoryTier) store(id, bucket, object string, data []byte) {
+	size := int64(len(data))
+	if size == 0 || size > m.maxEntry {
+		return
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if el, ok := m.entries[id]; ok {
+		m.remove(el, "replaced")
+	}
+	e := &memoryEntry{id: id, bucket: bucket, object: object, data: data, expires: m.now().Add(m.ttl)}
+	m.entries[id] = m.order.PushFront(e)
+	m.used += size
+	observability.MemoryCacheBytes.Add(float64(size))
+
+	for m.used > m.budget {
+		m.remove(m.order.Back(), "budget")
+	}
+}
+
+// remove unlinks one entry. The caller holds mu.
+func (m *memoryTier) remove(el *list.Element, reason string) {
+	e := m.order.Remove(el).(*memoryEntry)
+	delete(m.entries, e.id)
+	m.used -= int64(len(e.data))
+	observability.MemoryCacheBytes.Sub(float64(len(e.data)))
+	if reason != "replaced" {
+		observability.MemoryCacheEvictions.WithLabelValues(reason).Inc()
+	}
+}
+
+// covers reports whether an object falls inside the scope. It assumes a scope
+// that passed Validate.
+func (s PurgeScope) covers(bucket, object string) bool {
+	if bucket != s.Bucket {
+		return false
+	}
+	if s.Key != "" {
+		return object == s.Key
+	}
+	return strings.HasPrefix(object, s.Prefix)
+}
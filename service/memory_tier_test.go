@@ -0,0 +1,171 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+)
+
+// variantStore stands in for Redis behind the memory tier, counting reads so a
+// test can tell which tier answered.
+type variantStore struct {
+	CacheService
+	data   map[string][]byte
+	reads  int
+	purges []PurgeScope
+	onSub  func(PurgeScope)
+}
+
+func newVariantStore() *variantStore { return &variantStore{data: map[string][]byte{}} }
+
+func (v *variantStore) GetResizedImage(bucket, object string, w, h uint) ([]byte, error) {
+	v.reads++
+	if d, ok := v.data[memoryID(bucket, object, w, h)]; ok {
+		return d, nil
+	}
+	return nil, fmt.Errorf("%w: %s", ErrCacheMiss, object)
+}
+
+func (v *variantStore) SetResizedImage(bucket, object string, w, h uint, data []byte) error {
+	v.data[memoryID(bucket, object, w, h)] = data
+	return nil
+}
+
+func (v *variantStore) PurgeVariants(_ context.Context, scope PurgeScope) (int, error) {
+	v.purges = append(v.purges, scope)
+	return 0, nil
+}
+
+func (v *variantStore) SubscribePurges(_ context.Context, fn func(PurgeScope)) { v.onSub = fn }
+
+func TestMemoryTierServesRepeatHitsFromMemory(t *testing.T) {
+	inner := newVariantStore()
+	inner.data[memoryID("photos", "a.jpg", 100, 100)] = []byte("thumb")
+	m := newMemoryTier(inner, 1<<20, time.Minute)
+
+	for i := 0; i < 3; i++ {
+		got, err := m.GetResizedImage("photos", "a.jpg", 100, 100)
+		if err != nil || string(got) != "thumb" {
+			t.Fatalf("get %d = (%q, %v)", i, got, err)
+		}
+	}
+	if inner.reads != 1 {
+		t.Fatalf("Redis read %d times, want once to fill memory", inner.reads)
+	}
+}
+
+func TestMemoryTierEvictsLeastRecentlyUsedOverBudget(t *testing.T) {
+	// Budget for three 10-byte entries; maxEntry is budget/8, so widen it.
+	m := newMemoryTier(newVariantStore(), 30, time.Minute)
+	m.maxEntry = 30
+	blob := make([]byte, 10)
+
+	for _, k := range []string{"a", "b", "c"} {
+		_ = m.SetResizedImage("photos", k, 1, 1, blob)
+	}
+	// Touch a so b becomes the oldest.
+	if _, err := m.GetResizedImage("photos", "a", 1, 1); err != nil {
+		t.Fatalf("a missing: %v", err)
+	}
+	_ = m.SetResizedImage("photos", "d", 1, 1, blob)
+
+	if _, ok := m.entries[memoryID("photos", "b", 1, 1)]; ok {
+		t.Error("b survived; the least recently used entry should have gone")
+	}
+	for _, k := range []string{"a", "c", "d"} {
+		if _, ok := m.entries[memoryID("photos", k, 1, 1)]; !ok {
+			t.Errorf("%s was evicted", k)
+		}
+	}
+	if m.used != 30 {
+		t.Errorf("used = %d, want 30", m.used)
+	}
+}
+
+func TestMemoryTierSkipsEntriesTooLargeToShare(t *testing.T) {
+	m := newMemoryTier(newVariantStore(), 80, time.Minute) // maxEntry 10
+
+	_ = m.SetResizedImage("photos", "big.jpg", 1, 1, make([]byte, 11))
+	if len(m.entries) != 0 {
+		t.Fatal("an entry over an eighth of the budget was kept in memory")
+	}
+}
+
+func TestMemoryTierExpiresEntries(t *testing.T) {
+	inner := newVariantStore()
+	m := newMemoryTier(inner, 1<<20, time.Minute)
+	now := time.Now()
+	m.now = func() time.Time { return now }
+
+	_ = m.SetResizedImage("photos", "a.jpg", 1, 1, []byte("x"))
+	now = now.Add(2 * time.Minute)
+
+	_, _ = m.GetResizedImage("photos", "a.jpg", 1, 1)
+	if inner.reads != 1 {
+		t.Fatal("an expired entry was served from memory")
+	}
+}
+
+func TestMemoryTierPurgeIsScopedAndReachesRedis(t *testing.T) {
+	inner := newVariantStore()
+	m := newMemoryTier(inner, 1<<20, time.Minute)
+	for _, e := range []struct{ bucket, key string }{
+		{"photos", "2026/a.jpg"},
+		{"photos", "2026/a.jpg.bak"},
+		{"photos", "2025/b.jpg"},
+		{"docs", "2026/a.jpg"},
+	} {
+		_ = m.SetResizedImage(e.bucket, e.key, 1, 1, []byte("x"))
+	}
+
+	scope := PurgeScope{Bucket: "photos", Key: "2026/a.jpg"}
+	if _, err := m.PurgeVariants(context.Background(), scope); err != nil {
+		t.Fatalf("purge: %v", err)
+	}
+	if len(m.entries) != 3 {
+		t.Fatalf("exact purge left %d entries, want 3", len(m.entries))
+	}
+	if len(inner.purges) != 1 || inner.purges[0] != scope {
+		t.Fatalf("Redis saw %v, want the same scope", inner.purges)
+	}
+
+	_, _ = m.PurgeVariants(context.Background(), PurgeScope{Bucket: "photos", Prefix: "2026/"})
+	_, _ = m.PurgeVariants(context.Background(), PurgeScope{Bucket: "photos"})
+	if len(m.entries) != 1 {
+		t.Fatalf("bucket purge left %d entries, want only the other bucket's", len(m.entries))
+	}
+	if m.used != 1 {
+		t.Errorf("used = %d after purges, want 1", m.used)
+	}
+}
+
+// A purge made on another replica arrives through the subscription and has to
+// drop this replica's copy.
+func TestMemoryTierAppliesBroadcastPurges(t *testing.T) {
+	t.Setenv("MEMORY_CACHE_MB", "1")
+	inner := newVariantStore()
+	c := NewMemoryTier(context.Background(), inner)
+	_ = c.SetResizedImage("photos", "a.jpg", 1, 1, []byte("x"))
+
+	if inner.onSub == nil {
+		t.Fatal("the tier did not subscribe to purges")
+	}
+	inner.onSub(PurgeScope{Bucket: "photos", Key: "a.jpg"})
+
+	_, _ = c.GetResizedImage("photos", "a.jpg", 1, 1)
+	if inner.reads != 1 {
+		t.Fatal("a broadcast purge did not reach the in-memory copy")
+	}
+}
+
+func TestNewMemoryTierDisabled(t *testing.T) {
+	t.Setenv("MEMORY_CACHE_MB", "0")
+	inner := newVariantStore()
+	if c := NewMemoryTier(context.Background(), inner); c != CacheService(inner) {
+		t.Fatal("a zero budget should hand back the wrapped cache")
+	}
+	if c := NewMemoryTier(context.Background(), nil); c != nil {
+		t.Fatal("no cache should stay no cache")
+	}
+}
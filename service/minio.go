@@ -24,3 +24,23 @@ func MinioClient() *minio.Client {
 
 	return minioClient
 }
+
+// PresignClient builds the client that signs direct-upload URLs, or nil when
+// MINIO_PUBLIC_ENDPOINT is unset and the feature is off.
+//
+// It cannot be the client above. A presigned URL's signature covers the host,
+// and MINIO_ENDPOINT is the address this service reaches MinIO on, usually a
+// container name no browser can resolve. The region is fixed rather than looked
+// up so that signing never makes a request: the public endpoint is often not
+// reachable from inside the deployment at all.
+func PresignClient() (*minio.Client, error) {
+	endpoint := config.GetEnvOrDefault("MINIO_PUBLIC_ENDPOINT", "")
+	if endpoint == "" {
+		return nil, nil
+	}
+	return minio.New(endpoint, &minio.Options{
+		Creds:  credentials.NewStaticV4(config.GetEnvOrDefault("MINIO_ROOT_USER", "minioadmin"), config.GetEnvOrDefault("MINIO_ROOT_PASSWORD", "minioadmin"), ""),
+		Secure: config.GetEnvAsBoolOrDefault("MINIO_PUBLIC_USE_SSL", true),
+		Region: config.GetEnvOrDefault("MINIO_REGION", "us-east-1"),
+	})
+}
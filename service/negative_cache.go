@@ -0,0 +1,179 @@
+package service
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mstgnz/cdn/pkg/config"
+	"github.com/mstgnz/cdn/pkg/observability"
+)
+
+// NegativeCache remembers, briefly, that an object exists in neither tier.
+//
+// Every MinIO miss on the read path falls through to the archive, which is a
+// billed S3 request with real latency. That is the right trade for an object
+// the retention job moved, and the wrong one for a scanner walking random keys:
+// each probe became an AWS call, and the only thing in front of it was nginx's
+// 404 cache, which a query string defeats. A few seconds of memory per key
+// turns a burst of probes for the same key into one archive lookup.
+//
+// There are two layers. The in-process one answers without any I/O; the shared
+// one, when Redis is configured, lets every replica benefit from a lookup any
+// one of them made. The TTL is kept short because it is also the bound on how
+// long a replica that missed an invalidation keeps answering 404 for an object
+// that now exists.
+//
+// A nil *NegativeCache is a disabled one; every method accepts it.
+type NegativeCache struct {
+	shared CacheService
+	ttl    time.Duration
+	max    int
+	now    func() time.Time
+
+	mu      sync.Mutex
+	entries map[string]time.Time // expiry
+}
+
+// NewNegativeCache reads NEGATIVE_CACHE_TTL_SECONDS (default 30, 0 disables)
+// and NEGATIVE_CACHE_MAX_ENTRIES (default 100000). shared may be nil, and is
+// ignored when NEGATIVE_CACHE_REDIS is false.
+func NewNegativeCache(shared CacheService) *NegativeCache {
+	ttl := time.Duration(config.GetEnvAsIntOrDefault("NEGATIVE_CACHE_TTL_SECONDS", 30)) * time.Second
+	if ttl <= 0 {
+		return nil
+	}
+	if !config.GetEnvAsBoolOrDefault("NEGATIVE_CACHE_REDIS", true) {
+		shared = nil
+	}
+	return newNegativeCache(shared, ttl, config.GetEnvAsIntOrDefault("NEGATIVE_CACHE_MAX_ENTRIES", 100000))
+}
+
+func newNegativeCache(shared CacheService, ttl time.Duration, max int) *NegativeCache {
+	if max < 1 {
+		max = 1
+	}
+	return &NegativeCache{
+		shared:  shared,
+		ttl:     ttl,
+		max:     max,
+		now:     time.Now,
+		entries: make(map[string]time.Time),
+	}
+}
+
+func negativeID(bucket, object string) string {
+	return bucket + "\x00" + object
+}
+
+func negativeKey(bucket, object string) string {
+	return CacheNamespace() + ":missing:" + bucket + ":" + object
+}
+
+// Missing reports whether the object was recently found in neither tier. A
+// true answer is counted as an archive lookup saved.
+func (n *NegativeCache) Missing(bucket, object string) bool {
+	if n == nil {
+		return false
+	}
+	id := negativeID(bucket, object)
+
+	n.mu.Lock()
+	expires, ok := n.entries[id]
+	if ok && !n.now().Before(expires) {
+		delete(n.entries, id)
+		ok = false
+	}
+	n.mu.Unlock()
+	if ok {
+		observability.NegativeCacheSaved.WithLabelValues("memory").Inc()
+		return true
+	}
+
+	if n.shared == nil {
+		return false
+	}
+	if v, err := n.shared.Get(negativeKey(bucket, object)); err == nil && len(v) > 0 {
+		// Held locally only for what is left of a TTL would be better, but
+		// Get does not say; a full local TTL at most doubles the window.
+		n.remember(id)
+		observability.NegativeCacheSaved.WithLabelValues("redis").Inc()
+		return true
+	}
+	return false
+}
+
+// Remember records that neither tier has the object. Callers must only call it
+// for a definite not-found: remembering a timeout would turn an archive hiccup
+// into a run of 404s for an object that exists.
+func (n *NegativeCache) Remember(bucket, object string) {
+	if n == nil {
+		return
+	}
+	n.remember(negativeID(bucket, object))
+	if n.shared != nil {
+		_ = n.shared.Set(negativeKey(bucket, object), []byte{1}, n.ttl)
+	}
+}
+
+func (n *NegativeCache) remember(id string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if len(n.entries) >= n.max {
+		// A scanner can mint keys faster than they expire. Dropping expired
+		// entries first, and then anything, keeps memory bounded; the cost of
+		// forgetting is one archive lookup.
+		now := n.now()
+		for k, exp := range n.entries {
+			if !now.Before(exp) {
+				delete(n.entries, k)
+			}
+		}
+		for k := range n.entries {
+			if len(n.entries) < n.max {
+				break
+			}
+			delete(n.entries, k)
+		}
+	}
+	n.entries[id] = n.now().Add(n.ttl)
+}
+
+// Forget drops the entry for an object that has just been written, here and in
+// the shared layer. Other replicas' in-process entries are dropped through the
+// purge broadcast; see Subscribe.
+func (n *NegativeCache) Forget(bucket, object string) {
+	if n == nil {
+		return
+	}
+	n.forgetLocal(PurgeScope{Bucket: bucket, Key: object})
+	if n.shared != nil {
+		_ = n.shared.Delete(negativeKey(bucket, object))
+	}
+}
+
+func (n *NegativeCache) forgetLocal(scope PurgeScope) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if scope.Key != "" {
+		delete(n.entries, negativeID(scope.Bucket, scope.Key))
+		return
+	}
+	for id := range n.entries {
+		bucket, object, _ := strings.Cut(id, "\x00")
+		if scope.covers(bucket, object) {
+			delete(n.entries, id)
+		}
+	}
+}
+
+// Subscribe drops local entries whenever any replica publishes a purge, which
+// is how an upload on one replica reaches the others' memory.
+func (n *NegativeCache) Subscribe(ctx context.Context, sub PurgeSubscriber) {
+	if n == nil || sub == nil {
+		return
+	}
+	sub.SubscribePurges(ctx, n.forgetLocal)
+}
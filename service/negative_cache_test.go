@@ -0,0 +1,113 @@
+package service
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"github.com/mstgnz/cdn/pkg/observability"
+)
+
+// keyStore is the shared layer: plain keys only, TTLs ignored.
+type keyStore struct {
+	CacheService
+	data map[string][]byte
+}
+
+func (k *keyStore) Get(key string) ([]byte, error) {
+	if v, ok := k.data[key]; ok {
+		return v, nil
+	}
+	return nil, ErrCacheMiss
+}
+
+func (k *keyStore) Set(key string, value []byte, _ time.Duration) error {
+	k.data[key] = value
+	return nil
+}
+
+func (k *keyStore) Delete(key string) error {
+	delete(k.data, key)
+	return nil
+}
+
+func TestNegativeCacheExpires(t *testing.T) {
+	n := newNegativeCache(nil, 10*time.Second, 100)
+	now := time.Unix(1_000_000, 0)
+	n.now = func() time.Time { return now }
+
+	n.Remember("photos", "nope.jpg")
+	if !n.Missing("photos", "nope.jpg") {
+		t.Fatal("a remembered key is not reported missing")
+	}
+	if n.Missing("photos", "other.jpg") {
+		t.Fatal("an unrelated key is reported missing")
+	}
+
+	now = now.Add(10 * time.Second)
+	if n.Missing("photos", "nope.jpg") {
+		t.Fatal("an entry outlived its TTL")
+	}
+}
+
+func TestNegativeCacheCountsSavedLookups(t *testing.T) {
+	memory := observability.NegativeCacheSaved.WithLabelValues("memory")
+	before := testutil.ToFloat64(memory)
+
+	n := newNegativeCache(nil, time.Minute, 100)
+	n.Remember("photos", "nope.jpg")
+	n.Missing("photos", "nope.jpg")
+	n.Missing("photos", "nope.jpg")
+	n.Missing("photos", "exists.jpg")
+
+	if got := testutil.ToFloat64(memory) - before; got != 2 {
+		t.Fatalf("saved lookups = %v, want 2", got)
+	}
+}
+
+// A replica that has never seen the key learns about it from Redis, and an
+// upload on any replica clears it there.
+func TestNegativeCacheSharedLayer(t *testing.T) {
+	shared := &keyStore{data: map[string][]byte{}}
+	a := newNegativeCache(shared, time.Minute, 100)
+	b := newNegativeCache(shared, time.Minute, 100)
+
+	a.Remember("photos", "nope.jpg")
+	if !b.Missing("photos", "nope.jpg") {
+		t.Fatal("second replica did not see the shared entry")
+	}
+
+	a.Forget("photos", "nope.jpg")
+	if a.Missing("photos", "nope.jpg") {
+		t.Fatal("forgotten key still missing on the replica that wrote it")
+	}
+
+	// b copied the entry into memory; the purge broadcast is what clears it.
+	b.forgetLocal(PurgeScope{Bucket: "photos", Key: "nope.jpg"})
+	if b.Missing("photos", "nope.jpg") {
+		t.Fatal("broadcast did not clear the other replica")
+	}
+}
+
+func TestNegativeCacheStaysBounded(t *testing.T) {
+	n := newNegativeCache(nil, time.Minute, 3)
+	for _, k := range []string{"a", "b", "c", "d", "e"} {
+		n.Remember("photos", k)
+	}
+	if len(n.entries) > 3 {
+		t.Fatalf("%d entries held, cap is 3", len(n.entries))
+	}
+	if !n.Missing("photos", "e") {
+		t.Fatal("the newest entry was the one dropped")
+	}
+}
+
+func TestNegativeCacheNilIsDisabled(t *testing.T) {
+	var n *NegativeCache
+	n.Remember("photos", "a")
+	n.Forget("photos", "a")
+	if n.Missing("photos", "a") {
+		t.Fatal("a nil cache reported a key missing")
+	}
+}
@@ -22,7 +22,10 @@ type RetentionStats struct {
 	BytesFreed   int64
 	NotArchived  int
 	SizeMismatch int
-	Errors       int
+	// DigestMismatch counts objects kept because the archived copy, though the
+	// right size, was recorded with a different SHA-256.
+	DigestMismatch int
+	Errors         int
 }
 
 // Retention frees local disk by removing objects that the archive already holds.
@@ -43,6 +46,10 @@ type Retention struct {
 	tiering *Tiering
 	logger  zerolog.Logger
 
+	// notifier hears about every local copy the sweep removes. Dry runs remove
+	// nothing and report nothing.
+	notifier PurgeNotifier
+
 	enabled  bool
 	dryRun   bool
 	window   time.Duration
@@ -78,6 +85,7 @@ func NewRetention(store ObjectStore, archive Archive) *Retention {
 		archive:  archive,
 		tiering:  NewTiering(store, archive),
 		logger:   observability.Logger(),
+		notifier: NopPurgeNotifier{},
 		enabled:  config.GetEnvAsBoolOrDefault("RETENTION_ENABLED", false),
 		dryRun:   config.GetEnvAsBoolOrDefault("RETENTION_DRY_RUN", true),
 		window:   time.Duration(days) * 24 * time.Hour,
@@ -86,6 +94,16 @@ func NewRetention(store ObjectStore, archive Archive) *Retention {
 	}
 }
 
+// SetPurgeNotifier reports the sweep's evictions upstream, like the on-demand
+// archive endpoint does.
+func (r *Retention) SetPurgeNotifier(n PurgeNotifier) {
+	if n == nil {
+		n = NopPurgeNotifier{}
+	}
+	r.notifier = n
+	r.tiering.SetPurgeNotifier(n)
+}
+
 // Enabled reports whether the job will do anything. Retention without an archive
 // is just deletion, so the archive being off disables it regardless of
 // RETENTION_ENABLED.
@@ -133,6 +151,7 @@ func (r *Retention) Start(ctx context.Context) {
 					Int64("bytes_freed", stats.BytesFreed).
 					Int("not_archived", stats.NotArchived).
 					Int("size_mismatch", stats.SizeMismatch).
+					Int("digest_mismatch", stats.DigestMismatch).
 					Int("errors", stats.Errors).
 					Bool("dry_run", r.dryRun).
 					Msg("retention pass complete")
@@ -235,6 +254,7 @@ func (r *Retention) process(ctx context.Context, bucket string, obj minio.Object
 			Msg("retention: delete failed")
 		return
 	}
+	r.notifier.Notify(PurgeEvicted, bucket, obj.Key)
 
 	c.deleted.Add(1)
 	c.bytesFreed.Add(obj.Size)
@@ -243,24 +263,26 @@ func (r *Retention) process(ctx context.Context, bucket string, obj minio.Object
 // retentionCounters is the concurrent form of RetentionStats. The exported type
 // stays a plain struct so callers and tests keep reading ordinary fields.
 type retentionCounters struct {
-	scanned      atomic.Int64
-	eligible     atomic.Int64
-	deleted      atomic.Int64
-	bytesFreed   atomic.Int64
-	notArchived  atomic.Int64
-	sizeMismatch atomic.Int64
-	errors       atomic.Int64
+	scanned        atomic.Int64
+	eligible       atomic.Int64
+	deleted        atomic.Int64
+	bytesFreed     atomic.Int64
+	notArchived    atomic.Int64
+	sizeMismatch   atomic.Int64
+	digestMismatch atomic.Int64
+	errors         atomic.Int64
 }
 
 func (c *retentionCounters) snapshot() RetentionStats {
 	return RetentionStats{
-		Scanned:      int(c.scanned.Load()),
-		Eligible:     int(c.eligible.Load()),
-		Deleted:      int(c.deleted.Load()),
-		BytesFreed:   c.bytesFreed.Load(),
-		NotArchived:  int(c.notArchived.Load()),
-		SizeMismatch: int(c.sizeMismatch.Load()),
-		Errors:       int(c.errors.Load()),
+		Scanned:        int(c.scanned.Load()),
+		Eligible:       int(c.eligible.Load()),
+		Deleted:        int(c.deleted.Load()),
+		BytesFreed:     c.bytesFreed.Load(),
+		NotArchived:    int(c.notArchived.Load()),
+		SizeMismatch:   int(c.sizeMismatch.Load()),
+		DigestMismatch: int(c.digestMismatch.Load()),
+		Errors:         int(c.errors.Load()),
 	}
 }
 
@@ -269,7 +291,9 @@ func (c *retentionCounters) snapshot() RetentionStats {
 // endpoint cannot drift apart on the one rule that protects the data; what is
 // left here is turning the answer into this job's counters and log lines.
 func (r *Retention) verifyArchived(ctx context.Context, bucket string, obj minio.ObjectInfo, c *retentionCounters) bool {
-	ok, reason, err := r.tiering.VerifyArchived(ctx, bucket, obj.Key, obj.Size)
+	// A listing carries no user metadata, so the digest costs one StatObject,
+	// paid only for objects old enough to be deleted.
+	ok, reason, err := r.tiering.VerifyArchived(ctx, bucket, obj.Key, obj.Size, r.tiering.LocalSHA256(ctx, bucket, obj.Key))
 	if ok {
 		return true
 	}
@@ -288,6 +312,12 @@ func (r *Retention) verifyArchived(ctx context.Context, bucket string, obj minio
 			Str("object", obj.Key).
 			Int64("local_size", obj.Size).
 			Msg("retention: keeping object, archived copy differs in size")
+	case VerifyDigestMismatch:
+		c.digestMismatch.Add(1)
+		r.logger.Warn().
+			Str("bucket", bucket).
+			Str("object", obj.Key).
+			Msg("retention: keeping object, archived copy differs in content")
 	default:
 		c.errors.Add(1)
 		r.logger.Error().Err(err).
@@ -317,8 +347,16 @@ func (r *Retention) targetBuckets(ctx context.Context) ([]string, error) {
 	// sweeping it could only ever produce "keeping object, no archived copy" for
 	// every object in it. Drop it here rather than walking millions of objects to
 	// reach a conclusion already known.
+	//
+	// The service's own buckets are dropped too. Derivatives can be
+	// regenerated and have their own size cap, and archiving them would pay to
+	// keep thumbnails in cold storage forever; staged upload chunks are
+	// temporary by definition.
 	names := make([]string, 0, len(candidates))
 	for _, b := range candidates {
+		if InternalBucket(b) {
+			continue
+		}
 		if r.archive.InScope(b) {
 			names = append(names, b)
 		}
@@ -37,6 +37,7 @@ type fakeStore struct {
 	contents map[string][]byte
 	openErr  error
 	putErr   error
+	copied   []string
 }
 
 func (f *fakeStore) StatObject(_ context.Context, bucket, object string, _ minio.StatObjectOptions) (minio.ObjectInfo, error) {
@@ -99,17 +100,31 @@ func (f *fakeStore) ListBuckets(context.Context) ([]minio.BucketInfo, error) {
 	return out, nil
 }
 
-func (f *fakeStore) ListObjects(_ context.Context, bucket string, _ minio.ListObjectsOptions) <-chan minio.ObjectInfo {
+func (f *fakeStore) ListObjects(_ context.Context, bucket string, opts minio.ListObjectsOptions) <-chan minio.ObjectInfo {
 	ch := make(chan minio.ObjectInfo)
 	go func() {
 		defer close(ch)
 		for _, o := range f.objects[bucket] {
-			ch <- o
+			if strings.HasPrefix(o.Key, opts.Prefix) {
+				ch <- o
+			}
 		}
 	}()
 	return ch
 }
 
+func (f *fakeStore) CopyObject(_ context.Context, dst minio.CopyDestOptions, src minio.CopySrcOptions) (minio.UploadInfo, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	body, ok := f.contents[src.Bucket+"/"+src.Object]
+	if !ok {
+		return minio.UploadInfo{}, errors.New("object not found")
+	}
+	f.contents[dst.Bucket+"/"+dst.Object] = body
+	f.copied = append(f.copied, src.Bucket+"/"+src.Object+" -> "+dst.Bucket+"/"+dst.Object)
+	return minio.UploadInfo{Bucket: dst.Bucket, Key: dst.Object}, nil
+}
+
 func (f *fakeStore) RemoveObject(_ context.Context, bucket, object string, _ minio.RemoveObjectOptions) error {
 	if f.removeErr != nil {
 		return f.removeErr
@@ -138,6 +153,7 @@ type fakeArchive struct {
 
 	enabled bool
 	sizes   map[string]int64
+	sums    map[string]string
 	errs    map[string]error
 
 	// bodies is what Open hands back, keyed "bucket/object". Only the restore
@@ -208,7 +224,7 @@ func (f *fakeArchive) InScope(bucket string) bool {
 
 // Put records what actually arrived, so a test can prove the archive received
 // the object's real bytes rather than an already-drained reader.
-func (f *fakeArchive) Put(_ context.Context, bucket, object string, body io.Reader) error {
+func (f *fakeArchive) Put(_ context.Context, bucket, object string, body io.Reader, sum, _ string) error {
 	if f.putErr != nil {
 		return f.putErr
 	}
@@ -221,11 +237,15 @@ func (f *fakeArchive) Put(_ context.Context, bucket, object string, body io.Read
 	if f.sizes == nil {
 		f.sizes = map[string]int64{}
 	}
+	if f.sums == nil {
+		f.sums = map[string]string{}
+	}
 	if f.putCorrupts {
 		f.sizes[bucket+"/"+object] = 0
 	} else {
 		f.sizes[bucket+"/"+object] = int64(len(b))
 	}
+	f.sums[bucket+"/"+object] = sum
 	f.putBodies = append(f.putBodies, string(b))
 	return nil
 }
@@ -243,17 +263,31 @@ func (f *fakeArchive) Open(_ context.Context, bucket, object string) (io.ReadClo
 	return io.NopCloser(bytes.NewReader(body)), int64(len(body)), nil
 }
 
-func (f *fakeArchive) Stat(_ context.Context, bucket, object string) (int64, error) {
+func (f *fakeArchive) Copy(_ context.Context, srcBucket, srcObject, dstBucket, dstObject string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	size, ok := f.sizes[srcBucket+"/"+srcObject]
+	if !ok {
+		return ErrArchiveNotFound
+	}
+	f.sizes[dstBucket+"/"+dstObject] = size
+	if f.sums != nil {
+		f.sums[dstBucket+"/"+dstObject] = f.sums[srcBucket+"/"+srcObject]
+	}
+	return nil
+}
+
+func (f *fakeArchive) Stat(_ context.Context, bucket, object string) (ArchiveInfo, error) {
 	f.mu.Lock()
 	defer f.mu.Unlock()
 	key := bucket + "/" + object
 	if err, ok := f.errs[key]; ok {
-		return 0, err
+		return ArchiveInfo{}, err
 	}
 	if size, ok := f.sizes[key]; ok {
-		return size, nil
+		return ArchiveInfo{Size: size, SHA256: f.sums[key]}, nil
 	}
-	return 0, ErrArchiveNotFound
+	return ArchiveInfo{}, ErrArchiveNotFound
 }
 
 // newTestRetention builds a job with the schedule already switched on, so each
@@ -7,6 +7,7 @@ import (
 	"fmt"
 	"io"
 	"net/http"
+	"strings"
 
 	"github.com/minio/minio-go/v7"
 	"github.com/rs/zerolog"
@@ -25,6 +26,7 @@ type ObjectStore interface {
 	PutObject(ctx context.Context, bucket, object string, reader io.Reader, size int64, opts minio.PutObjectOptions) (minio.UploadInfo, error)
 	MakeBucket(ctx context.Context, bucket string, opts minio.MakeBucketOptions) error
 	BucketExists(ctx context.Context, bucket string) (bool, error)
+	CopyObject(ctx context.Context, dst minio.CopyDestOptions, src minio.CopySrcOptions) (minio.UploadInfo, error)
 
 	// OpenObject reads an object's contents. It is deliberately not GetObject:
 	// the minio-go signature returns the concrete *minio.Object, which cannot be
@@ -84,7 +86,10 @@ const (
 	VerifyOK           VerifyReason = "ok"
 	VerifyNotArchived  VerifyReason = "not_archived"
 	VerifySizeMismatch VerifyReason = "size_mismatch"
-	VerifyError        VerifyReason = "error"
+	// VerifyDigestMismatch: the sizes agree but both sides recorded a SHA-256
+	// and the two differ.
+	VerifyDigestMismatch VerifyReason = "digest_mismatch"
+	VerifyError          VerifyReason = "error"
 )
 
 // Tiering moves objects between the local store and the archive.
@@ -95,19 +100,30 @@ const (
 // go through here, so there is a single place where that decision is made and a
 // single place to get it wrong.
 type Tiering struct {
-	store   ObjectStore
-	archive Archive
-	logger  zerolog.Logger
+	store    ObjectStore
+	archive  Archive
+	notifier PurgeNotifier
+	logger   zerolog.Logger
 }
 
 func NewTiering(store ObjectStore, archive Archive) *Tiering {
 	return &Tiering{
-		store:   store,
-		archive: archive,
-		logger:  observability.Logger(),
+		store:    store,
+		archive:  archive,
+		notifier: NopPurgeNotifier{},
+		logger:   observability.Logger(),
 	}
 }
 
+// SetPurgeNotifier makes evictions visible to the caches in front of the
+// service. Without one they are not reported anywhere.
+func (t *Tiering) SetPurgeNotifier(n PurgeNotifier) {
+	if n == nil {
+		n = NopPurgeNotifier{}
+	}
+	t.notifier = n
+}
+
 // Enabled reports whether tiering can do anything at all.
 func (t *Tiering) Enabled() bool {
 	return t.archive != nil && t.archive.Enabled()
@@ -127,11 +143,18 @@ func (t *Tiering) InScope(bucket string) bool {
 // measure. Comparing sizes is what turns "there is something under that key"
 // into "the object is safe to remove locally".
 //
+// Size is still only a proxy for content, so when the local object carries
+// the SHA-256 its upload recorded (localSum) and the archived copy was written
+// with one too, the two digests have to agree as well. Either side without a
+// digest, which is everything stored before digests were recorded, falls back
+// to the size check alone rather than failing: refusing those would stall
+// retention for the whole existing archive.
+//
 // Every failure mode returns false. An archive that cannot be reached is not an
 // archive that is empty, and a transient outage must postpone a delete rather
 // than license it.
-func (t *Tiering) VerifyArchived(ctx context.Context, bucket, key string, localSize int64) (bool, VerifyReason, error) {
-	archivedSize, err := t.archive.Stat(ctx, bucket, key)
+func (t *Tiering) VerifyArchived(ctx context.Context, bucket, key string, localSize int64, localSum string) (bool, VerifyReason, error) {
+	archived, err := t.archive.Stat(ctx, bucket, key)
 	if err != nil {
 		if errors.Is(err, ErrArchiveNotFound) {
 			return false, VerifyNotArchived, nil
@@ -139,12 +162,26 @@ func (t *Tiering) VerifyArchived(ctx context.Context, bucket, key string, localS
 		return false, VerifyError, err
 	}
 
-	if archivedSize != localSize {
+	if archived.Size != localSize {
 		return false, VerifySizeMismatch, nil
 	}
+	if localSum != "" && archived.SHA256 != "" && !strings.EqualFold(localSum, archived.SHA256) {
+		return false, VerifyDigestMismatch, nil
+	}
 	return true, VerifyOK, nil
 }
 
+// LocalSHA256 returns the digest an object was uploaded with, or "" when it
+// has none or cannot be read. For callers that only have a listing entry,
+// which does not carry user metadata.
+func (t *Tiering) LocalSHA256(ctx context.Context, bucket, key string) string {
+	info, err := t.store.StatObject(ctx, bucket, key, minio.StatObjectOptions{})
+	if err != nil {
+		return ""
+	}
+	return info.UserMetadata[MetaSHA256]
+}
+
 // ArchiveObject copies one object to the archive and, when evict is set, removes
 // the local copy once the archive is verified to hold it.
 //
@@ -171,17 +208,26 @@ func (t *Tiering) ArchiveObject(ctx context.Context, bucket, key string, evict b
 		return TierResult{Key: key, Outcome: TierNotFound, Err: statErr}
 	}
 
-	return t.ArchiveKnownObject(ctx, bucket, key, info.Size, evict)
+	return t.archiveKnown(ctx, bucket, key, info.Size, info.UserMetadata[MetaSHA256], info.VersionID, evict)
 }
 
 // ArchiveKnownObject is ArchiveObject for a caller that already knows the
-// object's local size, which lets it skip the StatObject round trip.
+// object's local size, which lets it skip the StatObject round trip. localSum
+// is the object's recorded SHA-256, or "" when the caller does not have it;
+// without it the archived copy is written and verified by size alone.
 //
 // This is not a micro-optimisation at the scale it exists for: a backfill walks
 // millions of objects and gets each one's size from the listing it is already
 // paginating through, so re-statting every one of them would double the calls
 // into local storage for information already in hand.
-func (t *Tiering) ArchiveKnownObject(ctx context.Context, bucket, key string, localSize int64, evict bool) TierResult {
+func (t *Tiering) ArchiveKnownObject(ctx context.Context, bucket, key string, localSize int64, localSum string, evict bool) TierResult {
+	return t.archiveKnown(ctx, bucket, key, localSize, localSum, "", evict)
+}
+
+// archiveKnown is ArchiveKnownObject with the object's MinIO version ID, for
+// the callers that statted it and so have one to record with the archived
+// copy. A listing does not carry it, so a backfill archives without.
+func (t *Tiering) archiveKnown(ctx context.Context, bucket, key string, localSize int64, localSum, version string, evict bool) TierResult {
 	res := TierResult{Key: key, Size: localSize}
 
 	if !t.Enabled() {
@@ -202,7 +248,7 @@ func (t *Tiering) ArchiveKnownObject(ctx context.Context, bucket, key string, lo
 	// re-run over a large batch this turns almost every object into one HeadObject
 	// instead of a full read and write, which is what makes an interrupted
 	// backfill cheap to resume.
-	verified, _, verifyErr := t.VerifyArchived(ctx, bucket, key, localSize)
+	verified, _, verifyErr := t.VerifyArchived(ctx, bucket, key, localSize, localSum)
 	if verifyErr != nil {
 		res.Outcome = TierFailed
 		res.Err = verifyErr
@@ -210,7 +256,7 @@ func (t *Tiering) ArchiveKnownObject(ctx context.Context, bucket, key string, lo
 	}
 
 	if !verified {
-		if err := t.copyToArchive(ctx, bucket, key); err != nil {
+		if err := t.copyToArchive(ctx, bucket, key, localSum, version); err != nil {
 			res.Outcome = TierFailed
 			res.Err = err
 			return res
@@ -219,7 +265,7 @@ func (t *Tiering) ArchiveKnownObject(ctx context.Context, bucket, key string, lo
 		// Re-verify against the archive rather than trusting the write. A short
 		// write, a truncated reader or a proxy that swallowed the body all produce
 		// a successful-looking PUT, and this is the last point before a delete.
-		verified, reason, err := t.VerifyArchived(ctx, bucket, key, localSize)
+		verified, reason, err := t.VerifyArchived(ctx, bucket, key, localSize, localSum)
 		if err != nil {
 			res.Outcome = TierFailed
 			res.Err = err
@@ -243,6 +289,7 @@ func (t *Tiering) ArchiveKnownObject(ctx context.Context, bucket, key string, lo
 		res.Err = fmt.Errorf("archived but local copy could not be removed: %w", err)
 		return res
 	}
+	t.notifier.Notify(PurgeEvicted, bucket, key)
 
 	res.Outcome = TierArchived
 	return res
@@ -335,15 +382,16 @@ func (t *Tiering) Walk(ctx context.Context, bucket string, fn func(key string, s
 	return t.archive.Walk(ctx, bucket, fn)
 }
 
-// copyToArchive streams the object from the local store into the archive.
-func (t *Tiering) copyToArchive(ctx context.Context, bucket, key string) error {
+// copyToArchive streams the object from the local store into the archive,
+// with its recorded digest and version when it has them.
+func (t *Tiering) copyToArchive(ctx context.Context, bucket, key, sum, version string) error {
 	body, err := t.store.OpenObject(ctx, bucket, key)
 	if err != nil {
 		return fmt.Errorf("read %s/%s: %w", bucket, key, err)
 	}
 	defer body.Close()
 
-	if err := t.archive.Put(ctx, bucket, key, body); err != nil {
+	if err := t.archive.Put(ctx, bucket, key, body, sum, version); err != nil {
 		return err
 	}
 	return nil
@@ -348,7 +348,7 @@ func TestVerifyArchivedReasons(t *testing.T) {
 
 	t.Run("matching size", func(t *testing.T) {
 		a := &fakeArchive{enabled: true, sizes: map[string]int64{"b/o": 100}}
-		ok, reason, err := newTestTiering(&fakeStore{}, a).VerifyArchived(ctx, "b", "o", 100)
+		ok, reason, err := newTestTiering(&fakeStore{}, a).VerifyArchived(ctx, "b", "o", 100, "")
 		if !ok || reason != VerifyOK || err != nil {
 			t.Fatalf("want ok, got ok=%v reason=%q err=%v", ok, reason, err)
 		}
@@ -356,7 +356,7 @@ func TestVerifyArchivedReasons(t *testing.T) {
 
 	t.Run("absent", func(t *testing.T) {
 		a := &fakeArchive{enabled: true, sizes: map[string]int64{}}
-		ok, reason, _ := newTestTiering(&fakeStore{}, a).VerifyArchived(ctx, "b", "o", 100)
+		ok, reason, _ := newTestTiering(&fakeStore{}, a).VerifyArchived(ctx, "b", "o", 100, "")
 		if ok || reason != VerifyNotArchived {
 			t.Fatalf("want not_archived, got ok=%v reason=%q", ok, reason)
 		}
@@ -364,15 +364,36 @@ func TestVerifyArchivedReasons(t *testing.T) {
 
 	t.Run("size mismatch", func(t *testing.T) {
 		a := &fakeArchive{enabled: true, sizes: map[string]int64{"b/o": 0}}
-		ok, reason, _ := newTestTiering(&fakeStore{}, a).VerifyArchived(ctx, "b", "o", 100)
+		ok, reason, _ := newTestTiering(&fakeStore{}, a).VerifyArchived(ctx, "b", "o", 100, "")
 		if ok || reason != VerifySizeMismatch {
 			t.Fatalf("want size_mismatch, got ok=%v reason=%q", ok, reason)
 		}
 	})
 
+	t.Run("digest mismatch", func(t *testing.T) {
+		a := &fakeArchive{enabled: true, sizes: map[string]int64{"b/o": 100}, sums: map[string]string{"b/o": "aaaa"}}
+		ok, reason, _ := newTestTiering(&fakeStore{}, a).VerifyArchived(ctx, "b", "o", 100, "bbbb")
+		if ok || reason != VerifyDigestMismatch {
+			t.Fatalf("want digest_mismatch, got ok=%v reason=%q", ok, reason)
+		}
+	})
+
+	// Copies archived before digests were recorded, or objects uploaded
+	// before, still verify by size.
+	t.Run("digest on one side only", func(t *testing.T) {
+		a := &fakeArchive{enabled: true, sizes: map[string]int64{"b/o": 100}}
+		if ok, _, _ := newTestTiering(&fakeStore{}, a).VerifyArchived(ctx, "b", "o", 100, "bbbb"); !ok {
+			t.Fatal("an archived copy without a digest failed verification")
+		}
+		a.sums = map[string]string{"b/o": "aaaa"}
+		if ok, _, _ := newTestTiering(&fakeStore{}, a).VerifyArchived(ctx, "b", "o", 100, ""); !ok {
+			t.Fatal("a local object without a digest failed verification")
+		}
+	})
+
 	t.Run("unreachable archive is not an empty archive", func(t *testing.T) {
 		a := &fakeArchive{enabled: true, errs: map[string]error{"b/o": errors.New("connection reset")}}
-		ok, reason, err := newTestTiering(&fakeStore{}, a).VerifyArchived(ctx, "b", "o", 100)
+		ok, reason, err := newTestTiering(&fakeStore{}, a).VerifyArchived(ctx, "b", "o", 100, "")
 		if ok {
 			t.Fatal("verified an object while the archive was unreachable")
 		}
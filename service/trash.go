@@ -0,0 +1,290 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/rs/zerolog"
+
+	"github.com/mstgnz/cdn/pkg/bucket"
+	"github.com/mstgnz/cdn/pkg/config"
+	"github.com/mstgnz/cdn/pkg/observability"
+)
+
+// orphanTrashDays is how long the trash keeps what was deleted from a bucket
+// whose policy no longer has a trash. Purging it on the next pass would turn
+// a policy edit into a delete; keeping it forever would leave it where nothing
+// lists it but this endpoint.
+const orphanTrashDays = 30
+
+// TrashItem is one deleted object waiting in the trash. ID is what restores
+// it: the key it was deleted from, followed by when.
+type TrashItem struct {
+	ID        string    `json:"id"`
+	Key       string    `json:"key"`
+	Size      int64     `json:"size"`
+	DeletedAt time.Time `json:"deleted_at"`
+	PurgeAt   time.Time `json:"purge_at"`
+}
+
+// TrashPurgeStats summarises one pass of the purge job.
+type TrashPurgeStats struct {
+	Scanned    int
+	Purged     int
+	BytesFreed int64
+	Skipped    int // keys the trash did not write, left alone
+	Errors     int
+}
+
+// Trash keeps the objects deleted from buckets whose policy asks for it, so a
+// delete can be undone until the purge job removes them for good.
+//
+// Everything is kept in one bucket of its own, under a prefix per source
+// bucket: "<bucket>/<key>~<unix nanoseconds>". The deletion time is in the
+// key rather than in metadata, so the purge job decides from a listing alone
+// and two deletes of the same key are two items rather than one overwriting
+// the other. A deleted object is moved there with a server-side copy, which
+// keeps its content type, metadata and tags for the restore.
+//
+// The trash holds local copies only. The archive is not touched by a delete
+// that goes to the trash, and keeps answering for the object as it does after
+// any delete.
+//
+// A nil *Trash is valid and disabled, so callers need no checks.
+type Trash struct {
+	store    ObjectStore
+	bucket   string
+	interval time.Duration
+	logger   zerolog.Logger
+	now      func() time.Time
+}
+
+// TrashBucket is the bucket deleted objects are kept in.
+func TrashBucket() string {
+	return config.GetEnvOrDefault("TRASH_BUCKET", "cdn-trash")
+}
+
+// NewTrash returns the trash, or nil when no bucket policy keeps one.
+func NewTrash(store ObjectStore) (*Trash, error) {
+	if !config.TrashConfigured() {
+		return nil, nil
+	}
+	name := TrashBucket()
+	if err := bucket.Validate(name); err != nil {
+		return nil, fmt.Errorf("TRASH_BUCKET: %w", err)
+	}
+	minutes := config.GetEnvAsIntOrDefault("TRASH_PURGE_INTERVAL_MINUTES", 60)
+	if minutes < 1 {
+		minutes = 1
+	}
+	return &Trash{
+		store:    store,
+		bucket:   name,
+		interval: time.Duration(minutes) * time.Minute,
+		logger:   observability.Logger(),
+		now:      time.Now,
+	}, nil
+}
+
+// Enabled reports whether there is a trash at all.
+func (t *Trash) Enabled() bool {
+	return t != nil
+}
+
+// Bucket is the bucket the trash is kept in.
+func (t *Trash) Bucket() string {
+	if t == nil {
+		return ""
+	}
+	return t.bucket
+}
+
+// InUse reports whether deletes from a bucket go to the trash.
+func (t *Trash) InUse(bucketName string) bool {
+	return t.Enabled() && config.TrashDaysFor(bucketName) > 0
+}
+
+// EnsureBucket creates the trash bucket on first boot.
+func (t *Trash) EnsureBucket(ctx context.Context) error {
+	if t == nil {
+		return nil
+	}
+	exists, err := t.store.BucketExists(ctx, t.bucket)
+	if err != nil || exists {
+		return err
+	}
+	return t.store.MakeBucket(ctx, t.bucket, minio.MakeBucketOptions{})
+}
+
+// TrashID names the trash item of key deleted at deletedAt.
+func TrashID(key string, deletedAt time.Time) string {
+	return key + "~" + strconv.FormatInt(deletedAt.UnixNano(), 10)
+}
+
+// ParseTrashID splits a trash item's ID into the key it was deleted from and
+// when. The last "~" is the one TrashID added, whatever the key contains.
+func ParseTrashID(id string) (string, time.Time, bool) {
+	cut := strings.LastIndex(id, "~")
+	if cut <= 0 {
+		return "", time.Time{}, false
+	}
+	nanos, err := strconv.ParseInt(id[cut+1:], 10, 64)
+	if err != nil || nanos <= 0 {
+		return "", time.Time{}, false
+	}
+	return id[:cut], time.Unix(0, nanos).UTC(), true
+}
+
+// Key is the object key of a trash item in the trash bucket.
+func (t *Trash) Key(bucketName, id string) string {
+	return bucketName + "/" + id
+}
+
+// Discard moves bucketName/key to the trash and returns its trash ID. An
+// object that is not there returns "" and no error, as deleting it would.
+//
+// The copy is conditional on the ETag the object was stat'ed with, so what
+// lands in the trash is what was there when the delete began; the removal
+// that follows is not, and a write racing a delete loses to it, as it did
+// before there was a trash.
+func (t *Trash) Discard(ctx context.Context, bucketName, key string) (string, error) {
+	info, err := t.store.StatObject(ctx, bucketName, key, minio.StatObjectOptions{})
+	if err != nil {
+		if minio.ToErrorResponse(err).Code == "NoSuchKey" {
+			return "", nil
+		}
+		return "", err
+	}
+	id := TrashID(key, t.now())
+	if _, err := t.store.CopyObject(ctx,
+		minio.CopyDestOptions{Bucket: t.bucket, Object: t.Key(bucketName, id)},
+		minio.CopySrcOptions{Bucket: bucketName, Object: key, MatchETag: info.ETag}); err != nil {
+		return "", fmt.Errorf("could not move the object to the trash: %w", err)
+	}
+	if err := t.store.RemoveObject(ctx, bucketName, key, minio.RemoveObjectOptions{}); err != nil {
+		return id, err
+	}
+	return id, nil
+}
+
+// PurgeAt is when the purge job removes an item of bucketName deleted at
+// deletedAt, under the bucket's policy as it is now.
+func PurgeAt(bucketName string, deletedAt time.Time) time.Time {
+	days := config.TrashDaysFor(bucketName)
+	if days <= 0 {
+		days = orphanTrashDays
+	}
+	return deletedAt.Add(time.Duration(days) * 24 * time.Hour)
+}
+
+// List returns up to limit items of bucketName's trash whose key starts with
+// prefix, after the ID after, and whether there are more. The trash holds no
+// folders, so its listing is MinIO's recursive one, which is sorted.
+func (t *Trash) List(ctx context.Context, bucketName, prefix, after string, limit int) ([]TrashItem, bool, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	root := bucketName + "/"
+	opts := minio.ListObjectsOptions{Prefix: root + prefix, Recursive: true, MaxKeys: limit}
+	if after != "" {
+		opts.StartAfter = root + after
+	}
+	items := []TrashItem{}
+	for info := range t.store.ListObjects(ctx, t.bucket, opts) {
+		if info.Err != nil {
+			return nil, false, info.Err
+		}
+		id := strings.TrimPrefix(info.Key, root)
+		if id <= after {
+			continue
+		}
+		key, deletedAt, ok := ParseTrashID(id)
+		if !ok {
+			continue
+		}
+		if len(items) == limit {
+			return items, true, nil
+		}
+		items = append(items, TrashItem{
+			ID:        id,
+			Key:       key,
+			Size:      info.Size,
+			DeletedAt: deletedAt,
+			PurgeAt:   PurgeAt(bucketName, deletedAt),
+		})
+	}
+	return items, false, nil
+}
+
+// Start runs the purge job on its interval until ctx is cancelled.
+func (t *Trash) Start(ctx context.Context) {
+	if !t.Enabled() {
+		return
+	}
+	t.logger.Info().
+		Str("bucket", t.bucket).
+		Dur("interval", t.interval).
+		Msg("trash enabled")
+
+	go func() {
+		ticker := time.NewTicker(t.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				stats, err := t.Purge(ctx, t.now())
+				ev := t.logger.Info()
+				if err != nil {
+					ev = t.logger.Error().Err(err)
+				}
+				ev.Int("scanned", stats.Scanned).
+					Int("purged", stats.Purged).
+					Int64("bytes_freed", stats.BytesFreed).
+					Int("skipped", stats.Skipped).
+					Int("errors", stats.Errors).
+					Msg("trash purge finished")
+			}
+		}
+	}()
+}
+
+// Purge removes every item whose time in the trash is up at now. now is a
+// parameter so the boundary can be tested exactly.
+//
+// Nothing is purged upstream: the object's caches were purged when it was
+// deleted, and nothing has served it since.
+func (t *Trash) Purge(ctx context.Context, now time.Time) (TrashPurgeStats, error) {
+	var stats TrashPurgeStats
+	if !t.Enabled() {
+		return stats, nil
+	}
+	for info := range t.store.ListObjects(ctx, t.bucket, minio.ListObjectsOptions{Recursive: true}) {
+		if info.Err != nil {
+			return stats, info.Err
+		}
+		stats.Scanned++
+		bucketName, id, found := strings.Cut(info.Key, "/")
+		_, deletedAt, ok := ParseTrashID(id)
+		if !found || !ok {
+			stats.Skipped++
+			continue
+		}
+		if now.Before(PurgeAt(bucketName, deletedAt)) {
+			continue
+		}
+		if err := t.store.RemoveObject(ctx, t.bucket, info.Key, minio.RemoveObjectOptions{}); err != nil {
+			stats.Errors++
+			t.logger.Warn().Err(err).Str("key", info.Key).Msg("trash: could not purge an item")
+			continue
+		}
+		stats.Purged++
+		stats.BytesFreed += info.Size
+	}
+	return stats, ctx.Err()
+}
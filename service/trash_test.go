@@ -0,0 +1,76 @@
+package service
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+)
+
+func TestTrashOnlyWhenAPolicyAsksForIt(t *testing.T) {
+	if tr, err := NewTrash(&fakeStore{}); tr != nil || err != nil {
+		t.Fatalf("without a policy: (%v, %v)", tr, err)
+	}
+	if InternalBucket(TrashBucket()) {
+		t.Fatal("trash bucket reserved while the trash is off")
+	}
+
+	loadDedupPolicy(t, `{"buckets":[{"bucket":"photos","trash":{"days":7}},{"bucket":"scratch"}]}`)
+	tr, err := NewTrash(&fakeStore{})
+	if err != nil || !tr.Enabled() {
+		t.Fatalf("with a policy: (%v, %v)", tr, err)
+	}
+	if !InternalBucket(TrashBucket()) {
+		t.Fatal("trash bucket is not internal")
+	}
+	if !tr.InUse("photos") || tr.InUse("scratch") {
+		t.Fatal("InUse does not follow the policy")
+	}
+}
+
+// The key may contain "~" itself; the last one is the trash's.
+func TestTrashIDRoundTrips(t *testing.T) {
+	at := time.Date(2026, 5, 1, 12, 0, 0, 42, time.UTC)
+	key, deletedAt, ok := ParseTrashID(TrashID("a~b/c.png", at))
+	if !ok || key != "a~b/c.png" || !deletedAt.Equal(at) {
+		t.Fatalf("ParseTrashID = (%q, %v, %v)", key, deletedAt, ok)
+	}
+	for _, id := range []string{"c.png", "~123", "c.png~", "c.png~abc", "c.png~-5"} {
+		if _, _, ok := ParseTrashID(id); ok {
+			t.Errorf("%q parsed as a trash ID", id)
+		}
+	}
+}
+
+// Each bucket's items are kept for its own number of days, to the
+// nanosecond, and what the trash did not write is left alone.
+func TestTrashPurgeFollowsEachBucketsDays(t *testing.T) {
+	loadDedupPolicy(t, `{"defaults":{"trash":{"days":30}},"buckets":[{"bucket":"photos","trash":{"days":7}}]}`)
+	now := time.Date(2026, 6, 1, 0, 0, 0, 0, time.UTC)
+	day := 24 * time.Hour
+	store := &fakeStore{objects: map[string][]minio.ObjectInfo{TrashBucket(): {
+		{Key: "photos/" + TrashID("due.png", now.Add(-7*day)), Size: 10},
+		{Key: "photos/" + TrashID("early.png", now.Add(-7*day+time.Nanosecond)), Size: 10},
+		{Key: "docs/" + TrashID("recent.pdf", now.Add(-8*day)), Size: 20},
+		{Key: "docs/" + TrashID("old.pdf", now.Add(-31*day)), Size: 20},
+		{Key: "photos/put-here-by-hand.png", Size: 5},
+	}}}
+	tr, err := NewTrash(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stats, err := tr.Purge(context.Background(), now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Scanned != 5 || stats.Purged != 2 || stats.BytesFreed != 30 || stats.Skipped != 1 {
+		t.Errorf("stats = %+v", stats)
+	}
+	got := strings.Join(store.removedKeys(), " ")
+	if !strings.Contains(got, "due.png") || !strings.Contains(got, "old.pdf") || strings.Contains(got, "early") || strings.Contains(got, "recent") {
+		t.Errorf("purged %s", got)
+	}
+}
@@ -0,0 +1,328 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+
+	"github.com/mstgnz/cdn/pkg/config"
+	"github.com/mstgnz/cdn/pkg/observability"
+)
+
+// PurgeReason says why an object's URL has to leave the caches in front of this
+// service. It is sent with every event so a receiver can treat them differently.
+type PurgeReason string
+
+const (
+	// PurgeDeleted: the object is gone and its URL now answers with the
+	// not-found placeholder.
+	PurgeDeleted PurgeReason = "deleted"
+
+	// PurgeEvicted: the local copy was removed after the archive verified it.
+	// The URL still serves the same bytes, from the archive. It is reported
+	// because an upstream that caches by origin tier (an nginx proxy_cache
+	// keyed on the MinIO path, for one) needs to hear about it; a receiver that
+	// only fronts the public URL can ignore it.
+	PurgeEvicted PurgeReason = "evicted"
+
+	// PurgeOverwritten: an upload replaced the object under a caller-chosen
+	// key. The URL now serves different bytes, so anything cached under it is
+	// stale.
+	PurgeOverwritten PurgeReason = "overwritten"
+
+	// PurgeMoved: the object was moved to another key and is gone from this
+	// one, the way a deleted object is. A receiver that knows where it went may
+	// want to redirect the old URL instead.
+	PurgeMoved PurgeReason = "moved"
+)
+
+// PurgeEvent is one object to purge upstream.
+type PurgeEvent struct {
+	Bucket string      `json:"bucket"`
+	Key    string      `json:"key"`
+	URL    string      `json:"url"`
+	Reason PurgeReason `json:"reason"`
+}
+
+// PurgeNotifier tells the caches in front of this service (Cloudflare, the nginx
+// proxy cache) that a URL no longer means what it did.
+//
+// Notify never blocks on the upstream. The paths that call it have already
+// changed storage, and a slow or broken purge endpoint must not turn into slow
+// or failed deletes; what could not be delivered is counted and logged instead.
+type PurgeNotifier interface {
+	Notify(reason PurgeReason, bucket string, keys ...string)
+
+	// Close delivers whatever is still queued, waiting until ctx is done at
+	// the latest.
+	Close(ctx context.Context) error
+}
+
+// NopPurgeNotifier is the notifier of a deployment with no upstream to purge.
+type NopPurgeNotifier struct{}
+
+func (NopPurgeNotifier) Notify(PurgeReason, string, ...string) {}
+func (NopPurgeNotifier) Close(context.Context) error           { return nil }
+
+// WebhookPurgeConfig configures WebhookPurgeNotifier. Zero values take the
+// defaults NewPurgeNotifier documents.
+type WebhookPurgeConfig struct {
+	URL   string
+	Token string
+
+	// PublicURL is the base the events' url field is built from, the same
+	// APP_URL the upload endpoints build links from.
+	PublicURL string
+
+	BatchSize     int
+	FlushInterval time.Duration
+	Retries       int
+	Backoff       time.Duration
+	Timeout       time.Duration
+	QueueSize     int
+}
+
+// WebhookPurgeNotifier POSTs purge events as JSON to one URL:
+//
+//	{"objects": [{"bucket": "photos", "key": "a.jpg", "url": "https://cdn.example.com/photos/a.jpg", "reason": "deleted"}]}
+//
+// The receiver owns the translation into a vendor API. Cloudflare, nginx and
+// Varnish each purge differently, and resized variants live under query-string
+// URLs that only the receiver knows whether its cache keys on; a generic hook
+// keeps that knowledge out of this service.
+//
+// Events are batched, because a batch delete of a hundred files should be one
+// purge call rather than a hundred, and a batch is retried with backoff on a
+// network error, a 5xx or a 429. Any other 4xx means the receiver refused the
+// payload, which repeating it will not change.
+type WebhookPurgeNotifier struct {
+	cfg    WebhookPurgeConfig
+	client *http.Client
+	logger zerolog.Logger
+
+	mu     sync.RWMutex
+	closed bool
+	queue  chan PurgeEvent
+	done   chan struct{}
+}
+
+// NewPurgeNotifier builds the notifier the environment asks for.
+//
+// Without PURGE_WEBHOOK_URL it is a no-op, which is every deployment that does
+// not put a cache in front of this service. A URL that is set but unusable is an
+// error, so boot stops rather than running with purges silently going nowhere.
+func NewPurgeNotifier() (PurgeNotifier, error) {
+	target := strings.TrimSpace(config.GetEnvOrDefault("PURGE_WEBHOOK_URL", ""))
+	if target == "" {
+		return NopPurgeNotifier{}, nil
+	}
+
+	u, err := url.Parse(target)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("PURGE_WEBHOOK_URL %q is not an http(s) URL", target)
+	}
+
+	return NewWebhookPurgeNotifier(WebhookPurgeConfig{
+		URL:           target,
+		Token:         config.GetEnvOrDefault("PURGE_WEBHOOK_TOKEN", ""),
+		PublicURL:     config.GetEnvOrDefault("APP_URL", "http://localhost:9090"),
+		BatchSize:     config.GetEnvAsIntOrDefault("PURGE_WEBHOOK_BATCH_SIZE", 100),
+		FlushInterval: time.Duration(config.GetEnvAsIntOrDefault("PURGE_WEBHOOK_FLUSH_MS", 1000)) * time.Millisecond,
+		Retries:       config.GetEnvAsIntOrDefault("PURGE_WEBHOOK_RETRIES", 3),
+		Timeout:       time.Duration(config.GetEnvAsIntOrDefault("PURGE_WEBHOOK_TIMEOUT_SECONDS", 10)) * time.Second,
+	}), nil
+}
+
+// NewWebhookPurgeNotifier starts the delivery goroutine. Close stops it.
+func NewWebhookPurgeNotifier(cfg WebhookPurgeConfig) *WebhookPurgeNotifier {
+	if cfg.BatchSize < 1 {
+		cfg.BatchSize = 100
+	}
+	if cfg.FlushInterval <= 0 {
+		cfg.FlushInterval = time.Second
+	}
+	if cfg.Retries < 0 {
+		cfg.Retries = 0
+	}
+	if cfg.Backoff <= 0 {
+		cfg.Backoff = 500 * time.Millisecond
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = 10 * time.Second
+	}
+	if cfg.QueueSize < cfg.BatchSize {
+		cfg.QueueSize = cfg.BatchSize * 10
+	}
+	cfg.PublicURL = strings.TrimSuffix(cfg.PublicURL, "/")
+
+	w := &WebhookPurgeNotifier{
+		cfg:    cfg,
+		client: &http.Client{Timeout: cfg.Timeout},
+		logger: observability.Logger(),
+		queue:  make(chan PurgeEvent, cfg.QueueSize),
+		done:   make(chan struct{}),
+	}
+	go w.run()
+	return w
+}
+
+// Notify queues one event per key. When the queue is full the event is dropped
+// and counted: blocking here would stall the delete that called it on an
+// upstream that is already not keeping up.
+func (w *WebhookPurgeNotifier) Notify(reason PurgeReason, bucket string, keys ...string) {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	if w.closed {
+		return
+	}
+
+	for _, key := range keys {
+		ev := PurgeEvent{
+			Bucket: bucket,
+			Key:    key,
+			URL:    w.cfg.PublicURL + "/" + bucket + "/" + escapeKeyPath(key),
+			Reason: reason,
+		}
+		select {
+		case w.queue <- ev:
+		default:
+			observability.UpstreamPurgeFailures.WithLabelValues("dropped").Inc()
+			w.logger.Warn().
+				Str("bucket", bucket).
+				Str("key", key).
+				Msg("upstream purge queue full; event dropped")
+		}
+	}
+}
+
+// escapeKeyPath escapes each segment of a key for a URL path and keeps the
+// slashes between them. Keys may hold spaces, '#', '?' and '%'; unescaped, the
+// url field would name some other object, or none, and the purge would miss
+// the one that changed.
+func escapeKeyPath(key string) string {
+	segments := strings.Split(key, "/")
+	for idx, seg := range segments {
+		segments[idx] = url.PathEscape(seg)
+	}
+	return strings.Join(segments, "/")
+}
+
+func (w *WebhookPurgeNotifier) Close(ctx context.Context) error {
+	w.mu.Lock()
+	if !w.closed {
+		w.closed = true
+		close(w.queue)
+	}
+	w.mu.Unlock()
+
+	select {
+	case <-w.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (w *WebhookPurgeNotifier) run() {
+	defer close(w.done)
+
+	ticker := time.NewTicker(w.cfg.FlushInterval)
+	defer ticker.Stop()
+
+	batch := make([]PurgeEvent, 0, w.cfg.BatchSize)
+	flush := func() {
+		if len(batch) > 0 {
+			w.deliver(batch)
+			batch = make([]PurgeEvent, 0, w.cfg.BatchSize)
+		}
+	}
+
+	for {
+		select {
+		case ev, ok := <-w.queue:
+			if !ok {
+				flush()
+				return
+			}
+			batch = append(batch, ev)
+			if len(batch) >= w.cfg.BatchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		}
+	}
+}
+
+// errPurgeRejected marks a response retrying cannot fix.
+var errPurgeRejected = errors.New("purge webhook rejected the request")
+
+func (w *WebhookPurgeNotifier) deliver(batch []PurgeEvent) {
+	body, err := json.Marshal(struct {
+		Objects []PurgeEvent `json:"objects"`
+	}{batch})
+	if err != nil {
+		// Not reachable with these field types; counted rather than ignored
+		// all the same.
+		observability.UpstreamPurgeFailures.WithLabelValues("rejected").Add(float64(len(batch)))
+		return
+	}
+
+	for attempt := 0; ; attempt++ {
+		err = w.post(body)
+		if err == nil {
+			return
+		}
+		if errors.Is(err, errPurgeRejected) || attempt >= w.cfg.Retries {
+			break
+		}
+		time.Sleep(w.cfg.Backoff << attempt)
+	}
+
+	reason := "exhausted"
+	if errors.Is(err, errPurgeRejected) {
+		reason = "rejected"
+	}
+	observability.UpstreamPurgeFailures.WithLabelValues(reason).Add(float64(len(batch)))
+	w.logger.Error().Err(err).
+		Int("objects", len(batch)).
+		Str("first_key", batch[0].Bucket+"/"+batch[0].Key).
+		Msg("upstream purge failed; those URLs stay cached until they expire")
+}
+
+func (w *WebhookPurgeNotifier) post(body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, w.cfg.URL, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("%w: %v", errPurgeRejected, err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if w.cfg.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+w.cfg.Token)
+	}
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return nil
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+		return fmt.Errorf("purge webhook answered %d", resp.StatusCode)
+	default:
+		return fmt.Errorf("%w: status %d", errPurgeRejected, resp.StatusCode)
+	}
+}
@@ -0,0 +1,267 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"github.com/mstgnz/cdn/pkg/observability"
+)
+
+// purgeStub is a local stand-in for the purge receiver. It answers with the
+// statuses it is given, in order, and then 200.
+type purgeStub struct {
+	mu       sync.Mutex
+	statuses []int
+	batches  [][]PurgeEvent
+	auth     []string
+	calls    atomic.Int32
+}
+
+func (s *purgeStub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.calls.Add(1)
+	var body struct {
+		Objects []PurgeEvent `json:"objects"`
+	}
+	_ = json.NewDecoder(r.Body).Decode(&body)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.auth = append(s.auth, r.Header.Get("Authorization"))
+	status := http.StatusOK
+	if len(s.statuses) > 0 {
+		status, s.statuses = s.statuses[0], s.statuses[1:]
+	}
+	if status == http.StatusOK {
+		s.batches = append(s.batches, body.Objects)
+	}
+	w.WriteHeader(status)
+}
+
+func newStubNotifier(t *testing.T, stub *purgeStub, cfg WebhookPurgeConfig) *WebhookPurgeNotifier {
+	t.Helper()
+	srv := httptest.NewServer(stub)
+	t.Cleanup(srv.Close)
+
+	cfg.URL = srv.URL
+	cfg.PublicURL = "https://cdn.example.com/"
+	cfg.Backoff = time.Millisecond
+	if cfg.FlushInterval == 0 {
+		// Long enough that only the batch size or Close flushes in a test.
+		cfg.FlushInterval = time.Hour
+	}
+	return NewWebhookPurgeNotifier(cfg)
+}
+
+func closeNotifier(t *testing.T, n PurgeNotifier) {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := n.Close(ctx); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+}
+
+func TestWebhookPurgeBatchesEvents(t *testing.T) {
+	stub := &purgeStub{}
+	n := newStubNotifier(t, stub, WebhookPurgeConfig{BatchSize: 2, Token: "secret"})
+
+	n.Notify(PurgeDeleted, "photos", "a.jpg", "b.jpg", "c.jpg")
+	closeNotifier(t, n)
+
+	if len(stub.batches) != 2 || len(stub.batches[0]) != 2 || len(stub.batches[1]) != 1 {
+		t.Fatalf("batches = %v, want one of two and one of one", stub.batches)
+	}
+	got := stub.batches[0][0]
+	want := PurgeEvent{Bucket: "photos", Key: "a.jpg", URL: "https://cdn.example.com/photos/a.jpg", Reason: PurgeDeleted}
+	if got != want {
+		t.Errorf("event = %+v, want %+v", got, want)
+	}
+	if stub.auth[0] != "Bearer secret" {
+		t.Errorf("Authorization = %q", stub.auth[0])
+	}
+}
+
+// A key is escaped segment by segment in the url field, so the upstream is
+// told to purge the URL the object is actually served on.
+func TestWebhookPurgeEscapesTheKeyInTheURL(t *testing.T) {
+	stub := &purgeStub{}
+	n := newStubNotifier(t, stub, WebhookPurgeConfig{})
+
+	n.Notify(PurgeOverwritten, "photos", "2026/summer #1/50% off?.jpg")
+	closeNotifier(t, n)
+
+	if len(stub.batches) != 1 || len(stub.batches[0]) != 1 {
+		t.Fatalf("batches = %v", stub.batches)
+	}
+	if got, want := stub.batches[0][0].URL, "https://cdn.example.com/photos/2026/summer%20%231/50%25%20off%3F.jpg"; got != want {
+		t.Errorf("url = %q, want %q", got, want)
+	}
+}
+
+func TestWebhookPurgeFlushesOnInterval(t *testing.T) {
+	stub := &purgeStub{}
+	n := newStubNotifier(t, stub, WebhookPurgeConfig{BatchSize: 100, FlushInterval: 10 * time.Millisecond})
+	defer closeNotifier(t, n)
+
+	n.Notify(PurgeDeleted, "photos", "a.jpg")
+
+	deadline := time.Now().Add(2 * time.Second)
+	for stub.calls.Load() == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("a partial batch was never flushed")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// A receiver that is briefly down or rate limiting gets the same batch again.
+func TestWebhookPurgeRetriesTransientFailures(t *testing.T) {
+	stub := &purgeStub{statuses: []int{http.StatusServiceUnavailable, http.StatusTooManyRequests}}
+	n := newStubNotifier(t, stub, WebhookPurgeConfig{Retries: 3})
+	before := testutil.ToFloat64(observability.UpstreamPurgeFailures.WithLabelValues("exhausted"))
+
+	n.Notify(PurgeDeleted, "photos", "a.jpg")
+	closeNotifier(t, n)
+
+	if stub.calls.Load() != 3 || len(stub.batches) != 1 {
+		t.Fatalf("calls = %d, delivered = %d; want 3 calls and one delivery", stub.calls.Load(), len(stub.batches))
+	}
+	if after := testutil.ToFloat64(observability.UpstreamPurgeFailures.WithLabelValues("exhausted")); after != before {
+		t.Errorf("a delivered batch was counted as failed")
+	}
+}
+
+func TestWebhookPurgeCountsFailures(t *testing.T) {
+	t.Run("exhausted", func(t *testing.T) {
+		stub := &purgeStub{statuses: []int{500, 500, 500}}
+		n := newStubNotifier(t, stub, WebhookPurgeConfig{Retries: 2})
+		metric := observability.UpstreamPurgeFailures.WithLabelValues("exhausted")
+		before := testutil.ToFloat64(metric)
+
+		n.Notify(PurgeDeleted, "photos", "a.jpg", "b.jpg")
+		closeNotifier(t, n)
+
+		if stub.calls.Load() != 3 {
+			t.Errorf("calls = %d, want the first try plus two retries", stub.calls.Load())
+		}
+		if got := testutil.ToFloat64(metric) - before; got != 2 {
+			t.Errorf("failures counted = %v, want 2 (one per object)", got)
+		}
+	})
+
+	// Retrying a refused payload cannot change the answer.
+	t.Run("rejected", func(t *testing.T) {
+		stub := &purgeStub{statuses: []int{http.StatusUnauthorized}}
+		n := newStubNotifier(t, stub, WebhookPurgeConfig{Retries: 3})
+		metric := observability.UpstreamPurgeFailures.WithLabelValues("rejected")
+		before := testutil.ToFloat64(metric)
+
+		n.Notify(PurgeDeleted, "photos", "a.jpg")
+		closeNotifier(t, n)
+
+		if stub.calls.Load() != 1 {
+			t.Errorf("calls = %d, want no retry on a 4xx", stub.calls.Load())
+		}
+		if got := testutil.ToFloat64(metric) - before; got != 1 {
+			t.Errorf("failures counted = %v, want 1", got)
+		}
+	})
+}
+
+func TestWebhookPurgeIgnoresNotifyAfterClose(t *testing.T) {
+	stub := &purgeStub{}
+	n := newStubNotifier(t, stub, WebhookPurgeConfig{})
+	closeNotifier(t, n)
+
+	n.Notify(PurgeDeleted, "photos", "a.jpg") // must not panic on the closed queue
+	if stub.calls.Load() != 0 {
+		t.Fatalf("delivered after Close")
+	}
+}
+
+func TestNewPurgeNotifierFromEnvironment(t *testing.T) {
+	t.Setenv("PURGE_WEBHOOK_URL", "")
+	if n, err := NewPurgeNotifier(); err != nil || n != (NopPurgeNotifier{}) {
+		t.Fatalf("unset URL = (%v, %v), want the no-op", n, err)
+	}
+
+	t.Setenv("PURGE_WEBHOOK_URL", "ftp://purge.internal")
+	if _, err := NewPurgeNotifier(); err == nil {
+		t.Fatal("a non-http URL was accepted")
+	}
+}
+
+// recordingNotifier collects what the storage paths report.
+type recordingNotifier struct {
+	mu     sync.Mutex
+	events []PurgeEvent
+}
+
+func (r *recordingNotifier) Notify(reason PurgeReason, bucket string, keys ...string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, k := range keys {
+		r.events = append(r.events, PurgeEvent{Bucket: bucket, Key: k, Reason: reason})
+	}
+}
+
+func (r *recordingNotifier) Close(context.Context) error { return nil }
+
+func TestArchiveEvictionNotifiesUpstream(t *testing.T) {
+	store := &fakeStore{contents: map[string][]byte{"photos/cat.jpg": []byte("image bytes")}}
+	rec := &recordingNotifier{}
+	tiering := newTestTiering(store, &fakeArchive{enabled: true})
+	tiering.SetPurgeNotifier(rec)
+
+	tiering.ArchiveObject(context.Background(), "photos", "cat.jpg", true)
+
+	want := PurgeEvent{Bucket: "photos", Key: "cat.jpg", Reason: PurgeEvicted}
+	if len(rec.events) != 1 || rec.events[0] != want {
+		t.Fatalf("events = %v, want [%v]", rec.events, want)
+	}
+
+	// Keeping the local copy changes nothing upstream, so nothing is reported.
+	rec.events = nil
+	store.contents["photos/dog.jpg"] = []byte("more bytes")
+	tiering.ArchiveObject(context.Background(), "photos", "dog.jpg", false)
+	if len(rec.events) != 0 {
+		t.Fatalf("a kept copy was reported: %v", rec.events)
+	}
+}
+
+func TestRetentionNotifiesOnlyWhenItDeletes(t *testing.T) {
+	old := time.Now().Add(-400 * 24 * time.Hour)
+	for _, dryRun := range []bool{true, false} {
+		store := &fakeStore{
+			buckets: []string{"photos"},
+			objects: map[string][]minio.ObjectInfo{
+				"photos": {{Key: "2023/cat.jpg", Size: 1024, LastModified: old}},
+			},
+		}
+		archive := &fakeArchive{enabled: true, sizes: map[string]int64{"photos/2023/cat.jpg": 1024}}
+		rec := &recordingNotifier{}
+		r := newTestRetention(t, store, archive, 365, dryRun)
+		r.SetPurgeNotifier(rec)
+
+		if _, err := r.RunOnce(context.Background(), time.Now()); err != nil {
+			t.Fatalf("RunOnce: %v", err)
+		}
+
+		wantEvents := 1
+		if dryRun {
+			wantEvents = 0
+		}
+		if len(rec.events) != wantEvents {
+			t.Errorf("dryRun=%v: events = %v, want %d", dryRun, rec.events, wantEvents)
+		}
+	}
+}
@@ -177,7 +177,9 @@ func IsImageFile(filename string) bool {
 	return false
 }
 
-func GetWidthAndHeight(c *fiber.Ctx, requestType string) (bool, uint, uint) {
+// GetWidthAndHeight reads the requested size from where requestType says it
+// is, clamped to what the bucket allows (see config.MaxResizeDimensionFor).
+func GetWidthAndHeight(c *fiber.Ctx, requestType, bucket string) (bool, uint, uint) {
 	width, height := 0, 0
 	resize := false
 
@@ -216,7 +218,7 @@ func GetWidthAndHeight(c *fiber.Ctx, requestType string) (bool, uint, uint) {
 	// int cast to uint would otherwise wrap to a huge value and allocate a giant
 	// canvas), and both axes are capped so the unauthenticated GET resize path
 	// cannot be driven to exhaust memory with e.g. w:99999/h:99999.
-	maxDim := config.GetEnvAsIntOrDefault("MAX_RESIZE_DIMENSION", 4096)
+	maxDim := config.MaxResizeDimensionFor(bucket)
 	if width < 0 {
 		width = 0
 	}
@@ -239,26 +241,6 @@ func GetWidthAndHeight(c *fiber.Ctx, requestType string) (bool, uint, uint) {
 	return resize, uint(width), uint(height)
 }
 
-func CreateFile(file []byte) (*os.File, error) {
-	tempFile, err := os.CreateTemp("", "create_image_*.png")
-	if err != nil {
-		return tempFile, err
-	}
-
-	// Write the resized content to the temporary file
-	_, err = tempFile.Write(file)
-	if err != nil {
-		return tempFile, err
-	}
-
-	// Seek back to the beginning of the file
-	_, err = tempFile.Seek(0, 0)
-	if err != nil {
-		return tempFile, err
-	}
-	return tempFile, nil
-}
-
 func RatioWidthHeight(width, height, targetWidth, targetHeight uint) (uint, uint) {
 	whRatio := float64(width) / float64(height)
 	hwRatio := float64(height) / float64(width)
@@ -1,6 +1,7 @@
 package service
 
 import (
+	"io"
 	"net/http"
 	"net/http/httptest"
 	"os"
@@ -10,6 +11,8 @@ import (
 	"testing"
 
 	"github.com/gofiber/fiber/v2"
+
+	"github.com/mstgnz/cdn/pkg/config"
 )
 
 func TestIsInt(t *testing.T) {
@@ -131,7 +134,7 @@ func TestRatioWidthHeight(t *testing.T) {
 func TestGetWidthAndHeight_Query(t *testing.T) {
 	app := fiber.New()
 	app.Get("/", func(c *fiber.Ctx) error {
-		resize, w, h := GetWidthAndHeight(c, QueryType)
+		resize, w, h := GetWidthAndHeight(c, QueryType, "")
 		return c.JSON(fiber.Map{"resize": resize, "w": w, "h": h})
 	})
 
@@ -269,7 +272,7 @@ func TestGetWidthAndHeight_Clamp(t *testing.T) {
 	t.Setenv("MAX_RESIZE_DIMENSION", "4096")
 	app := fiber.New()
 	app.Get("/", func(c *fiber.Ctx) error {
-		_, w, h := GetWidthAndHeight(c, QueryType)
+		_, w, h := GetWidthAndHeight(c, QueryType, "")
 		c.Set("W", strconv.Itoa(int(w)))
 		c.Set("H", strconv.Itoa(int(h)))
 		return c.SendString("ok")
@@ -294,3 +297,32 @@ func TestGetWidthAndHeight_Clamp(t *testing.T) {
 		t.Fatalf("expected height 100, got H=%s", resp2.Header.Get("H"))
 	}
 }
+
+// A bucket's upload policy lowers the clamp for its own images only.
+func TestGetWidthAndHeightUsesTheBucketsLimit(t *testing.T) {
+	t.Setenv("MAX_RESIZE_DIMENSION", "4096")
+	path := filepath.Join(t.TempDir(), "buckets.json")
+	if err := os.WriteFile(path, []byte(`{"buckets":[{"bucket":"avatars","upload":{"max_resize_dimension":256}}]}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := config.LoadBucketPolicies(path); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _, _ = config.LoadBucketPolicies(filepath.Join(t.TempDir(), "absent.json")) })
+
+	for bucket, want := range map[string]uint{"avatars": 256, "photos": 1000} {
+		app := fiber.New()
+		app.Get("/", func(c *fiber.Ctx) error {
+			_, w, _ := GetWidthAndHeight(c, QueryType, bucket)
+			return c.SendString(strconv.Itoa(int(w)))
+		})
+		resp, err := app.Test(httptest.NewRequest("GET", "/?width=1000", nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		if string(body) != strconv.Itoa(int(want)) {
+			t.Errorf("%s: width %s, want %d", bucket, body, want)
+		}
+	}
+}